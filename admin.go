@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminUserKey is the request context key of the admin named by a per-user token
+type adminUserKey struct{}
+
+// requireAdmin protects admin endpoints with bearer tokens. ADMIN_TOKENS
+// gives each admin their own token as comma-separated user:token pairs, and
+// the user is recorded in the audit trail of held orders; the shared
+// ADMIN_TOKEN names nobody and cannot decide held orders. When no token is
+// configured the admin API is disabled entirely.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shared := os.Getenv("ADMIN_TOKEN")
+		users, err := adminTokens(os.Getenv("ADMIN_TOKENS"))
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, "admin API disabled: "+err.Error())
+			return
+		}
+		if shared == "" && len(users) == 0 {
+			writeJSONError(w, http.StatusServiceUnavailable, "admin API disabled: neither ADMIN_TOKEN nor ADMIN_TOKENS is set")
+			return
+		}
+
+		// Compare against every token so the time taken reveals nothing
+		provided := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		matched := shared != "" && subtle.ConstantTimeCompare(provided, []byte(shared)) == 1
+		var user string
+		for name, token := range users {
+			if subtle.ConstantTimeCompare(provided, []byte(token)) == 1 {
+				user = name
+				matched = true
+			}
+		}
+		if !matched {
+			log.Printf("Rejected admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		if user != "" {
+			r = r.WithContext(context.WithValue(r.Context(), adminUserKey{}, user))
+		}
+		next(w, r)
+	}
+}
+
+// adminTokens parses ADMIN_TOKENS, e.g. "alice:s3cret,bob:t0ken", into tokens by user
+func adminTokens(value string) (map[string]string, error) {
+	users := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		user, token, ok := strings.Cut(pair, ":")
+		user, token = strings.TrimSpace(user), strings.TrimSpace(token)
+		if !ok || user == "" || token == "" {
+			return nil, fmt.Errorf("invalid ADMIN_TOKENS entry for %q, want user:token", user)
+		}
+		if _, dup := users[user]; dup {
+			return nil, fmt.Errorf("ADMIN_TOKENS lists user %s twice", user)
+		}
+		if seen[token] {
+			return nil, fmt.Errorf("ADMIN_TOKENS gives user %s a token already in use", user)
+		}
+		users[user] = token
+		seen[token] = true
+	}
+	return users, nil
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	// SOAP envelopes are returned verbatim, so keep < and > readable
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+}
+
+// writeJSONError writes a JSON error body
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{
+		"status": "error",
+		"error":  message,
+	})
+}
+
+// adminUser names the admin behind a request for audit trails. Only
+// per-user tokens from ADMIN_TOKENS carry a name.
+func adminUser(r *http.Request) (string, bool) {
+	user, ok := r.Context().Value(adminUserKey{}).(string)
+	return user, ok && user != ""
+}
+
+// requireAdminUser returns the admin deciding a held order, or writes a 403
+// when the request used the shared ADMIN_TOKEN and so names nobody
+func requireAdminUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, ok := adminUser(r)
+	if !ok {
+		writeJSONError(w, http.StatusForbidden, "held orders can only be decided with a per-user token from ADMIN_TOKENS")
+	}
+	return user, ok
+}
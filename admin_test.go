@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "unset", want: map[string]string{}},
+		{name: "two users", value: "alice:a-token, bob:b-token", want: map[string]string{"alice": "a-token", "bob": "b-token"}},
+		{name: "trailing comma", value: "alice:a-token,", want: map[string]string{"alice": "a-token"}},
+		{name: "token with colon", value: "alice:a:token", want: map[string]string{"alice": "a:token"}},
+		{name: "missing token", value: "alice", wantErr: true},
+		{name: "empty user", value: ":a-token", wantErr: true},
+		{name: "user listed twice", value: "alice:a-token,alice:b-token", wantErr: true},
+		{name: "token shared by users", value: "alice:a-token,bob:a-token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := adminTokens(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("adminTokens() error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("adminTokens() = %v, want %v", got, tt.want)
+			}
+			for user, token := range tt.want {
+				if got[user] != token {
+					t.Errorf("token of %s = %q, want %q", user, got[user], token)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		shared     string
+		users      string
+		token      string
+		wantStatus int
+		wantUser   string
+	}{
+		{name: "no tokens configured", token: "anything", wantStatus: http.StatusServiceUnavailable},
+		{name: "invalid ADMIN_TOKENS", users: "alice", token: "alice", wantStatus: http.StatusServiceUnavailable},
+		{name: "shared token names nobody", shared: "shared-token", users: "alice:a-token", token: "shared-token", wantStatus: http.StatusOK},
+		{name: "per-user token names its user", shared: "shared-token", users: "alice:a-token,bob:b-token", token: "b-token", wantStatus: http.StatusOK, wantUser: "bob"},
+		{name: "per-user tokens only", users: "alice:a-token", token: "a-token", wantStatus: http.StatusOK, wantUser: "alice"},
+		{name: "wrong token", shared: "shared-token", users: "alice:a-token", token: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "no token", shared: "shared-token", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKEN", tt.shared)
+			t.Setenv("ADMIN_TOKENS", tt.users)
+
+			var user string
+			handler := (&Server{}).requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+				user, _ = adminUser(r)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/admin/review", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			req.Header.Set("X-Admin-User", "mallory") // never trusted
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if user != tt.wantUser {
+				t.Errorf("admin user = %q, want %q", user, tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	EnvelopeFormatAIF = "aif"
+
+	AIFCreateAction = "http://schemas.microsoft.com/dynamics/2008/01/services/SalesOrderService/create"
+	AIFDeleteAction = "http://schemas.microsoft.com/dynamics/2008/01/services/SalesOrderService/delete"
+
+	AIFFreeTextInvoiceCreateAction = "http://schemas.microsoft.com/dynamics/2008/01/services/FreeTextInvoiceService/create"
+
+	AIFCustomerFindAction   = "http://schemas.microsoft.com/dynamics/2008/01/services/CustomerService/find"
+	AIFCustomerCreateAction = "http://schemas.microsoft.com/dynamics/2008/01/services/CustomerService/create"
+)
+
+// AIFConfig holds the AX 2012 settings used by the "aif" envelope format.
+// It is read from the "aif" section of SOAP_ENVELOPE_CONFIG, AX_* variables override it.
+type AIFConfig struct {
+	Company            string `json:"company"`              // CallContext Company (DataAreaId)
+	Language           string `json:"language"`             // CallContext Language, e.g. en-us
+	LogonAsUser        string `json:"logon_as_user"`        // CallContext LogonAsUser, e.g. DOMAIN\user
+	CustAccount        string `json:"cust_account"`         // AX customer account of orders without a resolved customer
+	SalesUnit          string `json:"sales_unit"`           // unit of measure for sales lines, optional
+	InventSiteID       string `json:"invent_site_id"`       // InventDim site for every line, optional
+	InventLocationID   string `json:"invent_location_id"`   // InventDim warehouse for every line, optional
+	ReturnReasonCode   string `json:"return_reason_code"`   // ReturnReasonCodeId of return orders created for refunds, optional
+	CreditNoteAccount  string `json:"credit_note_account"`  // ledger account of credit note lines, e.g. 401100, optional
+	ShippingChargeCode string `json:"shipping_charge_code"` // MarkupCode of shipping charges, defaults to the Shopify shipping code
+}
+
+// loadEnv applies AX_* environment overrides
+func (c *AIFConfig) loadEnv() {
+	overrides := map[string]*string{
+		"AX_COMPANY":              &c.Company,
+		"AX_LANGUAGE":             &c.Language,
+		"AX_LOGON_AS_USER":        &c.LogonAsUser,
+		"AX_CUST_ACCOUNT":         &c.CustAccount,
+		"AX_SALES_UNIT":           &c.SalesUnit,
+		"AX_INVENT_SITE_ID":       &c.InventSiteID,
+		"AX_INVENT_LOCATION_ID":   &c.InventLocationID,
+		"AX_RETURN_REASON_CODE":   &c.ReturnReasonCode,
+		"AX_CREDIT_NOTE_ACCOUNT":  &c.CreditNoteAccount,
+		"AX_SHIPPING_CHARGE_CODE": &c.ShippingChargeCode,
+	}
+	for key, field := range overrides {
+		if value := os.Getenv(key); value != "" {
+			*field = value
+		}
+	}
+}
+
+// validate checks the settings AX requires to accept a sales order
+func (c *AIFConfig) validate() error {
+	if c.Company == "" {
+		return fmt.Errorf("SOAP format %q requires AX_COMPANY", EnvelopeFormatAIF)
+	}
+	if c.CustAccount == "" {
+		return fmt.Errorf("SOAP format %q requires AX_CUST_ACCOUNT", EnvelopeFormatAIF)
+	}
+	return nil
+}
+
+// aifCallContext is the AIF CallContext SOAP header
+type aifCallContext struct {
+	XMLName     xml.Name `xml:"http://schemas.microsoft.com/dynamics/2010/01/datacontracts CallContext"`
+	Company     string   `xml:"Company,omitempty"`
+	Language    string   `xml:"Language,omitempty"`
+	LogonAsUser string   `xml:"LogonAsUser,omitempty"`
+	MessageID   string   `xml:"MessageId,omitempty"`
+}
+
+// aifCallContext returns the CallContext header for a new message
+func (b *EnvelopeBuilder) aifCallContext() aifCallContext {
+	cfg := b.config.AIF
+	return aifCallContext{
+		Company:     cfg.Company,
+		Language:    cfg.Language,
+		LogonAsUser: cfg.LogonAsUser,
+		MessageID:   "urn:uuid:" + newUUID(),
+	}
+}
+
+// aifCreateRequest is the body of SalesOrderService.create
+type aifCreateRequest struct {
+	XMLName    xml.Name      `xml:"http://schemas.microsoft.com/dynamics/2008/01/services SalesOrderServiceCreateRequest"`
+	SalesOrder axdSalesOrder `xml:"http://schemas.microsoft.com/dynamics/2008/01/documents/SalesOrder SalesOrder"`
+}
+
+// aifDeleteRequest is the body of SalesOrderService.delete, used to cancel
+// orders. AX refuses to delete orders that are already delivered or invoiced.
+type aifDeleteRequest struct {
+	XMLName       xml.Name         `xml:"http://schemas.microsoft.com/dynamics/2008/01/services SalesOrderServiceDeleteRequest"`
+	EntityKeyList aifEntityKeyList `xml:"http://schemas.microsoft.com/dynamics/2006/02/documents/EntityKeyList EntityKeyList"`
+}
+
+type aifEntityKeyList struct {
+	EntityKey []aifEntityKey `xml:"http://schemas.microsoft.com/dynamics/2006/02/documents/EntityKey EntityKey"`
+}
+
+type aifEntityKey struct {
+	KeyField []aifKeyField `xml:"KeyData>KeyField"`
+}
+
+type aifKeyField struct {
+	Field string `xml:"Field"`
+	Value string `xml:"Value"`
+}
+
+// axdSalesOrder is the AxdSalesOrder document. Field order follows the AIF
+// schema, which lists fields alphabetically before child entities.
+type axdSalesOrder struct {
+	SalesTable axdSalesTable `xml:"SalesTable"`
+}
+
+type axdSalesTable struct {
+	Class                string           `xml:"class,attr"`
+	CurrencyCode         string           `xml:"CurrencyCode,omitempty"`
+	CustAccount          string           `xml:"CustAccount"`
+	CustomerRef          string           `xml:"CustomerRef,omitempty"`
+	DeliveryName         string           `xml:"DeliveryName,omitempty"`
+	Email                string           `xml:"Email,omitempty"`
+	PurchOrderFormNum    string           `xml:"PurchOrderFormNum,omitempty"`
+	ReceiptDateRequested string           `xml:"ReceiptDateRequested,omitempty"`
+	ReturnReasonCodeID   string           `xml:"ReturnReasonCodeId,omitempty"`
+	SalesType            string           `xml:"SalesType,omitempty"`
+	MarkupTransHeader    []axdMarkupTrans `xml:"MarkupTransHeader,omitempty"`
+	SalesLine            []axdSalesLine   `xml:"SalesLine"`
+	TableDlvAddr         *axdTableDlvAdr  `xml:"TableDlvAddr,omitempty"`
+}
+
+type axdSalesLine struct {
+	Class      string        `xml:"class,attr"`
+	ItemID     string        `xml:"ItemId"`
+	LineAmount string        `xml:"LineAmount,omitempty"`
+	LineDisc   string        `xml:"LineDisc,omitempty"`
+	Name       string        `xml:"Name,omitempty"`
+	SalesPrice string        `xml:"SalesPrice,omitempty"`
+	SalesQty   string        `xml:"SalesQty"`
+	SalesUnit  string        `xml:"SalesUnit,omitempty"`
+	InventDim  *axdInventDim `xml:"InventDim,omitempty"`
+}
+
+// axdMarkupTrans is a misc charge (MarkupTrans) on the sales order header
+type axdMarkupTrans struct {
+	Class        string `xml:"class,attr"`
+	CurrencyCode string `xml:"CurrencyCode,omitempty"`
+	MarkupCode   string `xml:"MarkupCode"`
+	Txt          string `xml:"Txt,omitempty"`
+	Value        string `xml:"Value"`
+}
+
+type axdInventDim struct {
+	Class            string `xml:"class,attr"`
+	ConfigID         string `xml:"configId,omitempty"`
+	InventColorID    string `xml:"InventColorId,omitempty"`
+	InventLocationID string `xml:"InventLocationId,omitempty"`
+	InventSiteID     string `xml:"InventSiteId,omitempty"`
+	InventSizeID     string `xml:"InventSizeId,omitempty"`
+	InventStyleID    string `xml:"InventStyleId,omitempty"`
+}
+
+type axdTableDlvAdr struct {
+	Class           string `xml:"class,attr"`
+	City            string `xml:"City,omitempty"`
+	CountryRegionID string `xml:"CountryRegionId,omitempty"`
+	LocationName    string `xml:"LocationName,omitempty"`
+	State           string `xml:"State,omitempty"`
+	Street          string `xml:"Street,omitempty"`
+	ZipCode         string `xml:"ZipCode,omitempty"`
+}
+
+// buildAIF renders an ERP order as an AIF SalesOrderService create request
+func (b *EnvelopeBuilder) buildAIF(order *ERPOrder) (string, error) {
+	cfg := b.config.AIF
+
+	header := b.aifCallContext()
+
+	deliveryName := order.CustomerName
+	if addr := order.ShippingAddress; addr != nil {
+		deliveryName = firstNonEmpty(addr.Name, addr.Company, deliveryName)
+	}
+
+	table := axdSalesTable{
+		Class:                "entity",
+		CurrencyCode:         order.Currency,
+		CustAccount:          firstNonEmpty(order.CustAccount, cfg.CustAccount),
+		CustomerRef:          order.OrderNumber,
+		DeliveryName:         deliveryName,
+		Email:                order.CustomerEmail,
+		PurchOrderFormNum:    order.OrderID,
+		ReceiptDateRequested: aifDate(order.OrderDate),
+	}
+
+	// AX calculates tax from its own tax groups, so Shopify tax lines are not sent
+	for _, item := range order.Items {
+		lineDisc, lineAmount := lineDiscount(item)
+		line := axdSalesLine{
+			Class:      "entity",
+			ItemID:     item.ItemID,
+			LineAmount: lineAmount,
+			LineDisc:   lineDisc,
+			Name:       item.ProductName,
+			SalesPrice: item.UnitPrice.String(),
+			SalesQty:   strconv.Itoa(item.Quantity),
+			SalesUnit:  cfg.SalesUnit,
+			InventDim:  b.aifInventDim(item.InventDim),
+		}
+		table.SalesLine = append(table.SalesLine, line)
+	}
+
+	for _, charge := range order.Charges {
+		code := cfg.ShippingChargeCode
+		if code == "" {
+			code = charge.Code
+		}
+		table.MarkupTransHeader = append(table.MarkupTransHeader, axdMarkupTrans{
+			Class:        "entity",
+			CurrencyCode: order.Currency,
+			MarkupCode:   code,
+			Txt:          charge.Title,
+			Value:        charge.Amount.String(),
+		})
+	}
+
+	if addr := order.ShippingAddress; addr != nil {
+		street := addr.AddressLine1
+		if addr.AddressLine2 != "" {
+			street += "\n" + addr.AddressLine2
+		}
+		table.TableDlvAddr = &axdTableDlvAdr{
+			Class:           "entity",
+			City:            addr.City,
+			CountryRegionID: addr.CountryCode,
+			LocationName:    deliveryName,
+			State:           addr.State,
+			Street:          street,
+			ZipCode:         addr.PostalCode,
+		}
+	}
+
+	request := aifCreateRequest{SalesOrder: axdSalesOrder{SalesTable: table}}
+	return marshalEnvelope(b.envelopeNamespace(DestinationCreateOrder), []interface{}{header}, request)
+}
+
+// buildAIFCancel renders a cancellation as a SalesOrderService delete request
+func (b *EnvelopeBuilder) buildAIFCancel(c *ERPCancellation) (string, error) {
+	header := b.aifCallContext()
+
+	request := aifDeleteRequest{
+		EntityKeyList: aifEntityKeyList{
+			EntityKey: []aifEntityKey{{KeyField: []aifKeyField{{Field: "SalesId", Value: c.SalesID}}}},
+		},
+	}
+	return marshalEnvelope(b.envelopeNamespace(DestinationCancelOrder), []interface{}{header}, request)
+}
+
+// aifReadRequest is the body of SalesOrderService.read
+type aifReadRequest struct {
+	XMLName       xml.Name         `xml:"http://schemas.microsoft.com/dynamics/2008/01/services SalesOrderServiceReadRequest"`
+	EntityKeyList aifEntityKeyList `xml:"http://schemas.microsoft.com/dynamics/2006/02/documents/EntityKeyList EntityKeyList"`
+}
+
+// buildAIFReadOrder renders a SalesOrderService read request for a SalesId.
+// The response carries the SalesTable with its SalesStatus.
+func (b *EnvelopeBuilder) buildAIFReadOrder(salesID string) (string, error) {
+	header := b.aifCallContext()
+
+	request := aifReadRequest{
+		EntityKeyList: aifEntityKeyList{
+			EntityKey: []aifEntityKey{{KeyField: []aifKeyField{{Field: "SalesId", Value: salesID}}}},
+		},
+	}
+	return marshalEnvelope(b.envelopeNamespace(DestinationReadOrder), []interface{}{header}, request)
+}
+
+// buildAIFReturnOrder renders a refund as a SalesOrderService create request
+// for a return order (SalesType ReturnItem) with negative quantities. The
+// original SalesId is carried in PurchOrderFormNum.
+func (b *EnvelopeBuilder) buildAIFReturnOrder(r *ERPRefund) (string, error) {
+	// transformRefund puts adjustments on the credit note; a return order
+	// has no line to carry them, so never drop them silently
+	if len(r.Adjustments) > 0 {
+		return "", fmt.Errorf("return order for refund %s cannot carry %d order adjustments", r.RefundID, len(r.Adjustments))
+	}
+	cfg := b.config.AIF
+	header := b.aifCallContext()
+
+	table := axdSalesTable{
+		Class:                "entity",
+		CurrencyCode:         r.Currency,
+		CustAccount:          firstNonEmpty(r.CustAccount, cfg.CustAccount),
+		CustomerRef:          r.OrderNumber,
+		PurchOrderFormNum:    r.SalesID,
+		ReceiptDateRequested: aifDate(r.RefundDate),
+		ReturnReasonCodeID:   cfg.ReturnReasonCode,
+		SalesType:            "ReturnItem",
+	}
+
+	for _, item := range r.Lines {
+		line := axdSalesLine{
+			Class:      "entity",
+			ItemID:     item.ItemID,
+			Name:       item.ProductName,
+			SalesPrice: item.UnitPrice.String(),
+			SalesQty:   strconv.Itoa(-item.Quantity),
+			SalesUnit:  cfg.SalesUnit,
+			InventDim:  b.aifInventDim(item.InventDim),
+		}
+		table.SalesLine = append(table.SalesLine, line)
+	}
+
+	request := aifCreateRequest{SalesOrder: axdSalesOrder{SalesTable: table}}
+	return marshalEnvelope(b.envelopeNamespace(DestinationReturnOrder), []interface{}{header}, request)
+}
+
+// aifFreeTextInvoiceRequest is the body of FreeTextInvoiceService.create
+type aifFreeTextInvoiceRequest struct {
+	XMLName         xml.Name           `xml:"http://schemas.microsoft.com/dynamics/2008/01/services FreeTextInvoiceServiceCreateRequest"`
+	FreeTextInvoice axdFreeTextInvoice `xml:"http://schemas.microsoft.com/dynamics/2008/01/documents/FreeTextInvoice FreeTextInvoice"`
+}
+
+type axdFreeTextInvoice struct {
+	CustInvoiceTable axdCustInvoiceTable `xml:"CustInvoiceTable"`
+}
+
+type axdCustInvoiceTable struct {
+	Class             string               `xml:"class,attr"`
+	CurrencyCode      string               `xml:"CurrencyCode,omitempty"`
+	CustomerRef       string               `xml:"CustomerRef,omitempty"`
+	InvoiceDate       string               `xml:"InvoiceDate,omitempty"`
+	OrderAccount      string               `xml:"OrderAccount"`
+	PurchOrderFormNum string               `xml:"PurchOrderFormNum,omitempty"`
+	CustInvoiceLine   []axdCustInvoiceLine `xml:"CustInvoiceLine"`
+}
+
+type axdCustInvoiceLine struct {
+	Class           string              `xml:"class,attr"`
+	AmountCur       string              `xml:"AmountCur"`
+	Description     string              `xml:"Description,omitempty"`
+	LedgerDimension *axdLedgerDimension `xml:"LedgerDimension,omitempty"`
+}
+
+type axdLedgerDimension struct {
+	DisplayValue string `xml:"http://schemas.microsoft.com/dynamics/2008/01/sharedtypes DisplayValue"`
+}
+
+// buildAIFCreditNote renders a refund as a free text credit note: a
+// FreeTextInvoiceService create request with negative line amounts
+func (b *EnvelopeBuilder) buildAIFCreditNote(r *ERPRefund) (string, error) {
+	cfg := b.config.AIF
+	header := b.aifCallContext()
+
+	table := axdCustInvoiceTable{
+		Class:             "entity",
+		CurrencyCode:      r.Currency,
+		CustomerRef:       r.OrderNumber,
+		InvoiceDate:       aifDate(r.RefundDate),
+		OrderAccount:      firstNonEmpty(r.CustAccount, cfg.CustAccount),
+		PurchOrderFormNum: r.SalesID,
+	}
+
+	var ledger *axdLedgerDimension
+	if cfg.CreditNoteAccount != "" {
+		ledger = &axdLedgerDimension{DisplayValue: cfg.CreditNoteAccount}
+	}
+	addLine := func(description string, amount Money) {
+		table.CustInvoiceLine = append(table.CustInvoiceLine, axdCustInvoiceLine{
+			Class:           "entity",
+			AmountCur:       amount.String(),
+			Description:     description,
+			LedgerDimension: ledger,
+		})
+	}
+
+	for _, item := range r.Lines {
+		addLine(fmt.Sprintf("%d x %s (%s)", item.Quantity, item.ProductName, item.SKU), item.Amount.Neg())
+	}
+	// Adjustments are already negative in Shopify, e.g. -5.00 for a shipping refund
+	for _, adjustment := range r.Adjustments {
+		description := adjustment.Reason
+		if description == "" {
+			description = adjustment.Kind
+		}
+		addLine(description, adjustment.Amount)
+	}
+	if len(table.CustInvoiceLine) == 0 {
+		// A refund of money only, e.g. a goodwill refund
+		addLine(fmt.Sprintf("Refund of order %s", r.OrderNumber), r.TotalAmount.Neg())
+	}
+
+	request := aifFreeTextInvoiceRequest{FreeTextInvoice: axdFreeTextInvoice{CustInvoiceTable: table}}
+	return marshalEnvelope(b.envelopeNamespace(DestinationCreditNote), []interface{}{header}, request)
+}
+
+// aifCustomerFindRequest is the body of CustomerService.find
+type aifCustomerFindRequest struct {
+	XMLName       xml.Name         `xml:"http://schemas.microsoft.com/dynamics/2008/01/services CustomerServiceFindRequest"`
+	QueryCriteria aifQueryCriteria `xml:"http://schemas.microsoft.com/dynamics/2006/02/documents/QueryCriteria QueryCriteria"`
+}
+
+type aifQueryCriteria struct {
+	CriteriaElement []aifCriteriaElement `xml:"CriteriaElement"`
+}
+
+type aifCriteriaElement struct {
+	DataSourceName string `xml:"DataSourceName"`
+	FieldName      string `xml:"FieldName"`
+	Operator       string `xml:"Operator"`
+	Value1         string `xml:"Value1"`
+}
+
+// aifCustomerCreateRequest is the body of CustomerService.create
+type aifCustomerCreateRequest struct {
+	XMLName  xml.Name    `xml:"http://schemas.microsoft.com/dynamics/2008/01/services CustomerServiceCreateRequest"`
+	Customer axdCustomer `xml:"http://schemas.microsoft.com/dynamics/2008/01/documents/Customer Customer"`
+}
+
+// axdCustomer is the AxdCustomer document
+type axdCustomer struct {
+	CustTable axdCustTable `xml:"CustTable"`
+}
+
+type axdCustTable struct {
+	Class      string      `xml:"class,attr"`
+	AccountNum string      `xml:"AccountNum"`
+	Currency   string      `xml:"Currency,omitempty"`
+	CustGroup  string      `xml:"CustGroup"`
+	DirParty   axdDirParty `xml:"DirParty"`
+}
+
+// axdDirParty is the party of a customer, created as a person
+type axdDirParty struct {
+	Class       string                   `xml:"class,attr"`
+	XSI         string                   `xml:"xmlns:xsi,attr"`
+	Type        string                   `xml:"xsi:type,attr"`
+	LanguageID  string                   `xml:"LanguageId,omitempty"`
+	Name        string                   `xml:"Name"`
+	ContactInfo []axdDirPartyContactInfo `xml:"DirPartyContactInfoView"`
+	PersonName  *axdPersonName           `xml:"PersonName,omitempty"`
+}
+
+type axdDirPartyContactInfo struct {
+	Class        string `xml:"class,attr"`
+	IsPrimary    string `xml:"IsPrimary"`
+	LocationName string `xml:"LocationName"`
+	Locator      string `xml:"Locator"`
+	Type         string `xml:"Type"`
+}
+
+type axdPersonName struct {
+	Class     string `xml:"class,attr"`
+	FirstName string `xml:"FirstName,omitempty"`
+	LastName  string `xml:"LastName,omitempty"`
+}
+
+// buildAIFFindCustomer renders a CustomerService find request for the
+// customer's account number, or for its email address when the account
+// number is empty
+func (b *EnvelopeBuilder) buildAIFFindCustomer(c *ERPCustomer) (string, error) {
+	criteria := aifCriteriaElement{
+		DataSourceName: "CustTable",
+		FieldName:      "AccountNum",
+		Operator:       "Equal",
+		Value1:         c.AccountNum,
+	}
+	if c.AccountNum == "" {
+		criteria = aifCriteriaElement{
+			DataSourceName: "DirPartyContactInfoView",
+			FieldName:      "Locator",
+			Operator:       "Equal",
+			Value1:         c.Email,
+		}
+	}
+	request := aifCustomerFindRequest{QueryCriteria: aifQueryCriteria{
+		CriteriaElement: []aifCriteriaElement{criteria},
+	}}
+	return marshalEnvelope(b.envelopeNamespace(DestinationFindCustomer), []interface{}{b.aifCallContext()}, request)
+}
+
+// buildAIFCreateCustomer renders a CustomerService create request for a
+// person customer with the Shopify email and phone as contact information
+func (b *EnvelopeBuilder) buildAIFCreateCustomer(c *ERPCustomer) (string, error) {
+	party := axdDirParty{
+		Class:      "entity",
+		XSI:        "http://www.w3.org/2001/XMLSchema-instance",
+		Type:       "AxdEntity_DirParty_DirPerson",
+		LanguageID: b.config.AIF.Language,
+		Name:       c.Name,
+	}
+	if c.Email != "" {
+		party.ContactInfo = append(party.ContactInfo, axdDirPartyContactInfo{
+			Class: "entity", IsPrimary: "Yes", LocationName: "Email", Locator: c.Email, Type: "Email",
+		})
+	}
+	if c.Phone != "" {
+		party.ContactInfo = append(party.ContactInfo, axdDirPartyContactInfo{
+			Class: "entity", IsPrimary: "Yes", LocationName: "Phone", Locator: c.Phone, Type: "Phone",
+		})
+	}
+	if c.FirstName != "" || c.LastName != "" {
+		party.PersonName = &axdPersonName{Class: "entity", FirstName: c.FirstName, LastName: c.LastName}
+	}
+
+	request := aifCustomerCreateRequest{Customer: axdCustomer{CustTable: axdCustTable{
+		Class:      "entity",
+		AccountNum: c.AccountNum,
+		Currency:   c.Currency,
+		CustGroup:  c.CustGroup,
+		DirParty:   party,
+	}}}
+	return marshalEnvelope(b.envelopeNamespace(DestinationCreateCustomer), []interface{}{b.aifCallContext()}, request)
+}
+
+// aifInventDim returns the InventDim of a line: the mapped dimensions, with
+// the configured site and warehouse where the mapping has none. It returns
+// nil when the line has no dimensions at all.
+func (b *EnvelopeBuilder) aifInventDim(dim ERPInventDim) *axdInventDim {
+	cfg := b.config.AIF
+	if dim.SiteID == "" {
+		dim.SiteID = cfg.InventSiteID
+	}
+	if dim.LocationID == "" {
+		dim.LocationID = cfg.InventLocationID
+	}
+	if dim == (ERPInventDim{}) {
+		return nil
+	}
+	return &axdInventDim{
+		Class:            "entity",
+		ConfigID:         dim.ConfigID,
+		InventColorID:    dim.ColorID,
+		InventLocationID: dim.LocationID,
+		InventSiteID:     dim.SiteID,
+		InventSizeID:     dim.SizeID,
+		InventStyleID:    dim.StyleID,
+	}
+}
+
+// lineDiscount returns the LineDisc and LineAmount of a discounted line.
+// LineDisc is a per-unit amount, so a discount that does not split evenly
+// over the units is sent as the line's net LineAmount instead, which AX
+// keeps as given. Both are "" when the line has no discount.
+func lineDiscount(item ERPItem) (lineDisc, lineAmount string) {
+	if item.DiscountAmount.IsZero() || item.Quantity <= 0 {
+		return "", ""
+	}
+	perUnit := item.DiscountAmount.Div(item.Quantity)
+	if perUnit.Mul(item.Quantity).Equal(item.DiscountAmount) {
+		return perUnit.String(), ""
+	}
+	return "", item.UnitPrice.Mul(item.Quantity).Sub(item.DiscountAmount).String()
+}
+
+// firstNonEmpty returns the first value that is not empty
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// aifDate converts a Shopify timestamp to the xs:date AX expects
+func aifDate(value string) string {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return ""
+	}
+	return parsed.Format("2006-01-02")
+}
+
+// newUUID returns a random RFC 4122 version 4 UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
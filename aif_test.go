@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestAIFBuilder(t *testing.T) *EnvelopeBuilder {
+	t.Helper()
+	t.Setenv("SOAP_ENVELOPE_CONFIG", "")
+	t.Setenv("SOAP_FORMAT", EnvelopeFormatAIF)
+	t.Setenv("AX_COMPANY", "ceu")
+	t.Setenv("AX_CUST_ACCOUNT", "WEB")
+
+	b, err := NewEnvelopeBuilder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLineDiscount(t *testing.T) {
+	tests := []struct {
+		name           string
+		price          string
+		quantity       int
+		discount       string
+		wantLineDisc   string
+		wantLineAmount string
+	}{
+		{name: "no discount", price: "10.00", quantity: 3, discount: "0.00"},
+		{name: "splits evenly", price: "10.00", quantity: 4, discount: "2.00", wantLineDisc: "0.50"},
+		{name: "single unit", price: "25.00", quantity: 1, discount: "3.33", wantLineDisc: "3.33"},
+		{name: "does not split evenly", price: "20.00", quantity: 3, discount: "10.00", wantLineAmount: "50.00"},
+		{name: "odd cent", price: "1.99", quantity: 2, discount: "0.03", wantLineAmount: "3.95"},
+		{name: "zero quantity", price: "10.00", quantity: 0, discount: "1.00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := ERPItem{
+				Quantity:       tt.quantity,
+				UnitPrice:      MustParseMoney(tt.price),
+				DiscountAmount: MustParseMoney(tt.discount),
+			}
+			lineDisc, lineAmount := lineDiscount(item)
+			if lineDisc != tt.wantLineDisc || lineAmount != tt.wantLineAmount {
+				t.Errorf("lineDiscount() = %q, %q, want %q, %q", lineDisc, lineAmount, tt.wantLineDisc, tt.wantLineAmount)
+			}
+		})
+	}
+}
+
+func TestBuildAIFDiscountedLines(t *testing.T) {
+	b := newTestAIFBuilder(t)
+	order := &ERPOrder{
+		OrderID:  "1001",
+		Currency: "EUR",
+		Items: []ERPItem{
+			{ItemID: "A", Quantity: 3, UnitPrice: MustParseMoney("20.00"), DiscountAmount: MustParseMoney("10.00")},
+			{ItemID: "B", Quantity: 2, UnitPrice: MustParseMoney("5.00"), DiscountAmount: MustParseMoney("1.00")},
+		},
+	}
+
+	envelope, err := b.buildAIF(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"<ItemId>A</ItemId><LineAmount>50.00</LineAmount><SalesPrice>20.00</SalesPrice>",
+		"<ItemId>B</ItemId><LineDisc>0.50</LineDisc><SalesPrice>5.00</SalesPrice>",
+		"<CustAccount>WEB</CustAccount>",
+	} {
+		if !strings.Contains(compactXML(envelope), want) {
+			t.Errorf("envelope does not contain %s:\n%s", want, envelope)
+		}
+	}
+}
+
+// compactXML drops the indentation between elements
+func compactXML(s string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		b.WriteString(strings.TrimSpace(line))
+	}
+	return b.String()
+}
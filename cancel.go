@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ERPCancellation is a Shopify cancellation of an order that exists in AX
+type ERPCancellation struct {
+	OrderID     string `json:"order_id"`
+	OrderNumber string `json:"order_number"`
+	SalesID     string `json:"sales_id"`
+	Reason      string `json:"reason"`
+	CancelledAt string `json:"cancelled_at"`
+	Timestamp   string `json:"timestamp"`
+}
+
+// CancelAction returns the SOAPAction for cancellations for the configured format
+func (b *EnvelopeBuilder) CancelAction() string {
+	if b.config.CancelAction != "" {
+		return b.config.CancelAction
+	}
+	if b.config.Format == EnvelopeFormatAIF {
+		return AIFDeleteAction
+	}
+	return DefaultCancelAction
+}
+
+// BuildCancel renders the SOAP envelope for a cancellation
+func (b *EnvelopeBuilder) BuildCancel(c *ERPCancellation) (string, error) {
+	if b.config.Format == EnvelopeFormatAIF {
+		return b.buildAIFCancel(c)
+	}
+	if b.cancelTemplate != nil {
+		return b.executeTemplate(b.cancelTemplate, envelopeTemplateData{
+			Cancellation:      c,
+			EnvelopeNamespace: b.envelopeNamespace(DestinationCancelOrder),
+			Operation:         b.config.CancelOperation,
+		})
+	}
+
+	el := b.element("cancellation", "cancellation")
+	el.add(b.text("SalesId", c.SalesID))
+	el.add(b.text("OrderID", c.OrderID))
+	el.add(b.text("OrderNumber", c.OrderNumber))
+	el.add(b.text("Reason", c.Reason))
+	el.add(b.text("CancelledAt", c.CancelledAt))
+	el.add(b.text("Timestamp", c.Timestamp))
+
+	prefix := b.config.Prefix
+	operation := &xmlElement{
+		Name:     qualify(prefix, b.config.CancelOperation),
+		Attrs:    []xml.Attr{{Name: xml.Name{Local: "xmlns:" + prefix}, Value: b.config.Namespace}},
+		Children: []*xmlElement{el},
+	}
+	return marshalEnvelope(b.envelopeNamespace(DestinationCancelOrder), nil, operation)
+}
+
+// processOrderCancelled cancels the AX sales order created for a Shopify
+// order. Orders that never reached AX are stopped before they are sent.
+func (s *Server) processOrderCancelled(job *QueuedOrder) error {
+	var order ShopifyOrder
+	if err := json.Unmarshal(job.Body, &order); err != nil {
+		err = fmt.Errorf("failed to parse cancelled order: %w", err)
+		s.dedupe.MarkFailed(job.WebhookID, "", job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+
+	// Either the SalesId is already known, or the pending creation will see
+	// the cancellation request; orderMu makes sure one of the two happens.
+	// The webhook is kept so a creation in flight can queue it again.
+	s.orderMu.Lock()
+	mapping, err := s.orderMap.ByShopifyOrder(job.OrderID)
+	if errors.Is(err, ErrOrderMappingNotFound) {
+		if err := s.cancels.Save(job); err != nil {
+			log.Printf("[%s] Error saving cancellation of order %s: %v", job.RequestID, job.OrderID, err)
+		}
+		s.dedupe.RequestCancel(job.OrderID, job.RequestID)
+	}
+	s.orderMu.Unlock()
+
+	if mapping == nil {
+		if _, delivered := s.dedupe.Delivered(job.OrderID); delivered {
+			// AX accepted the order but did not return a SalesId we could record
+			err := fmt.Errorf("order %s was accepted by AX but its SalesId is unknown, cancel it in AX manually", job.OrderID)
+			log.Printf("[%s] %v", job.RequestID, err)
+			s.dedupe.MarkFailed(job.WebhookID, "", job.RequestID, err)
+			return s.deadLetters.Add(job, nil, err)
+		}
+
+		log.Printf("[%s] Order %s never reached AX, its creation will be skipped", job.RequestID, job.OrderID)
+		s.discardPendingCreate(job.OrderID, job.RequestID)
+		s.closeHeldOrders(job.OrderID, job.RequestID)
+		s.updates.Take(job.OrderID)
+		s.refunds.TakeAll(job.OrderID)
+		s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, "")
+		return nil
+	}
+
+	if mapping.Status == OrderStatusCancelled {
+		log.Printf("[%s] AX sales order %s for order %s is already cancelled", job.RequestID, mapping.SalesID, job.OrderID)
+		s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, mapping.SalesID)
+		return nil
+	}
+
+	delivery, err := s.cancelSalesOrder(mapping, &order, job.RequestID)
+	if err != nil {
+		s.dedupe.MarkFailed(job.WebhookID, "", job.RequestID, err)
+		return s.deadLetters.Add(job, delivery, err)
+	}
+	s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, mapping.SalesID)
+
+	// Clear any dead letter left from an earlier failed attempt
+	if err := s.deadLetters.Delete(job.ID); err != nil {
+		log.Printf("[%s] Error removing resolved dead letter: %v", job.RequestID, err)
+	}
+	return nil
+}
+
+// cancelSalesOrder sends the cancel operation for a mapped order and records the outcome
+func (s *Server) cancelSalesOrder(mapping *OrderMapping, order *ShopifyOrder, requestID string) (*ERPDelivery, error) {
+	cancellation := &ERPCancellation{
+		OrderID:     mapping.ShopifyOrderID,
+		OrderNumber: mapping.ShopifyOrderNumber,
+		SalesID:     mapping.SalesID,
+		Reason:      order.CancelReason,
+		CancelledAt: order.CancelledAt,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	soapXML, err := s.envelope.BuildCancel(cancellation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build SOAP envelope: %w", err)
+	}
+
+	log.Printf("[%s] Cancelling AX sales order %s for order %s", requestID, mapping.SalesID, mapping.ShopifyOrderID)
+	delivery, err := s.deliverSOAP(s.envelope.Destination(DestinationCancelOrder), soapXML, mapping.ShopifyOrderID, requestID)
+	if err != nil {
+		return delivery, err
+	}
+
+	if err := s.orderMap.MarkCancelled(mapping.ShopifyOrderID, requestID); err != nil {
+		log.Printf("[%s] Error saving cancellation of %s: %v", requestID, mapping.SalesID, err)
+	}
+	log.Printf("[%s] AX sales order %s cancelled", requestID, mapping.SalesID)
+	return delivery, nil
+}
+
+// discardPendingCreate drops dead-lettered creations of an order that was
+// cancelled or has been delivered by a replay. Queued creations are skipped
+// by processOrderCreate.
+func (s *Server) discardPendingCreate(orderID, requestID string) {
+	letters, err := s.deadLetters.List(orderID)
+	if err != nil {
+		log.Printf("[%s] Error listing dead letters for order %s: %v", requestID, orderID, err)
+		return
+	}
+	for _, letter := range letters {
+		if letter.Topic != "" && letter.Topic != TopicOrdersCreate {
+			continue
+		}
+		if err := s.deadLetters.Delete(letter.ID); err != nil {
+			log.Printf("[%s] Error removing dead letter %s: %v", requestID, letter.ID, err)
+			continue
+		}
+		log.Printf("[%s] Removed dead letter %s of order %s", requestID, letter.ID, orderID)
+	}
+}
+
+// closeHeldOrders closes the review entries of a cancelled order so they
+// can no longer be approved
+func (s *Server) closeHeldOrders(orderID, requestID string) {
+	closed, err := s.review.Cancel(orderID, fmt.Sprintf("order cancelled in Shopify by request %s", requestID))
+	if err != nil {
+		log.Printf("[%s] Error closing held orders of order %s: %v", requestID, orderID, err)
+	}
+	for _, entry := range closed {
+		s.dedupe.MarkCancelled(entry.WebhookID, entry.OrderID, entry.RequestID)
+		log.Printf("[%s] Closed held order %s of cancelled order %s", requestID, entry.ID, orderID)
+	}
+}
+
+// cancelAfterCreate queues the cancellation webhook of an order that was
+// cancelled in Shopify while it was being created in AX
+func (s *Server) cancelAfterCreate(orderID, requestID string) {
+	cancel, err := s.cancels.Take(orderID)
+	if err != nil {
+		// Without the webhook the cancellation has no reason or date
+		log.Printf("[%s] Cancellation webhook of order %s not found (%v), queuing a cancellation without details", requestID, orderID, err)
+		cancel = &QueuedOrder{
+			RequestID: requestID,
+			OrderID:   orderID,
+			Body:      json.RawMessage(fmt.Sprintf(`{"id":%s}`, orderID)),
+		}
+	}
+	cancel.ID = generateRequestID()
+	cancel.Topic = TopicOrdersCancelled
+	cancel.WebhookID = ""
+	cancel.ReceivedAt = time.Now().UTC().Format(time.RFC3339)
+
+	log.Printf("[%s] Order %s was cancelled during creation, queued cancellation %s", requestID, orderID, cancel.ID)
+	if err := s.queue.Enqueue(cancel); err != nil {
+		err = fmt.Errorf("failed to queue cancellation: %w", err)
+		log.Printf("[%s] %v", requestID, err)
+		s.deadLetters.Add(cancel, nil, err)
+	}
+}
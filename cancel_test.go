@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiscardPendingCreate(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	store, err := NewDeadLetterStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{deadLetters: store}
+
+	jobs := []*QueuedOrder{
+		{ID: "create", RequestID: "create", OrderID: "1", Topic: TopicOrdersCreate},
+		{ID: "untyped", RequestID: "untyped", OrderID: "1"},
+		{ID: "update", RequestID: "update", OrderID: "1", Topic: TopicOrdersUpdated},
+		{ID: "other", RequestID: "other", OrderID: "2", Topic: TopicOrdersCreate},
+	}
+	for _, job := range jobs {
+		if err := store.Add(job, nil, errors.New("boom")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.discardPendingCreate("1", "replay")
+
+	tests := []struct {
+		id       string
+		wantKept bool
+	}{
+		{id: "create"},
+		{id: "untyped"},
+		{id: "update", wantKept: true},
+		{id: "other", wantKept: true},
+	}
+	for _, tt := range tests {
+		_, err := store.Get(tt.id)
+		if kept := err == nil; kept != tt.wantKept {
+			t.Errorf("dead letter %s kept = %t, want %t (%v)", tt.id, kept, tt.wantKept, err)
+		}
+	}
+}
+
+func TestCancelAfterCreateQueuesCancellationWebhook(t *testing.T) {
+	tests := []struct {
+		name       string
+		saved      bool
+		wantReason string
+	}{
+		{name: "stored webhook", saved: true, wantReason: "customer"},
+		{name: "webhook missing", saved: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, nil)
+			if tt.saved {
+				s.cancels.Save(&QueuedOrder{
+					ID:        "cancel-1",
+					RequestID: "cancel-1",
+					Topic:     TopicOrdersCancelled,
+					OrderID:   "1001",
+					Body:      json.RawMessage(`{"id":1001,"cancel_reason":"customer","cancelled_at":"2024-05-01T10:00:00Z"}`),
+				})
+			}
+
+			s.cancelAfterCreate("1001", "create-1")
+
+			pending, _ := filepath.Glob(filepath.Join(os.Getenv("DATA_DIR"), "queue", "pending", "*.json"))
+			if len(pending) != 1 {
+				t.Fatalf("queued jobs = %v, want one cancellation", pending)
+			}
+			job, err := readQueuedOrder(pending[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var order ShopifyOrder
+			if err := json.Unmarshal(job.Body, &order); err != nil {
+				t.Fatal(err)
+			}
+			if job.Topic != TopicOrdersCancelled || job.OrderID != "1001" || order.ID != 1001 {
+				t.Errorf("queued job = %s for order %s (payload id %d)", job.Topic, job.OrderID, order.ID)
+			}
+			if order.CancelReason != tt.wantReason {
+				t.Errorf("cancel_reason = %q, want %q", order.CancelReason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestProcessOrderCancelledClosesHeldOrder(t *testing.T) {
+	s, erp := newTestServer(t, nil)
+
+	create := &QueuedOrder{ID: "create-1", RequestID: "create-1", Topic: TopicOrdersCreate, WebhookID: "w1", OrderID: "1001", Body: json.RawMessage(`{"id":1001}`)}
+	s.dedupe.Claim(create.WebhookID, create.OrderID, create.RequestID)
+	if err := s.holdOrder(create, &ERPOrder{OrderID: "1001"}, "needs review"); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel := &QueuedOrder{ID: "cancel-1", RequestID: "cancel-1", Topic: TopicOrdersCancelled, WebhookID: "w2", OrderID: "1001", Body: json.RawMessage(`{"id":1001,"cancel_reason":"customer"}`)}
+	if err := s.processOrderCancelled(cancel); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := s.review.Get("create-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != ReviewCancelled || entry.DecidedBy != AuditSystem {
+		t.Errorf("held order status = %s decided by %q, want %s by %s", entry.Status, entry.DecidedBy, ReviewCancelled, AuditSystem)
+	}
+	if last := entry.Audit[len(entry.Audit)-1]; last.Action != AuditCancelled || !strings.Contains(last.Note, "cancel-1") {
+		t.Errorf("last audit record = %+v, want a cancellation by cancel-1", last)
+	}
+	if record, _ := s.dedupe.Claim("w1", "", "again"); record == nil || record.Status != DeliveryCancelled {
+		t.Errorf("delivery record = %+v, want cancelled", record)
+	}
+	if _, err := s.review.Update("create-1", func(*HeldOrder) error { return nil }); !errors.Is(err, ErrReviewDecided) {
+		t.Errorf("Update() of a cancelled held order = %v, want ErrReviewDecided", err)
+	}
+	if len(erp.Requests()) != 0 {
+		t.Errorf("ERP received %d requests, want none", len(erp.Requests()))
+	}
+}
+
+func TestCancelSalesOrder(t *testing.T) {
+	aifEnv := map[string]string{"SOAP_FORMAT": EnvelopeFormatAIF, "AX_COMPANY": "ceu", "AX_CUST_ACCOUNT": "WEB", "ORDER_UPDATES": "off"}
+	fault := `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>Sales order is invoiced</faultstring></s:Fault></s:Body></s:Envelope>`
+
+	tests := []struct {
+		name          string
+		env           map[string]string
+		status        int
+		response      string
+		wantAction    string
+		wantElements  map[string]string
+		wantCancelled bool
+	}{
+		{
+			name:       "default envelope",
+			wantAction: DefaultCancelAction,
+			wantElements: map[string]string{
+				"SalesId":     "SO-7",
+				"OrderID":     "1001",
+				"OrderNumber": "#1001",
+				"Reason":      "customer",
+				"CancelledAt": "2024-05-01T10:00:00Z",
+			},
+			wantCancelled: true,
+		},
+		{
+			name:          "AIF delete request",
+			env:           aifEnv,
+			wantAction:    AIFDeleteAction,
+			wantElements:  map[string]string{"Field": "SalesId", "Value": "SO-7", "Company": "ceu"},
+			wantCancelled: true,
+		},
+		{
+			name:         "ERP fault",
+			status:       http.StatusInternalServerError,
+			response:     fault,
+			wantAction:   DefaultCancelAction,
+			wantElements: map[string]string{"SalesId": "SO-7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, erp := newTestServer(t, tt.env)
+			if tt.status != 0 {
+				erp.status, erp.response = tt.status, tt.response
+			}
+			if err := s.orderMap.Put("1001", "#1001", "SO-7", "WEB", "create-1"); err != nil {
+				t.Fatal(err)
+			}
+			mapping, err := s.orderMap.ByShopifyOrder("1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			order := &ShopifyOrder{ID: 1001, CancelReason: "customer", CancelledAt: "2024-05-01T10:00:00Z"}
+			_, err = s.cancelSalesOrder(mapping, order, "cancel-1")
+			if (err == nil) != tt.wantCancelled {
+				t.Fatalf("cancelSalesOrder() error = %v, want cancelled %t", err, tt.wantCancelled)
+			}
+
+			requests, actions := erp.Requests(), erp.Actions()
+			if len(requests) != 1 {
+				t.Fatalf("ERP received %d requests, want 1", len(requests))
+			}
+			if want := `"` + tt.wantAction + `"`; actions[0] != want {
+				t.Errorf("SOAPAction = %s, want %s", actions[0], want)
+			}
+			texts := elementTexts(t, requests[0])
+			for name, want := range tt.wantElements {
+				if got := texts[name]; len(got) != 1 || got[0] != want {
+					t.Errorf("%s = %q, want %q\n%s", name, got, want, requests[0])
+				}
+			}
+
+			mapping, err = s.orderMap.ByShopifyOrder("1001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cancelled := mapping.Status == OrderStatusCancelled; cancelled != tt.wantCancelled {
+				t.Errorf("mapping status = %q, want cancelled %t", mapping.Status, tt.wantCancelled)
+			}
+			if tt.wantCancelled && (mapping.CancelRequestID != "cancel-1" || mapping.CancelledAt == "") {
+				t.Errorf("mapping cancelled by %q at %q, want cancel-1 with a time", mapping.CancelRequestID, mapping.CancelledAt)
+			}
+		})
+	}
+}
+
+func TestBuildCancel(t *testing.T) {
+	cancellation := &ERPCancellation{OrderID: "1001", OrderNumber: "#1001", SalesID: "SO-7", Reason: "fraud", CancelledAt: "2024-05-01T10:00:00Z", Timestamp: "2024-05-01T10:00:01Z"}
+	templatePath := filepath.Join(t.TempDir(), "cancel.xml")
+	template := `<soap:Envelope xmlns:soap="{{.EnvelopeNamespace}}"><soap:Body><{{.Operation}}><Id>{{.Cancellation.SalesID}}</Id></{{.Operation}}></soap:Body></soap:Envelope>`
+	if err := os.WriteFile(templatePath, []byte(template), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantRoot     string
+		wantElements map[string]string
+	}{
+		{
+			name:         "default",
+			wantRoot:     DefaultCancelOperation,
+			wantElements: map[string]string{"SalesId": "SO-7", "OrderID": "1001", "Reason": "fraud", "Timestamp": "2024-05-01T10:00:01Z"},
+		},
+		{
+			name:         "template",
+			env:          map[string]string{"SOAP_TEMPLATE": templatePath, "SOAP_CANCEL_TEMPLATE": templatePath},
+			wantRoot:     DefaultCancelOperation,
+			wantElements: map[string]string{"Id": "SO-7"},
+		},
+		{
+			name:         "AIF",
+			env:          map[string]string{"SOAP_FORMAT": EnvelopeFormatAIF, "AX_COMPANY": "ceu", "AX_CUST_ACCOUNT": "WEB"},
+			wantRoot:     "SalesOrderServiceDeleteRequest",
+			wantElements: map[string]string{"Field": "SalesId", "Value": "SO-7", "Company": "ceu"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newTestEnvelopeBuilder(t, tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			envelope, err := b.BuildCancel(cancellation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			root, err := parseSOAPNode([]byte(envelope))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body := root.child("Body"); body == nil || len(body.Children) != 1 || body.Children[0].Name.Local != tt.wantRoot {
+				t.Errorf("body does not contain %s:\n%s", tt.wantRoot, envelope)
+			}
+			texts := elementTexts(t, envelope)
+			for name, want := range tt.wantElements {
+				if got := texts[name]; len(got) != 1 || got[0] != want {
+					t.Errorf("%s = %q, want %q\n%s", name, got, want, envelope)
+				}
+			}
+		})
+	}
+}
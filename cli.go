@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// runCommand dispatches CLI subcommands and returns the process exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "replay":
+		return runReplayCommand(args)
+	case "help", "-h", "--help":
+		printCommandUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+		printCommandUsage()
+		return 2
+	}
+}
+
+func printCommandUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  shopify-ax-integration                 Start the middleware server")
+	fmt.Fprintln(os.Stderr, "  shopify-ax-integration replay [flags]  Resend a stored webhook to AX via the admin API")
+}
+
+// runReplayCommand calls POST /admin/replay on a running server
+func runReplayCommand(args []string) int {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	serverURL := flags.String("server", "http://localhost:"+port, "base URL of the running middleware")
+	token := flags.String("token", "", "admin token (defaults to ADMIN_TOKEN)")
+	requestID := flags.String("request-id", "", "request ID of the stored incoming webhook")
+	orderID := flags.String("order-id", "", "Shopify order ID, replays the latest stored webhook for it")
+	dryRun := flags.Bool("dry-run", false, "only build and print the SOAP envelope")
+	force := flags.Bool("force", false, "resend an order that was already delivered")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	// Read the environment after parsing so usage output never shows the token
+	if *token == "" {
+		*token = os.Getenv("ADMIN_TOKEN")
+	}
+
+	if *requestID == "" && *orderID == "" {
+		fmt.Fprintln(os.Stderr, "replay: -request-id or -order-id is required")
+		flags.Usage()
+		return 2
+	}
+
+	payload, _ := json.Marshal(ReplayRequest{
+		RequestID: *requestID,
+		OrderID:   *orderID,
+		DryRun:    *dryRun,
+		Force:     *force,
+	})
+
+	req, err := http.NewRequest("POST", *serverURL+"/admin/replay", bytes.NewReader(payload))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+*token)
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	// Pretty print JSON responses, fall back to the raw body
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, body, "", "  ") == nil {
+		body = pretty.Bytes()
+	}
+	fmt.Println(string(body))
+
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
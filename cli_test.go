@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureStderr returns what fn writes to os.Stderr
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	fn()
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestRunReplayCommandToken(t *testing.T) {
+	const envToken = "env-secret-token"
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "from ADMIN_TOKEN", want: "Bearer " + envToken},
+		{name: "flag overrides ADMIN_TOKEN", args: []string{"-token", "flag-token"}, want: "Bearer flag-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKEN", envToken)
+
+			var got string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("Authorization")
+				w.Write([]byte(`{"status":"dry_run"}`))
+			}))
+			defer server.Close()
+
+			args := append([]string{"-server", server.URL, "-order-id", "1", "-dry-run"}, tt.args...)
+			if code := runReplayCommand(args); code != 0 {
+				t.Fatalf("exit code = %d, want 0", code)
+			}
+			if got != tt.want {
+				t.Errorf("Authorization = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunReplayCommandUsageHidesToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "env-secret-token")
+
+	var code int
+	out := captureStderr(t, func() { code = runReplayCommand(nil) })
+	if code != 2 {
+		t.Errorf("exit code = %d, want 2", code)
+	}
+	if !strings.Contains(out, "-token") {
+		t.Fatalf("usage not printed: %q", out)
+	}
+	if strings.Contains(out, "env-secret-token") {
+		t.Errorf("usage output contains the admin token: %q", out)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Policies for orders without a customer or shipping address
+const (
+	ContactSend   = "send"   // send the order as it is
+	ContactEnrich = "enrich" // deliver to the billing address
+	ContactHold   = "hold"   // hold the order for manual review
+)
+
+var ErrMissingContact = errors.New("order is missing customer data")
+
+// ContactPolicy decides what happens to guest checkouts, set with
+// GUEST_ORDERS (send or hold, default send), and to orders with lines that
+// require shipping but no shipping address, set with MISSING_SHIPPING_ADDRESS
+// (enrich, send or hold, default enrich). Orders without shippable lines,
+// such as digital goods and POS sales, are sent without a delivery address.
+type ContactPolicy struct {
+	Guest           string
+	MissingShipping string
+}
+
+// NewContactPolicy reads GUEST_ORDERS and MISSING_SHIPPING_ADDRESS
+func NewContactPolicy() (ContactPolicy, error) {
+	policy := ContactPolicy{
+		Guest:           ContactSend,
+		MissingShipping: ContactEnrich,
+	}
+
+	if value := os.Getenv("GUEST_ORDERS"); value != "" {
+		switch guest := strings.ToLower(value); guest {
+		case ContactSend, ContactHold:
+			policy.Guest = guest
+		default:
+			return policy, fmt.Errorf("invalid GUEST_ORDERS %q (expected send or hold)", value)
+		}
+	}
+
+	if value := os.Getenv("MISSING_SHIPPING_ADDRESS"); value != "" {
+		switch missing := strings.ToLower(value); missing {
+		case ContactSend, ContactEnrich, ContactHold:
+			policy.MissingShipping = missing
+		default:
+			return policy, fmt.Errorf("invalid MISSING_SHIPPING_ADDRESS %q (expected enrich, send or hold)", value)
+		}
+	}
+	return policy, nil
+}
+
+// Describe summarises the policy for the startup log
+func (p ContactPolicy) Describe() string {
+	return fmt.Sprintf("guest orders: %s, missing shipping address: %s", p.Guest, p.MissingShipping)
+}
+
+// isGuest reports whether the order was placed without a customer account
+func (o *ShopifyOrder) isGuest() bool {
+	return o.Customer == nil || o.Customer.ID == 0
+}
+
+// requiresShipping reports whether any line has to be shipped. Lines from
+// payloads without requires_shipping are assumed to need shipping.
+func (o *ShopifyOrder) requiresShipping() bool {
+	for _, item := range o.LineItems {
+		if item.RequiresShipping == nil || *item.RequiresShipping {
+			return true
+		}
+	}
+	return false
+}
+
+// contactEmail returns the order email, falling back to the customer's
+func (o *ShopifyOrder) contactEmail() string {
+	var customerEmail string
+	if o.Customer != nil {
+		customerEmail = o.Customer.Email
+	}
+	return strings.TrimSpace(firstNonEmpty(o.Email, customerEmail))
+}
+
+// contactName returns the customer's name, falling back to the name on the
+// billing and then the shipping address
+func (o *ShopifyOrder) contactName() string {
+	var names []string
+	if o.Customer != nil {
+		names = append(names, fullName(o.Customer.FirstName, o.Customer.LastName))
+	}
+	if o.BillingAddress != nil {
+		names = append(names, fullName(o.BillingAddress.FirstName, o.BillingAddress.LastName))
+	}
+	if o.ShippingAddress != nil {
+		names = append(names, fullName(o.ShippingAddress.FirstName, o.ShippingAddress.LastName))
+	}
+	return firstNonEmpty(names...)
+}
+
+// contactPhone returns the order phone, falling back to the customer's and
+// then the phone on the billing and shipping address
+func (o *ShopifyOrder) contactPhone() string {
+	phones := []string{o.Phone}
+	if o.Customer != nil {
+		phones = append(phones, o.Customer.Phone)
+	}
+	if o.BillingAddress != nil {
+		phones = append(phones, o.BillingAddress.Phone)
+	}
+	if o.ShippingAddress != nil {
+		phones = append(phones, o.ShippingAddress.Phone)
+	}
+	return strings.TrimSpace(firstNonEmpty(phones...))
+}
+
+// fullName joins the parts of a name that are set
+func fullName(first, last string) string {
+	return strings.Join(strings.Fields(first+" "+last), " ")
+}
+
+// isEmpty reports whether an address is missing or has no usable fields.
+// Shopify sends null for missing addresses, but some apps send empty objects.
+func (a *Address) isEmpty() bool {
+	if a == nil {
+		return true
+	}
+	return strings.TrimSpace(a.Address1+a.Address2+a.City+a.Zip+a.Country+a.CountryCode) == ""
+}
+
+// transformAddress converts a Shopify address, returning nil for a missing one
+func transformAddress(addr *Address) *ERPAddress {
+	if addr.isEmpty() {
+		return nil
+	}
+	return &ERPAddress{
+		Name:         fullName(addr.FirstName, addr.LastName),
+		Company:      addr.Company,
+		AddressLine1: addr.Address1,
+		AddressLine2: addr.Address2,
+		City:         addr.City,
+		State:        addr.Province,
+		PostalCode:   addr.Zip,
+		Country:      addr.Country,
+		CountryCode:  addr.CountryCode,
+		Phone:        addr.Phone,
+	}
+}
+
+// checkContact applies the contact policy to a transformed order. Gaps that
+// were filled or are sent as they are only get logged; otherwise
+// ErrMissingContact lists why the order should be held.
+func (s *Server) checkContact(order *ShopifyOrder, erpOrder *ERPOrder, requestID string) error {
+	var reasons []string
+
+	if order.isGuest() {
+		if s.contact.Guest == ContactHold {
+			reasons = append(reasons, "guest checkout")
+		} else {
+			log.Printf("[%s] Order %s is a guest checkout", requestID, erpOrder.OrderID)
+		}
+	}
+
+	if order.ShippingAddress.isEmpty() && order.requiresShipping() {
+		switch {
+		case s.contact.MissingShipping == ContactHold:
+			reasons = append(reasons, "no shipping address")
+		case erpOrder.ShippingAddress != nil:
+			log.Printf("[%s] Order %s has no shipping address, delivering to the billing address", requestID, erpOrder.OrderID)
+		default:
+			log.Printf("[%s] Warning: order %s has no shipping address", requestID, erpOrder.OrderID)
+		}
+	}
+
+	if erpOrder.CustomerEmail == "" {
+		log.Printf("[%s] Warning: order %s has no email address", requestID, erpOrder.OrderID)
+	}
+
+	if len(reasons) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingContact, strings.Join(reasons, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestContactDetails(t *testing.T) {
+	billing := &Address{FirstName: "Bill", LastName: "Payer", Phone: "+49 30 1"}
+	shipping := &Address{FirstName: "Sam", LastName: "Receiver", Phone: "+49 30 2"}
+
+	tests := []struct {
+		name      string
+		order     ShopifyOrder
+		wantGuest bool
+		wantEmail string
+		wantName  string
+		wantPhone string
+	}{
+		{
+			name:      "customer",
+			order:     ShopifyOrder{Email: " order@example.com ", Phone: "+1", Customer: &Customer{ID: 1, Email: "customer@example.com", FirstName: "Jane", LastName: "Doe", Phone: "+2"}},
+			wantEmail: "order@example.com",
+			wantName:  "Jane Doe",
+			wantPhone: "+1",
+		},
+		{
+			name:      "customer fields as fallback",
+			order:     ShopifyOrder{Customer: &Customer{ID: 1, Email: "customer@example.com", LastName: "Doe", Phone: "+2"}},
+			wantEmail: "customer@example.com",
+			wantName:  "Doe",
+			wantPhone: "+2",
+		},
+		{
+			name:      "guest with addresses",
+			order:     ShopifyOrder{BillingAddress: billing, ShippingAddress: shipping},
+			wantGuest: true,
+			wantName:  "Bill Payer",
+			wantPhone: "+49 30 1",
+		},
+		{
+			name:      "guest with shipping address only",
+			order:     ShopifyOrder{Customer: &Customer{}, ShippingAddress: shipping},
+			wantGuest: true,
+			wantName:  "Sam Receiver",
+			wantPhone: "+49 30 2",
+		},
+		{
+			name:      "nothing known",
+			order:     ShopifyOrder{},
+			wantGuest: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.order.isGuest(); got != tt.wantGuest {
+				t.Errorf("isGuest() = %t, want %t", got, tt.wantGuest)
+			}
+			if got := tt.order.contactEmail(); got != tt.wantEmail {
+				t.Errorf("contactEmail() = %q, want %q", got, tt.wantEmail)
+			}
+			if got := tt.order.contactName(); got != tt.wantName {
+				t.Errorf("contactName() = %q, want %q", got, tt.wantName)
+			}
+			if got := tt.order.contactPhone(); got != tt.wantPhone {
+				t.Errorf("contactPhone() = %q, want %q", got, tt.wantPhone)
+			}
+		})
+	}
+}
+
+func TestTransformAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address *Address
+		wantNil bool
+	}{
+		{name: "missing", address: nil, wantNil: true},
+		{name: "empty object", address: &Address{FirstName: "Jane"}, wantNil: true},
+		{name: "whitespace only", address: &Address{Address1: " ", City: "  "}, wantNil: true},
+		{name: "country only", address: &Address{CountryCode: "DE"}},
+		{name: "full", address: &Address{FirstName: "Jane", LastName: "Doe", Address1: "Main St 1", City: "Berlin", Zip: "10115"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transformAddress(tt.address); (got == nil) != tt.wantNil {
+				t.Errorf("transformAddress() = %+v, want nil %t", got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestCheckContact(t *testing.T) {
+	shippable, digital := true, false
+	address := &Address{Address1: "Main St 1", City: "Berlin", CountryCode: "DE"}
+
+	tests := []struct {
+		name             string
+		guestPolicy      string
+		shippingPolicy   string
+		order            ShopifyOrder
+		wantHeld         bool
+		wantShipToBilled bool
+	}{
+		{
+			name:           "complete order",
+			guestPolicy:    ContactHold,
+			shippingPolicy: ContactHold,
+			order:          ShopifyOrder{Customer: &Customer{ID: 1}, ShippingAddress: address, BillingAddress: address},
+		},
+		{
+			name:        "guest sent",
+			guestPolicy: ContactSend,
+			order:       ShopifyOrder{ShippingAddress: address},
+		},
+		{
+			name:        "guest held",
+			guestPolicy: ContactHold,
+			order:       ShopifyOrder{ShippingAddress: address},
+			wantHeld:    true,
+		},
+		{
+			name:             "missing shipping address enriched",
+			shippingPolicy:   ContactEnrich,
+			order:            ShopifyOrder{Customer: &Customer{ID: 1}, BillingAddress: address, LineItems: []LineItem{{RequiresShipping: &shippable}}},
+			wantShipToBilled: true,
+		},
+		{
+			name:           "missing shipping address held",
+			shippingPolicy: ContactHold,
+			order:          ShopifyOrder{Customer: &Customer{ID: 1}, BillingAddress: address, LineItems: []LineItem{{RequiresShipping: &shippable}}},
+			wantHeld:       true,
+		},
+		{
+			name:           "digital goods need no shipping address",
+			shippingPolicy: ContactHold,
+			order:          ShopifyOrder{Customer: &Customer{ID: 1}, BillingAddress: address, LineItems: []LineItem{{RequiresShipping: &digital}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				contact:   ContactPolicy{Guest: firstNonEmpty(tt.guestPolicy, ContactSend), MissingShipping: firstNonEmpty(tt.shippingPolicy, ContactEnrich)},
+				reconcile: ReconcileConfig{Mode: ReconcileOff},
+				items:     &ItemMap{},
+			}
+			erpOrder := s.transformOrder(&tt.order)
+
+			err := s.checkContact(&tt.order, erpOrder, "r1")
+			if held := errors.Is(err, ErrMissingContact); held != tt.wantHeld {
+				t.Errorf("checkContact() = %v, want held %t", err, tt.wantHeld)
+			}
+			if shipToBilled := tt.order.ShippingAddress == nil && erpOrder.ShippingAddress != nil; shipToBilled != tt.wantShipToBilled {
+				t.Errorf("shipping address taken from billing = %t, want %t", shipToBilled, tt.wantShipToBilled)
+			}
+		})
+	}
+}
+
+func TestNewContactPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		guest    string
+		shipping string
+		wantErr  bool
+	}{
+		{name: "defaults"},
+		{name: "case insensitive", guest: "HOLD", shipping: "Send"},
+		{name: "invalid guest policy", guest: "enrich", wantErr: true},
+		{name: "invalid shipping policy", shipping: "drop", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GUEST_ORDERS", tt.guest)
+			t.Setenv("MISSING_SHIPPING_ADDRESS", tt.shipping)
+			if _, err := NewContactPolicy(); (err != nil) != tt.wantErr {
+				t.Errorf("NewContactPolicy() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Customer lookup modes, set with CUSTOMER_LOOKUP
+const (
+	CustomerLookupOff    = "off"    // only the local mapping store and the default account
+	CustomerLookupFind   = "find"   // find unknown customers in AX
+	CustomerLookupCreate = "create" // find unknown customers in AX and create them when missing
+
+	DefaultCustomerAccountPrefix = "SHOP-"
+
+	DefaultFindCustomerOperation   = "FindCustomer"
+	DefaultFindCustomerAction      = "http://tempuri.org/FindCustomer"
+	DefaultCreateCustomerOperation = "CreateCustomer"
+	DefaultCreateCustomerAction    = "http://tempuri.org/CreateCustomer"
+)
+
+// Sources of a customer mapping
+const (
+	CustomerSourceManual  = "manual"  // set through the admin API
+	CustomerSourceFound   = "found"   // found in AX
+	CustomerSourceCreated = "created" // created in AX
+)
+
+var ErrCustomerMappingNotFound = errors.New("customer mapping not found")
+
+// CustomerMapping links a Shopify customer ID or email to an AX customer account
+type CustomerMapping struct {
+	Key         string `json:"key"` // "id:<customer id>" or "email:<address>"
+	CustAccount string `json:"cust_account"`
+	Source      string `json:"source"`
+	RequestID   string `json:"request_id,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// ERPCustomer is a Shopify customer looked up or created in AX
+type ERPCustomer struct {
+	CustomerID string `json:"customer_id"`
+	AccountNum string `json:"account_num"` // account number the customer is found or created under
+	Name       string `json:"name"`
+	FirstName  string `json:"first_name"`
+	LastName   string `json:"last_name"`
+	Email      string `json:"email"`
+	Phone      string `json:"phone"`
+	Currency   string `json:"currency"`
+	CustGroup  string `json:"cust_group"`
+}
+
+// CustomerMapStore persists customer mappings in DATA_DIR/customer_map.json
+// and holds the customer resolution settings read from CUSTOMER_* variables
+type CustomerMapStore struct {
+	mu       sync.Mutex
+	path     string
+	mappings map[string]*CustomerMapping
+
+	lookup         string
+	defaultAccount string
+	accountPrefix  string
+	custGroup      string
+}
+
+// NewCustomerMapStore loads the existing mappings. CUSTOMER_LOOKUP selects
+// AX lookups, CUSTOMER_DEFAULT_ACCOUNT is used for guest checkouts and
+// unresolved customers, CUSTOMER_ACCOUNT_PREFIX and CUSTOMER_GROUP set the
+// account number and group of customers found or created in AX.
+func NewCustomerMapStore() (*CustomerMapStore, error) {
+	if err := os.MkdirAll(dataDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	c := &CustomerMapStore{
+		path:           filepath.Join(dataDir(), "customer_map.json"),
+		mappings:       make(map[string]*CustomerMapping),
+		lookup:         CustomerLookupOff,
+		defaultAccount: os.Getenv("CUSTOMER_DEFAULT_ACCOUNT"),
+		accountPrefix:  DefaultCustomerAccountPrefix,
+		custGroup:      os.Getenv("CUSTOMER_GROUP"),
+	}
+	if value, ok := os.LookupEnv("CUSTOMER_ACCOUNT_PREFIX"); ok {
+		c.accountPrefix = value
+	}
+	if value := os.Getenv("CUSTOMER_LOOKUP"); value != "" {
+		switch lookup := strings.ToLower(value); lookup {
+		case CustomerLookupOff, CustomerLookupFind, CustomerLookupCreate:
+			c.lookup = lookup
+		default:
+			return nil, fmt.Errorf("invalid CUSTOMER_LOOKUP %q (expected off, find or create)", value)
+		}
+	}
+	if c.lookup == CustomerLookupCreate && c.custGroup == "" {
+		return nil, fmt.Errorf("CUSTOMER_LOOKUP=create requires CUSTOMER_GROUP")
+	}
+
+	var mappings []*CustomerMapping
+	if err := readJSONFile(c.path, &mappings); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", c.path, err)
+	}
+	for _, mapping := range mappings {
+		c.mappings[mapping.Key] = mapping
+	}
+
+	return c, nil
+}
+
+// Describe summarises the settings for the startup log
+func (c *CustomerMapStore) Describe() string {
+	defaultAccount := c.defaultAccount
+	if defaultAccount == "" {
+		defaultAccount = "none"
+	}
+	return fmt.Sprintf("lookup %s, %d mappings, default account %s", c.lookup, len(c.mappings), defaultAccount)
+}
+
+// Get returns the account mapped to a key
+func (c *CustomerMapStore) Get(key string) (*CustomerMapping, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mapping, ok := c.mappings[key]
+	if !ok {
+		return nil, ErrCustomerMappingNotFound
+	}
+	found := *mapping
+	return &found, nil
+}
+
+// Put maps a key to an AX customer account
+func (c *CustomerMapStore) Put(key, custAccount, source, requestID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	mapping, ok := c.mappings[key]
+	if !ok {
+		mapping = &CustomerMapping{Key: key, CreatedAt: now}
+		c.mappings[key] = mapping
+	}
+	mapping.CustAccount = custAccount
+	mapping.Source = source
+	mapping.RequestID = requestID
+	mapping.UpdatedAt = now
+
+	return c.save()
+}
+
+// Delete removes a mapping. Deleting a missing mapping is not an error.
+func (c *CustomerMapStore) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.mappings, key)
+	return c.save()
+}
+
+// List returns all mappings sorted by key
+func (c *CustomerMapStore) List() []CustomerMapping {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mappings := make([]CustomerMapping, 0, len(c.mappings))
+	for _, mapping := range c.mappings {
+		mappings = append(mappings, *mapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Key < mappings[j].Key
+	})
+	return mappings
+}
+
+// save persists all mappings. Callers must hold c.mu.
+func (c *CustomerMapStore) save() error {
+	mappings := make([]*CustomerMapping, 0, len(c.mappings))
+	for _, mapping := range c.mappings {
+		mappings = append(mappings, mapping)
+	}
+	return writeJSONFile(c.path, mappings)
+}
+
+// customerIDKey and customerEmailKey build the mapping store keys
+func customerIDKey(id int64) string {
+	return "id:" + strconv.FormatInt(id, 10)
+}
+
+func customerEmailKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// resolveCustomer sets the AX customer account of an order. Customers are
+// looked up in the mapping store by Shopify customer ID, then by email, then
+// in AX by account number and email when CUSTOMER_LOOKUP is enabled. Accounts
+// found or created in AX are stored under both keys. Guest checkouts and
+// customers that cannot be resolved get CUSTOMER_DEFAULT_ACCOUNT, or no
+// account at all so the envelope format's own default applies.
+func (s *Server) resolveCustomer(order *ShopifyOrder, erpOrder *ERPOrder, requestID string) error {
+	return s.lookupCustomer(order, erpOrder, requestID, false)
+}
+
+// lookupCustomer is resolveCustomer; a dry run only reads, it neither
+// creates customers in AX nor stores new mappings
+func (s *Server) lookupCustomer(order *ShopifyOrder, erpOrder *ERPOrder, requestID string, dryRun bool) error {
+	email := order.contactEmail()
+
+	var keys []string
+	if !order.isGuest() {
+		keys = append(keys, customerIDKey(order.Customer.ID))
+	}
+	if email != "" {
+		keys = append(keys, customerEmailKey(email))
+	}
+	for _, key := range keys {
+		if mapping, err := s.customers.Get(key); err == nil {
+			erpOrder.CustAccount = mapping.CustAccount
+			return nil
+		}
+	}
+
+	if order.isGuest() || s.customers.lookup == CustomerLookupOff {
+		erpOrder.CustAccount = s.customers.defaultAccount
+		return nil
+	}
+
+	customer := order.Customer
+	erpCustomer := &ERPCustomer{
+		CustomerID: strconv.FormatInt(customer.ID, 10),
+		AccountNum: s.customers.accountPrefix + strconv.FormatInt(customer.ID, 10),
+		Name:       order.contactName(),
+		FirstName:  customer.FirstName,
+		LastName:   customer.LastName,
+		Email:      email,
+		Phone:      order.contactPhone(),
+		Currency:   order.Currency,
+		CustGroup:  s.customers.custGroup,
+	}
+
+	account, err := s.findCustomer(erpCustomer, erpOrder.OrderID, requestID)
+	if err == nil && account == "" && email != "" {
+		// Customers created in AX by hand have an account number of their own
+		byEmail := *erpCustomer
+		byEmail.AccountNum = ""
+		account, err = s.findCustomer(&byEmail, erpOrder.OrderID, requestID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find customer %s in AX: %w", erpCustomer.CustomerID, err)
+	}
+	source := CustomerSourceFound
+	if account == "" && s.customers.lookup == CustomerLookupCreate && !dryRun {
+		account, err = s.createCustomer(erpCustomer, erpOrder.OrderID, requestID)
+		if err != nil {
+			return fmt.Errorf("failed to create customer %s in AX: %w", erpCustomer.CustomerID, err)
+		}
+		source = CustomerSourceCreated
+	}
+	if account == "" {
+		log.Printf("[%s] Customer %s not found in AX, using the default account", requestID, erpCustomer.CustomerID)
+		erpOrder.CustAccount = s.customers.defaultAccount
+		return nil
+	}
+
+	log.Printf("[%s] Customer %s resolved to AX account %s (%s)", requestID, erpCustomer.CustomerID, account, source)
+	if dryRun {
+		erpOrder.CustAccount = account
+		return nil
+	}
+	// Later orders may carry only one of the two, e.g. a guest checkout with the same email
+	for _, key := range keys {
+		if err := s.customers.Put(key, account, source, requestID); err != nil {
+			log.Printf("[%s] Error saving customer mapping %s -> %s: %v", requestID, key, account, err)
+		}
+	}
+	erpOrder.CustAccount = account
+	return nil
+}
+
+// findCustomer looks a customer up in AX, returning "" when AX has no match
+func (s *Server) findCustomer(customer *ERPCustomer, orderID, requestID string) (string, error) {
+	soapXML, err := s.envelope.BuildFindCustomer(customer)
+	if err != nil {
+		return "", fmt.Errorf("failed to build SOAP envelope: %w", err)
+	}
+	delivery, err := s.deliverSOAP(s.envelope.Destination(DestinationFindCustomer), soapXML, orderID, requestID)
+	if err != nil {
+		return "", err
+	}
+	return delivery.AccountNum, nil
+}
+
+// createCustomer creates a customer in AX and returns its account number
+func (s *Server) createCustomer(customer *ERPCustomer, orderID, requestID string) (string, error) {
+	soapXML, err := s.envelope.BuildCreateCustomer(customer)
+	if err != nil {
+		return "", fmt.Errorf("failed to build SOAP envelope: %w", err)
+	}
+	delivery, err := s.deliverSOAP(s.envelope.Destination(DestinationCreateCustomer), soapXML, orderID, requestID)
+	if err != nil {
+		return "", err
+	}
+	if delivery.AccountNum == "" {
+		// AX keeps the account number it was given
+		return customer.AccountNum, nil
+	}
+	return delivery.AccountNum, nil
+}
+
+// CustomerAction returns the default SOAPAction of a customer operation for the configured format
+func (b *EnvelopeBuilder) CustomerAction(destination string) string {
+	if b.config.Format == EnvelopeFormatAIF {
+		if destination == DestinationCreateCustomer {
+			return AIFCustomerCreateAction
+		}
+		return AIFCustomerFindAction
+	}
+	if destination == DestinationCreateCustomer {
+		return DefaultCreateCustomerAction
+	}
+	return DefaultFindCustomerAction
+}
+
+// BuildFindCustomer renders the SOAP envelope that looks a customer up in AX
+func (b *EnvelopeBuilder) BuildFindCustomer(c *ERPCustomer) (string, error) {
+	if b.config.Format == EnvelopeFormatAIF {
+		return b.buildAIFFindCustomer(c)
+	}
+
+	el := b.element("customer", "customer")
+	el.add(b.text("AccountNum", c.AccountNum))
+	el.add(b.text("CustomerID", c.CustomerID))
+	el.add(b.text("Email", c.Email))
+	return b.customerEnvelope(DestinationFindCustomer, DefaultFindCustomerOperation, el)
+}
+
+// BuildCreateCustomer renders the SOAP envelope that creates a customer in AX
+func (b *EnvelopeBuilder) BuildCreateCustomer(c *ERPCustomer) (string, error) {
+	if b.config.Format == EnvelopeFormatAIF {
+		return b.buildAIFCreateCustomer(c)
+	}
+
+	el := b.element("customer", "customer")
+	el.add(b.text("AccountNum", c.AccountNum))
+	el.add(b.text("CustomerID", c.CustomerID))
+	el.add(b.text("Name", c.Name))
+	el.add(b.text("FirstName", c.FirstName))
+	el.add(b.text("LastName", c.LastName))
+	el.add(b.text("Email", c.Email))
+	el.add(b.text("Phone", c.Phone))
+	el.add(b.text("Currency", c.Currency))
+	el.add(b.text("CustGroup", c.CustGroup))
+	return b.customerEnvelope(DestinationCreateCustomer, DefaultCreateCustomerOperation, el)
+}
+
+// customerEnvelope wraps a customer element in its operation element
+func (b *EnvelopeBuilder) customerEnvelope(destination, operationName string, el *xmlElement) (string, error) {
+	prefix := b.config.Prefix
+	operation := &xmlElement{
+		Name:     qualify(prefix, operationName),
+		Attrs:    []xml.Attr{{Name: xml.Name{Local: "xmlns:" + prefix}, Value: b.config.Namespace}},
+		Children: []*xmlElement{el},
+	}
+	return marshalEnvelope(b.envelopeNamespace(destination), nil, operation)
+}
+
+// handleListCustomerMappings lists the customer mappings
+func (s *Server) handleListCustomerMappings(w http.ResponseWriter, r *http.Request) {
+	mappings := s.customers.List()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":     len(mappings),
+		"customers": mappings,
+	})
+}
+
+// handlePutCustomerMapping maps a Shopify customer ID or email to an AX account.
+// The body is {"customer_id": 123, "cust_account": "C0001"} or uses "email".
+func (s *Server) handlePutCustomerMapping(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CustomerID  int64  `json:"customer_id"`
+		Email       string `json:"email"`
+		CustAccount string `json:"cust_account"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.CustAccount == "" || (req.CustomerID == 0) == (req.Email == "") {
+		writeJSONError(w, http.StatusBadRequest, "cust_account and either customer_id or email are required")
+		return
+	}
+
+	key := customerEmailKey(req.Email)
+	if req.CustomerID != 0 {
+		key = customerIDKey(req.CustomerID)
+	}
+	if err := s.customers.Put(key, req.CustAccount, CustomerSourceManual, ""); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	mapping, _ := s.customers.Get(key)
+	writeJSON(w, http.StatusOK, mapping)
+}
+
+// handleDeleteCustomerMapping removes a mapping by key, e.g. id:123 or email:a@example.com
+func (s *Server) handleDeleteCustomerMapping(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if _, err := s.customers.Get(key); errors.Is(err, ErrCustomerMappingNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := s.customers.Delete(key); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status": "deleted",
+		"key":    key,
+	})
+}
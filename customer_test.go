@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func customerFound(account string) string {
+	return `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><FindCustomerResponse><AccountNum>` +
+		account + `</AccountNum></FindCustomerResponse></s:Body></s:Envelope>`
+}
+
+const customerNotFound = `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><FindCustomerResponse/></s:Body></s:Envelope>`
+
+func TestLookupCustomer(t *testing.T) {
+	customer := &Customer{ID: 42, Email: "Jane@Example.com", FirstName: "Jane", LastName: "Doe"}
+
+	tests := []struct {
+		name         string
+		lookup       string
+		customer     *Customer
+		email        string
+		stored       map[string]string // key to account
+		responses    []string
+		dryRun       bool
+		wantAccount  string
+		wantRequests int
+		wantStored   map[string]string
+	}{
+		{
+			name:        "stored by customer ID",
+			lookup:      CustomerLookupFind,
+			customer:    customer,
+			stored:      map[string]string{"id:42": "C-ID"},
+			wantAccount: "C-ID",
+		},
+		{
+			name:        "stored by email",
+			lookup:      CustomerLookupFind,
+			customer:    customer,
+			stored:      map[string]string{"email:jane@example.com": "C-MAIL"},
+			wantAccount: "C-MAIL",
+		},
+		{
+			name:        "guest uses the default account",
+			lookup:      CustomerLookupFind,
+			email:       "guest@example.com",
+			wantAccount: "WEB",
+		},
+		{
+			name:        "lookup off uses the default account",
+			lookup:      CustomerLookupOff,
+			customer:    customer,
+			wantAccount: "WEB",
+		},
+		{
+			name:         "found by account number",
+			lookup:       CustomerLookupFind,
+			customer:     customer,
+			responses:    []string{customerFound("SHOP-42")},
+			wantAccount:  "SHOP-42",
+			wantRequests: 1,
+			wantStored:   map[string]string{"id:42": "SHOP-42", "email:jane@example.com": "SHOP-42"},
+		},
+		{
+			name:         "found by email",
+			lookup:       CustomerLookupFind,
+			customer:     customer,
+			responses:    []string{customerNotFound, customerFound("C0815")},
+			wantAccount:  "C0815",
+			wantRequests: 2,
+			wantStored:   map[string]string{"id:42": "C0815", "email:jane@example.com": "C0815"},
+		},
+		{
+			name:         "not found",
+			lookup:       CustomerLookupFind,
+			customer:     customer,
+			responses:    []string{customerNotFound, customerNotFound},
+			wantAccount:  "WEB",
+			wantRequests: 2,
+		},
+		{
+			name:         "created",
+			lookup:       CustomerLookupCreate,
+			customer:     customer,
+			responses:    []string{customerNotFound, customerNotFound, customerNotFound},
+			wantAccount:  "SHOP-42",
+			wantRequests: 3,
+			wantStored:   map[string]string{"id:42": "SHOP-42", "email:jane@example.com": "SHOP-42"},
+		},
+		{
+			name:         "dry run stores nothing",
+			lookup:       CustomerLookupCreate,
+			customer:     customer,
+			responses:    []string{customerFound("SHOP-42")},
+			dryRun:       true,
+			wantAccount:  "SHOP-42",
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, erp := newTestServer(t, map[string]string{
+				"CUSTOMER_LOOKUP":          tt.lookup,
+				"CUSTOMER_DEFAULT_ACCOUNT": "WEB",
+				"CUSTOMER_GROUP":           "10",
+			})
+			erp.responses = tt.responses
+			for key, account := range tt.stored {
+				if err := s.customers.Put(key, account, CustomerSourceManual, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			order := &ShopifyOrder{ID: 1001, Email: tt.email, Currency: "EUR", Customer: tt.customer}
+			erpOrder := &ERPOrder{OrderID: "1001"}
+			if err := s.lookupCustomer(order, erpOrder, "r1", tt.dryRun); err != nil {
+				t.Fatal(err)
+			}
+
+			if erpOrder.CustAccount != tt.wantAccount {
+				t.Errorf("CustAccount = %q, want %q", erpOrder.CustAccount, tt.wantAccount)
+			}
+			if requests := erp.Requests(); len(requests) != tt.wantRequests {
+				t.Errorf("ERP received %d requests, want %d", len(requests), tt.wantRequests)
+			}
+			stored := make(map[string]string)
+			for _, mapping := range s.customers.List() {
+				if mapping.Source != CustomerSourceManual {
+					stored[mapping.Key] = mapping.CustAccount
+				}
+			}
+			if len(stored) != len(tt.wantStored) {
+				t.Errorf("stored mappings = %v, want %v", stored, tt.wantStored)
+			}
+			for key, account := range tt.wantStored {
+				if stored[key] != account {
+					t.Errorf("mapping %s = %q, want %q", key, stored[key], account)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildFindCustomer(t *testing.T) {
+	tests := []struct {
+		name     string
+		customer *ERPCustomer
+		want     []string
+	}{
+		{
+			name:     "by account number",
+			customer: &ERPCustomer{AccountNum: "SHOP-42", Email: "jane@example.com"},
+			want:     []string{"<DataSourceName>CustTable</DataSourceName>", "<Value1>SHOP-42</Value1>"},
+		},
+		{
+			name:     "by email",
+			customer: &ERPCustomer{Email: "jane@example.com"},
+			want:     []string{"<FieldName>Locator</FieldName>", "<Value1>jane@example.com</Value1>"},
+		},
+	}
+
+	b := newTestAIFBuilder(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := b.BuildFindCustomer(tt.customer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(envelope, want) {
+					t.Errorf("envelope does not contain %s:\n%s", want, envelope)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dead-letter statuses
+const (
+	DeadLetterPending  = "pending"
+	DeadLetterRetrying = "retrying"
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrDeadLetterRetrying = errors.New("dead letter is already queued for retry")
+
+	validStoreID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// DeadLetter is an order that could not be delivered to the ERP
+type DeadLetter struct {
+	ID        string          `json:"id"`
+	RequestID string          `json:"request_id"`
+	OrderID   string          `json:"order_id"`
+	Topic     string          `json:"topic,omitempty"`
+	WebhookID string          `json:"webhook_id,omitempty"`
+	Status    string          `json:"status"`
+	Reason    string          `json:"reason"`
+	Class     string          `json:"class,omitempty"`
+	Retryable bool            `json:"retryable"`
+	Failures  int             `json:"failures"`
+	CreatedAt string          `json:"created_at"`
+	UpdatedAt string          `json:"updated_at"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Envelope  string          `json:"envelope,omitempty"`
+	Attempts  []ERPAttempt    `json:"attempts,omitempty"`
+}
+
+// DeadLetterStore keeps one JSON file per failed order under DATA_DIR/deadletter
+type DeadLetterStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewDeadLetterStore creates the dead-letter directory
+func NewDeadLetterStore() (*DeadLetterStore, error) {
+	dir := filepath.Join(dataDir(), "deadletter")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory %s: %w", dir, err)
+	}
+	return &DeadLetterStore{dir: dir}, nil
+}
+
+// Add stores a failed job. If the job was already dead-lettered, for example
+// after a retry from the admin API, its attempt history is kept.
+func (d *DeadLetterStore) Add(job *QueuedOrder, delivery *ERPDelivery, reason error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	entry, err := d.read(job.ID)
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		entry = &DeadLetter{
+			ID:        job.ID,
+			RequestID: job.RequestID,
+			OrderID:   job.OrderID,
+			Topic:     job.Topic,
+			WebhookID: job.WebhookID,
+			CreatedAt: now,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	entry.Status = DeadLetterPending
+	entry.Reason = reason.Error()
+	entry.Class = ""
+	entry.Retryable = false
+	var erpErr *ERPError
+	if errors.As(reason, &erpErr) {
+		entry.Class = string(erpErr.Class)
+		entry.Retryable = erpErr.Retryable()
+	}
+	entry.Failures++
+	entry.UpdatedAt = now
+	entry.Payload = job.Body
+	if delivery != nil {
+		entry.Envelope = delivery.Envelope
+		entry.Attempts = append(entry.Attempts, delivery.Attempts...)
+	}
+
+	if err := writeJSONFile(d.path(job.ID), entry); err != nil {
+		return fmt.Errorf("failed to store dead letter: %w", err)
+	}
+
+	log.Printf("[%s] Order %s moved to dead-letter store: %s", job.RequestID, job.OrderID, entry.Reason)
+	return nil
+}
+
+// Get returns a single dead letter
+func (d *DeadLetterStore) Get(id string) (*DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.read(id)
+}
+
+// List returns all dead letters oldest first, without payloads and envelopes.
+// If orderID is set only entries for that order are returned.
+func (d *DeadLetterStore) List(orderID string) ([]DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := []DeadLetter{}
+	for _, file := range entries {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		entry, err := d.read(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			log.Printf("Error reading dead letter %s: %v", name, err)
+			continue
+		}
+		if orderID != "" && entry.OrderID != orderID {
+			continue
+		}
+
+		entry.Payload = nil
+		entry.Envelope = ""
+		letters = append(letters, *entry)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].CreatedAt < letters[j].CreatedAt
+	})
+
+	return letters, nil
+}
+
+// Count returns the number of stored dead letters
+func (d *DeadLetterStore) Count() int {
+	matches, _ := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	return len(matches)
+}
+
+// Retry flags a dead letter as handed back to the queue and returns it. An
+// entry that is already being retried is refused so it is not queued twice.
+func (d *DeadLetterStore) Retry(id string) (*DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Status == DeadLetterRetrying {
+		return entry, ErrDeadLetterRetrying
+	}
+	return entry, d.setStatus(entry, DeadLetterRetrying)
+}
+
+// CancelRetry sets a dead letter back to pending when it could not be queued
+func (d *DeadLetterStore) CancelRetry(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, err := d.read(id)
+	if err != nil {
+		return err
+	}
+	return d.setStatus(entry, DeadLetterPending)
+}
+
+// setStatus stores entry with a new status. Callers must hold d.mu.
+func (d *DeadLetterStore) setStatus(entry *DeadLetter, status string) error {
+	entry.Status = status
+	entry.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return writeJSONFile(d.path(entry.ID), entry)
+}
+
+// Delete removes a dead letter. Deleting a missing entry is not an error.
+func (d *DeadLetterStore) Delete(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !validStoreID.MatchString(id) {
+		return ErrDeadLetterNotFound
+	}
+	if err := os.Remove(d.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// read loads a dead letter from disk. Callers must hold d.mu.
+func (d *DeadLetterStore) read(id string) (*DeadLetter, error) {
+	if !validStoreID.MatchString(id) {
+		return nil, ErrDeadLetterNotFound
+	}
+
+	data, err := os.ReadFile(d.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry DeadLetter
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (d *DeadLetterStore) path(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+// deadLetterFailedJob is the queue's failure hook: a job whose handler
+// returned an error is kept as a dead letter rather than left in queue/failed
+func (s *Server) deadLetterFailedJob(job *QueuedOrder, err error) error {
+	s.dedupe.MarkFailed(job.WebhookID, job.OrderID, job.RequestID, err)
+	return s.deadLetters.Add(job, nil, err)
+}
+
+// handleListDeadLetters lists dead letters, optionally filtered by ?order_id=
+func (s *Server) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := s.deadLetters.List(r.URL.Query().Get("order_id"))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":        len(letters),
+		"dead_letters": letters,
+	})
+}
+
+// handleGetDeadLetter returns a dead letter including payload, envelope and attempts
+func (s *Server) handleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	entry, err := s.deadLetters.Get(r.PathValue("id"))
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// handleRetryDeadLetter puts a dead-lettered order back on the delivery queue
+func (s *Server) handleRetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	entry, err := s.deadLetters.Retry(id)
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, ErrDeadLetterRetrying) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	job := &QueuedOrder{
+		ID:         entry.ID,
+		RequestID:  entry.RequestID,
+		Topic:      entry.Topic,
+		WebhookID:  entry.WebhookID,
+		OrderID:    entry.OrderID,
+		ReceivedAt: time.Now().UTC().Format(time.RFC3339),
+		Body:       entry.Payload,
+	}
+	if err := s.queue.Enqueue(job); err != nil {
+		if err := s.deadLetters.CancelRetry(id); err != nil {
+			log.Printf("[%s] Error resetting dead letter to pending: %v", entry.RequestID, err)
+		}
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("[%s] Dead letter for order %s requeued by admin", entry.RequestID, entry.OrderID)
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"status":     "queued",
+		"id":         entry.ID,
+		"order_id":   entry.OrderID,
+		"request_id": entry.RequestID,
+		"message":    "Order queued for redelivery to ERP",
+	})
+}
+
+// handleDeleteDeadLetter discards a dead letter, e.g. after manual resolution in AX
+func (s *Server) handleDeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.deadLetters.Get(id); errors.Is(err, ErrDeadLetterNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := s.deadLetters.Delete(id); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status": "deleted",
+		"id":     id,
+	})
+}
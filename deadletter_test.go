@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestDeadLetterStore(t *testing.T) *DeadLetterStore {
+	t.Helper()
+	t.Setenv("DATA_DIR", t.TempDir())
+
+	d, err := NewDeadLetterStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func deadLetterJob(id, orderID string) *QueuedOrder {
+	return &QueuedOrder{ID: id, RequestID: id, Topic: TopicOrdersCreate, OrderID: orderID, Body: json.RawMessage(`{"id":` + orderID + `}`)}
+}
+
+func TestDeadLetterStoreAdd(t *testing.T) {
+	serverError := &ERPError{Class: ClassServerError, StatusCode: 500, Err: errors.New("AOS down")}
+	clientFault := &ERPError{Class: ClassSOAPClientFault, StatusCode: 500, Err: errors.New("item missing")}
+
+	tests := []struct {
+		name          string
+		reasons       []error
+		wantFailures  int
+		wantClass     string
+		wantRetryable bool
+		wantAttempts  int
+	}{
+		{name: "plain error", reasons: []error{errors.New("parse failed")}, wantFailures: 1},
+		{name: "retryable ERP error", reasons: []error{serverError}, wantFailures: 1, wantClass: string(ClassServerError), wantRetryable: true, wantAttempts: 1},
+		{name: "failed again keeps history", reasons: []error{serverError, clientFault}, wantFailures: 2, wantClass: string(ClassSOAPClientFault), wantAttempts: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDeadLetterStore(t)
+			job := deadLetterJob("r1", "1001")
+			for i, reason := range tt.reasons {
+				var delivery *ERPDelivery
+				if errors.As(reason, new(*ERPError)) {
+					delivery = &ERPDelivery{Envelope: "<Envelope/>", Attempts: []ERPAttempt{{Attempt: i + 1, Error: reason.Error()}}}
+				}
+				if err := d.Add(job, delivery, reason); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			entry, err := d.Get("r1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Status != DeadLetterPending || entry.Failures != tt.wantFailures || entry.Reason != tt.reasons[len(tt.reasons)-1].Error() {
+				t.Errorf("entry = %s after %d failures (%s), want pending after %d", entry.Status, entry.Failures, entry.Reason, tt.wantFailures)
+			}
+			if entry.Class != tt.wantClass || entry.Retryable != tt.wantRetryable {
+				t.Errorf("class = %q retryable %t, want %q retryable %t", entry.Class, entry.Retryable, tt.wantClass, tt.wantRetryable)
+			}
+			if len(entry.Attempts) != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", len(entry.Attempts), tt.wantAttempts)
+			}
+			var payload struct{ ID int64 }
+			if err := json.Unmarshal(entry.Payload, &payload); err != nil || payload.ID != 1001 {
+				t.Errorf("payload = %s, want the queued order", entry.Payload)
+			}
+		})
+	}
+}
+
+func TestDeadLetterStoreListDeleteAndReopen(t *testing.T) {
+	d := newTestDeadLetterStore(t)
+	for _, job := range []*QueuedOrder{deadLetterJob("r1", "1001"), deadLetterJob("r2", "1002"), deadLetterJob("r3", "1001")} {
+		if err := d.Add(job, nil, errors.New("boom")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := NewDeadLetterStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Count() != 3 {
+		t.Fatalf("Count() after reopen = %d, want 3", reopened.Count())
+	}
+	letters, err := reopened.List("1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("List(1001) = %d entries, want 2", len(letters))
+	}
+	for _, letter := range letters {
+		if letter.Payload != nil || letter.Envelope != "" {
+			t.Errorf("listed entry %s carries its payload", letter.ID)
+		}
+	}
+
+	if err := reopened.Delete("r1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Delete("r1"); err != nil {
+		t.Errorf("deleting a missing entry = %v, want nil", err)
+	}
+	if _, err := reopened.Get("r1"); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("Get() of a deleted entry = %v, want not found", err)
+	}
+	if _, err := reopened.Get("../queue"); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("Get() of an invalid ID = %v, want not found", err)
+	}
+	if reopened.Count() != 2 {
+		t.Errorf("Count() after delete = %d, want 2", reopened.Count())
+	}
+}
+
+func TestDeadLetterStoreRetry(t *testing.T) {
+	d := newTestDeadLetterStore(t)
+	job := deadLetterJob("r1", "1001")
+	if err := d.Add(job, nil, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name       string
+		do         func() error
+		wantErr    error
+		wantStatus string
+	}{
+		{name: "retry", do: func() error { _, err := d.Retry("r1"); return err }, wantStatus: DeadLetterRetrying},
+		{name: "retry while retrying", do: func() error { _, err := d.Retry("r1"); return err }, wantErr: ErrDeadLetterRetrying, wantStatus: DeadLetterRetrying},
+		{name: "cancel retry", do: func() error { return d.CancelRetry("r1") }, wantStatus: DeadLetterPending},
+		{name: "retry again", do: func() error { _, err := d.Retry("r1"); return err }, wantStatus: DeadLetterRetrying},
+		{name: "failed again", do: func() error { return d.Add(job, nil, errors.New("boom")) }, wantStatus: DeadLetterPending},
+		{name: "retry unknown", do: func() error { _, err := d.Retry("r2"); return err }, wantErr: ErrDeadLetterNotFound, wantStatus: DeadLetterPending},
+	}
+
+	for _, step := range steps {
+		if err := step.do(); !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: error = %v, want %v", step.name, err, step.wantErr)
+		}
+		entry, err := d.Get("r1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Status != step.wantStatus {
+			t.Errorf("%s: status = %s, want %s", step.name, entry.Status, step.wantStatus)
+		}
+	}
+}
+
+func TestDeadLetterAdminAPI(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"ADMIN_TOKEN": "secret"})
+
+	// Handler failures reach the store through the queue's failure hook
+	for _, job := range []*QueuedOrder{deadLetterJob("r1", "1001"), deadLetterJob("r2", "1002")} {
+		if err := s.deadLetterFailedJob(job, errors.New("boom")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		id         string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "list", method: "GET", path: "/admin/dead-letters", handler: s.handleListDeadLetters, wantStatus: http.StatusOK, wantBody: `"count":2`},
+		{name: "list by order", method: "GET", path: "/admin/dead-letters?order_id=1002", handler: s.handleListDeadLetters, wantStatus: http.StatusOK, wantBody: `"count":1`},
+		{name: "get", method: "GET", id: "r1", handler: s.handleGetDeadLetter, wantStatus: http.StatusOK, wantBody: `"payload":{"id":1001}`},
+		{name: "get unknown", method: "GET", id: "r9", handler: s.handleGetDeadLetter, wantStatus: http.StatusNotFound},
+		{name: "retry", method: "POST", id: "r1", handler: s.handleRetryDeadLetter, wantStatus: http.StatusAccepted, wantBody: `"status":"queued"`},
+		{name: "retry while retrying", method: "POST", id: "r1", handler: s.handleRetryDeadLetter, wantStatus: http.StatusConflict},
+		{name: "retry unknown", method: "POST", id: "r9", handler: s.handleRetryDeadLetter, wantStatus: http.StatusNotFound},
+		{name: "delete", method: "DELETE", id: "r2", handler: s.handleDeleteDeadLetter, wantStatus: http.StatusOK},
+		{name: "delete unknown", method: "DELETE", id: "r2", handler: s.handleDeleteDeadLetter, wantStatus: http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		path := step.path
+		if path == "" {
+			path = "/admin/dead-letters/" + step.id
+		}
+		req := httptest.NewRequest(step.method, path, nil)
+		req.SetPathValue("id", step.id)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.requireAdmin(step.handler)(rec, req)
+
+		if rec.Code != step.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", step.name, rec.Code, step.wantStatus, rec.Body)
+		}
+		if !strings.Contains(rec.Body.String(), step.wantBody) {
+			t.Errorf("%s: body = %s, want %s", step.name, rec.Body, step.wantBody)
+		}
+	}
+
+	if s.queue.Depth() != 1 {
+		t.Errorf("queue depth = %d, want the one retried order", s.queue.Depth())
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DefaultDedupeRetention = 7 * 24 * time.Hour
+
+// Delivery statuses recorded in the deduplication store
+const (
+	DeliveryQueued    = "queued"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryCancelled = "cancelled" // cancelled in Shopify before it was sent to the ERP
+	DeliveryHeld      = "held"      // held for manual review
+	DeliveryRejected  = "rejected"  // rejected in manual review, never sent to the ERP
+)
+
+// DeliveryRecord remembers a webhook delivery and its ERP outcome
+type DeliveryRecord struct {
+	WebhookID       string `json:"webhook_id,omitempty"`
+	OrderID         string `json:"order_id,omitempty"`
+	RequestID       string `json:"request_id"`
+	Status          string `json:"status"`
+	SalesID         string `json:"sales_id,omitempty"`
+	Error           string `json:"error,omitempty"`
+	CancelRequested string `json:"cancel_requested,omitempty"` // cancellation that arrived before the order reached AX
+	FirstSeen       string `json:"first_seen"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+// DedupeStore is a persistent index of processed webhook IDs and Shopify
+// order IDs used to make order delivery idempotent
+type DedupeStore struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+	byWebhook map[string]*DeliveryRecord
+	byOrder   map[string]*DeliveryRecord
+}
+
+// NewDedupeStore loads DATA_DIR/dedupe.json, keeping records for DEDUPE_RETENTION
+func NewDedupeStore() (*DedupeStore, error) {
+	retention := DefaultDedupeRetention
+	if value := os.Getenv("DEDUPE_RETENTION"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("Warning: invalid DEDUPE_RETENTION %q, using %s", value, DefaultDedupeRetention)
+		} else {
+			retention = parsed
+		}
+	}
+
+	if err := os.MkdirAll(dataDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	d := &DedupeStore{
+		path:      filepath.Join(dataDir(), "dedupe.json"),
+		retention: retention,
+		byWebhook: make(map[string]*DeliveryRecord),
+		byOrder:   make(map[string]*DeliveryRecord),
+	}
+
+	var records []*DeliveryRecord
+	if err := readJSONFile(d.path, &records); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", d.path, err)
+	}
+	for _, record := range records {
+		d.index(record)
+	}
+	d.prune()
+
+	return d, nil
+}
+
+// Retention returns how long delivery records are kept
+func (d *DedupeStore) Retention() time.Duration {
+	return d.retention
+}
+
+// Claim records a new delivery unless the webhook ID or order ID has already
+// been seen. When a previous delivery exists it is returned with claimed=false.
+// An empty orderID only deduplicates on the webhook ID.
+func (d *DedupeStore) Claim(webhookID, orderID, requestID string) (*DeliveryRecord, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if existing := d.lookup(webhookID, orderID); existing != nil {
+		found := *existing
+		return &found, false
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	d.index(&DeliveryRecord{
+		WebhookID: webhookID,
+		OrderID:   orderID,
+		RequestID: requestID,
+		Status:    DeliveryQueued,
+		FirstSeen: now,
+		UpdatedAt: now,
+	})
+	d.save()
+
+	return nil, true
+}
+
+// Release forgets a claim, used when a delivery could not be queued
+func (d *DedupeStore) Release(webhookID, orderID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if webhookID != "" {
+		delete(d.byWebhook, webhookID)
+	}
+	if orderID != "" {
+		delete(d.byOrder, orderID)
+	}
+	d.save()
+}
+
+// Delivered reports whether the order has already been accepted by the ERP
+func (d *DedupeStore) Delivered(orderID string) (*DeliveryRecord, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	record, ok := d.byOrder[orderID]
+	if !ok || record.Status != DeliveryDelivered {
+		return nil, false
+	}
+	found := *record
+	return &found, true
+}
+
+// MarkDelivered records a successful ERP delivery and the resulting AX SalesId
+func (d *DedupeStore) MarkDelivered(webhookID, orderID, requestID, salesID string) {
+	d.update(webhookID, orderID, requestID, DeliveryDelivered, salesID, nil)
+}
+
+// MarkFailed records a failed ERP delivery
+func (d *DedupeStore) MarkFailed(webhookID, orderID, requestID string, err error) {
+	d.update(webhookID, orderID, requestID, DeliveryFailed, "", err)
+}
+
+// MarkCancelled records that an order was not sent because it was cancelled
+func (d *DedupeStore) MarkCancelled(webhookID, orderID, requestID string) {
+	d.update(webhookID, orderID, requestID, DeliveryCancelled, "", nil)
+}
+
+// MarkHeld records that an order was held for manual review instead of being sent
+func (d *DedupeStore) MarkHeld(webhookID, orderID, requestID string) {
+	d.update(webhookID, orderID, requestID, DeliveryHeld, "", nil)
+}
+
+// MarkRejected records that a held order was rejected in review
+func (d *DedupeStore) MarkRejected(webhookID, orderID, requestID string) {
+	d.update(webhookID, orderID, requestID, DeliveryRejected, "", nil)
+}
+
+// RequestCancel flags an order whose cancellation arrived before the order
+// reached AX. An order that was never seen is recorded as cancelled so a late
+// orders/create is treated as a duplicate.
+func (d *DedupeStore) RequestCancel(orderID, requestID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	record, ok := d.byOrder[orderID]
+	if !ok {
+		record = &DeliveryRecord{OrderID: orderID, RequestID: requestID, Status: DeliveryCancelled, FirstSeen: now}
+	}
+	record.CancelRequested = requestID
+	record.UpdatedAt = now
+	d.index(record)
+	d.save()
+}
+
+// CancelRequested reports whether a cancellation is waiting for the order
+func (d *DedupeStore) CancelRequested(orderID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	record, ok := d.byOrder[orderID]
+	return ok && record.CancelRequested != ""
+}
+
+// update sets the outcome of a delivery, creating the record if needed
+func (d *DedupeStore) update(webhookID, orderID, requestID, status, salesID string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	record := d.lookup(webhookID, orderID)
+	if record == nil {
+		record = &DeliveryRecord{WebhookID: webhookID, OrderID: orderID, FirstSeen: now}
+	}
+	record.RequestID = requestID
+	record.Status = status
+	if salesID != "" {
+		record.SalesID = salesID
+	}
+	record.Error = ""
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record.UpdatedAt = now
+	d.index(record)
+	d.save()
+}
+
+// lookup finds a record by webhook ID first, then order ID. Callers must hold d.mu.
+func (d *DedupeStore) lookup(webhookID, orderID string) *DeliveryRecord {
+	if webhookID != "" {
+		if record, ok := d.byWebhook[webhookID]; ok {
+			return record
+		}
+	}
+	if orderID != "" {
+		if record, ok := d.byOrder[orderID]; ok {
+			return record
+		}
+	}
+	return nil
+}
+
+// index adds the record to both lookup maps. Callers must hold d.mu.
+func (d *DedupeStore) index(record *DeliveryRecord) {
+	if record.WebhookID != "" {
+		d.byWebhook[record.WebhookID] = record
+	}
+	if record.OrderID != "" {
+		d.byOrder[record.OrderID] = record
+	}
+}
+
+// prune drops records older than the retention window. Callers must hold d.mu
+// or have exclusive access.
+func (d *DedupeStore) prune() {
+	cutoff := time.Now().Add(-d.retention)
+	for _, index := range []map[string]*DeliveryRecord{d.byWebhook, d.byOrder} {
+		for key, record := range index {
+			updated, err := time.Parse(time.RFC3339, record.UpdatedAt)
+			if err == nil && updated.Before(cutoff) {
+				delete(index, key)
+			}
+		}
+	}
+}
+
+// save prunes expired records and persists the rest. Callers must hold d.mu.
+func (d *DedupeStore) save() {
+	d.prune()
+
+	seen := make(map[*DeliveryRecord]bool)
+	records := make([]*DeliveryRecord, 0, len(d.byOrder))
+	for _, index := range []map[string]*DeliveryRecord{d.byWebhook, d.byOrder} {
+		for _, record := range index {
+			if !seen[record] {
+				seen[record] = true
+				records = append(records, record)
+			}
+		}
+	}
+
+	if err := writeJSONFile(d.path, records); err != nil {
+		log.Printf("Error saving deduplication store: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestDedupeStore(t *testing.T) *DedupeStore {
+	t.Helper()
+	t.Setenv("DATA_DIR", t.TempDir())
+	t.Setenv("DEDUPE_RETENTION", "")
+
+	d, err := NewDedupeStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDedupeStoreClaim(t *testing.T) {
+	tests := []struct {
+		name        string
+		first       [2]string // webhook ID, order ID
+		second      [2]string
+		wantClaimed bool
+	}{
+		{name: "same webhook", first: [2]string{"w1", "1"}, second: [2]string{"w1", "1"}},
+		{name: "redelivered order, new webhook ID", first: [2]string{"w1", "1"}, second: [2]string{"w2", "1"}},
+		{name: "same webhook without order ID", first: [2]string{"w1", ""}, second: [2]string{"w1", ""}},
+		{name: "different order", first: [2]string{"w1", "1"}, second: [2]string{"w2", "2"}, wantClaimed: true},
+		{name: "no webhook ID, different order", first: [2]string{"", "1"}, second: [2]string{"", "2"}, wantClaimed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDedupeStore(t)
+			if _, claimed := d.Claim(tt.first[0], tt.first[1], "r1"); !claimed {
+				t.Fatal("first claim failed")
+			}
+			previous, claimed := d.Claim(tt.second[0], tt.second[1], "r2")
+			if claimed != tt.wantClaimed {
+				t.Fatalf("second claim = %t, want %t", claimed, tt.wantClaimed)
+			}
+			if !claimed && (previous == nil || previous.RequestID != "r1" || previous.Status != DeliveryQueued) {
+				t.Errorf("previous delivery = %+v, want queued request r1", previous)
+			}
+		})
+	}
+}
+
+func TestDedupeStoreRelease(t *testing.T) {
+	d := newTestDedupeStore(t)
+	d.Claim("w1", "1", "r1")
+	d.Release("w1", "1")
+
+	if _, claimed := d.Claim("w1", "1", "r2"); !claimed {
+		t.Error("claim after release failed")
+	}
+}
+
+func TestDedupeStoreStatuses(t *testing.T) {
+	tests := []struct {
+		name          string
+		mark          func(d *DedupeStore)
+		wantStatus    string
+		wantDelivered bool
+	}{
+		{name: "delivered", mark: func(d *DedupeStore) { d.MarkDelivered("w1", "1", "r1", "SO-1") }, wantStatus: DeliveryDelivered, wantDelivered: true},
+		{name: "failed", mark: func(d *DedupeStore) { d.MarkFailed("w1", "1", "r1", errors.New("boom")) }, wantStatus: DeliveryFailed},
+		{name: "cancelled", mark: func(d *DedupeStore) { d.MarkCancelled("w1", "1", "r1") }, wantStatus: DeliveryCancelled},
+		{name: "held", mark: func(d *DedupeStore) { d.MarkHeld("w1", "1", "r1") }, wantStatus: DeliveryHeld},
+		{name: "rejected", mark: func(d *DedupeStore) { d.MarkRejected("w1", "1", "r1") }, wantStatus: DeliveryRejected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDedupeStore(t)
+			d.Claim("w1", "1", "r1")
+			tt.mark(d)
+
+			record, _ := d.Claim("w1", "", "r2")
+			if record == nil || record.Status != tt.wantStatus {
+				t.Fatalf("record = %+v, want status %s", record, tt.wantStatus)
+			}
+			delivered, ok := d.Delivered("1")
+			if ok != tt.wantDelivered {
+				t.Fatalf("Delivered() = %t, want %t", ok, tt.wantDelivered)
+			}
+			if ok && delivered.SalesID != "SO-1" {
+				t.Errorf("SalesID = %q, want SO-1", delivered.SalesID)
+			}
+		})
+	}
+}
+
+func TestDedupeStoreRequestCancel(t *testing.T) {
+	d := newTestDedupeStore(t)
+
+	d.RequestCancel("1", "c1")
+	if !d.CancelRequested("1") {
+		t.Fatal("cancel of an unseen order was not recorded")
+	}
+	if _, claimed := d.Claim("w1", "1", "r1"); claimed {
+		t.Error("late create of a cancelled order was claimed")
+	}
+
+	d.Claim("w2", "2", "r2")
+	if d.CancelRequested("2") {
+		t.Error("CancelRequested() true for an order without cancellation")
+	}
+	d.RequestCancel("2", "c2")
+	if !d.CancelRequested("2") {
+		t.Error("cancel of a queued order was not recorded")
+	}
+}
+
+func TestDedupeStorePersistsAndPrunes(t *testing.T) {
+	d := newTestDedupeStore(t)
+	d.Claim("w1", "1", "r1")
+	d.MarkDelivered("w1", "1", "r1", "SO-1")
+
+	d.mu.Lock()
+	d.index(&DeliveryRecord{
+		WebhookID: "old",
+		OrderID:   "2",
+		RequestID: "r0",
+		Status:    DeliveryDelivered,
+		UpdatedAt: time.Now().Add(-2 * DefaultDedupeRetention).UTC().Format(time.RFC3339),
+	})
+	d.save()
+	d.mu.Unlock()
+
+	reloaded, err := NewDedupeStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, ok := reloaded.Delivered("1"); !ok || record.SalesID != "SO-1" {
+		t.Errorf("Delivered(1) after reload = %+v, %t", record, ok)
+	}
+	if _, claimed := reloaded.Claim("old", "2", "r3"); !claimed {
+		t.Error("expired record was not pruned")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Destinations of the operations sent to the ERP
+	DestinationCreateOrder = "create_order"
+	DestinationUpdateOrder = "update_order"
+	DestinationReadOrder   = "read_order"
+	DestinationCancelOrder = "cancel_order"
+	DestinationReturnOrder = "return_order"
+	DestinationCreditNote  = "credit_note"
+
+	DestinationFindCustomer   = "find_customer"
+	DestinationCreateCustomer = "create_customer"
+
+	SOAPVersion11 = "1.1"
+	SOAPVersion12 = "1.2"
+
+	WSANamespace = "http://www.w3.org/2005/08/addressing"
+	WSAAnonymous = WSANamespace + "/anonymous"
+)
+
+// Destination is the ERP service an operation is sent to. Destinations are
+// configured in the "destinations" section of SOAP_ENVELOPE_CONFIG, keyed by
+// operation; empty settings fall back to ERP_ENDPOINT and the top-level
+// "soap_version", "addressing" and "security" settings.
+type Destination struct {
+	Name        string            `json:"-"`
+	Endpoint    string            `json:"endpoint"`
+	Action      string            `json:"action"`
+	SOAPVersion string            `json:"soap_version"` // "1.1" or "1.2"
+	Addressing  *bool             `json:"addressing"`   // adds WS-Addressing headers, required by wsHttpBinding
+	Security    *WSSecurityConfig `json:"security"`
+}
+
+// resolveDestinations fills in defaults for every configured destination and
+// makes sure the create_order destination exists
+func (b *EnvelopeBuilder) resolveDestinations() error {
+	if err := b.config.Security.loadEnv(); err != nil {
+		return err
+	}
+	if err := b.config.Security.prepare(); err != nil {
+		return err
+	}
+
+	if value := os.Getenv("SOAP_VERSION"); value != "" {
+		b.config.SOAPVersion = value
+	}
+	if b.config.SOAPVersion == "" {
+		b.config.SOAPVersion = SOAPVersion11
+	}
+	if value := os.Getenv("SOAP_ADDRESSING"); value != "" {
+		addressing, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid SOAP_ADDRESSING %q", value)
+		}
+		b.config.Addressing = addressing
+	}
+
+	endpoint := os.Getenv("ERP_ENDPOINT")
+	if endpoint == "" {
+		endpoint = DefaultERPEndpoint
+	}
+
+	b.destinations = make(map[string]*Destination)
+	for name, configured := range b.config.Destinations {
+		dest := *configured
+		if dest.Security != nil {
+			if err := dest.Security.prepare(); err != nil {
+				return fmt.Errorf("destination %s: %w", name, err)
+			}
+		}
+		b.destinations[name] = &dest
+	}
+	if _, ok := b.destinations[DestinationCreateOrder]; !ok {
+		b.destinations[DestinationCreateOrder] = &Destination{}
+	}
+
+	for name, dest := range b.destinations {
+		dest.Name = name
+		if dest.Endpoint == "" {
+			dest.Endpoint = endpoint
+		}
+		if dest.Security == nil {
+			dest.Security = &b.config.Security
+		}
+		if dest.SOAPVersion == "" {
+			dest.SOAPVersion = b.config.SOAPVersion
+		}
+		if dest.SOAPVersion != SOAPVersion11 && dest.SOAPVersion != SOAPVersion12 {
+			return fmt.Errorf("destination %s: unknown soap_version %q (expected 1.1 or 1.2)", name, dest.SOAPVersion)
+		}
+		if dest.Addressing == nil {
+			dest.Addressing = &b.config.Addressing
+		}
+	}
+
+	// Operations without a destination of their own share create_order's
+	create := b.destinations[DestinationCreateOrder]
+	for name, action := range b.operationActions() {
+		dest, ok := b.destinations[name]
+		if !ok {
+			shared := *create
+			shared.Name = name
+			shared.Action = ""
+			dest = &shared
+			b.destinations[name] = dest
+		}
+		if dest.Action == "" {
+			dest.Action = action
+		}
+	}
+	return nil
+}
+
+// operationActions returns the default SOAP action of every operation sent to the ERP
+func (b *EnvelopeBuilder) operationActions() map[string]string {
+	return map[string]string{
+		DestinationCreateOrder: b.Action(),
+		DestinationUpdateOrder: b.UpdateAction(),
+		DestinationReadOrder:   b.ReadOrderAction(),
+		DestinationCancelOrder: b.CancelAction(),
+		DestinationReturnOrder: b.RefundAction(RefundReturnOrder),
+		DestinationCreditNote:  b.RefundAction(RefundCreditNote),
+
+		DestinationFindCustomer:   b.CustomerAction(DestinationFindCustomer),
+		DestinationCreateCustomer: b.CustomerAction(DestinationCreateCustomer),
+	}
+}
+
+// Destination returns the named destination. Unknown names get
+// create_order's endpoint and security without an action.
+func (b *EnvelopeBuilder) Destination(name string) *Destination {
+	if dest, ok := b.destinations[name]; ok {
+		return dest
+	}
+	dest := *b.destinations[DestinationCreateOrder]
+	dest.Name = name
+	dest.Action = ""
+	return &dest
+}
+
+// Namespace returns the envelope namespace for the destination's SOAP version
+func (d *Destination) Namespace() string {
+	if d.SOAPVersion == SOAPVersion12 {
+		return SOAP12Namespace
+	}
+	return SOAP11Namespace
+}
+
+// SetHeaders sets the HTTP headers for the SOAP version. SOAP 1.1 carries the
+// action in the SOAPAction header, SOAP 1.2 in the Content-Type action parameter.
+func (d *Destination) SetHeaders(header http.Header, action string) {
+	if d.SOAPVersion == SOAPVersion12 {
+		header.Set("Content-Type", fmt.Sprintf(`application/soap+xml; charset=utf-8; action="%s"`, action))
+		return
+	}
+	header.Set("Content-Type", "text/xml; charset=utf-8")
+	header.Set("SOAPAction", fmt.Sprintf(`"%s"`, action))
+}
+
+// AddHeaders adds the destination's WS-Addressing, WS-Security and custom
+// headers to a rendered envelope. It runs for every attempt so that message
+// IDs, timestamps and nonces are fresh.
+func (d *Destination) AddHeaders(envelope, action string) (string, error) {
+	addressing := d.Addressing != nil && *d.Addressing
+	if !addressing && !d.Security.Enabled() {
+		return envelope, nil
+	}
+
+	prefix, namespace := envelopeName(envelope)
+
+	var entries string
+	if addressing {
+		data, err := addressingHeaders(prefix, namespace, action, d.Endpoint)
+		if err != nil {
+			return "", err
+		}
+		entries = data
+	}
+	if d.Security.Enabled() {
+		data, err := d.Security.headerXML(prefix, namespace, time.Now())
+		if err != nil {
+			return "", err
+		}
+		entries += data
+	}
+	return insertSOAPHeader(envelope, entries)
+}
+
+// addressingHeaders renders the WS-Addressing 1.0 headers WCF expects
+func addressingHeaders(soapPrefix, soapNamespace, action, to string) (string, error) {
+	ns := xml.Attr{Name: xml.Name{Local: "xmlns:wsa"}, Value: WSANamespace}
+
+	replyTo := &xmlElement{Name: "wsa:ReplyTo", Attrs: []xml.Attr{ns}}
+	replyTo.add(&xmlElement{Name: "wsa:Address", Text: WSAAnonymous})
+
+	headers := []*xmlElement{
+		{Name: "wsa:Action", Attrs: append([]xml.Attr{ns}, mustUnderstand(soapPrefix, soapNamespace)...), Text: action},
+		{Name: "wsa:MessageID", Attrs: []xml.Attr{ns}, Text: "urn:uuid:" + newUUID()},
+		replyTo,
+		{Name: "wsa:To", Attrs: append([]xml.Attr{ns}, mustUnderstand(soapPrefix, soapNamespace)...), Text: to},
+	}
+
+	var out []byte
+	for _, header := range headers {
+		data, err := xml.Marshal(header)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal WS-Addressing header: %w", err)
+		}
+		out = append(out, data...)
+	}
+	return string(out), nil
+}
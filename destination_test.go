@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDestinationSetHeaders(t *testing.T) {
+	tests := []struct {
+		name            string
+		version         string
+		wantContentType string
+		wantSOAPAction  string
+	}{
+		{
+			name:            "SOAP 1.1",
+			version:         SOAPVersion11,
+			wantContentType: "text/xml; charset=utf-8",
+			wantSOAPAction:  `"urn:CreateOrder"`,
+		},
+		{
+			name:            "SOAP 1.2",
+			version:         SOAPVersion12,
+			wantContentType: `application/soap+xml; charset=utf-8; action="urn:CreateOrder"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			(&Destination{SOAPVersion: tt.version}).SetHeaders(header, "urn:CreateOrder")
+
+			if got := header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if got := header.Get("SOAPAction"); got != tt.wantSOAPAction {
+				t.Errorf("SOAPAction = %q, want %q", got, tt.wantSOAPAction)
+			}
+		})
+	}
+}
+
+func TestDestinationAddHeaders(t *testing.T) {
+	on, off := true, false
+
+	tests := []struct {
+		name       string
+		version    string
+		addressing *bool
+		envelope   string
+		want       []string
+	}{
+		{
+			name:       "addressing off",
+			version:    SOAPVersion11,
+			addressing: &off,
+			envelope:   `<s:Envelope xmlns:s="` + SOAP11Namespace + `"><s:Body/></s:Envelope>`,
+		},
+		{
+			name:       "SOAP 1.1 without a header",
+			version:    SOAPVersion11,
+			addressing: &on,
+			envelope:   `<s:Envelope xmlns:s="` + SOAP11Namespace + `"><s:Body/></s:Envelope>`,
+			want:       []string{"<s:Header>", `s:mustUnderstand="1"`, ">urn:CreateOrder</wsa:Action>", ">https://ax.example.com/orders</wsa:To>"},
+		},
+		{
+			name:       "SOAP 1.2 with a header",
+			version:    SOAPVersion12,
+			addressing: &on,
+			envelope:   `<env:Envelope xmlns:env="` + SOAP12Namespace + `"><env:Header></env:Header><env:Body/></env:Envelope>`,
+			want:       []string{`env:mustUnderstand="1"`, "<wsa:MessageID", WSAAnonymous},
+		},
+		{
+			name:       "default namespace",
+			version:    SOAPVersion12,
+			addressing: &on,
+			envelope:   `<Envelope xmlns="` + SOAP12Namespace + `"><Body/></Envelope>`,
+			want:       []string{`xmlns:env="` + SOAP12Namespace + `"`, `env:mustUnderstand="1"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := &Destination{SOAPVersion: tt.version, Endpoint: "https://ax.example.com/orders", Addressing: tt.addressing}
+			got, err := dest.AddHeaders(tt.envelope, "urn:CreateOrder")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.want) == 0 && got != tt.envelope {
+				t.Errorf("AddHeaders() changed the envelope:\n%s", got)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("AddHeaders() = %s\nmissing %s", got, want)
+				}
+			}
+			if strings.Count(got, "Header>") > 2 {
+				t.Errorf("AddHeaders() added a second header element:\n%s", got)
+			}
+		})
+	}
+}
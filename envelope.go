@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	SOAP11Namespace        = "http://schemas.xmlsoap.org/soap/envelope/"
+	SOAP12Namespace        = "http://www.w3.org/2003/05/soap-envelope"
+	DefaultSOAPNamespace   = "http://tempuri.org/"
+	DefaultSOAPPrefix      = "tem"
+	DefaultSOAPOperation   = "CreateOrder"
+	DefaultCancelOperation = "CancelOrder"
+	DefaultCancelAction    = "http://tempuri.org/CancelOrder"
+	DefaultOrderElement    = "order"
+	EnvelopeFormatDefault  = "default"
+	EnvelopeFormatTemplate = "template"
+)
+
+// EnvelopeConfig controls how orders are rendered as SOAP. It is loaded from
+// the JSON file in SOAP_ENVELOPE_CONFIG, individual SOAP_* variables override it.
+type EnvelopeConfig struct {
+	Format              string                  `json:"format"`                // "default", "template" or "aif"
+	Action              string                  `json:"action"`                // SOAPAction, defaults depend on the format
+	Namespace           string                  `json:"namespace"`             // namespace of the operation element
+	Prefix              string                  `json:"prefix"`                // prefix bound to Namespace
+	Operation           string                  `json:"operation"`             // operation element, e.g. CreateOrder
+	OrderElement        string                  `json:"order_element"`         // element wrapping the order inside the operation
+	ElementNames        map[string]string       `json:"element_names"`         // renames payload elements, "-" omits them
+	TemplateFile        string                  `json:"template_file"`         // text/template used by the "template" format
+	UpdateOperation     string                  `json:"update_operation"`      // operation element for order updates, e.g. UpdateOrder
+	UpdateTemplate      string                  `json:"update_template_file"`  // text/template for order updates in the "template" format
+	CancelAction        string                  `json:"cancel_action"`         // SOAPAction for cancellations, defaults depend on the format
+	CancelOperation     string                  `json:"cancel_operation"`      // operation element for cancellations, e.g. CancelOrder
+	CancelTemplate      string                  `json:"cancel_template_file"`  // text/template for cancellations in the "template" format
+	RefundMode          string                  `json:"refund_mode"`           // AX document for refunds, "return_order" (default) or "credit_note"
+	ReturnOperation     string                  `json:"return_operation"`      // operation element for return orders
+	CreditNoteOperation string                  `json:"credit_note_operation"` // operation element for credit notes
+	RefundTemplate      string                  `json:"refund_template_file"`  // text/template for refunds in the "template" format
+	AIF                 AIFConfig               `json:"aif"`                   // settings for the "aif" format
+	SOAPVersion         string                  `json:"soap_version"`          // default SOAP version of destinations, "1.1" or "1.2"
+	Addressing          bool                    `json:"addressing"`            // default WS-Addressing setting of destinations
+	Security            WSSecurityConfig        `json:"security"`              // WS-Security for destinations without their own
+	Destinations        map[string]*Destination `json:"destinations"`          // per-operation endpoint, action and security
+}
+
+// EnvelopeBuilder turns ERP orders into SOAP envelopes
+type EnvelopeBuilder struct {
+	config         EnvelopeConfig
+	template       *template.Template
+	updateTemplate *template.Template
+	cancelTemplate *template.Template
+	refundTemplate *template.Template
+	destinations   map[string]*Destination
+}
+
+// NewEnvelopeBuilder loads the envelope configuration and template
+func NewEnvelopeBuilder() (*EnvelopeBuilder, error) {
+	config := EnvelopeConfig{
+		Format:              EnvelopeFormatDefault,
+		Namespace:           DefaultSOAPNamespace,
+		Prefix:              DefaultSOAPPrefix,
+		Operation:           DefaultSOAPOperation,
+		OrderElement:        DefaultOrderElement,
+		UpdateOperation:     DefaultUpdateOperation,
+		CancelOperation:     DefaultCancelOperation,
+		RefundMode:          RefundReturnOrder,
+		ReturnOperation:     DefaultReturnOperation,
+		CreditNoteOperation: DefaultCreditNoteOperation,
+	}
+
+	if path := os.Getenv("SOAP_ENVELOPE_CONFIG"); path != "" {
+		if err := readJSONFile(path, &config); err != nil {
+			return nil, fmt.Errorf("failed to load SOAP_ENVELOPE_CONFIG %s: %w", path, err)
+		}
+	}
+
+	overrides := map[string]*string{
+		"SOAP_FORMAT":                &config.Format,
+		"SOAP_ACTION":                &config.Action,
+		"SOAP_NAMESPACE":             &config.Namespace,
+		"SOAP_PREFIX":                &config.Prefix,
+		"SOAP_OPERATION":             &config.Operation,
+		"SOAP_ORDER_ELEMENT":         &config.OrderElement,
+		"SOAP_TEMPLATE":              &config.TemplateFile,
+		"SOAP_UPDATE_OPERATION":      &config.UpdateOperation,
+		"SOAP_UPDATE_TEMPLATE":       &config.UpdateTemplate,
+		"SOAP_CANCEL_ACTION":         &config.CancelAction,
+		"SOAP_CANCEL_OPERATION":      &config.CancelOperation,
+		"SOAP_CANCEL_TEMPLATE":       &config.CancelTemplate,
+		"SOAP_REFUND_MODE":           &config.RefundMode,
+		"SOAP_RETURN_OPERATION":      &config.ReturnOperation,
+		"SOAP_CREDIT_NOTE_OPERATION": &config.CreditNoteOperation,
+		"SOAP_REFUND_TEMPLATE":       &config.RefundTemplate,
+	}
+	for key, field := range overrides {
+		if value := os.Getenv(key); value != "" {
+			*field = value
+		}
+	}
+
+	// A template file on its own implies the template format
+	if config.TemplateFile != "" && config.Format == EnvelopeFormatDefault {
+		config.Format = EnvelopeFormatTemplate
+	}
+
+	b := &EnvelopeBuilder{config: config}
+
+	switch config.Format {
+	case EnvelopeFormatDefault:
+	case EnvelopeFormatTemplate:
+		if config.TemplateFile == "" {
+			return nil, fmt.Errorf("SOAP format %q requires SOAP_TEMPLATE", config.Format)
+		}
+		tmpl, err := parseEnvelopeTemplate(config.TemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		b.template = tmpl
+	case EnvelopeFormatAIF:
+		config.AIF.loadEnv()
+		if err := config.AIF.validate(); err != nil {
+			return nil, err
+		}
+		b.config.AIF = config.AIF
+	default:
+		return nil, fmt.Errorf("unknown SOAP format %q", config.Format)
+	}
+
+	// Without an update, cancel or refund template, those operations use the default layout
+	if config.Format == EnvelopeFormatTemplate && config.UpdateTemplate != "" {
+		tmpl, err := parseEnvelopeTemplate(config.UpdateTemplate)
+		if err != nil {
+			return nil, err
+		}
+		b.updateTemplate = tmpl
+	}
+	if config.Format == EnvelopeFormatTemplate && config.CancelTemplate != "" {
+		tmpl, err := parseEnvelopeTemplate(config.CancelTemplate)
+		if err != nil {
+			return nil, err
+		}
+		b.cancelTemplate = tmpl
+	}
+	if config.Format == EnvelopeFormatTemplate && config.RefundTemplate != "" {
+		tmpl, err := parseEnvelopeTemplate(config.RefundTemplate)
+		if err != nil {
+			return nil, err
+		}
+		b.refundTemplate = tmpl
+	}
+
+	if config.RefundMode != RefundReturnOrder && config.RefundMode != RefundCreditNote {
+		return nil, fmt.Errorf("unknown refund_mode %q (expected %s or %s)", config.RefundMode, RefundReturnOrder, RefundCreditNote)
+	}
+
+	if err := b.resolveDestinations(); err != nil {
+		return nil, err
+	}
+
+	if config.Format == EnvelopeFormatAIF {
+		log.Printf("SOAP envelope format: %s (company %s, customer account %s)", config.Format, config.AIF.Company, config.AIF.CustAccount)
+	} else {
+		log.Printf("SOAP envelope format: %s (operation %s, namespace %s)", config.Format, config.Operation, config.Namespace)
+	}
+	return b, nil
+}
+
+// Action returns the SOAPAction for the configured format
+func (b *EnvelopeBuilder) Action() string {
+	if b.config.Action != "" {
+		return b.config.Action
+	}
+	if b.config.Format == EnvelopeFormatAIF {
+		return AIFCreateAction
+	}
+	return SOAPAction
+}
+
+// Build renders the SOAP envelope for an order
+func (b *EnvelopeBuilder) Build(order *ERPOrder) (string, error) {
+	switch b.config.Format {
+	case EnvelopeFormatTemplate:
+		return b.renderTemplate(order)
+	case EnvelopeFormatAIF:
+		return b.buildAIF(order)
+	}
+
+	prefix := b.config.Prefix
+	operation := &xmlElement{
+		Name:  qualify(prefix, b.config.Operation),
+		Attrs: []xml.Attr{{Name: xml.Name{Local: "xmlns:" + prefix}, Value: b.config.Namespace}},
+		Children: []*xmlElement{
+			b.orderElement(order),
+		},
+	}
+
+	return marshalEnvelope(b.envelopeNamespace(DestinationCreateOrder), nil, operation)
+}
+
+// orderElement maps the ERP order to the configurable CreateOrder payload
+func (b *EnvelopeBuilder) orderElement(order *ERPOrder) *xmlElement {
+	el := b.element("order", b.config.OrderElement)
+	el.add(b.text("OrderID", order.OrderID))
+	el.add(b.text("OrderNumber", order.OrderNumber))
+	el.add(b.text("CustomerEmail", order.CustomerEmail))
+	el.add(b.text("CustomerName", order.CustomerName))
+	el.add(b.text("CustomerPhone", order.CustomerPhone))
+	el.add(b.text("CustAccount", order.CustAccount))
+	el.add(b.text("OrderDate", order.OrderDate))
+	el.add(b.text("TotalAmount", order.TotalAmount.String()))
+	el.add(b.text("SubtotalAmount", order.SubtotalAmount.String()))
+	el.add(b.text("TaxAmount", order.TaxAmount.String()))
+	el.add(b.text("DiscountAmount", order.DiscountAmount.String()))
+	el.add(b.text("Currency", order.Currency))
+	el.add(b.text("PaymentStatus", order.PaymentStatus))
+	el.add(b.text("FulfillmentStatus", order.FulfillmentStatus))
+	el.add(b.address("ShippingAddress", order.ShippingAddress))
+	el.add(b.address("BillingAddress", order.BillingAddress))
+
+	items := b.element("Items", "Items")
+	for _, item := range order.Items {
+		line := b.element("Item", "Item")
+		line.add(b.text("SKU", item.SKU))
+		line.add(b.text("ItemID", item.ItemID))
+		line.add(b.inventDim(item.InventDim))
+		line.add(b.text("ProductName", item.ProductName))
+		line.add(b.text("Quantity", strconv.Itoa(item.Quantity)))
+		line.add(b.text("UnitPrice", item.UnitPrice.String()))
+		line.add(b.text("VariantTitle", item.VariantTitle))
+		line.add(b.text("DiscountAmount", item.DiscountAmount.String()))
+		line.add(b.taxLines(item.TaxLines))
+		items.add(line)
+	}
+	el.add(items)
+
+	discounts := b.element("Discounts", "Discounts")
+	for _, discount := range order.Discounts {
+		line := b.element("Discount", "Discount")
+		line.add(b.text("Code", discount.Code))
+		line.add(b.text("Type", discount.Type))
+		line.add(b.text("Amount", discount.Amount.String()))
+		discounts.add(line)
+	}
+	el.add(discounts)
+
+	charges := b.element("Charges", "Charges")
+	for _, charge := range order.Charges {
+		line := b.element("Charge", "Charge")
+		line.add(b.text("Code", charge.Code))
+		line.add(b.text("Title", charge.Title))
+		line.add(b.text("Amount", charge.Amount.String()))
+		line.add(b.text("DiscountAmount", charge.DiscountAmount.String()))
+		line.add(b.text("Carrier", charge.Carrier))
+		line.add(b.taxLines(charge.TaxLines))
+		charges.add(line)
+	}
+	el.add(charges)
+
+	el.add(b.taxLines(order.TaxLines))
+
+	el.add(b.text("Timestamp", order.Timestamp))
+	return el
+}
+
+// address returns nil for a missing address so no empty block is sent
+func (b *EnvelopeBuilder) address(key string, addr *ERPAddress) *xmlElement {
+	if addr == nil {
+		return nil
+	}
+	el := b.element(key, key)
+	el.add(b.text("Name", addr.Name))
+	el.add(b.text("Company", addr.Company))
+	el.add(b.text("AddressLine1", addr.AddressLine1))
+	el.add(b.text("AddressLine2", addr.AddressLine2))
+	el.add(b.text("City", addr.City))
+	el.add(b.text("State", addr.State))
+	el.add(b.text("PostalCode", addr.PostalCode))
+	el.add(b.text("Country", addr.Country))
+	el.add(b.text("Phone", addr.Phone))
+	return el
+}
+
+func (b *EnvelopeBuilder) taxLines(taxLines []ERPTaxLine) *xmlElement {
+	el := b.element("TaxLines", "TaxLines")
+	for _, tax := range taxLines {
+		line := b.element("TaxLine", "TaxLine")
+		line.add(b.text("Title", tax.Title))
+		line.add(b.text("Rate", tax.Rate))
+		line.add(b.text("Amount", tax.Amount.String()))
+		el.add(line)
+	}
+	return el
+}
+
+func (b *EnvelopeBuilder) inventDim(dim ERPInventDim) *xmlElement {
+	el := b.element("InventDim", "InventDim")
+	el.add(b.text("ConfigID", dim.ConfigID))
+	el.add(b.text("ColorID", dim.ColorID))
+	el.add(b.text("SizeID", dim.SizeID))
+	el.add(b.text("StyleID", dim.StyleID))
+	el.add(b.text("SiteID", dim.SiteID))
+	el.add(b.text("LocationID", dim.LocationID))
+	return el
+}
+
+// element creates a payload element, applying the configured rename for key.
+// It returns nil when the element is configured to be omitted.
+func (b *EnvelopeBuilder) element(key, name string) *xmlElement {
+	if renamed, ok := b.config.ElementNames[key]; ok {
+		if renamed == "-" {
+			return nil
+		}
+		name = renamed
+	}
+	return &xmlElement{Name: qualify(b.config.Prefix, name)}
+}
+
+func (b *EnvelopeBuilder) text(key, value string) *xmlElement {
+	el := b.element(key, key)
+	if el != nil {
+		el.Text = value
+	}
+	return el
+}
+
+// envelopeTemplateData is passed to the SOAP_TEMPLATE, SOAP_UPDATE_TEMPLATE,
+// SOAP_CANCEL_TEMPLATE and SOAP_REFUND_TEMPLATE templates
+type envelopeTemplateData struct {
+	Order             *ERPOrder
+	Update            *ERPOrderUpdate  // set for update templates only
+	Cancellation      *ERPCancellation // set for cancel templates only
+	Refund            *ERPRefund       // set for refund templates only
+	EnvelopeNamespace string           // SOAP 1.1 or 1.2 envelope namespace
+	Namespace         string
+	Prefix            string
+	Operation         string
+	Timestamp         string
+}
+
+// parseEnvelopeTemplate loads a SOAP template file with the "xml" escaping function
+func parseEnvelopeTemplate(path string) (*template.Template, error) {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(template.FuncMap{
+		"xml": xmlText,
+	}).ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SOAP template %s: %w", path, err)
+	}
+	return tmpl, nil
+}
+
+// renderTemplate renders an order with the configured SOAP_TEMPLATE
+func (b *EnvelopeBuilder) renderTemplate(order *ERPOrder) (string, error) {
+	return b.executeTemplate(b.template, envelopeTemplateData{
+		Order:             order,
+		EnvelopeNamespace: b.envelopeNamespace(DestinationCreateOrder),
+		Operation:         b.config.Operation,
+	})
+}
+
+// executeTemplate fills in the shared template fields, renders tmpl and
+// checks that the result is well-formed XML
+func (b *EnvelopeBuilder) executeTemplate(tmpl *template.Template, data envelopeTemplateData) (string, error) {
+	data.Namespace = b.config.Namespace
+	data.Prefix = b.config.Prefix
+	data.Timestamp = time.Now().UTC().Format(time.RFC3339)
+
+	var out bytes.Buffer
+	err := tmpl.Execute(&out, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render SOAP template: %w", err)
+	}
+
+	if _, err := parseSOAPNode(out.Bytes()); err != nil {
+		return "", fmt.Errorf("SOAP template produced %w", err)
+	}
+	return out.String(), nil
+}
+
+// envelopeNamespace returns the envelope namespace of a destination's SOAP version
+func (b *EnvelopeBuilder) envelopeNamespace(destination string) string {
+	return b.Destination(destination).Namespace()
+}
+
+// soapEnvelope is the SOAP 1.1 or 1.2 envelope
+type soapEnvelope struct {
+	XMLName xml.Name   `xml:"soap:Envelope"`
+	Attrs   []xml.Attr `xml:",attr"`
+	Header  soapHeader `xml:"soap:Header"`
+	Body    soapBody   `xml:"soap:Body"`
+}
+
+type soapHeader struct {
+	Entries []interface{}
+}
+
+type soapBody struct {
+	Content interface{}
+}
+
+// marshalEnvelope wraps header entries and body content in a SOAP envelope
+// with the given envelope namespace
+func marshalEnvelope(namespace string, headers []interface{}, content interface{}) (string, error) {
+	envelope := soapEnvelope{
+		Attrs:  []xml.Attr{{Name: xml.Name{Local: "xmlns:soap"}, Value: namespace}},
+		Header: soapHeader{Entries: headers},
+		Body:   soapBody{Content: content},
+	}
+
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(envelope); err != nil {
+		return "", fmt.Errorf("failed to marshal SOAP envelope: %w", err)
+	}
+	return out.String(), nil
+}
+
+// xmlElement is a dynamically named element, used where element names come
+// from configuration rather than struct tags
+type xmlElement struct {
+	Name     string
+	Attrs    []xml.Attr
+	Text     string
+	Children []*xmlElement
+}
+
+// add appends child unless it is nil (omitted by configuration)
+func (e *xmlElement) add(child *xmlElement) {
+	if e != nil && child != nil {
+		e.Children = append(e.Children, child)
+	}
+}
+
+// MarshalXML writes the element; encoding/xml takes care of escaping and
+// replaces characters that are not allowed in XML
+func (e *xmlElement) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	start := xml.StartElement{Name: xml.Name{Local: e.Name}, Attr: e.Attrs}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if e.Text != "" {
+		if err := enc.EncodeToken(xml.CharData(e.Text)); err != nil {
+			return err
+		}
+	}
+	for _, child := range e.Children {
+		if err := enc.Encode(child); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// qualify prefixes a local name with a namespace prefix
+func qualify(prefix, name string) string {
+	if prefix == "" || strings.Contains(name, ":") {
+		return name
+	}
+	return prefix + ":" + name
+}
+
+// xmlText escapes a value for use in SOAP templates
+func xmlText(value interface{}) (string, error) {
+	var out bytes.Buffer
+	if err := xml.EscapeText(&out, []byte(fmt.Sprint(value))); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
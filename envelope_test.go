@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hostile is customer data with XML markup, control characters and invalid UTF-8
+const hostile = "A&B <C> \"D\" 'E' \x00\x01\x08\x0b\x1f\t\nend \xff\xfe"
+
+// hostileDecoded is hostile as an XML parser reads it back: characters that
+// XML cannot carry are replaced with U+FFFD
+const hostileDecoded = "A&B <C> \"D\" 'E' \uFFFD\uFFFD\uFFFD\uFFFD\uFFFD\t\nend \uFFFD\uFFFD"
+
+// newTestEnvelopeBuilder builds an envelope builder from env on top of a clean SOAP configuration
+func newTestEnvelopeBuilder(t *testing.T, env map[string]string) (*EnvelopeBuilder, error) {
+	t.Helper()
+	for _, key := range []string{"SOAP_ENVELOPE_CONFIG", "SOAP_FORMAT", "SOAP_TEMPLATE", "SOAP_VERSION", "SOAP_ADDRESSING", "WSSE_USERNAME"} {
+		t.Setenv(key, "")
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	return NewEnvelopeBuilder()
+}
+
+// elementTexts parses an envelope and returns the text of every element by local name
+func elementTexts(t *testing.T, envelope string) map[string][]string {
+	t.Helper()
+	texts := make(map[string][]string)
+	decoder := xml.NewDecoder(strings.NewReader(envelope))
+	var open []string
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return texts
+		}
+		if err != nil {
+			t.Fatalf("envelope is not well-formed XML: %v\n%s", err, envelope)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			open = append(open, token.Name.Local)
+			text.Reset()
+		case xml.CharData:
+			text.Write(token)
+		case xml.EndElement:
+			name := open[len(open)-1]
+			open = open[:len(open)-1]
+			texts[name] = append(texts[name], text.String())
+			text.Reset()
+		}
+	}
+}
+
+func TestEnvelopeEscaping(t *testing.T) {
+	order := &ERPOrder{
+		OrderID:       "1001",
+		CustomerName:  hostile,
+		CustomerEmail: hostile,
+		Currency:      "EUR",
+		Items:         []ERPItem{{LineID: "1", SKU: hostile, ItemID: "A", ProductName: hostile, Quantity: 1, UnitPrice: MustParseMoney("10.00")}},
+		Charges:       []ERPCharge{{Code: hostile, Title: hostile, Amount: MustParseMoney("4.90")}},
+	}
+
+	template, err := filepath.Abs("templates/create-order.xml.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantFields []string // elements expected to carry the hostile value
+		wantNS     string
+	}{
+		{
+			name:       "default format",
+			wantFields: []string{"CustomerName", "CustomerEmail", "SKU", "ProductName", "Code", "Title"},
+			wantNS:     SOAP11Namespace,
+		},
+		{
+			name:       "default format with SOAP 1.2",
+			env:        map[string]string{"SOAP_VERSION": SOAPVersion12},
+			wantFields: []string{"CustomerName", "ProductName"},
+			wantNS:     SOAP12Namespace,
+		},
+		{
+			name:       "template",
+			env:        map[string]string{"SOAP_TEMPLATE": template},
+			wantFields: []string{"CustomerName", "CustomerEmail", "SKU", "Code"},
+			wantNS:     SOAP11Namespace,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newTestEnvelopeBuilder(t, tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			envelope, err := b.Build(order)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			texts := elementTexts(t, envelope)
+			for _, field := range tt.wantFields {
+				if len(texts[field]) == 0 {
+					t.Errorf("envelope has no %s element", field)
+					continue
+				}
+				for _, got := range texts[field] {
+					if got != hostileDecoded {
+						t.Errorf("%s = %q, want %q", field, got, hostileDecoded)
+					}
+				}
+			}
+			if !strings.Contains(envelope, `"`+tt.wantNS+`"`) {
+				t.Errorf("envelope does not use namespace %s:\n%s", tt.wantNS, envelope)
+			}
+		})
+	}
+}
+
+func TestNewEnvelopeBuilderTemplateErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantErr  bool
+		buildErr bool
+	}{
+		{name: "template format without a template", env: map[string]string{"SOAP_FORMAT": EnvelopeFormatTemplate}, wantErr: true},
+		{name: "missing template file", env: map[string]string{"SOAP_TEMPLATE": filepath.Join(dir, "missing.tmpl")}, wantErr: true},
+		{name: "template syntax error", env: map[string]string{"SOAP_TEMPLATE": write("syntax.tmpl", `<a>{{.Order.OrderID</a>`)}, wantErr: true},
+		{name: "unescaped value breaks the XML", env: map[string]string{"SOAP_TEMPLATE": write("raw.tmpl", `<a>{{.Order.CustomerName}}</a>`)}, buildErr: true},
+		{name: "unknown field", env: map[string]string{"SOAP_TEMPLATE": write("field.tmpl", `<a>{{xml .Order.Nickname}}</a>`)}, buildErr: true},
+		{name: "escaped value", env: map[string]string{"SOAP_TEMPLATE": write("ok.tmpl", `<a>{{xml .Order.CustomerName}}</a>`)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newTestEnvelopeBuilder(t, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewEnvelopeBuilder() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			_, err = b.Build(&ERPOrder{OrderID: "1001", CustomerName: hostile})
+			if (err != nil) != tt.buildErr {
+				t.Errorf("Build() error = %v, want error %t", err, tt.buildErr)
+			}
+		})
+	}
+}
+
+func TestXMLText(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "plain", value: "Jane Doe", want: "Jane Doe"},
+		{name: "markup", value: `A&B <C> "D" 'E'`, want: "A&amp;B &lt;C&gt; &#34;D&#34; &#39;E&#39;"},
+		{name: "control characters", value: "a\x00b\x1fc", want: "a\uFFFDb\uFFFDc"},
+		{name: "whitespace", value: "a\tb\nc\rd", want: "a&#x9;b&#xA;c&#xD;d"},
+		{name: "invalid UTF-8", value: "a\xffb", want: "a\uFFFDb"},
+		{name: "money", value: MustParseMoney("12.50"), want: "12.50"},
+		{name: "number", value: 3, want: "3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := xmlText(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("xmlText(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	ERPAuthNone   = "none"
+	ERPAuthBasic  = "basic"
+	ERPAuthBearer = "bearer"
+	ERPAuthNTLM   = "ntlm"
+)
+
+// newERPTransport wraps base with the authentication selected by ERP_AUTH.
+// Credentials come from ERP_USERNAME, ERP_PASSWORD and ERP_BEARER_TOKEN, each
+// of which may instead be read from a file named by the matching _FILE variable.
+// It also returns a description of the mode for the startup log.
+func newERPTransport(base http.RoundTripper) (http.RoundTripper, string, error) {
+	mode := strings.ToLower(os.Getenv("ERP_AUTH"))
+	if mode == "" {
+		mode = ERPAuthNone
+	}
+
+	switch mode {
+	case ERPAuthNone:
+		return base, mode, nil
+
+	case ERPAuthBasic, ERPAuthNTLM:
+		user, err := readSecret("ERP_USERNAME")
+		if err != nil {
+			return nil, "", err
+		}
+		password, err := readSecret("ERP_PASSWORD")
+		if err != nil {
+			return nil, "", err
+		}
+		if user == "" || password == "" {
+			return nil, "", fmt.Errorf("ERP_AUTH=%s requires ERP_USERNAME and ERP_PASSWORD", mode)
+		}
+
+		if mode == ERPAuthBasic {
+			return &basicAuthTransport{base: base, user: user, password: password}, fmt.Sprintf("%s (%s)", mode, user), nil
+		}
+
+		if err := useHTTP1(base); err != nil {
+			return nil, "", err
+		}
+
+		user, domain := splitNTLMUser(user, os.Getenv("ERP_DOMAIN"))
+		workstation := os.Getenv("ERP_WORKSTATION")
+		if workstation == "" {
+			workstation, _ = os.Hostname()
+		}
+		transport := &ntlmTransport{
+			base:        base,
+			user:        user,
+			password:    password,
+			domain:      domain,
+			workstation: strings.ToUpper(workstation),
+		}
+		return transport, fmt.Sprintf("%s (%s\\%s)", mode, domain, user), nil
+
+	case ERPAuthBearer:
+		token, err := readSecret("ERP_BEARER_TOKEN")
+		if err != nil {
+			return nil, "", err
+		}
+		if token == "" {
+			return nil, "", errors.New("ERP_AUTH=bearer requires ERP_BEARER_TOKEN or ERP_BEARER_TOKEN_FILE")
+		}
+		return &bearerTransport{base: base, token: token}, mode, nil
+	}
+
+	return nil, "", fmt.Errorf("unknown ERP_AUTH %q (expected none, basic, bearer or ntlm)", mode)
+}
+
+// basicAuthTransport adds HTTP Basic credentials to every request
+type basicAuthTransport struct {
+	base     http.RoundTripper
+	user     string
+	password string
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	clone := req.Clone(req.Context())
+	clone.SetBasicAuth(t.user, t.password)
+	return t.base.RoundTrip(clone)
+}
+
+// bearerTransport adds a bearer token to every request. When the token comes
+// from ERP_BEARER_TOKEN_FILE the file is re-read per request, so a token
+// refreshed on disk is picked up without a restart.
+type bearerTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := t.token
+	if os.Getenv("ERP_BEARER_TOKEN") == "" {
+		if current, err := readSecret("ERP_BEARER_TOKEN"); err == nil && current != "" {
+			token = current
+		}
+	}
+
+	clone := req.Clone(req.Context())
+	clone.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(clone)
+}
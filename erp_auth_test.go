@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// authEcho records the Authorization header of every request
+func authEcho(t *testing.T) (*httptest.Server, *[]string) {
+	t.Helper()
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &seen
+}
+
+func setAuthEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, key := range []string{"ERP_AUTH", "ERP_USERNAME", "ERP_PASSWORD", "ERP_BEARER_TOKEN", "ERP_BEARER_TOKEN_FILE", "ERP_DOMAIN", "ERP_WORKSTATION"} {
+		t.Setenv(key, env[key])
+	}
+}
+
+func TestNewERPTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantErr  bool
+		wantType string
+		wantAuth string
+	}{
+		{name: "none", env: map[string]string{}, wantType: "*http.Transport"},
+		{name: "basic", env: map[string]string{"ERP_AUTH": "basic", "ERP_USERNAME": "ax", "ERP_PASSWORD": "pw"}, wantType: "*main.basicAuthTransport", wantAuth: "Basic YXg6cHc="},
+		{name: "basic without password", env: map[string]string{"ERP_AUTH": "basic", "ERP_USERNAME": "ax"}, wantErr: true},
+		{name: "bearer", env: map[string]string{"ERP_AUTH": "Bearer", "ERP_BEARER_TOKEN": "tok"}, wantType: "*main.bearerTransport", wantAuth: "Bearer tok"},
+		{name: "bearer without token", env: map[string]string{"ERP_AUTH": "bearer"}, wantErr: true},
+		{name: "ntlm", env: map[string]string{"ERP_AUTH": "ntlm", "ERP_USERNAME": `CORP\ax`, "ERP_PASSWORD": "pw"}, wantType: "*main.ntlmTransport"},
+		{name: "unknown", env: map[string]string{"ERP_AUTH": "kerberos"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAuthEnv(t, tt.env)
+
+			transport, _, err := newERPTransport(http.DefaultTransport.(*http.Transport).Clone())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newERPTransport() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := fmt.Sprintf("%T", transport); got != tt.wantType {
+				t.Fatalf("transport = %s, want %s", got, tt.wantType)
+			}
+			if tt.wantAuth == "" {
+				return
+			}
+
+			server, seen := authEcho(t)
+			resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if len(*seen) != 1 || (*seen)[0] != tt.wantAuth {
+				t.Errorf("Authorization = %q, want %q", *seen, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestBearerTransportRereadsTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setAuthEnv(t, map[string]string{"ERP_AUTH": "bearer", "ERP_BEARER_TOKEN_FILE": path})
+
+	transport, _, err := newERPTransport(http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, seen := authEcho(t)
+	client := &http.Client{Transport: transport}
+
+	for _, token := range []string{"first", "second"} {
+		if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	want := []string{"Bearer first", "Bearer second"}
+	if len(*seen) != 2 || (*seen)[0] != want[0] || (*seen)[1] != want[1] {
+		t.Errorf("Authorization headers = %q, want %q", *seen, want)
+	}
+}
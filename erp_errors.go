@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ERPErrorClass groups ERP failures by how they should be handled
+type ERPErrorClass string
+
+const (
+	ClassNetwork         ERPErrorClass = "network"
+	ClassTimeout         ERPErrorClass = "timeout"
+	ClassServerError     ERPErrorClass = "server_error"
+	ClassRateLimited     ERPErrorClass = "rate_limited"
+	ClassClientError     ERPErrorClass = "client_error"
+	ClassSOAPServerFault ERPErrorClass = "soap_server_fault"
+	ClassSOAPClientFault ERPErrorClass = "soap_client_fault"
+	ClassValidation      ERPErrorClass = "validation"
+)
+
+const MaxRetryDelay = 2 * time.Minute
+
+// RetryPolicy controls retries for one error class
+type RetryPolicy struct {
+	Retryable   bool
+	MaxAttempts int
+	BaseDelay   time.Duration
+}
+
+// retryPolicies gives outages more and longer retries while permanent errors
+// such as AX validation failures are not retried at all
+var retryPolicies = map[ERPErrorClass]RetryPolicy{
+	ClassNetwork:         {Retryable: true, MaxAttempts: 5, BaseDelay: RetryDelay},
+	ClassTimeout:         {Retryable: true, MaxAttempts: 5, BaseDelay: 5 * time.Second},
+	ClassServerError:     {Retryable: true, MaxAttempts: 5, BaseDelay: RetryDelay},
+	ClassRateLimited:     {Retryable: true, MaxAttempts: 5, BaseDelay: 10 * time.Second},
+	ClassSOAPServerFault: {Retryable: true, MaxAttempts: MaxRetries, BaseDelay: RetryDelay},
+	ClassClientError:     {Retryable: false, MaxAttempts: 1},
+	ClassSOAPClientFault: {Retryable: false, MaxAttempts: 1},
+	ClassValidation:      {Retryable: false, MaxAttempts: 1},
+}
+
+// ERPError is a classified ERP failure
+type ERPError struct {
+	Class      ERPErrorClass
+	StatusCode int
+	RetryAfter time.Duration // from the Retry-After header, if any
+	Err        error
+}
+
+func (e *ERPError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Class, e.Err)
+}
+
+func (e *ERPError) Unwrap() error {
+	return e.Err
+}
+
+// Policy returns the retry policy for the error's class
+func (e *ERPError) Policy() RetryPolicy {
+	return retryPolicies[e.Class]
+}
+
+// Retryable reports whether the failure may succeed if sent again
+func (e *ERPError) Retryable() bool {
+	return e.Policy().Retryable
+}
+
+// Backoff returns how long to wait before the next attempt. Delays grow
+// exponentially from the class base delay and honour Retry-After.
+func (e *ERPError) Backoff(attempt int) time.Duration {
+	delay := e.Policy().BaseDelay << (attempt - 1)
+	if e.RetryAfter > delay {
+		delay = e.RetryAfter
+	}
+	if delay > MaxRetryDelay || delay <= 0 {
+		delay = MaxRetryDelay
+	}
+	return delay
+}
+
+// classifyTransportError classifies errors returned by http.Client.Do
+func classifyTransportError(err error) *ERPError {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &ERPError{Class: ClassTimeout, Err: err}
+	}
+	return &ERPError{Class: ClassNetwork, Err: err}
+}
+
+// classifyResponse classifies a completed HTTP exchange, returning nil on success
+func classifyResponse(statusCode int, header http.Header, result *SOAPResult) *ERPError {
+	faultErr := result.Err()
+
+	if faultErr == nil && statusCode >= 200 && statusCode < 300 {
+		return nil
+	}
+
+	if faultErr == nil {
+		faultErr = fmt.Errorf("ERP returned status %d", statusCode)
+	}
+	erpErr := &ERPError{StatusCode: statusCode, Err: faultErr}
+
+	switch {
+	case result.Fault != nil && result.Fault.AIFFault:
+		// AIF reports document validation problems (unknown item, customer, ...) as faults
+		erpErr.Class = ClassValidation
+	case result.Fault != nil && isClientFaultCode(result.Fault.Code):
+		erpErr.Class = ClassSOAPClientFault
+	case result.Fault != nil:
+		erpErr.Class = ClassSOAPServerFault
+	case result.HasInfologErrors():
+		erpErr.Class = ClassValidation
+	case statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable:
+		erpErr.Class = ClassRateLimited
+		erpErr.RetryAfter = parseRetryAfter(header.Get("Retry-After"))
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		erpErr.Class = ClassTimeout
+	case statusCode >= 500:
+		erpErr.Class = ClassServerError
+	default:
+		erpErr.Class = ClassClientError
+	}
+
+	return erpErr
+}
+
+// isClientFaultCode reports whether a SOAP 1.1 or 1.2 fault code blames the caller
+func isClientFaultCode(code string) bool {
+	if i := strings.LastIndex(code, ":"); i >= 0 {
+		code = code[i+1:]
+	}
+	code = strings.SplitN(code, ".", 2)[0]
+	return strings.EqualFold(code, "Client") || strings.EqualFold(code, "Sender")
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(when); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassifyResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		header         http.Header
+		result         *SOAPResult
+		wantClass      ERPErrorClass // "" for success
+		wantRetryable  bool
+		wantRetryAfter time.Duration
+	}{
+		{name: "success", status: 200, result: &SOAPResult{}},
+		{name: "AIF fault", status: 500, result: &SOAPResult{Fault: &SOAPFault{Code: "s:Server", AIFFault: true}}, wantClass: ClassValidation},
+		{name: "SOAP client fault", status: 500, result: &SOAPResult{Fault: &SOAPFault{Code: "s:Client"}}, wantClass: ClassSOAPClientFault},
+		{name: "SOAP client fault subcode", status: 500, result: &SOAPResult{Fault: &SOAPFault{Code: "Client.Authentication"}}, wantClass: ClassSOAPClientFault},
+		{name: "SOAP 1.2 sender fault", status: 400, result: &SOAPResult{Fault: &SOAPFault{Code: "env:Sender"}}, wantClass: ClassSOAPClientFault},
+		{name: "SOAP server fault", status: 500, result: &SOAPResult{Fault: &SOAPFault{Code: "s:Server"}}, wantClass: ClassSOAPServerFault, wantRetryable: true},
+		{name: "infolog error on 200", status: 200, result: &SOAPResult{Infolog: []InfologMessage{{Type: "Error", Message: "blocked"}}}, wantClass: ClassValidation},
+		{name: "infolog warning on 200", status: 200, result: &SOAPResult{Infolog: []InfologMessage{{Type: "Warning", Message: "w"}}}},
+		{name: "rate limited", status: 429, header: http.Header{"Retry-After": {"30"}}, result: &SOAPResult{}, wantClass: ClassRateLimited, wantRetryable: true, wantRetryAfter: 30 * time.Second},
+		{name: "unavailable", status: 503, result: &SOAPResult{}, wantClass: ClassRateLimited, wantRetryable: true},
+		{name: "gateway timeout", status: 504, result: &SOAPResult{}, wantClass: ClassTimeout, wantRetryable: true},
+		{name: "server error", status: 502, result: &SOAPResult{}, wantClass: ClassServerError, wantRetryable: true},
+		{name: "unauthorized", status: 401, result: &SOAPResult{}, wantClass: ClassClientError},
+		{name: "not found", status: 404, result: &SOAPResult{}, wantClass: ClassClientError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.result.StatusCode = tt.status
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+
+			erpErr := classifyResponse(tt.status, header, tt.result)
+			if tt.wantClass == "" {
+				if erpErr != nil {
+					t.Fatalf("classifyResponse() = %v, want success", erpErr)
+				}
+				return
+			}
+			if erpErr == nil {
+				t.Fatalf("classifyResponse() = nil, want %s", tt.wantClass)
+			}
+			if erpErr.Class != tt.wantClass {
+				t.Errorf("Class = %s, want %s", erpErr.Class, tt.wantClass)
+			}
+			if erpErr.Retryable() != tt.wantRetryable {
+				t.Errorf("Retryable() = %t, want %t", erpErr.Retryable(), tt.wantRetryable)
+			}
+			if erpErr.RetryAfter != tt.wantRetryAfter {
+				t.Errorf("RetryAfter = %s, want %s", erpErr.RetryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestClassifyTransportError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ERPErrorClass
+	}{
+		{name: "deadline", err: context.DeadlineExceeded, want: ClassTimeout},
+		{name: "net timeout", err: &net.OpError{Op: "read", Err: timeoutError{}}, want: ClassTimeout},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: ClassNetwork},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			erpErr := classifyTransportError(tt.err)
+			if erpErr.Class != tt.want {
+				t.Errorf("Class = %s, want %s", erpErr.Class, tt.want)
+			}
+			if !erpErr.Retryable() {
+				t.Error("transport errors should be retryable")
+			}
+			if !errors.Is(erpErr, tt.err) {
+				t.Error("ERPError does not wrap the transport error")
+			}
+		})
+	}
+}
+
+func TestERPErrorBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     *ERPError
+		attempt int
+		want    time.Duration
+	}{
+		{name: "first attempt", err: &ERPError{Class: ClassRateLimited}, attempt: 1, want: 10 * time.Second},
+		{name: "grows exponentially", err: &ERPError{Class: ClassRateLimited}, attempt: 3, want: 40 * time.Second},
+		{name: "Retry-After wins when longer", err: &ERPError{Class: ClassRateLimited, RetryAfter: time.Minute}, attempt: 1, want: time.Minute},
+		{name: "capped", err: &ERPError{Class: ClassRateLimited}, attempt: 10, want: MaxRetryDelay},
+		{name: "no base delay", err: &ERPError{Class: ClassValidation}, attempt: 1, want: MaxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Backoff(tt.attempt); got != tt.want {
+				t.Errorf("Backoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "120", want: 2 * time.Minute},
+		{value: "0", want: 0},
+		{value: "-5", want: 0},
+		{value: "soon", want: 0},
+		{value: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0}, // in the past
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %s, want about an hour", future, got)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const TLSReloadInterval = 30 * time.Second
+
+// ERPTLSConfig holds the TLS settings for the ERP connection, read from
+// ERP_TLS_* variables. Certificate and CA variables accept comma separated
+// lists; certificate and key files are paired by position.
+type ERPTLSConfig struct {
+	CertFiles  []string
+	KeyFiles   []string
+	CAFiles    []string
+	MinVersion uint16
+	ServerName string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadERPTLSConfig reads the ERP_TLS_* variables. It returns nil when none
+// are set so the default transport is used unchanged.
+func loadERPTLSConfig() (*ERPTLSConfig, error) {
+	c := &ERPTLSConfig{
+		CertFiles:  splitList(os.Getenv("ERP_TLS_CERT_FILE")),
+		KeyFiles:   splitList(os.Getenv("ERP_TLS_KEY_FILE")),
+		CAFiles:    splitList(os.Getenv("ERP_TLS_CA_FILE")),
+		ServerName: os.Getenv("ERP_TLS_SERVER_NAME"),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	minVersion := os.Getenv("ERP_TLS_MIN_VERSION")
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid ERP_TLS_MIN_VERSION %q (expected 1.0, 1.1, 1.2 or 1.3)", minVersion)
+		}
+		c.MinVersion = version
+	}
+
+	if len(c.CertFiles) != len(c.KeyFiles) {
+		return nil, fmt.Errorf("ERP_TLS_CERT_FILE and ERP_TLS_KEY_FILE must list the same number of files")
+	}
+
+	if len(c.CertFiles) == 0 && len(c.CAFiles) == 0 && c.ServerName == "" && minVersion == "" {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// files returns every certificate, key and CA file, which are watched for changes
+func (c *ERPTLSConfig) files() []string {
+	files := append([]string{}, c.CertFiles...)
+	files = append(files, c.KeyFiles...)
+	return append(files, c.CAFiles...)
+}
+
+// build loads the certificates and returns the tls.Config for the ERP transport
+func (c *ERPTLSConfig) build() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: c.MinVersion,
+		ServerName: c.ServerName,
+	}
+
+	for i := range c.CertFiles {
+		cert, err := tls.LoadX509KeyPair(c.CertFiles[i], c.KeyFiles[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %w", c.CertFiles[i], err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	if len(c.CAFiles) > 0 {
+		// Private CAs are trusted in addition to the system roots
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, path := range c.CAFiles {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// Describe summarises the settings for the startup log
+func (c *ERPTLSConfig) Describe() string {
+	if c == nil {
+		return "default"
+	}
+	var parts []string
+	for name, version := range tlsVersions {
+		if version == c.MinVersion {
+			parts = append(parts, "min TLS "+name)
+		}
+	}
+	if len(c.CertFiles) > 0 {
+		parts = append(parts, fmt.Sprintf("%d client certificates", len(c.CertFiles)))
+	}
+	if len(c.CAFiles) > 0 {
+		parts = append(parts, "CA "+strings.Join(c.CAFiles, ", "))
+	}
+	if c.ServerName != "" {
+		parts = append(parts, "server name "+c.ServerName)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reloadingTransport is an http.Transport whose TLS settings are rebuilt when
+// the certificate, key or CA files change on disk. Requests in flight keep the
+// transport they started with; idle connections of the old one are closed.
+type reloadingTransport struct {
+	config   *ERPTLSConfig
+	current  atomic.Pointer[http.Transport]
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+	http1    bool // rebuilt transports keep one HTTP/1.1 connection, see useHTTP1
+}
+
+// newERPBaseTransport returns the transport used below the authentication
+// layer, applying ERP_TLS_* settings when any are configured
+func newERPBaseTransport() (http.RoundTripper, string, error) {
+	config, err := loadERPTLSConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	if config == nil {
+		return http.DefaultTransport.(*http.Transport).Clone(), config.Describe(), nil
+	}
+
+	t := &reloadingTransport{config: config}
+	if err := t.reload(); err != nil {
+		return nil, "", err
+	}
+	go t.watch(TLSReloadInterval)
+
+	return t, config.Describe(), nil
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current.Load().RoundTrip(req)
+}
+
+// reload rebuilds the transport from the current files
+func (t *reloadingTransport) reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tlsConfig, err := t.config.build()
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if t.http1 {
+		configureHTTP1(transport)
+	}
+
+	t.modTimes = t.stat()
+	if old := t.current.Swap(transport); old != nil {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+// useHTTP1 applies configureHTTP1 to the current and all future transports
+func (t *reloadingTransport) useHTTP1() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.http1 = true
+	transport := t.current.Load().Clone()
+	configureHTTP1(transport)
+	if old := t.current.Swap(transport); old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// stat returns the modification time of every watched file
+func (t *reloadingTransport) stat() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range t.config.files() {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// changed reports whether any watched file was modified since the last reload
+func (t *reloadingTransport) changed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for path, modTime := range t.stat() {
+		if !modTime.Equal(t.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch polls the files and reloads when they change. A failed reload, for
+// example while a certificate and its key are replaced one after the other,
+// keeps the previous settings and is retried on the next poll.
+func (t *reloadingTransport) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !t.changed() {
+			continue
+		}
+		if err := t.reload(); err != nil {
+			log.Printf("Error reloading ERP TLS certificates: %v", err)
+			continue
+		}
+		log.Printf("Reloaded ERP TLS certificates")
+	}
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the current transport
+func (t *reloadingTransport) CloseIdleConnections() {
+	t.current.Load().CloseIdleConnections()
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
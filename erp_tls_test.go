@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority for TLS tests
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test ERP CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a certificate for commonName and returns the certificate and key as PEM
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage, dnsNames ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+// newMTLSServer starts a TLS server for erp.internal that requires a client
+// certificate from ca and answers with the client certificate's common name
+func newMTLSServer(t *testing.T, ca *testCA, maxVersion uint16) *httptest.Server {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "erp.internal", x509.ExtKeyUsageServerAuth, "erp.internal")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MaxVersion:   maxVersion,
+	}
+	// Rejected handshakes are expected, keep them out of the test output
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// writeTestFile writes data to name in dir and returns the path
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fetchCommonName sends a request through transport and returns the response body
+func fetchCommonName(transport http.RoundTripper, url string) (string, error) {
+	resp, err := (&http.Client{Transport: transport, Timeout: 5 * time.Second}).Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestERPTLSConfigBuild(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	dir := t.TempDir()
+
+	caFile := writeTestFile(t, dir, "ca.pem", ca.certPEM)
+	otherCAFile := writeTestFile(t, dir, "other-ca.pem", otherCA.certPEM)
+	certPEM, keyPEM := ca.issue(t, "shopify-ax", x509.ExtKeyUsageClientAuth)
+	certFile := writeTestFile(t, dir, "client.pem", certPEM)
+	keyFile := writeTestFile(t, dir, "client-key.pem", keyPEM)
+	emptyFile := writeTestFile(t, dir, "empty.pem", nil)
+
+	tests := []struct {
+		name       string
+		config     ERPTLSConfig
+		maxVersion uint16
+		wantErr    bool // build fails
+		wantFail   bool // the handshake fails
+	}{
+		{
+			name:   "CA, client certificate and server name",
+			config: ERPTLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}, CAFiles: []string{caFile}, ServerName: "erp.internal", MinVersion: tls.VersionTLS12},
+		},
+		{
+			name:   "several CA bundles",
+			config: ERPTLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}, CAFiles: []string{otherCAFile, caFile}, ServerName: "erp.internal", MinVersion: tls.VersionTLS12},
+		},
+		{
+			name:     "server not signed by the CA",
+			config:   ERPTLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}, CAFiles: []string{otherCAFile}, ServerName: "erp.internal", MinVersion: tls.VersionTLS12},
+			wantFail: true,
+		},
+		{
+			name:     "no client certificate",
+			config:   ERPTLSConfig{CAFiles: []string{caFile}, ServerName: "erp.internal", MinVersion: tls.VersionTLS12},
+			wantFail: true,
+		},
+		{
+			name:     "without server name override",
+			config:   ERPTLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}, CAFiles: []string{caFile}, MinVersion: tls.VersionTLS12},
+			wantFail: true,
+		},
+		{
+			name:     "wrong server name",
+			config:   ERPTLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}, CAFiles: []string{caFile}, ServerName: "other.internal", MinVersion: tls.VersionTLS12},
+			wantFail: true,
+		},
+		{
+			name:       "server below min version",
+			config:     ERPTLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}, CAFiles: []string{caFile}, ServerName: "erp.internal", MinVersion: tls.VersionTLS13},
+			maxVersion: tls.VersionTLS12,
+			wantFail:   true,
+		},
+		{
+			name:       "server at min version",
+			config:     ERPTLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{keyFile}, CAFiles: []string{caFile}, ServerName: "erp.internal", MinVersion: tls.VersionTLS12},
+			maxVersion: tls.VersionTLS12,
+		},
+		{
+			name:    "missing key",
+			config:  ERPTLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{filepath.Join(dir, "missing.pem")}},
+			wantErr: true,
+		},
+		{
+			name:    "key does not match certificate",
+			config:  ERPTLSConfig{CertFiles: []string{certFile}, KeyFiles: []string{certFile}},
+			wantErr: true,
+		},
+		{
+			name:    "missing CA bundle",
+			config:  ERPTLSConfig{CAFiles: []string{filepath.Join(dir, "missing.pem")}},
+			wantErr: true,
+		},
+		{
+			name:    "empty CA bundle",
+			config:  ERPTLSConfig{CAFiles: []string{emptyFile}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := tt.config.build()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("build() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tlsConfig.MinVersion != tt.config.MinVersion || tlsConfig.ServerName != tt.config.ServerName {
+				t.Errorf("MinVersion = %x, ServerName = %q, want %x, %q", tlsConfig.MinVersion, tlsConfig.ServerName, tt.config.MinVersion, tt.config.ServerName)
+			}
+			if len(tlsConfig.Certificates) != len(tt.config.CertFiles) {
+				t.Errorf("%d certificates, want %d", len(tlsConfig.Certificates), len(tt.config.CertFiles))
+			}
+
+			server := newMTLSServer(t, ca, tt.maxVersion)
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			defer transport.CloseIdleConnections()
+
+			name, err := fetchCommonName(transport, server.URL)
+			if tt.wantFail {
+				if err == nil {
+					t.Fatalf("request succeeded, want a handshake failure")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if name != "shopify-ax" {
+				t.Errorf("server saw client certificate %q, want shopify-ax", name)
+			}
+		})
+	}
+}
+
+func TestReloadingTransportReload(t *testing.T) {
+	ca := newTestCA(t)
+	server := newMTLSServer(t, ca, 0)
+	dir := t.TempDir()
+
+	certPEM, keyPEM := ca.issue(t, "client-a", x509.ExtKeyUsageClientAuth)
+	config := &ERPTLSConfig{
+		CertFiles:  []string{writeTestFile(t, dir, "client.pem", certPEM)},
+		KeyFiles:   []string{writeTestFile(t, dir, "client-key.pem", keyPEM)},
+		CAFiles:    []string{writeTestFile(t, dir, "ca.pem", ca.certPEM)},
+		ServerName: "erp.internal",
+		MinVersion: tls.VersionTLS12,
+	}
+
+	transport := &reloadingTransport{config: config}
+	if err := transport.reload(); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+
+	if name, err := fetchCommonName(transport, server.URL); err != nil || name != "client-a" {
+		t.Fatalf("first request: name = %q, err = %v, want client-a", name, err)
+	}
+	if transport.changed() {
+		t.Errorf("changed() = true before the files were rewritten")
+	}
+
+	// rewrite marks the files as modified a second from now, so the change
+	// is seen even on file systems with coarse modification times
+	modified := time.Now().Add(time.Second)
+	rewrite := func(certPEM, keyPEM []byte) {
+		t.Helper()
+		writeTestFile(t, dir, "client.pem", certPEM)
+		writeTestFile(t, dir, "client-key.pem", keyPEM)
+		modified = modified.Add(time.Second)
+		for _, path := range config.files() {
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A half-written pair fails to load and keeps the current transport
+	before := transport.current.Load()
+	rewrite(certPEM, []byte("not a key"))
+	if !transport.changed() {
+		t.Fatalf("changed() = false after the files were rewritten")
+	}
+	if err := transport.reload(); err == nil {
+		t.Fatalf("reload() with an invalid key succeeded")
+	}
+	if transport.current.Load() != before {
+		t.Errorf("failed reload replaced the transport")
+	}
+
+	certPEM, keyPEM = ca.issue(t, "client-b", x509.ExtKeyUsageClientAuth)
+	rewrite(certPEM, keyPEM)
+	if !transport.changed() {
+		t.Fatalf("changed() = false after the files were rewritten")
+	}
+	if err := transport.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if transport.current.Load() == before {
+		t.Errorf("reload kept the old transport")
+	}
+	if transport.changed() {
+		t.Errorf("changed() = true right after reload")
+	}
+	if name, err := fetchCommonName(transport, server.URL); err != nil || name != "client-b" {
+		t.Errorf("after reload: name = %q, err = %v, want client-b", name, err)
+	}
+}
+
+func TestReloadingTransportWatch(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := writeTestFile(t, dir, "ca.pem", ca.certPEM)
+
+	transport := &reloadingTransport{config: &ERPTLSConfig{CAFiles: []string{caFile}, MinVersion: tls.VersionTLS12}}
+	if err := transport.reload(); err != nil {
+		t.Fatal(err)
+	}
+	before := transport.current.Load()
+	go transport.watch(10 * time.Millisecond)
+
+	modified := time.Now().Add(time.Minute)
+	if err := os.Chtimes(caFile, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for transport.current.Load() == before {
+		if time.Now().After(deadline) {
+			t.Fatalf("watch did not reload the transport after the CA bundle changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadingTransportUseHTTP1(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := writeTestFile(t, dir, "ca.pem", ca.certPEM)
+
+	transport := &reloadingTransport{config: &ERPTLSConfig{CAFiles: []string{caFile}, MinVersion: tls.VersionTLS12}}
+	if err := transport.reload(); err != nil {
+		t.Fatal(err)
+	}
+	before := transport.current.Load()
+	if err := useHTTP1(transport); err != nil {
+		t.Fatal(err)
+	}
+
+	http1 := func(stage string, current *http.Transport) {
+		t.Helper()
+		if current.ForceAttemptHTTP2 || current.TLSNextProto == nil || current.MaxConnsPerHost != 1 {
+			t.Errorf("%s: transport not restricted to HTTP/1.1: ForceAttemptHTTP2=%t TLSNextProto=%v MaxConnsPerHost=%d",
+				stage, current.ForceAttemptHTTP2, current.TLSNextProto, current.MaxConnsPerHost)
+		}
+		if current.TLSClientConfig == nil || current.TLSClientConfig.RootCAs == nil {
+			t.Errorf("%s: transport lost the TLS settings", stage)
+		}
+	}
+
+	current := transport.current.Load()
+	if current == before {
+		t.Errorf("useHTTP1 changed the transport in place instead of swapping it")
+	}
+	if before.MaxConnsPerHost == 1 {
+		t.Errorf("useHTTP1 modified the previous transport")
+	}
+	http1("after useHTTP1", current)
+
+	if err := transport.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if transport.current.Load() == current {
+		t.Fatalf("reload kept the old transport")
+	}
+	http1("after reload", transport.current.Load())
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ItemMapReloadInterval = 30 * time.Second
+
+// Policies for order lines without an item mapping, set with ITEM_MAP_UNMAPPED
+const (
+	UnmappedFail     = "fail"     // dead-letter the order
+	UnmappedHold     = "hold"     // hold the order for manual review
+	UnmappedFallback = "fallback" // send the line as ITEM_MAP_FALLBACK_ITEM
+)
+
+var ErrUnmappedItem = errors.New("order has unmapped items")
+
+// ItemMapping maps a Shopify SKU or variant to an AX item and its inventory dimensions
+type ItemMapping struct {
+	SKU       string `json:"sku,omitempty"`
+	VariantID string `json:"variant_id,omitempty"`
+	ItemID    string `json:"item_id"`
+	ERPInventDim
+}
+
+// ItemMap resolves Shopify SKUs and variant IDs to AX items. It is loaded
+// from the CSV or JSON file in ITEM_MAP_FILE and reloaded when the file
+// changes. Without a file every SKU is sent as the AX ItemId unchanged.
+type ItemMap struct {
+	path     string
+	policy   string
+	fallback string
+
+	mu        sync.RWMutex
+	bySKU     map[string]ItemMapping
+	byVariant map[string]ItemMapping
+	modTime   time.Time
+}
+
+// NewItemMap loads ITEM_MAP_FILE and starts watching it for changes
+func NewItemMap() (*ItemMap, error) {
+	m := &ItemMap{
+		path:     os.Getenv("ITEM_MAP_FILE"),
+		policy:   UnmappedFail,
+		fallback: os.Getenv("ITEM_MAP_FALLBACK_ITEM"),
+	}
+	if m.path == "" {
+		return m, nil
+	}
+
+	if value := os.Getenv("ITEM_MAP_UNMAPPED"); value != "" {
+		switch policy := strings.ToLower(value); policy {
+		case UnmappedFail, UnmappedHold, UnmappedFallback:
+			m.policy = policy
+		default:
+			return nil, fmt.Errorf("invalid ITEM_MAP_UNMAPPED %q (expected fail, hold or fallback)", value)
+		}
+	}
+	if m.policy == UnmappedFallback && m.fallback == "" {
+		return nil, fmt.Errorf("ITEM_MAP_UNMAPPED=fallback requires ITEM_MAP_FALLBACK_ITEM")
+	}
+
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	go m.watch()
+
+	return m, nil
+}
+
+// Enabled reports whether a mapping file is configured
+func (m *ItemMap) Enabled() bool {
+	return m.path != ""
+}
+
+// Policy returns the policy for unmapped lines
+func (m *ItemMap) Policy() string {
+	return m.policy
+}
+
+// Resolve returns the AX item of a Shopify line. Variant mappings take
+// precedence over SKU mappings. Unmapped lines get the fallback item under
+// the fallback policy and an empty ItemID otherwise; found is false for both.
+func (m *ItemMap) Resolve(sku string, variantID int64) (mapping ItemMapping, found bool) {
+	if !m.Enabled() {
+		return ItemMapping{SKU: sku, ItemID: sku}, true
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if variantID != 0 {
+		if mapping, ok := m.byVariant[strconv.FormatInt(variantID, 10)]; ok {
+			return mapping, true
+		}
+	}
+	if mapping, ok := m.bySKU[sku]; ok && sku != "" {
+		return mapping, true
+	}
+
+	if m.policy == UnmappedFallback {
+		return ItemMapping{SKU: sku, ItemID: m.fallback}, false
+	}
+	return ItemMapping{SKU: sku}, false
+}
+
+// Len returns the number of loaded mappings
+func (m *ItemMap) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.bySKU) + len(m.byVariant)
+}
+
+// Describe summarises the settings for the startup log
+func (m *ItemMap) Describe() string {
+	if !m.Enabled() {
+		return "disabled, SKUs are sent as AX item IDs"
+	}
+	description := fmt.Sprintf("%s (%d mappings), unmapped lines: %s", m.path, m.Len(), m.policy)
+	if m.policy == UnmappedFallback {
+		description += " to " + m.fallback
+	}
+	return description
+}
+
+// Reload reads the mapping file again. A file that fails to load leaves the
+// previous mappings in place.
+func (m *ItemMap) Reload() error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return fmt.Errorf("failed to read item map: %w", err)
+	}
+
+	mappings, err := loadItemMappings(m.path)
+	if err != nil {
+		return fmt.Errorf("failed to load item map %s: %w", m.path, err)
+	}
+
+	bySKU := make(map[string]ItemMapping)
+	byVariant := make(map[string]ItemMapping)
+	for i, mapping := range mappings {
+		if mapping.ItemID == "" || mapping.SKU == "" && mapping.VariantID == "" {
+			return fmt.Errorf("item map %s entry %d needs an item_id and a sku or variant_id", m.path, i+1)
+		}
+		if mapping.VariantID != "" {
+			byVariant[mapping.VariantID] = mapping
+		} else {
+			bySKU[mapping.SKU] = mapping
+		}
+	}
+
+	m.mu.Lock()
+	m.bySKU = bySKU
+	m.byVariant = byVariant
+	m.modTime = info.ModTime()
+	m.mu.Unlock()
+	return nil
+}
+
+// watch polls the mapping file and reloads it when it changes
+func (m *ItemMap) watch() {
+	ticker := time.NewTicker(ItemMapReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(m.path)
+		if err != nil {
+			continue
+		}
+		m.mu.RLock()
+		changed := !info.ModTime().Equal(m.modTime)
+		m.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := m.Reload(); err != nil {
+			log.Printf("Error reloading item map: %v", err)
+			continue
+		}
+		log.Printf("Reloaded item map %s (%d mappings)", m.path, m.Len())
+	}
+}
+
+// loadItemMappings reads a JSON array of mappings, or a CSV file with a
+// header row using the JSON field names
+func loadItemMappings(path string) ([]ItemMapping, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mappings []ItemMapping
+	if !strings.EqualFold(filepath.Ext(path), ".csv") {
+		err := json.NewDecoder(file).Decode(&mappings)
+		return mappings, err
+	}
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return mappings, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var mapping ItemMapping
+		fields := map[string]*string{
+			"sku":         &mapping.SKU,
+			"variant_id":  &mapping.VariantID,
+			"item_id":     &mapping.ItemID,
+			"config_id":   &mapping.ConfigID,
+			"color_id":    &mapping.ColorID,
+			"size_id":     &mapping.SizeID,
+			"style_id":    &mapping.StyleID,
+			"site_id":     &mapping.SiteID,
+			"location_id": &mapping.LocationID,
+		}
+		for i, column := range header {
+			if field, ok := fields[strings.ToLower(strings.TrimSpace(column))]; ok && i < len(record) {
+				*field = strings.TrimSpace(record[i])
+			}
+		}
+		mappings = append(mappings, mapping)
+	}
+}
+
+// checkItemMapping applies the unmapped item policy to a transformed order.
+// Fallback lines are only logged; otherwise ErrUnmappedItem lists the lines.
+func (s *Server) checkItemMapping(order *ERPOrder, requestID string) error {
+	var unmapped []string
+	for _, item := range order.Items {
+		if !item.Unmapped {
+			continue
+		}
+		if s.items.Policy() == UnmappedFallback {
+			log.Printf("[%s] Warning: SKU %q of order %s is not mapped, sending it as AX item %s", requestID, item.SKU, order.OrderID, item.ItemID)
+			continue
+		}
+		unmapped = append(unmapped, fmt.Sprintf("%q (line %s)", item.SKU, item.LineID))
+	}
+
+	if len(unmapped) > 0 {
+		return fmt.Errorf("%w: SKU %s", ErrUnmappedItem, strings.Join(unmapped, ", "))
+	}
+	return nil
+}
+
+// handleReloadItemMap reloads the item mapping file without waiting for the next poll
+func (s *Server) handleReloadItemMap(w http.ResponseWriter, r *http.Request) {
+	if !s.items.Enabled() {
+		writeJSONError(w, http.StatusNotFound, "ITEM_MAP_FILE is not set")
+		return
+	}
+	if err := s.items.Reload(); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	log.Printf("Reloaded item map %s (%d mappings) by admin", s.items.path, s.items.Len())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "reloaded",
+		"mappings": s.items.Len(),
+	})
+}
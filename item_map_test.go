@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestItemMap writes a mapping file and loads it with the given policy
+func newTestItemMap(t *testing.T, name, content, policy string) *ItemMap {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ITEM_MAP_FILE", path)
+	t.Setenv("ITEM_MAP_UNMAPPED", policy)
+	t.Setenv("ITEM_MAP_FALLBACK_ITEM", "MISC")
+
+	m, err := NewItemMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+const testItemMapCSV = `sku, variant_id, item_id, color_id, size_id
+TSHIRT-RED-L, , AX-TSHIRT, Red, L
+, 4711, AX-VARIANT, Blue, M
+`
+
+const testItemMapJSON = `[
+  {"sku": "TSHIRT-RED-L", "item_id": "AX-TSHIRT", "color_id": "Red", "size_id": "L"},
+  {"variant_id": "4711", "item_id": "AX-VARIANT", "color_id": "Blue", "size_id": "M"}
+]`
+
+func TestItemMapResolve(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		policy    string
+		sku       string
+		variantID int64
+		wantItem  string
+		wantColor string
+		wantFound bool
+	}{
+		{name: "csv sku", file: "items.csv", content: testItemMapCSV, sku: "TSHIRT-RED-L", wantItem: "AX-TSHIRT", wantColor: "Red", wantFound: true},
+		{name: "csv variant", file: "items.csv", content: testItemMapCSV, variantID: 4711, wantItem: "AX-VARIANT", wantColor: "Blue", wantFound: true},
+		{name: "variant wins over sku", file: "items.csv", content: testItemMapCSV, sku: "TSHIRT-RED-L", variantID: 4711, wantItem: "AX-VARIANT", wantColor: "Blue", wantFound: true},
+		{name: "unknown variant falls back to sku", file: "items.json", content: testItemMapJSON, sku: "TSHIRT-RED-L", variantID: 1, wantItem: "AX-TSHIRT", wantColor: "Red", wantFound: true},
+		{name: "json variant", file: "items.json", content: testItemMapJSON, variantID: 4711, wantItem: "AX-VARIANT", wantColor: "Blue", wantFound: true},
+		{name: "unmapped", file: "items.json", content: testItemMapJSON, sku: "OTHER"},
+		{name: "empty sku is never mapped", file: "items.json", content: `[{"sku": "", "variant_id": "1", "item_id": "X"}]`},
+		{name: "unmapped with fallback", file: "items.json", content: testItemMapJSON, policy: UnmappedFallback, sku: "OTHER", wantItem: "MISC"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestItemMap(t, tt.file, tt.content, tt.policy)
+
+			mapping, found := m.Resolve(tt.sku, tt.variantID)
+			if found != tt.wantFound || mapping.ItemID != tt.wantItem || mapping.ColorID != tt.wantColor {
+				t.Errorf("Resolve(%q, %d) = %s (color %q), %t, want %s (color %q), %t",
+					tt.sku, tt.variantID, mapping.ItemID, mapping.ColorID, found, tt.wantItem, tt.wantColor, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestItemMapDisabled(t *testing.T) {
+	t.Setenv("ITEM_MAP_FILE", "")
+	m, err := NewItemMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping, found := m.Resolve("SKU-1", 4711); !found || mapping.ItemID != "SKU-1" {
+		t.Errorf("Resolve() without a map = %s, %t, want the SKU", mapping.ItemID, found)
+	}
+}
+
+func TestNewItemMapSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		policy   string
+		fallback string
+		wantErr  bool
+	}{
+		{name: "valid", content: testItemMapJSON, policy: UnmappedHold},
+		{name: "unknown policy", content: testItemMapJSON, policy: "ignore", wantErr: true},
+		{name: "fallback without item", content: testItemMapJSON, policy: UnmappedFallback, wantErr: true},
+		{name: "entry without item id", content: `[{"sku": "A"}]`, wantErr: true},
+		{name: "entry without sku or variant", content: `[{"item_id": "A"}]`, wantErr: true},
+		{name: "not json", content: `sku,item_id`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "items.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("ITEM_MAP_FILE", path)
+			t.Setenv("ITEM_MAP_UNMAPPED", tt.policy)
+			t.Setenv("ITEM_MAP_FALLBACK_ITEM", tt.fallback)
+
+			if _, err := NewItemMap(); (err != nil) != tt.wantErr {
+				t.Errorf("NewItemMap() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestItemMapReloadKeepsMappingsOnError(t *testing.T) {
+	m := newTestItemMap(t, "items.json", testItemMapJSON, "")
+
+	if err := os.WriteFile(m.path, []byte(`[{"sku": "A"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("Reload() accepted an entry without item_id")
+	}
+	if mapping, found := m.Resolve("TSHIRT-RED-L", 0); !found || mapping.ItemID != "AX-TSHIRT" {
+		t.Errorf("mappings were dropped by a failed reload")
+	}
+}
+
+func TestCheckItemMapping(t *testing.T) {
+	order := &ERPOrder{OrderID: "1", Items: []ERPItem{
+		{LineID: "1", SKU: "A", ItemID: "AX-A"},
+		{LineID: "2", SKU: "B", ItemID: "MISC", Unmapped: true},
+	}}
+
+	tests := []struct {
+		policy  string
+		wantErr bool
+	}{
+		{policy: UnmappedFail, wantErr: true},
+		{policy: UnmappedHold, wantErr: true},
+		{policy: UnmappedFallback},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			s := &Server{items: &ItemMap{policy: tt.policy}}
+			err := s.checkItemMapping(order, "r1")
+			if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, ErrUnmappedItem) {
+				t.Errorf("checkItemMapping() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -5,36 +5,40 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 const (
-	DefaultERPEndpoint = "https://httpbin.org/post" // Temporary test endpoint that accepts any request
-	MaxRetries         = 3
-	RetryDelay         = 2 * time.Second
-	SOAPAction         = "http://tempuri.org/CreateOrder" // Update this to match your AX service
-	DefaultLogDir      = "./logs"
+	DefaultERPEndpoint    = "https://httpbin.org/post" // Temporary test endpoint that accepts any request
+	MaxRetries            = 3
+	RetryDelay            = 2 * time.Second
+	SOAPAction            = "http://tempuri.org/CreateOrder" // Update this to match your AX service
+	DefaultLogDir         = "./logs"
+	DefaultSalesIDElement = "SalesId" // Response element holding the created AX sales order number
 )
 
 // LogEntry represents a log entry for requests/responses
 type LogEntry struct {
-	RequestID   string      `json:"request_id"`
-	Timestamp   string      `json:"timestamp"`
-	Type        string      `json:"type"` // "incoming_webhook", "outgoing_soap", "soap_response"
-	Method      string      `json:"method,omitempty"`
-	URL         string      `json:"url,omitempty"`
-	Headers     interface{} `json:"headers,omitempty"`
-	Body        interface{} `json:"body,omitempty"`
-	StatusCode  int         `json:"status_code,omitempty"`
-	Error       string      `json:"error,omitempty"`
-	OrderID     string      `json:"order_id,omitempty"`
+	RequestID   string          `json:"request_id"`
+	Timestamp   string          `json:"timestamp"`
+	Type        string          `json:"type"` // "incoming_webhook", "rejected_webhook", "order_validation", "outgoing_soap", "soap_response"
+	Method      string          `json:"method,omitempty"`
+	URL         string          `json:"url,omitempty"`
+	Headers     interface{}     `json:"headers,omitempty"`
+	Body        interface{}     `json:"body,omitempty"`
+	StatusCode  int             `json:"status_code,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	OrderID     string          `json:"order_id,omitempty"`
+	FaultReason string          `json:"fault_reason,omitempty"`
+	Violations  []RuleViolation `json:"violations,omitempty"`
 }
 
 // Logger handles file-based logging
@@ -130,6 +134,50 @@ func (l *Logger) LogIncomingWebhook(requestID string, headers http.Header, body
 	l.writeLogEntry(entry)
 }
 
+// LogRejectedWebhook logs webhook requests that failed signature verification
+func (l *Logger) LogRejectedWebhook(requestID string, remoteAddr string, headers http.Header, bodySize int, reason error) {
+	entry := LogEntry{
+		RequestID: requestID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Type:      "rejected_webhook",
+		Method:    "POST",
+		URL:       "/webhook",
+		Headers:   headers,
+		Body:      map[string]interface{}{"remote_addr": remoteAddr, "size": bodySize},
+		Error:     reason.Error(),
+	}
+	
+	l.writeLogEntry(entry)
+}
+
+// LogIgnoredWebhook logs verified webhooks of topics this service does not handle
+func (l *Logger) LogIgnoredWebhook(requestID string, topic string, headers http.Header, bodySize int) {
+	entry := LogEntry{
+		RequestID: requestID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Type:      "ignored_webhook",
+		Method:    "POST",
+		URL:       "/webhook",
+		Headers:   headers,
+		Body:      map[string]interface{}{"topic": topic, "size": bodySize},
+	}
+	
+	l.writeLogEntry(entry)
+}
+
+// LogValidation logs the validation rules an order breaks
+func (l *Logger) LogValidation(requestID string, orderID string, violations []RuleViolation) {
+	entry := LogEntry{
+		RequestID:  requestID,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Type:       "order_validation",
+		OrderID:    orderID,
+		Violations: violations,
+	}
+	
+	l.writeLogEntry(entry)
+}
+
 // LogOutgoingSOAP logs outgoing SOAP requests to ERP
 func (l *Logger) LogOutgoingSOAP(requestID string, url string, headers http.Header, soapBody string, orderID string) {
 	entry := LogEntry{
@@ -147,15 +195,16 @@ func (l *Logger) LogOutgoingSOAP(requestID string, url string, headers http.Head
 }
 
 // LogSOAPResponse logs responses from ERP SOAP service
-func (l *Logger) LogSOAPResponse(requestID string, statusCode int, headers http.Header, responseBody string, orderID string, err error) {
+func (l *Logger) LogSOAPResponse(requestID string, statusCode int, headers http.Header, responseBody string, orderID string, faultReason string, err error) {
 	entry := LogEntry{
-		RequestID:  requestID,
-		Timestamp:  time.Now().UTC().Format(time.RFC3339),
-		Type:       "soap_response",
-		StatusCode: statusCode,
-		Headers:    headers,
-		Body:       responseBody,
-		OrderID:    orderID,
+		RequestID:   requestID,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Type:        "soap_response",
+		StatusCode:  statusCode,
+		Headers:     headers,
+		Body:        responseBody,
+		OrderID:     orderID,
+		FaultReason: faultReason,
 	}
 	
 	if err != nil {
@@ -170,18 +219,28 @@ type ShopifyOrder struct {
 	ID                int64    `json:"id"`
 	OrderNumber       int      `json:"order_number"`
 	Email             string   `json:"email"`
+	Phone             string   `json:"phone"`
 	CreatedAt         string   `json:"created_at"`
 	UpdatedAt         string   `json:"updated_at"`
-	TotalPrice        string   `json:"total_price"`
-	SubtotalPrice     string   `json:"subtotal_price"`
-	TotalTax          string   `json:"total_tax"`
+	TotalPrice        Money    `json:"total_price"`
+	SubtotalPrice     Money    `json:"subtotal_price"`
+	TotalTax          Money    `json:"total_tax"`
+	TotalDiscounts    Money    `json:"total_discounts"`
+	TotalTipReceived  Money    `json:"total_tip_received"`
+	TaxesIncluded     bool     `json:"taxes_included"`
 	Currency          string   `json:"currency"`
 	FinancialStatus   string   `json:"financial_status"`
 	FulfillmentStatus string   `json:"fulfillment_status"`
-	Customer          Customer `json:"customer"`
+	CancelledAt       string   `json:"cancelled_at"`
+	CancelReason      string   `json:"cancel_reason"`
+	Customer          *Customer `json:"customer"` // nil for guest checkouts
 	LineItems         []LineItem `json:"line_items"`
-	ShippingAddress   Address    `json:"shipping_address"`
-	BillingAddress    Address    `json:"billing_address"`
+	ShippingAddress   *Address   `json:"shipping_address"` // nil for digital goods and POS sales
+	BillingAddress    *Address   `json:"billing_address"`
+	Refunds           []ShopifyRefund `json:"refunds"`
+	DiscountCodes     []DiscountCode  `json:"discount_codes"`
+	ShippingLines     []ShippingLine  `json:"shipping_lines"`
+	TaxLines          []TaxLine       `json:"tax_lines"`
 }
 
 type Customer struct {
@@ -199,10 +258,37 @@ type LineItem struct {
 	Title           string `json:"title"`
 	Name            string `json:"name"`
 	Quantity        int    `json:"quantity"`
-	Price           string `json:"price"`
+	CurrentQuantity *int   `json:"current_quantity"` // quantity after order edits, missing in older payloads
+	Price           Money  `json:"price"`
 	SKU             string `json:"sku"`
 	VariantTitle    string `json:"variant_title"`
 	FulfillmentService string `json:"fulfillment_service"`
+	RequiresShipping *bool    `json:"requires_shipping"` // missing in older payloads
+	TotalDiscount   Money     `json:"total_discount"` // includes the line's share of order-level discount codes
+	TaxLines        []TaxLine `json:"tax_lines"`
+}
+
+type DiscountCode struct {
+	Code   string `json:"code"`
+	Amount Money  `json:"amount"`
+	Type   string `json:"type"` // "fixed_amount", "percentage" or "shipping"
+}
+
+type ShippingLine struct {
+	ID                int64     `json:"id"`
+	Title             string    `json:"title"`
+	Price             Money     `json:"price"`
+	DiscountedPrice   *Money    `json:"discounted_price"` // missing in older payloads
+	Code              string    `json:"code"`
+	Source            string    `json:"source"`
+	CarrierIdentifier string    `json:"carrier_identifier"`
+	TaxLines          []TaxLine `json:"tax_lines"`
+}
+
+type TaxLine struct {
+	Title string      `json:"title"`
+	Price Money       `json:"price"`
+	Rate  json.Number `json:"rate"` // a number in webhooks, a string in some exports
 }
 
 type Address struct {
@@ -227,25 +313,71 @@ type ERPOrder struct {
 	CustomerEmail     string      `json:"customer_email"`
 	CustomerName      string      `json:"customer_name"`
 	CustomerPhone     string      `json:"customer_phone"`
+	CustAccount       string      `json:"cust_account"` // AX customer account, see customer.go
 	OrderDate         string      `json:"order_date"`
-	TotalAmount       string      `json:"total_amount"`
-	SubtotalAmount    string      `json:"subtotal_amount"`
-	TaxAmount         string      `json:"tax_amount"`
+	TotalAmount       Money       `json:"total_amount"`
+	SubtotalAmount    Money       `json:"subtotal_amount"`
+	TaxAmount         Money       `json:"tax_amount"`
+	DiscountAmount    Money       `json:"discount_amount"`
 	Currency          string      `json:"currency"`
 	PaymentStatus     string      `json:"payment_status"`
 	FulfillmentStatus string      `json:"fulfillment_status"`
 	Items             []ERPItem   `json:"items"`
-	ShippingAddress   ERPAddress  `json:"shipping_address"`
-	BillingAddress    ERPAddress  `json:"billing_address"`
+	Discounts         []ERPDiscount `json:"discounts"`
+	Charges           []ERPCharge   `json:"charges"`
+	TaxLines          []ERPTaxLine  `json:"tax_lines"`
+	ShippingAddress   *ERPAddress `json:"shipping_address,omitempty"` // nil when there is nothing to ship
+	BillingAddress    *ERPAddress `json:"billing_address,omitempty"`
 	Timestamp         string      `json:"timestamp"`
+	Reconciliation    []ReconciliationIssue `json:"reconciliation,omitempty"` // totals that do not add up, see reconcile.go
 }
 
 type ERPItem struct {
-	SKU          string `json:"sku"`
-	ProductName  string `json:"product_name"`
-	Quantity     int    `json:"quantity"`
-	UnitPrice    string `json:"unit_price"`
-	VariantTitle string `json:"variant_title"`
+	LineID         string       `json:"line_id"`
+	SKU            string       `json:"sku"`
+	ItemID         string       `json:"item_id"` // AX ItemId, see item_map.go
+	InventDim      ERPInventDim `json:"invent_dim"`
+	Unmapped       bool         `json:"unmapped,omitempty"`
+	ProductName    string       `json:"product_name"`
+	Quantity       int          `json:"quantity"`
+	UnitPrice      Money        `json:"unit_price"`
+	VariantTitle   string       `json:"variant_title"`
+	DiscountAmount Money        `json:"discount_amount"` // total discount of the line, not per unit
+	TaxLines       []ERPTaxLine `json:"tax_lines"`
+}
+
+// ERPInventDim holds the AX inventory dimensions of a line
+type ERPInventDim struct {
+	ConfigID   string `json:"config_id,omitempty"`
+	ColorID    string `json:"color_id,omitempty"`
+	SizeID     string `json:"size_id,omitempty"`
+	StyleID    string `json:"style_id,omitempty"`
+	SiteID     string `json:"site_id,omitempty"`
+	LocationID string `json:"location_id,omitempty"`
+}
+
+// ERPDiscount is a discount code applied to the order. Shopify allocates
+// discount codes to lines, so the amounts are also part of each line's discount.
+type ERPDiscount struct {
+	Code   string `json:"code"`
+	Type   string `json:"type"`
+	Amount Money  `json:"amount"`
+}
+
+// ERPCharge is a miscellaneous charge on the order, booked in AX as a misc charge
+type ERPCharge struct {
+	Code           string       `json:"code"`
+	Title          string       `json:"title"`
+	Amount         Money        `json:"amount"`          // after shipping discounts
+	DiscountAmount Money        `json:"discount_amount"` // shipping discount already deducted from Amount
+	Carrier        string       `json:"carrier"`
+	TaxLines       []ERPTaxLine `json:"tax_lines"`
+}
+
+type ERPTaxLine struct {
+	Title  string `json:"title"`
+	Rate   string `json:"rate"`
+	Amount Money  `json:"amount"`
 }
 
 type ERPAddress struct {
@@ -257,227 +389,409 @@ type ERPAddress struct {
 	State        string `json:"state"`
 	PostalCode   string `json:"postal_code"`
 	Country      string `json:"country"`
+	CountryCode  string `json:"country_code"`
 	Phone        string `json:"phone"`
 }
 
 // Server represents our HTTP server
 type Server struct {
-	httpClient *http.Client
-	logger     *Logger
+	httpClient  *http.Client
+	logger      *Logger
+	verifier    *WebhookVerifier
+	queue       *OrderQueue
+	dedupe      *DedupeStore
+	deadLetters *DeadLetterStore
+	cancels     *PendingWebhookStore
+	updates     *PendingWebhookStore
+	refunds     *PendingWebhookStore
+	orderMap    *OrderMapStore
+	sentOrders  *SentOrderStore
+	envelope    *EnvelopeBuilder
+	items       *ItemMap
+	customers   *CustomerMapStore
+	review      *ReviewStore
+	reconcile   ReconcileConfig
+	contact     ContactPolicy
+	validator   *Validator
+	topics      map[string]TopicHandler
+	orderMu     sync.Mutex // orders SalesId recording against cancellation, update and refund requests
 }
 
 // NewServer creates a new server instance
 func NewServer() *Server {
-	return &Server{
+	base, tlsMode, err := newERPBaseTransport()
+	if err != nil {
+		log.Fatalf("Could not configure ERP TLS: %v", err)
+	}
+	log.Printf("ERP TLS: %s", tlsMode)
+
+	transport, authMode, err := newERPTransport(base)
+	if err != nil {
+		log.Fatalf("Could not configure ERP authentication: %v", err)
+	}
+	log.Printf("ERP authentication: %s", authMode)
+
+	s := &Server{
 		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: transport,
 		},
-		logger: NewLogger(),
-	}
-}
-
-// xmlEscape escapes XML special characters
-func xmlEscape(s string) string {
-	return html.EscapeString(s)
-}
-
-// createSOAPEnvelope creates a SOAP XML envelope for the ERP order
-func (s *Server) createSOAPEnvelope(erpOrder *ERPOrder) string {
-	// Create SOAP envelope with the order data
-	// Update the namespace and method name according to your AX 2012 service WSDL
-	soapEnvelope := `<?xml version="1.0" encoding="utf-8"?>
-<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" 
-               xmlns:tem="http://tempuri.org/">
-  <soap:Header/>
-  <soap:Body>
-    <tem:CreateOrder>
-      <tem:order>
-        <tem:OrderID>` + xmlEscape(erpOrder.OrderID) + `</tem:OrderID>
-        <tem:OrderNumber>` + xmlEscape(erpOrder.OrderNumber) + `</tem:OrderNumber>
-        <tem:CustomerEmail>` + xmlEscape(erpOrder.CustomerEmail) + `</tem:CustomerEmail>
-        <tem:CustomerName>` + xmlEscape(erpOrder.CustomerName) + `</tem:CustomerName>
-        <tem:CustomerPhone>` + xmlEscape(erpOrder.CustomerPhone) + `</tem:CustomerPhone>
-        <tem:OrderDate>` + xmlEscape(erpOrder.OrderDate) + `</tem:OrderDate>
-        <tem:TotalAmount>` + xmlEscape(erpOrder.TotalAmount) + `</tem:TotalAmount>
-        <tem:SubtotalAmount>` + xmlEscape(erpOrder.SubtotalAmount) + `</tem:SubtotalAmount>
-        <tem:TaxAmount>` + xmlEscape(erpOrder.TaxAmount) + `</tem:TaxAmount>
-        <tem:Currency>` + xmlEscape(erpOrder.Currency) + `</tem:Currency>
-        <tem:PaymentStatus>` + xmlEscape(erpOrder.PaymentStatus) + `</tem:PaymentStatus>
-        <tem:FulfillmentStatus>` + xmlEscape(erpOrder.FulfillmentStatus) + `</tem:FulfillmentStatus>
-        <tem:ShippingAddress>
-          <tem:Name>` + xmlEscape(erpOrder.ShippingAddress.Name) + `</tem:Name>
-          <tem:Company>` + xmlEscape(erpOrder.ShippingAddress.Company) + `</tem:Company>
-          <tem:AddressLine1>` + xmlEscape(erpOrder.ShippingAddress.AddressLine1) + `</tem:AddressLine1>
-          <tem:AddressLine2>` + xmlEscape(erpOrder.ShippingAddress.AddressLine2) + `</tem:AddressLine2>
-          <tem:City>` + xmlEscape(erpOrder.ShippingAddress.City) + `</tem:City>
-          <tem:State>` + xmlEscape(erpOrder.ShippingAddress.State) + `</tem:State>
-          <tem:PostalCode>` + xmlEscape(erpOrder.ShippingAddress.PostalCode) + `</tem:PostalCode>
-          <tem:Country>` + xmlEscape(erpOrder.ShippingAddress.Country) + `</tem:Country>
-          <tem:Phone>` + xmlEscape(erpOrder.ShippingAddress.Phone) + `</tem:Phone>
-        </tem:ShippingAddress>
-        <tem:BillingAddress>
-          <tem:Name>` + xmlEscape(erpOrder.BillingAddress.Name) + `</tem:Name>
-          <tem:Company>` + xmlEscape(erpOrder.BillingAddress.Company) + `</tem:Company>
-          <tem:AddressLine1>` + xmlEscape(erpOrder.BillingAddress.AddressLine1) + `</tem:AddressLine1>
-          <tem:AddressLine2>` + xmlEscape(erpOrder.BillingAddress.AddressLine2) + `</tem:AddressLine2>
-          <tem:City>` + xmlEscape(erpOrder.BillingAddress.City) + `</tem:City>
-          <tem:State>` + xmlEscape(erpOrder.BillingAddress.State) + `</tem:State>
-          <tem:PostalCode>` + xmlEscape(erpOrder.BillingAddress.PostalCode) + `</tem:PostalCode>
-          <tem:Country>` + xmlEscape(erpOrder.BillingAddress.Country) + `</tem:Country>
-          <tem:Phone>` + xmlEscape(erpOrder.BillingAddress.Phone) + `</tem:Phone>
-        </tem:BillingAddress>
-        <tem:Items>`
-
-	// Add line items
-	for _, item := range erpOrder.Items {
-		soapEnvelope += `
-          <tem:Item>
-            <tem:SKU>` + xmlEscape(item.SKU) + `</tem:SKU>
-            <tem:ProductName>` + xmlEscape(item.ProductName) + `</tem:ProductName>
-            <tem:Quantity>` + fmt.Sprintf("%d", item.Quantity) + `</tem:Quantity>
-            <tem:UnitPrice>` + xmlEscape(item.UnitPrice) + `</tem:UnitPrice>
-            <tem:VariantTitle>` + xmlEscape(item.VariantTitle) + `</tem:VariantTitle>
-          </tem:Item>`
-	}
-
-	soapEnvelope += `
-        </tem:Items>
-        <tem:Timestamp>` + xmlEscape(erpOrder.Timestamp) + `</tem:Timestamp>
-      </tem:order>
-    </tem:CreateOrder>
-  </soap:Body>
-</soap:Envelope>`
-
-	return soapEnvelope
-}
-
-// transformOrder converts Shopify order to ERP format
+		logger:    NewLogger(),
+		reconcile: NewReconcileConfig(),
+	}
+	s.registerTopics()
+	log.Printf("Totals reconciliation: %s", s.reconcile.Describe())
+
+	verifier, err := NewWebhookVerifier()
+	if err != nil {
+		log.Fatalf("Could not configure webhook verification: %v", err)
+	}
+	s.verifier = verifier
+
+	envelope, err := NewEnvelopeBuilder()
+	if err != nil {
+		log.Fatalf("Could not initialize SOAP envelope builder: %v", err)
+	}
+	s.envelope = envelope
+
+	updatesEnabled, err := orderUpdatesEnabled(envelope)
+	if err != nil {
+		log.Fatalf("Could not configure order updates: %v", err)
+	}
+	if !updatesEnabled {
+		delete(s.topics, TopicOrdersUpdated)
+	}
+	log.Printf("Order updates: %t", updatesEnabled)
+
+	dedupe, err := NewDedupeStore()
+	if err != nil {
+		log.Fatalf("Could not initialize deduplication store: %v", err)
+	}
+	s.dedupe = dedupe
+
+	orderMap, err := NewOrderMapStore()
+	if err != nil {
+		log.Fatalf("Could not initialize order mapping store: %v", err)
+	}
+	s.orderMap = orderMap
+
+	sentOrders, err := NewSentOrderStore()
+	if err != nil {
+		log.Fatalf("Could not initialize sent order store: %v", err)
+	}
+	s.sentOrders = sentOrders
+
+	items, err := NewItemMap()
+	if err != nil {
+		log.Fatalf("Could not initialize item map: %v", err)
+	}
+	s.items = items
+	log.Printf("Item map: %s", items.Describe())
+
+	customers, err := NewCustomerMapStore()
+	if err != nil {
+		log.Fatalf("Could not initialize customer mapping store: %v", err)
+	}
+	s.customers = customers
+	log.Printf("Customer resolution: %s", customers.Describe())
+
+	contact, err := NewContactPolicy()
+	if err != nil {
+		log.Fatalf("Could not configure customer data policy: %v", err)
+	}
+	s.contact = contact
+	log.Printf("Customer data: %s", contact.Describe())
+
+	validator, err := NewValidator()
+	if err != nil {
+		log.Fatalf("Could not initialize order validation: %v", err)
+	}
+	s.validator = validator
+	log.Printf("Order validation: %s", validator.Describe())
+
+	review, err := NewReviewStore()
+	if err != nil {
+		log.Fatalf("Could not initialize review store: %v", err)
+	}
+	s.review = review
+
+	deadLetters, err := NewDeadLetterStore()
+	if err != nil {
+		log.Fatalf("Could not initialize dead-letter store: %v", err)
+	}
+	s.deadLetters = deadLetters
+
+	cancels, err := NewPendingWebhookStore("cancel")
+	if err != nil {
+		log.Fatalf("Could not initialize cancellation store: %v", err)
+	}
+	s.cancels = cancels
+
+	updates, err := NewPendingWebhookStore("update")
+	if err != nil {
+		log.Fatalf("Could not initialize pending update store: %v", err)
+	}
+	s.updates = updates
+
+	refunds, err := NewPendingWebhookStore("refund")
+	if err != nil {
+		log.Fatalf("Could not initialize pending refund store: %v", err)
+	}
+	s.refunds = refunds
+
+	queue, err := NewOrderQueue(s.processQueuedOrder)
+	if err != nil {
+		log.Fatalf("Could not initialize order queue: %v", err)
+	}
+	queue.OnFailure(s.deadLetterFailedJob)
+	s.queue = queue
+
+	return s
+}
+
+// createSOAPEnvelope creates a SOAP XML envelope for the ERP order.
+// The layout is configured through EnvelopeBuilder, see envelope.go.
+func (s *Server) createSOAPEnvelope(erpOrder *ERPOrder) (string, error) {
+	return s.envelope.Build(erpOrder)
+}
+
+// transformOrder converts Shopify order to ERP format. Amounts are rounded to
+// the currency's minor units; totals that do not reconcile are listed on the
+// ERP order and enforced by checkReconciliation.
 func (s *Server) transformOrder(shopifyOrder *ShopifyOrder) *ERPOrder {
-	// Transform line items
-	items := make([]ERPItem, len(shopifyOrder.LineItems))
-	for i, item := range shopifyOrder.LineItems {
-		items[i] = ERPItem{
-			SKU:          item.SKU,
-			ProductName:  item.Title,
-			Quantity:     item.Quantity,
-			UnitPrice:    item.Price,
-			VariantTitle: item.VariantTitle,
+	digits := currencyDigits(shopifyOrder.Currency)
+
+	// Transform line items; lines removed by an order edit are left out
+	items := make([]ERPItem, 0, len(shopifyOrder.LineItems))
+	for _, item := range shopifyOrder.LineItems {
+		quantity := editedQuantity(shopifyOrder, item)
+		if quantity <= 0 {
+			continue
+		}
+		mapping, mapped := s.items.Resolve(item.SKU, item.VariantID)
+		items = append(items, ERPItem{
+			LineID:         fmt.Sprintf("%d", item.ID),
+			SKU:            item.SKU,
+			ItemID:         mapping.ItemID,
+			InventDim:      mapping.ERPInventDim,
+			Unmapped:       !mapped,
+			ProductName:    item.Title,
+			Quantity:       quantity,
+			UnitPrice:      item.Price.Round(digits),
+			VariantTitle:   item.VariantTitle,
+			DiscountAmount: item.TotalDiscount.Round(digits),
+			TaxLines:       transformTaxLines(item.TaxLines, digits),
+		})
+	}
+
+	// Transform discount codes and shipping lines
+	discounts := make([]ERPDiscount, len(shopifyOrder.DiscountCodes))
+	for i, discount := range shopifyOrder.DiscountCodes {
+		discounts[i] = ERPDiscount{
+			Code:   discount.Code,
+			Type:   discount.Type,
+			Amount: discount.Amount.Round(digits),
 		}
 	}
 
-	// Transform addresses
-	shippingAddr := ERPAddress{
-		Name:         fmt.Sprintf("%s %s", shopifyOrder.ShippingAddress.FirstName, shopifyOrder.ShippingAddress.LastName),
-		Company:      shopifyOrder.ShippingAddress.Company,
-		AddressLine1: shopifyOrder.ShippingAddress.Address1,
-		AddressLine2: shopifyOrder.ShippingAddress.Address2,
-		City:         shopifyOrder.ShippingAddress.City,
-		State:        shopifyOrder.ShippingAddress.Province,
-		PostalCode:   shopifyOrder.ShippingAddress.Zip,
-		Country:      shopifyOrder.ShippingAddress.Country,
-		Phone:        shopifyOrder.ShippingAddress.Phone,
-	}
-
-	billingAddr := ERPAddress{
-		Name:         fmt.Sprintf("%s %s", shopifyOrder.BillingAddress.FirstName, shopifyOrder.BillingAddress.LastName),
-		Company:      shopifyOrder.BillingAddress.Company,
-		AddressLine1: shopifyOrder.BillingAddress.Address1,
-		AddressLine2: shopifyOrder.BillingAddress.Address2,
-		City:         shopifyOrder.BillingAddress.City,
-		State:        shopifyOrder.BillingAddress.Province,
-		PostalCode:   shopifyOrder.BillingAddress.Zip,
-		Country:      shopifyOrder.BillingAddress.Country,
-		Phone:        shopifyOrder.BillingAddress.Phone,
-	}
-
-	return &ERPOrder{
+	charges := make([]ERPCharge, len(shopifyOrder.ShippingLines))
+	for i, shipping := range shopifyOrder.ShippingLines {
+		charges[i] = transformShippingLine(shipping, digits)
+	}
+
+	// Transform addresses; orders are invoiced to the delivery address when
+	// there is no billing address
+	shippingAddr := transformAddress(shopifyOrder.ShippingAddress)
+	billingAddr := transformAddress(shopifyOrder.BillingAddress)
+	if billingAddr == nil {
+		billingAddr = shippingAddr
+	}
+	if shippingAddr == nil && shopifyOrder.requiresShipping() && s.contact.MissingShipping == ContactEnrich {
+		shippingAddr = billingAddr
+	}
+
+	erpOrder := &ERPOrder{
 		OrderID:           fmt.Sprintf("%d", shopifyOrder.ID),
 		OrderNumber:       fmt.Sprintf("%d", shopifyOrder.OrderNumber),
-		CustomerEmail:     shopifyOrder.Email,
-		CustomerName:      fmt.Sprintf("%s %s", shopifyOrder.Customer.FirstName, shopifyOrder.Customer.LastName),
-		CustomerPhone:     shopifyOrder.Customer.Phone,
+		CustomerEmail:     shopifyOrder.contactEmail(),
+		CustomerName:      shopifyOrder.contactName(),
+		CustomerPhone:     shopifyOrder.contactPhone(),
 		OrderDate:         shopifyOrder.CreatedAt,
-		TotalAmount:       shopifyOrder.TotalPrice,
-		SubtotalAmount:    shopifyOrder.SubtotalPrice,
-		TaxAmount:         shopifyOrder.TotalTax,
+		TotalAmount:       shopifyOrder.TotalPrice.Round(digits),
+		SubtotalAmount:    shopifyOrder.SubtotalPrice.Round(digits),
+		TaxAmount:         shopifyOrder.TotalTax.Round(digits),
+		DiscountAmount:    shopifyOrder.TotalDiscounts.Round(digits),
 		Currency:          shopifyOrder.Currency,
 		PaymentStatus:     shopifyOrder.FinancialStatus,
 		FulfillmentStatus: shopifyOrder.FulfillmentStatus,
 		Items:             items,
+		Discounts:         discounts,
+		Charges:           charges,
+		TaxLines:          transformTaxLines(shopifyOrder.TaxLines, digits),
 		ShippingAddress:   shippingAddr,
 		BillingAddress:    billingAddr,
 		Timestamp:         time.Now().UTC().Format(time.RFC3339),
 	}
+	if s.reconcile.Mode != ReconcileOff {
+		erpOrder.Reconciliation = s.reconcile.Check(shopifyOrder)
+	}
+	return erpOrder
 }
 
-// sendToERP sends the transformed order to the ERP system with retry logic
-func (s *Server) sendToERP(erpOrder *ERPOrder, requestID string) error {
-	// Get ERP endpoint from environment variable or use default
-	erpEndpoint := os.Getenv("ERP_ENDPOINT")
-	if erpEndpoint == "" {
-		erpEndpoint = DefaultERPEndpoint
+// transformShippingLine converts a Shopify shipping line to a misc charge
+func transformShippingLine(shipping ShippingLine, digits int) ERPCharge {
+	return ERPCharge{
+		Code:           shipping.Code,
+		Title:          shipping.Title,
+		Amount:         shipping.chargedPrice().Round(digits),
+		DiscountAmount: shipping.Price.Sub(shipping.chargedPrice()).Round(digits),
+		Carrier:        shipping.CarrierIdentifier,
+		TaxLines:       transformTaxLines(shipping.TaxLines, digits),
 	}
+}
 
-	// Get SOAP Action from environment variable or use default
-	soapAction := os.Getenv("SOAP_ACTION")
-	if soapAction == "" {
-		soapAction = SOAPAction
+// chargedPrice is the shipping price after shipping discounts
+func (l ShippingLine) chargedPrice() Money {
+	if l.DiscountedPrice == nil {
+		return l.Price
 	}
+	return *l.DiscountedPrice
+}
 
+// transformTaxLines converts Shopify tax lines
+func transformTaxLines(taxLines []TaxLine, digits int) []ERPTaxLine {
+	lines := make([]ERPTaxLine, len(taxLines))
+	for i, tax := range taxLines {
+		lines[i] = ERPTaxLine{
+			Title:  tax.Title,
+			Rate:   tax.Rate.String(),
+			Amount: tax.Price.Round(digits),
+		}
+	}
+	return lines
+}
+
+// ERPAttempt records the outcome of a single delivery attempt
+type ERPAttempt struct {
+	Attempt    int    `json:"attempt"`
+	Timestamp  string `json:"timestamp"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Class      string `json:"class,omitempty"`
+	Response   string `json:"response,omitempty"`
+}
+
+// ERPDelivery describes what was sent to the ERP and how each attempt went
+type ERPDelivery struct {
+	Envelope    string       `json:"envelope"`
+	Attempts    []ERPAttempt `json:"attempts"`
+	SalesID     string       `json:"sales_id,omitempty"`
+	SalesStatus string       `json:"sales_status,omitempty"`
+	AccountNum  string       `json:"account_num,omitempty"` // customer account returned by customer operations
+}
+
+// sendToERP sends the transformed order to the ERP system with retry logic
+func (s *Server) sendToERP(erpOrder *ERPOrder, requestID string) (*ERPDelivery, error) {
 	// Create SOAP XML envelope
-	soapXML := s.createSOAPEnvelope(erpOrder)
+	soapXML, err := s.createSOAPEnvelope(erpOrder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build SOAP envelope: %w", err)
+	}
+
+	return s.deliverSOAP(s.envelope.Destination(DestinationCreateOrder), soapXML, erpOrder.OrderID, requestID)
+}
+
+// deliverSOAP posts an envelope to a destination, retrying according to the
+// class of each failure. It is shared by every operation sent to the ERP.
+func (s *Server) deliverSOAP(destination *Destination, soapXML, orderID, requestID string) (*ERPDelivery, error) {
+	// Get ERP endpoint and SOAP Action of the destination
+	erpEndpoint := destination.Endpoint
+	soapAction := destination.Action
+
+	// Get the response element carrying the AX SalesId
+	salesIDElement := os.Getenv("ERP_SALES_ID_ELEMENT")
+	if salesIDElement == "" {
+		salesIDElement = DefaultSalesIDElement
+	}
 
-	for attempt := 1; attempt <= MaxRetries; attempt++ {
-		req, err := http.NewRequest("POST", erpEndpoint, bytes.NewBufferString(soapXML))
+	delivery := &ERPDelivery{Envelope: soapXML}
+
+	for attempt := 1; ; attempt++ {
+		// Addressing and security headers are added per attempt so timestamps stay valid across retries
+		payload, err := destination.AddHeaders(soapXML, soapAction)
+		if err != nil {
+			return delivery, fmt.Errorf("failed to add SOAP security headers: %w", err)
+		}
+
+		req, err := http.NewRequest("POST", erpEndpoint, bytes.NewBufferString(payload))
 		if err != nil {
-			return fmt.Errorf("failed to create request: %w", err)
+			return delivery, fmt.Errorf("failed to create request: %w", err)
 		}
 
-		// Set SOAP headers
-		req.Header.Set("Content-Type", "text/xml; charset=utf-8")
-		req.Header.Set("SOAPAction", fmt.Sprintf(`"%s"`, soapAction))
+		// Set SOAP headers for the destination's SOAP version
+		destination.SetHeaders(req.Header, soapAction)
 		req.Header.Set("User-Agent", "Shopify-ERP-Middleware/1.0")
 
-		// Log outgoing SOAP request
-		s.logger.LogOutgoingSOAP(requestID, erpEndpoint, req.Header, soapXML, erpOrder.OrderID)
+		// Log outgoing SOAP request, without the security header that carries credentials
+		s.logger.LogOutgoingSOAP(requestID, erpEndpoint, req.Header, soapXML, orderID)
 		
 		log.Printf("[%s] Sending SOAP request to %s (attempt %d)", requestID, erpEndpoint, attempt)
 
+		record := ERPAttempt{
+			Attempt:   attempt,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+		}
+
+		var erpErr *ERPError
 		resp, err := s.httpClient.Do(req)
 		if err != nil {
-			log.Printf("[%s] Attempt %d failed: %v", requestID, attempt, err)
-			s.logger.LogSOAPResponse(requestID, 0, nil, "", erpOrder.OrderID, err)
+			s.logger.LogSOAPResponse(requestID, 0, nil, "", orderID, "", err)
+			erpErr = classifyTransportError(err)
+		} else {
+			// Read response body
+			responseBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			responseStr := string(responseBody)
+
+			// Interpret SOAP faults and AX infolog errors, which may arrive with any status
+			result := parseSOAPResponse(resp.StatusCode, responseBody)
 			
-			if attempt < MaxRetries {
-				time.Sleep(RetryDelay * time.Duration(attempt))
-				continue
+			// Log SOAP response
+			s.logger.LogSOAPResponse(requestID, resp.StatusCode, resp.Header, responseStr, orderID, result.FaultReason(), nil)
+
+			record.StatusCode = resp.StatusCode
+			record.Response = responseStr
+
+			erpErr = classifyResponse(resp.StatusCode, resp.Header, result)
+			if erpErr == nil {
+				delivery.Attempts = append(delivery.Attempts, record)
+				delivery.SalesID = result.SalesID(salesIDElement)
+				delivery.SalesStatus = result.SalesStatus()
+				delivery.AccountNum = result.AccountNum()
+				log.Printf("[%s] Successfully sent %s for order %s to ERP (attempt %d)", requestID, destination.Name, orderID, attempt)
+				log.Printf("[%s] ERP response: %s", requestID, responseStr)
+				return delivery, nil
 			}
-			return fmt.Errorf("failed to send request after %d attempts: %w", MaxRetries, err)
 		}
 
-		defer resp.Body.Close()
+		record.Error = erpErr.Error()
+		record.Class = string(erpErr.Class)
+		delivery.Attempts = append(delivery.Attempts, record)
 
-		// Read response body
-		responseBody, _ := io.ReadAll(resp.Body)
-		responseStr := string(responseBody)
-		
-		// Log SOAP response
-		s.logger.LogSOAPResponse(requestID, resp.StatusCode, resp.Header, responseStr, erpOrder.OrderID, nil)
+		log.Printf("[%s] Attempt %d failed: %v", requestID, attempt, erpErr)
 
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			log.Printf("[%s] Successfully sent order %s to ERP (attempt %d)", requestID, erpOrder.OrderID, attempt)
-			log.Printf("[%s] ERP response: %s", requestID, responseStr)
-			return nil
+		// Permanent failures go straight to the dead-letter store
+		if !erpErr.Retryable() {
+			return delivery, fmt.Errorf("ERP rejected order permanently: %w", erpErr)
 		}
-
-		log.Printf("[%s] Attempt %d failed with status %d: %s", requestID, attempt, resp.StatusCode, responseStr)
-
-		if attempt < MaxRetries {
-			time.Sleep(RetryDelay * time.Duration(attempt))
+		if attempt >= erpErr.Policy().MaxAttempts {
+			return delivery, fmt.Errorf("failed to send order to ERP after %d attempts: %w", attempt, erpErr)
 		}
-	}
 
-	return fmt.Errorf("failed to send order to ERP after %d attempts", MaxRetries)
+		delay := erpErr.Backoff(attempt)
+		log.Printf("[%s] Retrying in %s", requestID, delay)
+		time.Sleep(delay)
+	}
 }
 
 // handleWebhook handles incoming Shopify webhooks
@@ -500,57 +814,206 @@ func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Log the webhook topic for debugging
+	// Reject requests that were not signed by Shopify
+	if err := s.verifier.Verify(body, r.Header.Get("X-Shopify-Hmac-Sha256")); err != nil {
+		log.Printf("[%s] Rejected webhook from %s: %v", requestID, r.RemoteAddr, err)
+		s.logger.LogRejectedWebhook(requestID, r.RemoteAddr, r.Header, len(body), err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Route by topic; Shopify always sends one
 	webhookTopic := r.Header.Get("X-Shopify-Topic")
+	if webhookTopic == "" {
+		err := errors.New("missing X-Shopify-Topic header")
+		log.Printf("[%s] Rejected webhook from %s: %v", requestID, r.RemoteAddr, err)
+		s.logger.LogRejectedWebhook(requestID, r.RemoteAddr, r.Header, len(body), err)
+		http.Error(w, "Missing X-Shopify-Topic header", http.StatusBadRequest)
+		return
+	}
 	log.Printf("[%s] Received webhook: %s", requestID, webhookTopic)
 
-	// Parse the Shopify order
-	var shopifyOrder ShopifyOrder
-	if err := json.Unmarshal(body, &shopifyOrder); err != nil {
-		log.Printf("[%s] Error parsing Shopify order: %v", requestID, err)
+	// Acknowledge topics we do not handle so Shopify stops retrying them
+	if _, ok := s.topics[webhookTopic]; !ok {
+		log.Printf("[%s] Ignoring webhook: unsupported topic %q", requestID, webhookTopic)
+		s.logger.LogIgnoredWebhook(requestID, webhookTopic, r.Header, len(body))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":     "ignored",
+			"topic":      webhookTopic,
+			"request_id": requestID,
+			"message":    "Webhook topic is not handled by this service",
+		})
+		return
+	}
+
+	// Find the Shopify order the webhook refers to
+	payload, orderID, err := parseWebhookPayload(webhookTopic, body)
+	if err != nil {
+		log.Printf("[%s] Error parsing %s payload: %v", requestID, webhookTopic, err)
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	orderID := fmt.Sprintf("%d", shopifyOrder.ID)
-	log.Printf("[%s] Processing order ID: %d, Order Number: %d", requestID, shopifyOrder.ID, shopifyOrder.OrderNumber)
+	log.Printf("[%s] Processing %s for order ID: %s, Order Number: %d", requestID, webhookTopic, orderID, payload.OrderNumber)
 
 	// Log incoming webhook
 	s.logger.LogIncomingWebhook(requestID, r.Header, body, orderID)
 
-	// Transform the order for ERP
-	erpOrder := s.transformOrder(&shopifyOrder)
+	// Shopify delivers webhooks at least once, so skip anything already seen.
+	// Only order creation is also deduplicated by order ID.
+	webhookID := r.Header.Get("X-Shopify-Webhook-Id")
+	dedupeID := dedupeOrderID(webhookTopic, orderID)
+	if previous, claimed := s.dedupe.Claim(webhookID, dedupeID, requestID); !claimed {
+		log.Printf("[%s] Duplicate delivery of %s for order %s (original request %s, status %s)", requestID, webhookTopic, orderID, previous.RequestID, previous.Status)
 
-	// Send to ERP system
-	if err := s.sendToERP(erpOrder, requestID); err != nil {
-		log.Printf("[%s] Error sending order to ERP: %v", requestID, err)
+		response := map[string]string{
+			"status":              "duplicate",
+			"topic":               webhookTopic,
+			"order_id":            orderID,
+			"request_id":          requestID,
+			"original_request_id": previous.RequestID,
+			"delivery_status":     previous.Status,
+			"message":             "Webhook already received, not processed again",
+		}
+		if previous.SalesID != "" {
+			response["sales_id"] = previous.SalesID
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Persist the order so it survives restarts, then acknowledge immediately.
+	// Delivery to the ERP happens in the queue workers.
+	job := &QueuedOrder{
+		ID:         requestID,
+		RequestID:  requestID,
+		Topic:      webhookTopic,
+		WebhookID:  webhookID,
+		ShopDomain: r.Header.Get("X-Shopify-Shop-Domain"),
+		OrderID:    orderID,
+		ReceivedAt: time.Now().UTC().Format(time.RFC3339),
+		Body:       json.RawMessage(body),
+	}
+	if err := s.queue.Enqueue(job); err != nil {
+		log.Printf("[%s] Error queueing order: %v", requestID, err)
+		s.dedupe.Release(webhookID, dedupeID)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	// Respond with success
 	response := map[string]string{
-		"status":     "success",
+		"status":     "queued",
+		"topic":      webhookTopic,
 		"order_id":   orderID,
 		"request_id": requestID,
-		"message":    "Order successfully sent to ERP",
+		"message":    "Webhook queued for processing",
+	}
+	if mapping, err := s.orderMap.ByShopifyOrder(orderID); err == nil {
+		response["sales_id"] = mapping.SalesID
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 	
-	log.Printf("[%s] Successfully processed order %s", requestID, orderID)
+	log.Printf("[%s] Queued %s for order %s", requestID, webhookTopic, orderID)
+}
+
+// processOrderCreate transforms a queued Shopify order and sends it to the ERP.
+// Orders that cannot be delivered are moved to the dead-letter store.
+func (s *Server) processOrderCreate(job *QueuedOrder) error {
+	var shopifyOrder ShopifyOrder
+	if err := json.Unmarshal(job.Body, &shopifyOrder); err != nil {
+		err = fmt.Errorf("failed to parse queued order: %w", err)
+		s.dedupe.MarkFailed(job.WebhookID, job.OrderID, job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+
+	// A job may be retried after a crash, never send an order twice
+	if previous, delivered := s.dedupe.Delivered(job.OrderID); delivered {
+		log.Printf("[%s] Order %s already delivered by request %s, skipping", job.RequestID, job.OrderID, previous.RequestID)
+		return nil
+	}
+
+	// The order was cancelled in Shopify before it reached AX
+	if s.dedupe.CancelRequested(job.OrderID) {
+		log.Printf("[%s] Order %s was cancelled before it was sent to ERP, skipping", job.RequestID, job.OrderID)
+		s.dedupe.MarkCancelled(job.WebhookID, job.OrderID, job.RequestID)
+		s.cancels.Take(job.OrderID) // the cancellation needs no further action
+		s.updates.Take(job.OrderID)
+		s.refunds.TakeAll(job.OrderID)
+		if err := s.deadLetters.Delete(job.ID); err != nil {
+			log.Printf("[%s] Error removing resolved dead letter: %v", job.RequestID, err)
+		}
+		return nil
+	}
+
+	// Transform the order for ERP
+	erpOrder := s.transformOrder(&shopifyOrder)
+	if review, err := s.validateOrder(&shopifyOrder, erpOrder, job.RequestID); err != nil {
+		if review {
+			return s.holdOrder(job, erpOrder, err.Error())
+		}
+		s.dedupe.MarkFailed(job.WebhookID, job.OrderID, job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+	if err := s.checkReconciliation(erpOrder, job.RequestID); err != nil {
+		s.dedupe.MarkFailed(job.WebhookID, job.OrderID, job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+	if err := s.checkItemMapping(erpOrder, job.RequestID); err != nil {
+		if s.items.Policy() == UnmappedHold {
+			return s.holdOrder(job, erpOrder, err.Error())
+		}
+		s.dedupe.MarkFailed(job.WebhookID, job.OrderID, job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+	if err := s.checkContact(&shopifyOrder, erpOrder, job.RequestID); err != nil {
+		return s.holdOrder(job, erpOrder, err.Error())
+	}
+	if err := s.resolveCustomer(&shopifyOrder, erpOrder, job.RequestID); err != nil {
+		s.dedupe.MarkFailed(job.WebhookID, job.OrderID, job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+
+	// Send to ERP system
+	delivery, err := s.sendToERP(erpOrder, job.RequestID)
+	if err != nil {
+		s.dedupe.MarkFailed(job.WebhookID, job.OrderID, job.RequestID, err)
+		return s.deadLetters.Add(job, delivery, err)
+	}
+	s.dedupe.MarkDelivered(job.WebhookID, job.OrderID, job.RequestID, delivery.SalesID)
+
+	s.recordCreatedOrder(erpOrder, delivery, job.RequestID)
+
+	// Clear any dead letter left from an earlier failed attempt
+	if err := s.deadLetters.Delete(job.ID); err != nil {
+		log.Printf("[%s] Error removing resolved dead letter: %v", job.RequestID, err)
+	}
+
+	log.Printf("[%s] Successfully processed order %s", job.RequestID, job.OrderID)
+	return nil
 }
 
 // handleHealth handles health check requests
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":    "healthy",
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
-		"service":   "shopify-erp-middleware",
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       "healthy",
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+		"service":      "shopify-erp-middleware",
+		"queue_depth":  s.queue.Depth(),
+		"failed_jobs":  s.queue.Failed(),
+		"dead_letters": s.deadLetters.Count(),
+		"held_orders":  s.review.Count(),
 	})
 }
 
@@ -562,17 +1025,40 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 		"service":     "Shopify to ERP Middleware",
 		"version":     "1.0.0",
 		"description": "Middleware service to forward Shopify orders to Microsoft Dynamics AX 2012",
-		"endpoints": "/webhook (POST) - Shopify webhook handler, /health (GET) - Health check",
+		"endpoints": "/webhook (POST) - Shopify webhook handler, /health (GET) - Health check, /admin/dead-letters (GET) - Failed orders, /admin/review (GET) - Orders held for review, /admin/review/{id}/approve and /reject (POST) - Decide held orders, /admin/replay (POST) - Resend a stored webhook, /admin/orders/{id} and /admin/sales-orders/{sales_id} (GET) - Shopify/AX order lookup (admin endpoints require ADMIN_TOKEN or a per-user token from ADMIN_TOKENS)",
 	})
 }
 
 func main() {
+	// Subcommands such as "replay" talk to a running server and exit
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	server := NewServer()
+	workers := queueWorkers()
+	server.queue.Start(workers)
 
 	// Set up routes
 	http.HandleFunc("/", server.handleRoot)
 	http.HandleFunc("/webhook", server.handleWebhook)
 	http.HandleFunc("/health", server.handleHealth)
+	http.HandleFunc("GET /admin/dead-letters", server.requireAdmin(server.handleListDeadLetters))
+	http.HandleFunc("GET /admin/dead-letters/{id}", server.requireAdmin(server.handleGetDeadLetter))
+	http.HandleFunc("POST /admin/dead-letters/{id}/retry", server.requireAdmin(server.handleRetryDeadLetter))
+	http.HandleFunc("DELETE /admin/dead-letters/{id}", server.requireAdmin(server.handleDeleteDeadLetter))
+	http.HandleFunc("GET /admin/review", server.requireAdmin(server.handleListHeldOrders))
+	http.HandleFunc("GET /admin/review/{id}", server.requireAdmin(server.handleGetHeldOrder))
+	http.HandleFunc("PATCH /admin/review/{id}", server.requireAdmin(server.handleEditHeldOrder))
+	http.HandleFunc("POST /admin/review/{id}/approve", server.requireAdmin(server.handleApproveHeldOrder))
+	http.HandleFunc("POST /admin/review/{id}/reject", server.requireAdmin(server.handleRejectHeldOrder))
+	http.HandleFunc("POST /admin/replay", server.requireAdmin(server.handleReplay))
+	http.HandleFunc("POST /admin/item-map/reload", server.requireAdmin(server.handleReloadItemMap))
+	http.HandleFunc("GET /admin/customers", server.requireAdmin(server.handleListCustomerMappings))
+	http.HandleFunc("PUT /admin/customers", server.requireAdmin(server.handlePutCustomerMapping))
+	http.HandleFunc("DELETE /admin/customers/{key}", server.requireAdmin(server.handleDeleteCustomerMapping))
+	http.HandleFunc("GET /admin/orders/{order_id}", server.requireAdmin(server.handleGetOrderMapping))
+	http.HandleFunc("GET /admin/sales-orders/{sales_id}", server.requireAdmin(server.handleGetSalesOrderMapping))
 
 	// Get port from environment variable (DigitalOcean App Platform requirement)
 	port := os.Getenv("PORT")
@@ -580,17 +1066,10 @@ func main() {
 		port = "8080"
 	}
 
-	// Get ERP endpoint
-	erpEndpoint := os.Getenv("ERP_ENDPOINT")
-	if erpEndpoint == "" {
-		erpEndpoint = DefaultERPEndpoint
-	}
-
-	// Get SOAP Action
-	soapAction := os.Getenv("SOAP_ACTION")
-	if soapAction == "" {
-		soapAction = SOAPAction
-	}
+	// Get the ERP endpoint and SOAP Action new orders are sent to
+	createOrder := server.envelope.Destination(DestinationCreateOrder)
+	erpEndpoint := createOrder.Endpoint
+	soapAction := createOrder.Action
 
 	// Get log directory
 	logDir := os.Getenv("LOG_DIR")
@@ -604,9 +1083,16 @@ func main() {
 	log.Printf("Health check endpoint: /health")
 	log.Printf("ERP endpoint: %s", erpEndpoint)
 	log.Printf("SOAP Action: %s", soapAction)
+	log.Printf("SOAP version: %s", createOrder.SOAPVersion)
+	log.Printf("WS-Security: %s", createOrder.Security.Describe())
+	log.Printf("Webhook signature verification: %t", server.verifier.Enabled())
 	log.Printf("Log directory: %s", logDir)
+	log.Printf("Data directory: %s", dataDir())
+	log.Printf("Queue workers: %d", workers)
+	log.Printf("Deduplication retention: %s", server.dedupe.Retention())
 	log.Printf("Log files:")
 	log.Printf("  - Incoming webhooks: %s/YYYY-MM-DD_incoming_webhook.log", logDir)
+	log.Printf("  - Rejected webhooks: %s/YYYY-MM-DD_rejected_webhook.log", logDir)
 	log.Printf("  - Outgoing SOAP: %s/YYYY-MM-DD_outgoing_soap.log", logDir)
 	log.Printf("  - SOAP responses: %s/YYYY-MM-DD_soap_response.log", logDir)
 
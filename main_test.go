@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Settings cleared for test servers so the developer's environment does not leak in
+var testServerEnv = []string{
+	"SHOPIFY_WEBHOOK_SECRET", "SHOPIFY_WEBHOOK_SECRET_PREVIOUS", "ERP_AUTH", "ERP_SALES_ID_ELEMENT",
+	"ERP_TLS_CERT_FILE", "ERP_TLS_KEY_FILE", "ERP_TLS_CA_FILE", "ERP_TLS_MIN_VERSION", "ERP_TLS_SERVER_NAME",
+	"SOAP_ENVELOPE_CONFIG", "SOAP_FORMAT", "SOAP_TEMPLATE", "SOAP_VERSION", "SOAP_ADDRESSING", "WSSE_USERNAME",
+	"CUSTOMER_LOOKUP", "CUSTOMER_DEFAULT_ACCOUNT", "CUSTOMER_GROUP", "ITEM_MAP_FILE", "ITEM_MAP_UNMAPPED",
+	"VALIDATION_CONFIG", "VALIDATION_CURRENCIES", "RECONCILE_MODE", "RECONCILE_TOLERANCE",
+	"GUEST_ORDERS", "MISSING_SHIPPING_ADDRESS", "DEDUPE_RETENTION", "ADMIN_TOKEN", "ADMIN_TOKENS", "ORDER_UPDATES",
+}
+
+// fakeERP is an ERP endpoint that records requests. It answers with
+// responses in turn, then with response.
+type fakeERP struct {
+	mu        sync.Mutex
+	status    int
+	response  string
+	responses []string
+	requests  []string
+	actions   []string
+}
+
+func (f *fakeERP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, string(body))
+	f.actions = append(f.actions, r.Header.Get("SOAPAction"))
+	response := f.response
+	if len(f.responses) > 0 {
+		response, f.responses = f.responses[0], f.responses[1:]
+	}
+	w.WriteHeader(f.status)
+	io.WriteString(w, response)
+}
+
+// Requests returns the bodies received so far
+func (f *fakeERP) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+// Actions returns the SOAPAction headers received so far
+func (f *fakeERP) Actions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.actions...)
+}
+
+const fakeERPCreated = `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><CreateOrderResponse><SalesId>SO-1</SalesId></CreateOrderResponse></s:Body></s:Envelope>`
+
+// newTestServer builds a server with state in temporary directories that
+// talks to a fake ERP. env adds settings on top of a clean environment.
+func newTestServer(t *testing.T, env map[string]string) (*Server, *fakeERP) {
+	t.Helper()
+
+	erp := &fakeERP{status: http.StatusOK, response: fakeERPCreated}
+	endpoint := httptest.NewServer(erp)
+	t.Cleanup(endpoint.Close)
+
+	for _, key := range testServerEnv {
+		t.Setenv(key, "")
+	}
+	t.Setenv("WEBHOOK_VERIFY", "off")
+	t.Setenv("DATA_DIR", t.TempDir())
+	t.Setenv("LOG_DIR", t.TempDir())
+	t.Setenv("ERP_ENDPOINT", endpoint.URL)
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		if t.Failed() {
+			t.Log(output.String())
+		}
+	})
+
+	return NewServer(), erp
+}
+
+func TestTransformOrderChargesAndTaxes(t *testing.T) {
+	tests := []struct {
+		name          string
+		payload       string
+		wantDiscounts []ERPDiscount
+		wantCharges   []ERPCharge
+		wantTaxLines  []ERPTaxLine
+		wantLineDisc  string // total discount of the first line
+		wantEnvelope  []string
+	}{
+		{
+			name:         "plain order",
+			payload:      `{"id": 1, "currency": "EUR", "line_items": [{"id": 1, "sku": "A", "quantity": 1, "price": "10.00"}]}`,
+			wantLineDisc: "0.00",
+		},
+		{
+			name: "discount code and line discount",
+			payload: `{"id": 1, "currency": "EUR", "discount_codes": [{"code": "SPRING10", "amount": "5.00", "type": "percentage"}],
+				"line_items": [{"id": 1, "sku": "A", "quantity": 2, "price": "25.00", "total_discount": "5.00"}]}`,
+			wantDiscounts: []ERPDiscount{{Code: "SPRING10", Type: "percentage", Amount: MustParseMoney("5.00")}},
+			wantLineDisc:  "5.00",
+			wantEnvelope:  []string{"Code>SPRING10<", "DiscountAmount>5.00<"},
+		},
+		{
+			name: "shipping discount is deducted from the charge",
+			payload: `{"id": 1, "currency": "EUR", "line_items": [{"id": 1, "sku": "A", "quantity": 1, "price": "10.00"}],
+				"shipping_lines": [{"id": 9, "code": "STD", "title": "Standard", "price": "6.90", "discounted_price": "4.90", "carrier_identifier": "dhl",
+				"tax_lines": [{"title": "VAT", "price": "0.78", "rate": 0.19}]}]}`,
+			wantCharges: []ERPCharge{{
+				Code: "STD", Title: "Standard", Amount: MustParseMoney("4.90"), DiscountAmount: MustParseMoney("2.00"), Carrier: "dhl",
+				TaxLines: []ERPTaxLine{{Title: "VAT", Rate: "0.19", Amount: MustParseMoney("0.78")}},
+			}},
+			wantLineDisc: "0.00",
+			wantEnvelope: []string{"Amount>4.90<", "DiscountAmount>2.00<", "Carrier>dhl<"},
+		},
+		{
+			name: "older payload without discounted price",
+			payload: `{"id": 1, "currency": "EUR", "line_items": [{"id": 1, "sku": "A", "quantity": 1, "price": "10.00"}],
+				"shipping_lines": [{"id": 9, "code": "STD", "title": "Standard", "price": "6.90"}]}`,
+			wantCharges:  []ERPCharge{{Code: "STD", Title: "Standard", Amount: MustParseMoney("6.90"), DiscountAmount: MustParseMoney("0.00"), TaxLines: []ERPTaxLine{}}},
+			wantLineDisc: "0.00",
+		},
+		{
+			name: "order tax lines with a string rate",
+			payload: `{"id": 1, "currency": "EUR", "tax_lines": [{"title": "VAT", "price": "1.90", "rate": "0.19"}],
+				"line_items": [{"id": 1, "sku": "A", "quantity": 1, "price": "10.00"}]}`,
+			wantTaxLines: []ERPTaxLine{{Title: "VAT", Rate: "0.19", Amount: MustParseMoney("1.90")}},
+			wantLineDisc: "0.00",
+			wantEnvelope: []string{"Rate>0.19<", "Amount>1.90<"},
+		},
+		{
+			name:         "amounts are rounded to the currency",
+			payload:      `{"id": 1, "currency": "JPY", "line_items": [{"id": 1, "sku": "A", "quantity": 1, "price": "1000", "total_discount": "100.4"}]}`,
+			wantLineDisc: "100",
+			wantEnvelope: []string{"UnitPrice>1000<"},
+		},
+	}
+
+	s, _ := newTestServer(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var order ShopifyOrder
+			if err := json.Unmarshal([]byte(tt.payload), &order); err != nil {
+				t.Fatal(err)
+			}
+			erpOrder := s.transformOrder(&order)
+
+			// A nil want stands for no entries; the ERP order always has a list
+			assertJSON := func(field string, got, want interface{}) {
+				t.Helper()
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(want)
+				if string(wantJSON) == "null" {
+					wantJSON = []byte("[]")
+				}
+				if string(gotJSON) != string(wantJSON) {
+					t.Errorf("%s = %s, want %s", field, gotJSON, wantJSON)
+				}
+			}
+			assertJSON("discounts", erpOrder.Discounts, tt.wantDiscounts)
+			assertJSON("charges", erpOrder.Charges, tt.wantCharges)
+			assertJSON("tax lines", erpOrder.TaxLines, tt.wantTaxLines)
+			if got := erpOrder.Items[0].DiscountAmount.String(); got != tt.wantLineDisc {
+				t.Errorf("line discount = %s, want %s", got, tt.wantLineDisc)
+			}
+
+			envelope, err := s.createSOAPEnvelope(erpOrder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.wantEnvelope {
+				if !strings.Contains(envelope, want) {
+					t.Errorf("envelope is missing %s:\n%s", want, envelope)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Test suite of RFC 1320 appendix A.5
+func TestMD4Sum(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "31d6cfe0d16ae931b73c59d7e0c089c0"},
+		{in: "a", want: "bde52cb31de33e46245e05fbdbd6fb24"},
+		{in: "abc", want: "a448017aaf21d8525fc10ae87aa6729d"},
+		{in: "message digest", want: "d9130a8164549fe818874806e1c7014b"},
+		{in: "abcdefghijklmnopqrstuvwxyz", want: "d79e1c308aa5bbcdeea8ed63df412da9"},
+		{in: "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789", want: "043f8582f241db351ce627e153e7f0e4"},
+		{in: "12345678901234567890123456789012345678901234567890123456789012345678901234567890", want: "e33b4ddc9c38f2199c3e7b164fcc0536"},
+	}
+
+	for _, tt := range tests {
+		sum := md4Sum([]byte(tt.in))
+		if got := hex.EncodeToString(sum[:]); got != tt.want {
+			t.Errorf("md4Sum(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
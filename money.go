@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// moneyScale is the number of decimals Money keeps internally. It covers every
+// ISO 4217 minor unit and the extra precision of Shopify's presentment prices.
+const moneyScale = 6
+
+var moneyFactor = pow10(moneyScale)
+
+// Money is an exact decimal amount. It is parsed from Shopify's string or
+// number amounts and formatted with a fixed number of decimals, so amounts
+// never pass through floating point.
+type Money struct {
+	units  int64 // amount in 10^-moneyScale units
+	places int   // decimals printed by String
+}
+
+// ParseMoney parses a decimal amount such as "12.50" or "-3". An empty string is zero.
+func ParseMoney(value string) (Money, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return Money{places: 2}, nil
+	}
+
+	digits := value
+	negative := false
+	if digits[0] == '-' || digits[0] == '+' {
+		negative = digits[0] == '-'
+		digits = digits[1:]
+	}
+
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if whole == "" && fraction == "" || !isDigits(whole) || !isDigits(fraction) {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+	if len(fraction) > moneyScale {
+		return Money{}, fmt.Errorf("invalid amount %q: more than %d decimals", value, moneyScale)
+	}
+
+	var units int64
+	if whole != "" {
+		n, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil || n > (1<<63-1)/moneyFactor {
+			return Money{}, fmt.Errorf("invalid amount %q: out of range", value)
+		}
+		units = n * moneyFactor
+	}
+	if fraction != "" {
+		n, _ := strconv.ParseInt(fraction, 10, 64)
+		units += n * pow10(moneyScale-len(fraction))
+	}
+	if negative {
+		units = -units
+	}
+
+	return Money{units: units, places: max(len(fraction), 2)}, nil
+}
+
+// MustParseMoney parses a constant amount, panicking on invalid input
+func MustParseMoney(value string) Money {
+	m, err := ParseMoney(value)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Add returns m + o, keeping the larger number of decimals
+func (m Money) Add(o Money) Money {
+	return Money{units: m.units + o.units, places: max(m.places, o.places)}
+}
+
+// Sub returns m - o
+func (m Money) Sub(o Money) Money {
+	return m.Add(o.Neg())
+}
+
+// Neg returns -m
+func (m Money) Neg() Money {
+	return Money{units: -m.units, places: m.places}
+}
+
+// Abs returns |m|
+func (m Money) Abs() Money {
+	if m.units < 0 {
+		return m.Neg()
+	}
+	return m
+}
+
+// Mul returns m multiplied by a quantity
+func (m Money) Mul(quantity int) Money {
+	return Money{units: m.units * int64(quantity), places: m.places}
+}
+
+// Div returns m divided by a quantity, rounded half away from zero to m's decimals
+func (m Money) Div(quantity int) Money {
+	if quantity == 0 {
+		return m
+	}
+	return Money{units: roundDiv(m.units, int64(quantity)*m.step()) * m.step(), places: m.places}
+}
+
+// Round rounds half away from zero to the given number of decimals, which
+// are also the decimals String prints
+func (m Money) Round(places int) Money {
+	places = min(max(places, 0), moneyScale)
+	step := pow10(moneyScale - places)
+	return Money{units: roundDiv(m.units, step) * step, places: places}
+}
+
+// Places returns the number of decimals String prints
+func (m Money) Places() int {
+	return m.places
+}
+
+// Cmp compares m and o, returning -1, 0 or +1
+func (m Money) Cmp(o Money) int {
+	switch {
+	case m.units < o.units:
+		return -1
+	case m.units > o.units:
+		return 1
+	}
+	return 0
+}
+
+// Equal reports whether m and o are the same amount, regardless of decimals
+func (m Money) Equal(o Money) bool {
+	return m.units == o.units
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.units == 0
+}
+
+// Sign returns -1, 0 or +1
+func (m Money) Sign() int {
+	return m.Cmp(Money{})
+}
+
+// String formats the amount with its number of decimals, e.g. "12.50".
+// Digits beyond those decimals are rounded.
+func (m Money) String() string {
+	r := m.Round(m.places)
+	units := r.units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+
+	whole := units / moneyFactor
+	if r.places == 0 {
+		return sign + strconv.FormatInt(whole, 10)
+	}
+	fraction := fmt.Sprintf("%0*d", moneyScale, units%moneyFactor)[:r.places]
+	return sign + strconv.FormatInt(whole, 10) + "." + fraction
+}
+
+// MarshalJSON writes the amount as a string like Shopify does
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON accepts string and number amounts; null is zero
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*m = Money{places: 2}
+		return nil
+	}
+
+	var value string
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+	} else {
+		value = string(data)
+	}
+
+	parsed, err := ParseMoney(value)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// step is the internal unit of m's last printed decimal
+func (m Money) step() int64 {
+	return pow10(moneyScale - min(max(m.places, 0), moneyScale))
+}
+
+// currencyMinorUnits lists ISO 4217 currencies that do not use two decimals
+var currencyMinorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// currencyDigits returns the number of minor unit decimals of a currency
+func currencyDigits(currency string) int {
+	if digits, ok := currencyMinorUnits[strings.ToUpper(currency)]; ok {
+		return digits
+	}
+	return 2
+}
+
+// roundDiv divides a by b, rounding half away from zero
+func roundDiv(a, b int64) int64 {
+	q, r := a/b, a%b
+	if 2*abs64(r) >= abs64(b) {
+		if (a < 0) != (b < 0) {
+			q--
+		} else {
+			q++
+		}
+	}
+	return q
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
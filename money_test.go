@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "12.50", want: "12.50"},
+		{value: "12.5", want: "12.50"},
+		{value: "3", want: "3.00"},
+		{value: "-3.1", want: "-3.10"},
+		{value: "+0.005", want: "0.005"},
+		{value: ".5", want: "0.50"},
+		{value: " 7.25 ", want: "7.25"},
+		{value: "", want: "0.00"},
+		{value: "1.1234567", wantErr: true},
+		{value: "1,50", wantErr: true},
+		{value: "abc", wantErr: true},
+		{value: "-", wantErr: true},
+		{value: "99999999999999999", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseMoney(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMoney(%q) error = %v, want error %t", tt.value, err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("ParseMoney(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Money
+		want string
+	}{
+		{name: "add keeps more decimals", got: MustParseMoney("0.1").Add(MustParseMoney("0.205")), want: "0.305"},
+		{name: "add without float error", got: MustParseMoney("0.10").Add(MustParseMoney("0.20")), want: "0.30"},
+		{name: "sub", got: MustParseMoney("10.00").Sub(MustParseMoney("12.50")), want: "-2.50"},
+		{name: "mul", got: MustParseMoney("19.99").Mul(3), want: "59.97"},
+		{name: "div rounds half up", got: MustParseMoney("10.00").Div(3), want: "3.33"},
+		{name: "div rounds up", got: MustParseMoney("0.05").Div(2), want: "0.03"},
+		{name: "div negative", got: MustParseMoney("-0.05").Div(2), want: "-0.03"},
+		{name: "div by zero", got: MustParseMoney("1.00").Div(0), want: "1.00"},
+		{name: "round half away from zero", got: MustParseMoney("2.345").Round(2), want: "2.35"},
+		{name: "round negative", got: MustParseMoney("-2.345").Round(2), want: "-2.35"},
+		{name: "round to whole units", got: MustParseMoney("1234.5").Round(0), want: "1235"},
+		{name: "round to three decimals", got: MustParseMoney("1.2").Round(3), want: "1.200"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got.String() != tt.want {
+				t.Errorf("got %s, want %s", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyCompare(t *testing.T) {
+	a, b := MustParseMoney("1.5"), MustParseMoney("1.500")
+	if !a.Equal(b) || a.Cmp(b) != 0 {
+		t.Errorf("%s and %s should be equal", a, b)
+	}
+	if MustParseMoney("-0.01").Sign() != -1 || MustParseMoney("0").Sign() != 0 || !MustParseMoney("0.000").IsZero() {
+		t.Error("Sign() or IsZero() is wrong")
+	}
+	if MustParseMoney("-2.00").Abs().String() != "2.00" {
+		t.Error("Abs() is wrong")
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "string", input: `"12.50"`, want: `"12.50"`},
+		{name: "number", input: `12.5`, want: `"12.50"`},
+		{name: "null", input: `null`, want: `"0.00"`},
+		{name: "invalid", input: `"twelve"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Money
+			err := json.Unmarshal([]byte(tt.input), &m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%s) error = %v, want error %t", tt.input, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			data, err := json.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("Marshal() = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestCurrencyDigits(t *testing.T) {
+	tests := map[string]int{"USD": 2, "eur": 2, "JPY": 0, "KWD": 3, "": 2}
+	for currency, want := range tests {
+		if got := currencyDigits(currency); got != want {
+			t.Errorf("currencyDigits(%q) = %d, want %d", currency, got, want)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLM negotiate flags (MS-NLMP 2.2.2.5)
+const (
+	ntlmNegotiateUnicode          = 0x00000001
+	ntlmNegotiateOEM              = 0x00000002
+	ntlmRequestTarget             = 0x00000004
+	ntlmNegotiateNTLM             = 0x00000200
+	ntlmNegotiateAlwaysSign       = 0x00008000
+	ntlmNegotiateExtendedSecurity = 0x00080000
+	ntlmNegotiateTargetInfo       = 0x00800000
+	ntlmNegotiate128              = 0x20000000
+	ntlmNegotiate56               = 0x80000000
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmChallenge is the parsed CHALLENGE_MESSAGE (type 2)
+type ntlmChallenge struct {
+	Flags           uint32
+	ServerChallenge []byte
+	TargetInfo      []byte
+}
+
+// ntlmNegotiateMessage builds the NEGOTIATE_MESSAGE (type 1)
+func ntlmNegotiateMessage() []byte {
+	flags := uint32(ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSecurity | ntlmNegotiateTargetInfo |
+		ntlmNegotiate128 | ntlmNegotiate56)
+
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], flags)
+	// Domain and workstation fields stay empty
+	return msg
+}
+
+// parseNTLMChallenge decodes a CHALLENGE_MESSAGE
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("ntlm: invalid challenge message")
+	}
+
+	challenge := &ntlmChallenge{
+		Flags:           binary.LittleEndian.Uint32(msg[20:]),
+		ServerChallenge: msg[24:32],
+	}
+
+	if len(msg) >= 48 {
+		length := int(binary.LittleEndian.Uint16(msg[40:]))
+		offset := int(binary.LittleEndian.Uint32(msg[44:]))
+		if offset+length > len(msg) {
+			return nil, errors.New("ntlm: target info out of range")
+		}
+		challenge.TargetInfo = msg[offset : offset+length]
+	}
+
+	return challenge, nil
+}
+
+// ntlmV2ResponseKey computes ResponseKeyNT = HMAC_MD5(MD4(UNICODE(password)), UNICODE(Upper(user) + domain))
+func ntlmV2ResponseKey(user, password, domain string) []byte {
+	ntHash := md4Sum(utf16LE(password))
+	mac := hmac.New(md5.New, ntHash[:])
+	mac.Write(utf16LE(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmV2Responses computes the NTLMv2 and LMv2 challenge responses (MS-NLMP 3.3.2)
+func ntlmV2Responses(responseKey, serverChallenge, clientChallenge, targetInfo []byte, timestamp uint64) (nt, lm []byte) {
+	temp := make([]byte, 0, 28+len(targetInfo)+4)
+	temp = append(temp, 0x01, 0x01, 0, 0, 0, 0, 0, 0)
+	temp = binary.LittleEndian.AppendUint64(temp, timestamp)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	mac := hmac.New(md5.New, responseKey)
+	mac.Write(serverChallenge)
+	mac.Write(temp)
+	ntProof := mac.Sum(nil)
+	nt = append(ntProof, temp...)
+
+	mac = hmac.New(md5.New, responseKey)
+	mac.Write(serverChallenge)
+	mac.Write(clientChallenge)
+	lm = append(mac.Sum(nil), clientChallenge...)
+
+	return nt, lm
+}
+
+// ntlmAuthenticateMessage builds the AUTHENTICATE_MESSAGE (type 3) for the challenge
+func ntlmAuthenticateMessage(challenge *ntlmChallenge, user, password, domain, workstation string) []byte {
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+
+	// Prefer the server's timestamp; when it is present the LM response must be zeroed
+	timestamp, serverTime := ntlmTargetTimestamp(challenge.TargetInfo)
+	if !serverTime {
+		timestamp = ntlmFiletime(time.Now())
+	}
+
+	key := ntlmV2ResponseKey(user, password, domain)
+	nt, lm := ntlmV2Responses(key, challenge.ServerChallenge, clientChallenge, challenge.TargetInfo, timestamp)
+	if serverTime {
+		lm = make([]byte, 24)
+	}
+
+	encode := func(s string) []byte {
+		if challenge.Flags&ntlmNegotiateUnicode != 0 {
+			return utf16LE(s)
+		}
+		return []byte(s)
+	}
+
+	fields := [][]byte{lm, nt, encode(domain), encode(user), encode(workstation), nil}
+
+	const headerSize = 64
+	msg := make([]byte, headerSize)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+
+	offset := headerSize
+	for i, field := range fields {
+		pos := 12 + i*8
+		binary.LittleEndian.PutUint16(msg[pos:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[pos+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[pos+4:], uint32(offset))
+		offset += len(field)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], challenge.Flags)
+
+	for _, field := range fields {
+		msg = append(msg, field...)
+	}
+	return msg
+}
+
+// ntlmTargetTimestamp returns MsvAvTimestamp from the target info, if present
+func ntlmTargetTimestamp(targetInfo []byte) (uint64, bool) {
+	for len(targetInfo) >= 4 {
+		id := binary.LittleEndian.Uint16(targetInfo)
+		length := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if id == ntlmAvEOL || 4+length > len(targetInfo) {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return binary.LittleEndian.Uint64(targetInfo[4:]), true
+		}
+		targetInfo = targetInfo[4+length:]
+	}
+	return 0, false
+}
+
+// ntlmFiletime converts t to 100ns intervals since 1601-01-01
+func ntlmFiletime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
+
+func utf16LE(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	out := make([]byte, len(encoded)*2)
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(out[i*2:], r)
+	}
+	return out
+}
+
+// ntlmTransport performs the NTLM handshake for every request. NTLM
+// authenticates the TCP connection rather than the request, so the
+// negotiate, challenge and authenticate legs must share one keep-alive
+// connection: requests are serialised, both legs go through the same
+// http.Transport and that transport keeps a single HTTP/1.1 connection.
+type ntlmTransport struct {
+	base        http.RoundTripper
+	user        string
+	password    string
+	domain      string
+	workstation string
+	mu          sync.Mutex
+}
+
+func (t *ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.GetBody == nil {
+		return nil, errors.New("ntlm: request body must be replayable")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// A TLS reload between the legs must not move the second one to a new transport
+	base := t.base
+	if reloading, ok := base.(*reloadingTransport); ok {
+		base = reloading.current.Load()
+	}
+
+	// Leg 1: negotiate
+	resp, err := base.RoundTrip(ntlmRequest(req, ntlmNegotiateMessage()))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		// The endpoint does not require authentication
+		return resp, nil
+	}
+
+	challengeMsg, ok := ntlmHeaderToken(resp.Header)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if !ok {
+		return nil, errors.New("ntlm: server did not return an NTLM challenge")
+	}
+
+	challenge, err := parseNTLMChallenge(challengeMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leg 2: authenticate and send the real request
+	auth := ntlmAuthenticateMessage(challenge, t.user, t.password, t.domain, t.workstation)
+	return base.RoundTrip(ntlmRequest(req, auth))
+}
+
+// useHTTP1 restricts base to one HTTP/1.1 connection per host. HTTP/2
+// multiplexes requests and cannot carry NTLM, and with a single connection
+// the authenticate leg always reuses the connection of the negotiate leg.
+func useHTTP1(base http.RoundTripper) error {
+	switch t := base.(type) {
+	case *http.Transport:
+		configureHTTP1(t)
+	case *reloadingTransport:
+		t.useHTTP1()
+	default:
+		return fmt.Errorf("ntlm: unsupported transport %T", base)
+	}
+	return nil
+}
+
+func configureHTTP1(t *http.Transport) {
+	t.ForceAttemptHTTP2 = false
+	t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	t.MaxConnsPerHost = 1
+}
+
+// ntlmRequest clones req with a fresh body and an NTLM Authorization header
+func ntlmRequest(req *http.Request, token []byte) *http.Request {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		clone.Body, _ = req.GetBody()
+	}
+	clone.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(token))
+	return clone
+}
+
+// ntlmHeaderToken extracts the decoded NTLM token from WWW-Authenticate
+func ntlmHeaderToken(header http.Header) ([]byte, bool) {
+	for _, value := range header.Values("WWW-Authenticate") {
+		scheme, token, found := strings.Cut(value, " ")
+		if !found || !strings.EqualFold(scheme, "NTLM") {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+		if err == nil {
+			return decoded, true
+		}
+	}
+	return nil, false
+}
+
+// splitNTLMUser accepts DOMAIN\user or user@domain when no domain is configured
+func splitNTLMUser(user, domain string) (string, string) {
+	if domain != "" {
+		return user, domain
+	}
+	if d, u, ok := strings.Cut(user, `\`); ok {
+		return u, d
+	}
+	if u, d, ok := strings.Cut(user, "@"); ok {
+		return u, d
+	}
+	return user, ""
+}
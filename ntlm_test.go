@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Known answers of MS-NLMP 4.2.4, NTLMv2 authentication
+var (
+	nlmpUser            = "User"
+	nlmpDomain          = "Domain"
+	nlmpPassword        = "Password"
+	nlmpServerChallenge = mustHex("0123456789abcdef")
+	nlmpClientChallenge = mustHex("aaaaaaaaaaaaaaaa")
+
+	// CHALLENGE_MESSAGE of 4.2.4.3 with target name "Server" and the
+	// NetBIOS domain and computer name AV pairs
+	nlmpChallengeMessage = mustHex("4e544c4d53535000" + "02000000" + "0c000c0038000000" + "33828ae2" +
+		"0123456789abcdef" + "0000000000000000" + "2400240044000000" + "060070170000000f" +
+		"530065007200760065007200" +
+		"02000c0044006f006d00610069006e00" + "01000c005300650072007600650072000000" + "0000")
+	nlmpTargetInfo = mustHex("02000c0044006f006d00610069006e00" + "01000c005300650072007600650072000000" + "0000")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestNTLMKnownAnswers(t *testing.T) {
+	ntHash := md4Sum(utf16LE(nlmpPassword))
+	key := ntlmV2ResponseKey(nlmpUser, nlmpPassword, nlmpDomain)
+	nt, lm := ntlmV2Responses(key, nlmpServerChallenge, nlmpClientChallenge, nlmpTargetInfo, 0)
+
+	tests := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{name: "NTOWFv1 (4.2.2.1.2)", got: ntHash[:], want: "a4f49c406510bdcab6824ee7c30fd852"},
+		{name: "NTOWFv2 (4.2.4.1.1)", got: key, want: "0c868a403bfd7a93a3001ef22ef02e3f"},
+		{name: "LMv2 response (4.2.4.2.1)", got: lm, want: "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"},
+		{name: "NTProofStr (4.2.4.2.2)", got: nt[:16], want: "68cd0ab851e51c96aabc927bebef6a1c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tt.got); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNTLMChallenge(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		wantErr bool
+	}{
+		{name: "MS-NLMP 4.2.4.3", msg: nlmpChallengeMessage},
+		{name: "too short", msg: nlmpChallengeMessage[:20], wantErr: true},
+		{name: "wrong type", msg: append(append([]byte{}, nlmpChallengeMessage[:8]...), append([]byte{1, 0, 0, 0}, nlmpChallengeMessage[12:]...)...), wantErr: true},
+		{name: "target info out of range", msg: nlmpChallengeMessage[:80], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge, err := parseNTLMChallenge(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNTLMChallenge() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if challenge.Flags != 0xe28a8233 {
+				t.Errorf("Flags = %#x, want 0xe28a8233", challenge.Flags)
+			}
+			if !bytes.Equal(challenge.ServerChallenge, nlmpServerChallenge) {
+				t.Errorf("ServerChallenge = %x", challenge.ServerChallenge)
+			}
+			if !bytes.Equal(challenge.TargetInfo, nlmpTargetInfo) {
+				t.Errorf("TargetInfo = %x, want %x", challenge.TargetInfo, nlmpTargetInfo)
+			}
+		})
+	}
+}
+
+func TestSplitNTLMUser(t *testing.T) {
+	tests := []struct {
+		user, domain         string
+		wantUser, wantDomain string
+	}{
+		{user: "ax", domain: "CORP", wantUser: "ax", wantDomain: "CORP"},
+		{user: `CORP\ax`, wantUser: "ax", wantDomain: "CORP"},
+		{user: "ax@corp.local", wantUser: "ax", wantDomain: "corp.local"},
+		{user: "ax", wantUser: "ax"},
+	}
+
+	for _, tt := range tests {
+		user, domain := splitNTLMUser(tt.user, tt.domain)
+		if user != tt.wantUser || domain != tt.wantDomain {
+			t.Errorf("splitNTLMUser(%q, %q) = %q, %q, want %q, %q", tt.user, tt.domain, user, domain, tt.wantUser, tt.wantDomain)
+		}
+	}
+}
+
+// ntlmStub is an NTLM protected endpoint. It answers the negotiate leg with
+// the MS-NLMP challenge, verifies the NTLMv2 proof of the authenticate leg
+// and requires both legs on the same connection.
+type ntlmStub struct {
+	password string
+
+	mu         sync.Mutex
+	challenged map[string]bool // remote addresses that received a challenge
+	bodies     []string
+}
+
+func (s *ntlmStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := ntlmHeaderToken(http.Header{"Www-Authenticate": r.Header.Values("Authorization")})
+	if !ok || len(token) < 12 {
+		w.Header().Set("WWW-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch binary.LittleEndian.Uint32(token[8:]) {
+	case 1:
+		io.Copy(io.Discard, r.Body)
+		s.challenged[r.RemoteAddr] = true
+		w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(nlmpChallengeMessage))
+		w.WriteHeader(http.StatusUnauthorized)
+	case 3:
+		if !s.challenged[r.RemoteAddr] || !s.verify(token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		delete(s.challenged, r.RemoteAddr)
+		body, _ := io.ReadAll(r.Body)
+		s.bodies = append(s.bodies, string(body))
+		w.Write([]byte("<ok/>"))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// verify checks the NTProofStr of an AUTHENTICATE_MESSAGE
+func (s *ntlmStub) verify(msg []byte) bool {
+	field := func(pos int) []byte {
+		length := int(binary.LittleEndian.Uint16(msg[pos:]))
+		offset := int(binary.LittleEndian.Uint32(msg[pos+4:]))
+		return msg[offset : offset+length]
+	}
+	nt := field(20)
+	domain := field(28)
+	user := field(36)
+	if len(nt) <= 16 || !bytes.Equal(user, utf16LE(nlmpUser)) || !bytes.Equal(domain, utf16LE(nlmpDomain)) {
+		return false
+	}
+
+	mac := hmac.New(md5.New, ntlmV2ResponseKey(nlmpUser, s.password, nlmpDomain))
+	mac.Write(nlmpServerChallenge)
+	mac.Write(nt[16:])
+	return hmac.Equal(mac.Sum(nil), nt[:16])
+}
+
+func TestNTLMTransportHandshake(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		wantStatus int
+	}{
+		{name: "valid credentials", password: nlmpPassword, wantStatus: http.StatusOK},
+		{name: "wrong password", password: "wrong", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &ntlmStub{password: nlmpPassword, challenged: make(map[string]bool)}
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			base := http.DefaultTransport.(*http.Transport).Clone()
+			if err := useHTTP1(base); err != nil {
+				t.Fatal(err)
+			}
+			transport := &ntlmTransport{base: base, user: nlmpUser, password: tt.password, domain: nlmpDomain, workstation: "COMPUTER"}
+			client := &http.Client{Transport: transport}
+
+			for i := 0; i < 3; i++ {
+				resp, err := client.Post(server.URL, "text/xml", strings.NewReader("<order/>"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Fatalf("request %d: status = %d, want %d", i, resp.StatusCode, tt.wantStatus)
+				}
+			}
+
+			if tt.wantStatus == http.StatusOK && len(stub.bodies) != 3 {
+				t.Errorf("stub received %d bodies, want 3", len(stub.bodies))
+			}
+			for _, body := range stub.bodies {
+				if body != "<order/>" {
+					t.Errorf("body = %q, want the original request body", body)
+				}
+			}
+		})
+	}
+}
+
+func TestNTLMTransportUnprotectedEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<ok/>"))
+	}))
+	defer server.Close()
+
+	transport := &ntlmTransport{base: http.DefaultTransport, user: nlmpUser, password: nlmpPassword}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestUseHTTP1(t *testing.T) {
+	plain := http.DefaultTransport.(*http.Transport).Clone()
+	reloading := &reloadingTransport{}
+	reloading.current.Store(http.DefaultTransport.(*http.Transport).Clone())
+
+	tests := []struct {
+		name      string
+		base      http.RoundTripper
+		transport func() *http.Transport
+		wantErr   bool
+	}{
+		{name: "transport", base: plain, transport: func() *http.Transport { return plain }},
+		{name: "reloading transport", base: reloading, transport: func() *http.Transport { return reloading.current.Load() }},
+		{name: "unknown", base: http.NewFileTransport(http.Dir(".")), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := useHTTP1(tt.base)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("useHTTP1() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			transport := tt.transport()
+			if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil || transport.MaxConnsPerHost != 1 {
+				t.Errorf("transport not restricted to HTTP/1.1: ForceAttemptHTTP2=%t TLSNextProto=%v MaxConnsPerHost=%d",
+					transport.ForceAttemptHTTP2, transport.TLSNextProto, transport.MaxConnsPerHost)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrOrderMappingNotFound = errors.New("order mapping not found")
+
+// OrderStatusCancelled marks a mapping whose AX sales order was cancelled
+const OrderStatusCancelled = "cancelled"
+
+// OrderMapping links a Shopify order to the sales order created in AX
+type OrderMapping struct {
+	ShopifyOrderID     string           `json:"shopify_order_id"`
+	ShopifyOrderNumber string           `json:"shopify_order_number,omitempty"`
+	SalesID            string           `json:"sales_id"`
+	CustAccount        string           `json:"cust_account,omitempty"`
+	RequestID          string           `json:"request_id"`
+	Status             string           `json:"status,omitempty"`
+	SalesStatus        string           `json:"sales_status,omitempty"` // last SalesStatus AX reported, e.g. Invoiced
+	CancelledAt        string           `json:"cancelled_at,omitempty"`
+	CancelRequestID    string           `json:"cancel_request_id,omitempty"`
+	Refunds            []RefundDocument `json:"refunds,omitempty"`
+	CreatedAt          string           `json:"created_at"`
+	UpdatedAt          string           `json:"updated_at"`
+}
+
+// RefundDocument records the AX document a Shopify refund was booked as
+type RefundDocument struct {
+	RefundID   string `json:"refund_id"`
+	Kind       string `json:"kind"`        // "return_order" or "credit_note"
+	DocumentID string `json:"document_id"` // return order SalesId or credit note number, when AX returned one
+	Amount     Money  `json:"amount"`
+	RequestID  string `json:"request_id"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// Refund returns the document of a kind recorded for a Shopify refund ID, or nil
+func (m *OrderMapping) Refund(refundID, kind string) *RefundDocument {
+	for i := range m.Refunds {
+		if m.Refunds[i].RefundID == refundID && m.Refunds[i].Kind == kind {
+			return &m.Refunds[i]
+		}
+	}
+	return nil
+}
+
+// OrderMapStore persists Shopify order ID <-> AX SalesId mappings in DATA_DIR/order_map.json
+type OrderMapStore struct {
+	mu        sync.Mutex
+	path      string
+	byShopify map[string]*OrderMapping
+	bySalesID map[string]*OrderMapping
+}
+
+// NewOrderMapStore loads the existing mappings
+func NewOrderMapStore() (*OrderMapStore, error) {
+	if err := os.MkdirAll(dataDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	m := &OrderMapStore{
+		path:      filepath.Join(dataDir(), "order_map.json"),
+		byShopify: make(map[string]*OrderMapping),
+		bySalesID: make(map[string]*OrderMapping),
+	}
+
+	var mappings []*OrderMapping
+	if err := readJSONFile(m.path, &mappings); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", m.path, err)
+	}
+	for _, mapping := range mappings {
+		m.byShopify[mapping.ShopifyOrderID] = mapping
+		m.bySalesID[mapping.SalesID] = mapping
+	}
+
+	return m, nil
+}
+
+// Put records the SalesId created for a Shopify order and the customer account it was posted against
+func (m *OrderMapStore) Put(shopifyOrderID, shopifyOrderNumber, salesID, custAccount, requestID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	mapping, ok := m.byShopify[shopifyOrderID]
+	if !ok {
+		mapping = &OrderMapping{ShopifyOrderID: shopifyOrderID, CreatedAt: now}
+		m.byShopify[shopifyOrderID] = mapping
+	} else if mapping.SalesID != salesID {
+		delete(m.bySalesID, mapping.SalesID)
+	}
+
+	mapping.ShopifyOrderNumber = shopifyOrderNumber
+	mapping.SalesID = salesID
+	mapping.CustAccount = custAccount
+	mapping.RequestID = requestID
+	mapping.UpdatedAt = now
+	m.bySalesID[salesID] = mapping
+
+	return m.save()
+}
+
+// MarkCancelled records that the AX sales order of a Shopify order was cancelled
+func (m *OrderMapStore) MarkCancelled(shopifyOrderID, requestID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mapping, ok := m.byShopify[shopifyOrderID]
+	if !ok {
+		return ErrOrderMappingNotFound
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	mapping.Status = OrderStatusCancelled
+	mapping.CancelledAt = now
+	mapping.CancelRequestID = requestID
+	mapping.UpdatedAt = now
+
+	return m.save()
+}
+
+// SetSalesStatus records the SalesStatus AX reported for a Shopify order's sales order
+func (m *OrderMapStore) SetSalesStatus(shopifyOrderID, salesStatus string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mapping, ok := m.byShopify[shopifyOrderID]
+	if !ok {
+		return ErrOrderMappingNotFound
+	}
+	if mapping.SalesStatus == salesStatus {
+		return nil
+	}
+
+	mapping.SalesStatus = salesStatus
+	mapping.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	return m.save()
+}
+
+// AddRefund records a refund booked against the AX sales order of a Shopify order
+func (m *OrderMapStore) AddRefund(shopifyOrderID string, document RefundDocument) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mapping, ok := m.byShopify[shopifyOrderID]
+	if !ok {
+		return ErrOrderMappingNotFound
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	document.CreatedAt = now
+	mapping.Refunds = append(mapping.Refunds, document)
+	mapping.UpdatedAt = now
+
+	return m.save()
+}
+
+// ByShopifyOrder looks up the mapping for a Shopify order ID
+func (m *OrderMapStore) ByShopifyOrder(shopifyOrderID string) (*OrderMapping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mapping, ok := m.byShopify[shopifyOrderID]
+	if !ok {
+		return nil, ErrOrderMappingNotFound
+	}
+	found := *mapping
+	return &found, nil
+}
+
+// BySalesID looks up the mapping for an AX SalesId
+func (m *OrderMapStore) BySalesID(salesID string) (*OrderMapping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mapping, ok := m.bySalesID[salesID]
+	if !ok {
+		return nil, ErrOrderMappingNotFound
+	}
+	found := *mapping
+	return &found, nil
+}
+
+// save persists all mappings. Callers must hold m.mu.
+func (m *OrderMapStore) save() error {
+	mappings := make([]*OrderMapping, 0, len(m.byShopify))
+	for _, mapping := range m.byShopify {
+		mappings = append(mappings, mapping)
+	}
+	return writeJSONFile(m.path, mappings)
+}
+
+// recordSalesID stores the mapping for a delivered order, logging failures
+// since the order itself has already been accepted by AX
+func (s *Server) recordSalesID(erpOrder *ERPOrder, salesID, requestID string) {
+	if salesID == "" {
+		log.Printf("[%s] No SalesId found in ERP response for order %s", requestID, erpOrder.OrderID)
+		return
+	}
+
+	log.Printf("[%s] Order %s created in AX as %s", requestID, erpOrder.OrderID, salesID)
+	if err := s.orderMap.Put(erpOrder.OrderID, erpOrder.OrderNumber, salesID, erpOrder.CustAccount, requestID); err != nil {
+		log.Printf("[%s] Error saving order mapping %s -> %s: %v", requestID, erpOrder.OrderID, salesID, err)
+	}
+}
+
+// recordCreatedOrder stores the SalesId and sent version of an order AX has
+// just created, then queues the cancellation, update or refunds that arrived
+// while the order was on its way
+func (s *Server) recordCreatedOrder(erpOrder *ERPOrder, delivery *ERPDelivery, requestID string) {
+	s.orderMu.Lock()
+	s.recordSalesID(erpOrder, delivery.SalesID, requestID)
+	s.recordSentOrder(erpOrder, delivery, requestID)
+	cancelled := s.dedupe.CancelRequested(erpOrder.OrderID)
+	s.orderMu.Unlock()
+
+	if cancelled {
+		// The cancellation supersedes any edit, and refunds of a cancelled
+		// sales order have nothing to book
+		s.updates.Take(erpOrder.OrderID)
+		s.refunds.TakeAll(erpOrder.OrderID)
+		s.cancelAfterCreate(erpOrder.OrderID, requestID)
+		return
+	}
+	s.updateAfterCreate(erpOrder.OrderID, requestID)
+	s.refundsAfterCreate(erpOrder.OrderID, requestID)
+}
+
+// handleGetOrderMapping looks up the AX SalesId for a Shopify order ID
+func (s *Server) handleGetOrderMapping(w http.ResponseWriter, r *http.Request) {
+	mapping, err := s.orderMap.ByShopifyOrder(r.PathValue("order_id"))
+	writeOrderMapping(w, mapping, err)
+}
+
+// handleGetSalesOrderMapping looks up the Shopify order for an AX SalesId
+func (s *Server) handleGetSalesOrderMapping(w http.ResponseWriter, r *http.Request) {
+	mapping, err := s.orderMap.BySalesID(r.PathValue("sales_id"))
+	writeOrderMapping(w, mapping, err)
+}
+
+// writeOrderMapping writes a lookup result or the matching error response
+func writeOrderMapping(w http.ResponseWriter, mapping *OrderMapping, err error) {
+	if errors.Is(err, ErrOrderMappingNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, mapping)
+}
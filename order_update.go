@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUpdateOperation = "UpdateOrder"
+	DefaultUpdateAction    = "http://tempuri.org/UpdateOrder"
+
+	DefaultReadOrderOperation = "ReadOrder"
+	DefaultReadOrderAction    = "http://tempuri.org/ReadOrder"
+
+	AIFUpdateAction = "http://schemas.microsoft.com/dynamics/2008/01/services/SalesOrderService/update"
+	AIFReadAction   = "http://schemas.microsoft.com/dynamics/2008/01/services/SalesOrderService/read"
+
+	// SalesStatusInvoiced is the AX SalesStatus after which order edits are refused
+	SalesStatusInvoiced = "Invoiced"
+
+	// Line changes sent in an order update
+	LineAdded   = "add"
+	LineChanged = "update"
+	LineRemoved = "remove"
+)
+
+var ErrSentOrderNotFound = errors.New("no sent version of the order")
+
+// SentOrderStore keeps the last version of every order sent to AX, one JSON
+// file per order under DATA_DIR/sent_orders. Order edits are diffed against it.
+type SentOrderStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewSentOrderStore creates the sent order directory
+func NewSentOrderStore() (*SentOrderStore, error) {
+	dir := filepath.Join(dataDir(), "sent_orders")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create sent order directory %s: %w", dir, err)
+	}
+	return &SentOrderStore{dir: dir}, nil
+}
+
+// Get returns the last version sent for a Shopify order ID
+func (s *SentOrderStore) Get(orderID string) (*ERPOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !validStoreID.MatchString(orderID) {
+		return nil, ErrSentOrderNotFound
+	}
+	data, err := os.ReadFile(s.path(orderID))
+	if os.IsNotExist(err) {
+		return nil, ErrSentOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var order ERPOrder
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// Put replaces the sent version of an order
+func (s *SentOrderStore) Put(order *ERPOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !validStoreID.MatchString(order.OrderID) {
+		return fmt.Errorf("invalid order ID %q", order.OrderID)
+	}
+	return writeJSONFile(s.path(order.OrderID), order)
+}
+
+func (s *SentOrderStore) path(orderID string) string {
+	return filepath.Join(s.dir, orderID+".json")
+}
+
+// recordSentOrder stores the version AX accepted and the SalesStatus it
+// reported, logging failures since AX has already accepted the order
+func (s *Server) recordSentOrder(erpOrder *ERPOrder, delivery *ERPDelivery, requestID string) {
+	if err := s.sentOrders.Put(erpOrder); err != nil {
+		log.Printf("[%s] Error saving sent version of order %s: %v", requestID, erpOrder.OrderID, err)
+	}
+	if delivery.SalesStatus == "" {
+		return
+	}
+	err := s.orderMap.SetSalesStatus(erpOrder.OrderID, delivery.SalesStatus)
+	if err != nil && !errors.Is(err, ErrOrderMappingNotFound) {
+		log.Printf("[%s] Error saving sales status of order %s: %v", requestID, erpOrder.OrderID, err)
+	}
+}
+
+// orderUpdatesEnabled reads ORDER_UPDATES, "on" (default) or "off". The aif
+// format cannot send updates, so it must be combined with ORDER_UPDATES=off.
+func orderUpdatesEnabled(b *EnvelopeBuilder) (bool, error) {
+	switch value := os.Getenv("ORDER_UPDATES"); strings.ToLower(value) {
+	case "", "on":
+		if b.config.Format == EnvelopeFormatAIF {
+			return false, fmt.Errorf("SOAP format %q cannot update sales orders, set ORDER_UPDATES=off", EnvelopeFormatAIF)
+		}
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid ORDER_UPDATES %q (expected on or off)", value)
+	}
+}
+
+// editedQuantity returns a line's quantity after order edits. Shopify's
+// current_quantity also drops when items are refunded; refunds are booked
+// separately by processRefundCreate, so refunded quantities are added back.
+func editedQuantity(order *ShopifyOrder, item LineItem) int {
+	if item.CurrentQuantity == nil {
+		return item.Quantity
+	}
+
+	quantity := *item.CurrentQuantity
+	for _, refund := range order.Refunds {
+		for _, refunded := range refund.RefundLineItems {
+			if refunded.LineItemID == item.ID {
+				quantity += refunded.Quantity
+			}
+		}
+	}
+	return quantity
+}
+
+// ERPOrderUpdate holds the changes between the version of an order last sent
+// to AX and its current version. Quantities are absolute so that applying the
+// same update twice leaves the order unchanged.
+type ERPOrderUpdate struct {
+	OrderID         string          `json:"order_id"`
+	OrderNumber     string          `json:"order_number"`
+	SalesID         string          `json:"sales_id"`
+	ShippingAddress *ERPAddress     `json:"shipping_address,omitempty"` // set when changed
+	BillingAddress  *ERPAddress     `json:"billing_address,omitempty"`  // set when changed
+	Lines           []ERPLineChange `json:"lines,omitempty"`
+	Timestamp       string          `json:"timestamp"`
+}
+
+// ERPLineChange is an added, changed or removed order line
+type ERPLineChange struct {
+	Action           string `json:"action"` // "add", "update" or "remove"
+	LineID           string `json:"line_id"`
+	SKU              string `json:"sku"`
+	ItemID           string `json:"item_id"`
+	ProductName      string `json:"product_name"`
+	Quantity         int    `json:"quantity"`
+	PreviousQuantity int    `json:"previous_quantity"`
+	UnitPrice        Money  `json:"unit_price"`
+	VariantTitle     string `json:"variant_title"`
+}
+
+// Empty reports whether the update changes nothing
+func (u *ERPOrderUpdate) Empty() bool {
+	return u.ShippingAddress == nil && u.BillingAddress == nil && len(u.Lines) == 0
+}
+
+// sameAddress compares two addresses, treating a missing address as empty
+func sameAddress(a, b *ERPAddress) bool {
+	var x, y ERPAddress
+	if a != nil {
+		x = *a
+	}
+	if b != nil {
+		y = *b
+	}
+	return x == y
+}
+
+// diffOrder compares the sent and current versions of an order
+func diffOrder(sent, current *ERPOrder, salesID string) *ERPOrderUpdate {
+	update := &ERPOrderUpdate{
+		OrderID:     current.OrderID,
+		OrderNumber: current.OrderNumber,
+		SalesID:     salesID,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	// AX keeps the last address it was sent when Shopify removes one
+	if current.ShippingAddress != nil && !sameAddress(current.ShippingAddress, sent.ShippingAddress) {
+		update.ShippingAddress = current.ShippingAddress
+	}
+	if current.BillingAddress != nil && !sameAddress(current.BillingAddress, sent.BillingAddress) {
+		update.BillingAddress = current.BillingAddress
+	}
+
+	previous := make(map[string]ERPItem)
+	for _, item := range sent.Items {
+		previous[lineKey(item)] = item
+	}
+
+	for _, item := range current.Items {
+		change := ERPLineChange{
+			LineID:       item.LineID,
+			SKU:          item.SKU,
+			ItemID:       item.ItemID,
+			ProductName:  item.ProductName,
+			Quantity:     item.Quantity,
+			UnitPrice:    item.UnitPrice,
+			VariantTitle: item.VariantTitle,
+		}
+
+		old, ok := previous[lineKey(item)]
+		delete(previous, lineKey(item))
+		switch {
+		case !ok:
+			change.Action = LineAdded
+		case old.Quantity != item.Quantity || !old.UnitPrice.Equal(item.UnitPrice) || old.ItemID != item.ItemID:
+			change.Action = LineChanged
+			change.PreviousQuantity = old.Quantity
+		default:
+			continue
+		}
+		update.Lines = append(update.Lines, change)
+	}
+
+	// Lines left over were removed from the order
+	for _, item := range sent.Items {
+		if _, ok := previous[lineKey(item)]; !ok {
+			continue
+		}
+		update.Lines = append(update.Lines, ERPLineChange{
+			Action:           LineRemoved,
+			LineID:           item.LineID,
+			SKU:              item.SKU,
+			ItemID:           item.ItemID,
+			ProductName:      item.ProductName,
+			PreviousQuantity: item.Quantity,
+			UnitPrice:        item.UnitPrice,
+			VariantTitle:     item.VariantTitle,
+		})
+	}
+
+	return update
+}
+
+// lineKey identifies a line across versions by its Shopify line item ID,
+// falling back to the SKU for versions stored without line IDs
+func lineKey(item ERPItem) string {
+	if item.LineID != "" && item.LineID != "0" {
+		return item.LineID
+	}
+	return "sku:" + item.SKU
+}
+
+// UpdateAction returns the SOAPAction for order updates for the configured format
+func (b *EnvelopeBuilder) UpdateAction() string {
+	if b.config.Format == EnvelopeFormatAIF {
+		return AIFUpdateAction
+	}
+	return DefaultUpdateAction
+}
+
+// ReadOrderAction returns the SOAPAction of sales order reads for the configured format
+func (b *EnvelopeBuilder) ReadOrderAction() string {
+	if b.config.Format == EnvelopeFormatAIF {
+		return AIFReadAction
+	}
+	return DefaultReadOrderAction
+}
+
+// BuildReadOrder renders the SOAP envelope that reads a sales order's status
+func (b *EnvelopeBuilder) BuildReadOrder(salesID, orderID string) (string, error) {
+	if b.config.Format == EnvelopeFormatAIF {
+		return b.buildAIFReadOrder(salesID)
+	}
+
+	el := b.element("salesOrder", "salesOrder")
+	el.add(b.text("SalesId", salesID))
+	el.add(b.text("OrderID", orderID))
+
+	prefix := b.config.Prefix
+	operation := &xmlElement{
+		Name:     qualify(prefix, DefaultReadOrderOperation),
+		Attrs:    []xml.Attr{{Name: xml.Name{Local: "xmlns:" + prefix}, Value: b.config.Namespace}},
+		Children: []*xmlElement{el},
+	}
+	return marshalEnvelope(b.envelopeNamespace(DestinationReadOrder), nil, operation)
+}
+
+// BuildUpdate renders the SOAP envelope for an order update
+func (b *EnvelopeBuilder) BuildUpdate(u *ERPOrderUpdate) (string, error) {
+	if b.config.Format == EnvelopeFormatAIF {
+		// SalesOrderService.update needs the document hash and record
+		// versions returned by a read, which this service does not keep
+		return "", fmt.Errorf("order updates are not supported by the %q format", EnvelopeFormatAIF)
+	}
+	if b.updateTemplate != nil {
+		return b.executeTemplate(b.updateTemplate, envelopeTemplateData{
+			Update:            u,
+			EnvelopeNamespace: b.envelopeNamespace(DestinationUpdateOrder),
+			Operation:         b.config.UpdateOperation,
+		})
+	}
+
+	el := b.element("orderUpdate", "orderUpdate")
+	el.add(b.text("SalesId", u.SalesID))
+	el.add(b.text("OrderID", u.OrderID))
+	el.add(b.text("OrderNumber", u.OrderNumber))
+	el.add(b.address("ShippingAddress", u.ShippingAddress))
+	el.add(b.address("BillingAddress", u.BillingAddress))
+
+	lines := b.element("Lines", "Lines")
+	for _, change := range u.Lines {
+		line := b.element("Line", "Line")
+		line.add(b.text("Action", change.Action))
+		line.add(b.text("LineID", change.LineID))
+		line.add(b.text("SKU", change.SKU))
+		line.add(b.text("ItemID", change.ItemID))
+		line.add(b.text("ProductName", change.ProductName))
+		line.add(b.text("Quantity", strconv.Itoa(change.Quantity)))
+		line.add(b.text("PreviousQuantity", strconv.Itoa(change.PreviousQuantity)))
+		line.add(b.text("UnitPrice", change.UnitPrice.String()))
+		line.add(b.text("VariantTitle", change.VariantTitle))
+		lines.add(line)
+	}
+	el.add(lines)
+
+	el.add(b.text("Timestamp", u.Timestamp))
+
+	prefix := b.config.Prefix
+	operation := &xmlElement{
+		Name:     qualify(prefix, b.config.UpdateOperation),
+		Attrs:    []xml.Attr{{Name: xml.Name{Local: "xmlns:" + prefix}, Value: b.config.Namespace}},
+		Children: []*xmlElement{el},
+	}
+	return marshalEnvelope(b.envelopeNamespace(DestinationUpdateOrder), nil, operation)
+}
+
+// processOrderUpdated sends the changes of an edited Shopify order to its AX
+// sales order. Updates that change nothing AX knows about are skipped, and
+// updates are refused once AX has reported the order as invoiced.
+func (s *Server) processOrderUpdated(job *QueuedOrder) error {
+	var order ShopifyOrder
+	if err := json.Unmarshal(job.Body, &order); err != nil {
+		err = fmt.Errorf("failed to parse updated order: %w", err)
+		s.dedupe.MarkFailed(job.WebhookID, "", job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+
+	// Shopify also sends orders/updated for cancellations, which orders/cancelled handles
+	if order.CancelledAt != "" {
+		log.Printf("[%s] Order %s is cancelled, ignoring update", job.RequestID, job.OrderID)
+		s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, "")
+		return nil
+	}
+
+	// Either the SalesId is already known, or the pending creation will
+	// queue this update again once it has one; orderMu makes sure one of
+	// the two happens
+	s.orderMu.Lock()
+	mapping, err := s.orderMap.ByShopifyOrder(job.OrderID)
+	_, delivered := s.dedupe.Delivered(job.OrderID)
+	deferred := errors.Is(err, ErrOrderMappingNotFound) && !delivered
+	if deferred {
+		err = s.deferUpdate(job, &order)
+	}
+	s.orderMu.Unlock()
+
+	if errors.Is(err, ErrOrderMappingNotFound) {
+		// AX accepted the order but did not return a SalesId we could record
+		err = fmt.Errorf("order %s was accepted by AX but its SalesId is unknown, update it in AX manually", job.OrderID)
+	}
+	if err != nil {
+		return s.failUpdate(job, nil, err)
+	}
+	if deferred {
+		log.Printf("[%s] Order %s is not in AX yet, the update will be sent once it is created", job.RequestID, job.OrderID)
+		s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, "")
+		return nil
+	}
+
+	if mapping.Status == OrderStatusCancelled {
+		log.Printf("[%s] AX sales order %s for order %s is cancelled, ignoring update", job.RequestID, mapping.SalesID, job.OrderID)
+		s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, mapping.SalesID)
+		return nil
+	}
+	// The stored status is only as recent as the last response from AX
+	salesStatus, err := s.readSalesStatus(mapping, job.RequestID)
+	if err != nil {
+		return s.failUpdate(job, nil, fmt.Errorf("failed to read status of AX sales order %s: %w", mapping.SalesID, err))
+	}
+	if strings.EqualFold(salesStatus, SalesStatusInvoiced) {
+		err := fmt.Errorf("AX sales order %s is invoiced, changes to order %s must be handled in AX", mapping.SalesID, job.OrderID)
+		return s.failUpdate(job, nil, err)
+	}
+
+	sent, err := s.sentVersion(job.OrderID)
+	if err != nil {
+		return s.failUpdate(job, nil, err)
+	}
+
+	current := s.transformOrder(&order)
+	// Held orders are new orders only, so rules that route to review fail an update
+	if _, err := s.validateOrder(&order, current, job.RequestID); err != nil {
+		return s.failUpdate(job, nil, err)
+	}
+	if err := s.checkReconciliation(current, job.RequestID); err != nil {
+		return s.failUpdate(job, nil, err)
+	}
+	if err := s.checkItemMapping(current, job.RequestID); err != nil {
+		return s.failUpdate(job, nil, err)
+	}
+	update := diffOrder(sent, current, mapping.SalesID)
+	if update.Empty() {
+		log.Printf("[%s] Update of order %s changes nothing sent to AX, skipping", job.RequestID, job.OrderID)
+		s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, mapping.SalesID)
+		return nil
+	}
+
+	soapXML, err := s.envelope.BuildUpdate(update)
+	if err != nil {
+		return s.failUpdate(job, nil, fmt.Errorf("failed to build SOAP envelope: %w", err))
+	}
+
+	log.Printf("[%s] Updating AX sales order %s for order %s (%d line changes)", job.RequestID, mapping.SalesID, job.OrderID, len(update.Lines))
+	delivery, err := s.deliverSOAP(s.envelope.Destination(DestinationUpdateOrder), soapXML, job.OrderID, job.RequestID)
+	if err != nil {
+		return s.failUpdate(job, delivery, err)
+	}
+
+	s.recordSentOrder(current, delivery, job.RequestID)
+	s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, mapping.SalesID)
+	log.Printf("[%s] AX sales order %s updated", job.RequestID, mapping.SalesID)
+
+	// Clear any dead letter left from an earlier failed attempt
+	if err := s.deadLetters.Delete(job.ID); err != nil {
+		log.Printf("[%s] Error removing resolved dead letter: %v", job.RequestID, err)
+	}
+	return nil
+}
+
+// readSalesStatus asks AX for the current status of a sales order and
+// stores it. The stored status is returned when AX does not report one.
+func (s *Server) readSalesStatus(mapping *OrderMapping, requestID string) (string, error) {
+	soapXML, err := s.envelope.BuildReadOrder(mapping.SalesID, mapping.ShopifyOrderID)
+	if err != nil {
+		return "", fmt.Errorf("failed to build SOAP envelope: %w", err)
+	}
+	delivery, err := s.deliverSOAP(s.envelope.Destination(DestinationReadOrder), soapXML, mapping.ShopifyOrderID, requestID)
+	if err != nil {
+		return "", err
+	}
+	if delivery.SalesStatus == "" {
+		return mapping.SalesStatus, nil
+	}
+	if err := s.orderMap.SetSalesStatus(mapping.ShopifyOrderID, delivery.SalesStatus); err != nil {
+		log.Printf("[%s] Error saving sales status of order %s: %v", requestID, mapping.ShopifyOrderID, err)
+	}
+	return delivery.SalesStatus, nil
+}
+
+// deferUpdate keeps the update of an order that has no AX sales order yet,
+// unless a newer version of the order is already waiting. Callers must hold orderMu.
+func (s *Server) deferUpdate(job *QueuedOrder, order *ShopifyOrder) error {
+	if pending, err := s.updates.Get(job.OrderID); err == nil {
+		var waiting ShopifyOrder
+		if json.Unmarshal(pending.Body, &waiting) == nil && newerVersion(waiting.UpdatedAt, order.UpdatedAt) {
+			return nil
+		}
+	}
+	return s.updates.Save(job)
+}
+
+// newerVersion reports whether Shopify timestamp a is later than b
+func newerVersion(a, b string) bool {
+	x, err := time.Parse(time.RFC3339, a)
+	if err != nil {
+		return false
+	}
+	y, err := time.Parse(time.RFC3339, b)
+	if err != nil {
+		return false
+	}
+	return x.After(y)
+}
+
+// updateAfterCreate queues the update webhook of an order that was edited
+// in Shopify before it reached AX
+func (s *Server) updateAfterCreate(orderID, requestID string) {
+	update, err := s.updates.Take(orderID)
+	if errors.Is(err, ErrPendingWebhookNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Error reading pending update of order %s: %v", requestID, orderID, err)
+		return
+	}
+	update.ID = generateRequestID()
+	update.WebhookID = ""
+	update.ReceivedAt = time.Now().UTC().Format(time.RFC3339)
+
+	log.Printf("[%s] Order %s was edited before it reached AX, queued update %s", requestID, orderID, update.ID)
+	if err := s.queue.Enqueue(update); err != nil {
+		err = fmt.Errorf("failed to queue update: %w", err)
+		log.Printf("[%s] %v", requestID, err)
+		s.deadLetters.Add(update, nil, err)
+	}
+}
+
+// sentVersion returns the version of an order last sent to AX. Orders sent
+// before versions were stored fall back to the logged orders/create payload.
+func (s *Server) sentVersion(orderID string) (*ERPOrder, error) {
+	sent, err := s.sentOrders.Get(orderID)
+	if !errors.Is(err, ErrSentOrderNotFound) {
+		return sent, err
+	}
+
+	stored, err := s.logger.FindIncomingWebhook("", orderID)
+	if err != nil {
+		return nil, fmt.Errorf("no version of order %s sent to AX is known: %w", orderID, err)
+	}
+	var order ShopifyOrder
+	if err := json.Unmarshal(stored.Body, &order); err != nil {
+		return nil, fmt.Errorf("failed to parse stored order %s: %w", orderID, err)
+	}
+	return s.transformOrder(&order), nil
+}
+
+// failUpdate records a failed order update in the dead-letter store
+func (s *Server) failUpdate(job *QueuedOrder, delivery *ERPDelivery, err error) error {
+	log.Printf("[%s] Update of order %s failed: %v", job.RequestID, job.OrderID, err)
+	s.dedupe.MarkFailed(job.WebhookID, "", job.RequestID, err)
+	return s.deadLetters.Add(job, delivery, err)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffOrder(t *testing.T) {
+	item := func(lineID, sku string, quantity int, price string) ERPItem {
+		return ERPItem{LineID: lineID, SKU: sku, ItemID: sku, Quantity: quantity, UnitPrice: MustParseMoney(price)}
+	}
+	address := &ERPAddress{Name: "Jane Doe", City: "Berlin", CountryCode: "DE"}
+	moved := &ERPAddress{Name: "Jane Doe", City: "Hamburg", CountryCode: "DE"}
+
+	tests := []struct {
+		name         string
+		sent         *ERPOrder
+		current      *ERPOrder
+		wantLines    []string // action:line ID
+		wantShipping bool
+	}{
+		{
+			name:    "unchanged",
+			sent:    &ERPOrder{Items: []ERPItem{item("1", "A", 2, "10.00")}, ShippingAddress: address},
+			current: &ERPOrder{Items: []ERPItem{item("1", "A", 2, "10.00")}, ShippingAddress: address},
+		},
+		{
+			name:      "quantity changed",
+			sent:      &ERPOrder{Items: []ERPItem{item("1", "A", 2, "10.00")}},
+			current:   &ERPOrder{Items: []ERPItem{item("1", "A", 3, "10.00")}},
+			wantLines: []string{"update:1"},
+		},
+		{
+			name:      "price changed",
+			sent:      &ERPOrder{Items: []ERPItem{item("1", "A", 2, "10.00")}},
+			current:   &ERPOrder{Items: []ERPItem{item("1", "A", 2, "9.50")}},
+			wantLines: []string{"update:1"},
+		},
+		{
+			name:      "line added and removed",
+			sent:      &ERPOrder{Items: []ERPItem{item("1", "A", 2, "10.00"), item("2", "B", 1, "5.00")}},
+			current:   &ERPOrder{Items: []ERPItem{item("1", "A", 2, "10.00"), item("3", "C", 1, "7.00")}},
+			wantLines: []string{"add:3", "remove:2"},
+		},
+		{
+			name:      "versions without line IDs match by SKU",
+			sent:      &ERPOrder{Items: []ERPItem{item("", "A", 2, "10.00")}},
+			current:   &ERPOrder{Items: []ERPItem{item("0", "A", 1, "10.00")}},
+			wantLines: []string{"update:0"},
+		},
+		{
+			name:         "shipping address changed",
+			sent:         &ERPOrder{ShippingAddress: address},
+			current:      &ERPOrder{ShippingAddress: moved},
+			wantShipping: true,
+		},
+		{
+			name:    "removed address is kept in AX",
+			sent:    &ERPOrder{ShippingAddress: address},
+			current: &ERPOrder{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := diffOrder(tt.sent, tt.current, "SO-1")
+
+			var lines []string
+			for _, change := range update.Lines {
+				lines = append(lines, change.Action+":"+change.LineID)
+			}
+			if strings.Join(lines, ",") != strings.Join(tt.wantLines, ",") {
+				t.Errorf("line changes = %v, want %v", lines, tt.wantLines)
+			}
+			if (update.ShippingAddress != nil) != tt.wantShipping {
+				t.Errorf("shipping address changed = %t, want %t", update.ShippingAddress != nil, tt.wantShipping)
+			}
+			if update.Empty() != (len(tt.wantLines) == 0 && !tt.wantShipping) {
+				t.Errorf("Empty() = %t", update.Empty())
+			}
+		})
+	}
+}
+
+func TestDiffOrderKeepsPreviousQuantity(t *testing.T) {
+	sent := &ERPOrder{Items: []ERPItem{{LineID: "1", SKU: "A", Quantity: 2}, {LineID: "2", SKU: "B", Quantity: 4}}}
+	current := &ERPOrder{Items: []ERPItem{{LineID: "1", SKU: "A", Quantity: 5}}}
+
+	update := diffOrder(sent, current, "SO-1")
+	if len(update.Lines) != 2 {
+		t.Fatalf("line changes = %+v, want an update and a removal", update.Lines)
+	}
+	if changed := update.Lines[0]; changed.Quantity != 5 || changed.PreviousQuantity != 2 {
+		t.Errorf("changed line quantity = %d (was %d), want 5 (was 2)", changed.Quantity, changed.PreviousQuantity)
+	}
+	if removed := update.Lines[1]; removed.Quantity != 0 || removed.PreviousQuantity != 4 {
+		t.Errorf("removed line quantity = %d (was %d), want 0 (was 4)", removed.Quantity, removed.PreviousQuantity)
+	}
+}
+
+func TestOrderUpdatesEnabled(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{name: "default format", format: EnvelopeFormatDefault, want: true},
+		{name: "explicitly on", format: EnvelopeFormatDefault, value: "ON", want: true},
+		{name: "off", format: EnvelopeFormatDefault, value: "off"},
+		{name: "aif needs updates off", format: EnvelopeFormatAIF, wantErr: true},
+		{name: "aif with updates off", format: EnvelopeFormatAIF, value: "off"},
+		{name: "invalid value", format: EnvelopeFormatDefault, value: "sometimes", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ORDER_UPDATES", tt.value)
+			b := &EnvelopeBuilder{config: EnvelopeConfig{Format: tt.format}}
+
+			got, err := orderUpdatesEnabled(b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("orderUpdatesEnabled() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("orderUpdatesEnabled() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func updateJob(id, body string) *QueuedOrder {
+	return &QueuedOrder{ID: id, RequestID: id, Topic: TopicOrdersUpdated, WebhookID: id, OrderID: "1001", Body: json.RawMessage(body)}
+}
+
+func TestProcessOrderUpdatedWaitsForCreate(t *testing.T) {
+	s, erp := newTestServer(t, nil)
+
+	newer := updateJob("u2", `{"id":1001,"updated_at":"2024-05-01T10:05:00Z"}`)
+	older := updateJob("u1", `{"id":1001,"updated_at":"2024-05-01T10:00:00Z"}`)
+	for _, job := range []*QueuedOrder{newer, older} {
+		if err := s.processOrderUpdated(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(erp.Requests()) != 0 {
+		t.Fatalf("ERP received %d requests before the order was created", len(erp.Requests()))
+	}
+	if letters, _ := s.deadLetters.List("1001"); len(letters) != 0 {
+		t.Errorf("early update was dead-lettered: %+v", letters)
+	}
+
+	s.recordCreatedOrder(&ERPOrder{OrderID: "1001"}, &ERPDelivery{SalesID: "SO-1"}, "create-1")
+
+	pending, _ := filepath.Glob(filepath.Join(os.Getenv("DATA_DIR"), "queue", "pending", "*.json"))
+	if len(pending) != 1 {
+		t.Fatalf("queued jobs = %v, want the deferred update", pending)
+	}
+	job, err := readQueuedOrder(pending[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Topic != TopicOrdersUpdated || !strings.Contains(string(job.Body), "10:05:00") {
+		t.Errorf("queued %s with %s, want the newest update", job.Topic, job.Body)
+	}
+	if _, err := s.updates.Get("1001"); err == nil {
+		t.Error("deferred update is still pending after the create")
+	}
+}
+
+func TestProcessOrderUpdatedReadsSalesStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       string
+		wantRequests int
+		wantFailed   bool
+	}{
+		{name: "open order is updated", status: "Backorder", wantRequests: 2},
+		{name: "invoiced order is refused", status: SalesStatusInvoiced, wantRequests: 1, wantFailed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, erp := newTestServer(t, nil)
+			erp.response = `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><ReadOrderResponse><SalesStatus>` +
+				tt.status + `</SalesStatus></ReadOrderResponse></s:Body></s:Envelope>`
+
+			if err := s.orderMap.Put("1001", "#1001", "SO-1", "WEB", "create-1"); err != nil {
+				t.Fatal(err)
+			}
+			sent := &ERPOrder{OrderID: "1001", Items: []ERPItem{{LineID: "1", SKU: "A", ItemID: "A", Quantity: 2, UnitPrice: MustParseMoney("10.00")}}}
+			if err := s.sentOrders.Put(sent); err != nil {
+				t.Fatal(err)
+			}
+
+			job := updateJob("u1", `{"id":1001,"currency":"EUR","line_items":[{"id":1,"sku":"A","title":"A","quantity":3,"price":"10.00"}]}`)
+			if err := s.processOrderUpdated(job); err != nil {
+				t.Fatal(err)
+			}
+
+			requests := erp.Requests()
+			if len(requests) != tt.wantRequests {
+				t.Fatalf("ERP received %d requests, want %d", len(requests), tt.wantRequests)
+			}
+			if !strings.Contains(requests[0], DefaultReadOrderOperation) {
+				t.Errorf("first request is not a read:\n%s", requests[0])
+			}
+			letters, _ := s.deadLetters.List("1001")
+			if failed := len(letters) > 0; failed != tt.wantFailed {
+				t.Errorf("update failed = %t, want %t", failed, tt.wantFailed)
+			}
+			if mapping, _ := s.orderMap.ByShopifyOrder("1001"); mapping.SalesStatus != tt.status {
+				t.Errorf("stored sales status = %q, want %q", mapping.SalesStatus, tt.status)
+			}
+		})
+	}
+}
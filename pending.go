@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var ErrPendingWebhookNotFound = errors.New("pending webhook not found")
+
+// PendingWebhookStore keeps webhooks that arrived before their order reached
+// AX, one file per Shopify order under a DATA_DIR subdirectory. They are
+// queued again once the order has been created. Webhooks that must all be
+// kept, such as refunds, are added per order with Add and taken with TakeAll.
+type PendingWebhookStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewPendingWebhookStore creates the directory DATA_DIR/<name>
+func NewPendingWebhookStore(name string) (*PendingWebhookStore, error) {
+	dir := filepath.Join(dataDir(), name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pending webhook directory %s: %w", dir, err)
+	}
+	return &PendingWebhookStore{dir: dir}, nil
+}
+
+// Save stores the webhook of an order, replacing an older one
+func (p *PendingWebhookStore) Save(job *QueuedOrder) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !validStoreID.MatchString(job.OrderID) {
+		return fmt.Errorf("invalid order ID %q", job.OrderID)
+	}
+	return writeJSONFile(p.path(job.OrderID), job)
+}
+
+// Get returns the webhook of an order without removing it
+func (p *PendingWebhookStore) Get(orderID string) (*QueuedOrder, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.read(orderID)
+}
+
+// Take returns and removes the webhook of an order
+func (p *PendingWebhookStore) Take(orderID string) (*QueuedOrder, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	job, err := p.read(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(p.path(orderID)); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Add stores one of several webhooks of an order, keyed by its job ID
+func (p *PendingWebhookStore) Add(job *QueuedOrder) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !validStoreID.MatchString(job.OrderID) {
+		return fmt.Errorf("invalid order ID %q", job.OrderID)
+	}
+	if !validStoreID.MatchString(job.ID) {
+		return fmt.Errorf("invalid job ID %q", job.ID)
+	}
+	dir := filepath.Join(p.dir, job.OrderID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(dir, job.ID+".json"), job)
+}
+
+// TakeAll returns and removes the webhooks added for an order, oldest first
+func (p *PendingWebhookStore) TakeAll(orderID string) ([]*QueuedOrder, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !validStoreID.MatchString(orderID) {
+		return nil, nil
+	}
+	dir := filepath.Join(p.dir, orderID)
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*QueuedOrder
+	for _, path := range files {
+		job, err := readQueuedOrder(path)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].ReceivedAt != jobs[j].ReceivedAt {
+			return jobs[i].ReceivedAt < jobs[j].ReceivedAt
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs, nil
+}
+
+// read loads the webhook of an order. Callers must hold p.mu.
+func (p *PendingWebhookStore) read(orderID string) (*QueuedOrder, error) {
+	if !validStoreID.MatchString(orderID) {
+		return nil, ErrPendingWebhookNotFound
+	}
+	job, err := readQueuedOrder(p.path(orderID))
+	if os.IsNotExist(err) {
+		return nil, ErrPendingWebhookNotFound
+	}
+	return job, err
+}
+
+func (p *PendingWebhookStore) path(orderID string) string {
+	return filepath.Join(p.dir, orderID+".json")
+}
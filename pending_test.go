@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPendingWebhookStore(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	store, err := NewPendingWebhookStore("cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(&QueuedOrder{ID: "c1", OrderID: "1", Body: json.RawMessage(`{"id":1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(&QueuedOrder{ID: "c2", OrderID: "1", Body: json.RawMessage(`{"id":1,"cancel_reason":"fraud"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(&QueuedOrder{ID: "c3", OrderID: "../1"}); err == nil {
+		t.Error("Save() accepted an order ID with a path")
+	}
+	if job, err := store.Get("1"); err != nil || job.ID != "c2" {
+		t.Fatalf("Get() = %+v, %v, want c2", job, err)
+	}
+
+	tests := []struct {
+		name    string
+		orderID string
+		wantID  string
+		wantErr error
+	}{
+		{name: "latest webhook", orderID: "1", wantID: "c2"},
+		{name: "taken only once", orderID: "1", wantErr: ErrPendingWebhookNotFound},
+		{name: "unknown order", orderID: "2", wantErr: ErrPendingWebhookNotFound},
+		{name: "invalid order ID", orderID: "../1", wantErr: ErrPendingWebhookNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, err := store.Take(tt.orderID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Take() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && job.ID != tt.wantID {
+				t.Errorf("Take() = %s, want %s", job.ID, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestPendingWebhookStoreAddTakeAll(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	store, err := NewPendingWebhookStore("refund")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := []*QueuedOrder{
+		{ID: "r2", OrderID: "1", ReceivedAt: "2024-05-01T10:05:00Z"},
+		{ID: "r1", OrderID: "1", ReceivedAt: "2024-05-01T10:00:00Z"},
+		{ID: "r3", OrderID: "2", ReceivedAt: "2024-05-01T10:00:00Z"},
+	}
+	for _, job := range jobs {
+		if err := store.Add(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Add(&QueuedOrder{ID: "r4", OrderID: "../1"}); err == nil {
+		t.Error("Add() accepted an order ID with a path")
+	}
+	if err := store.Add(&QueuedOrder{ID: "../r4", OrderID: "1"}); err == nil {
+		t.Error("Add() accepted a job ID with a path")
+	}
+
+	tests := []struct {
+		name    string
+		orderID string
+		wantIDs string
+	}{
+		{name: "oldest first", orderID: "1", wantIDs: "r1,r2"},
+		{name: "taken only once", orderID: "1"},
+		{name: "other order kept", orderID: "2", wantIDs: "r3"},
+		{name: "unknown order", orderID: "3"},
+		{name: "invalid order ID", orderID: "../1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs, err := store.TakeAll(tt.orderID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, job := range jobs {
+				ids = append(ids, job.ID)
+			}
+			if got := strings.Join(ids, ","); got != tt.wantIDs {
+				t.Errorf("TakeAll() = %s, want %s", got, tt.wantIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDataDir      = "./data"
+	DefaultQueueWorkers = 2
+	QueuePollInterval   = 5 * time.Second
+)
+
+// QueuedOrder is a webhook persisted to disk until it has been delivered to the ERP
+type QueuedOrder struct {
+	ID         string          `json:"id"`
+	RequestID  string          `json:"request_id"`
+	Topic      string          `json:"topic"`
+	WebhookID  string          `json:"webhook_id,omitempty"`
+	ShopDomain string          `json:"shop_domain,omitempty"`
+	OrderID    string          `json:"order_id"`
+	ReceivedAt string          `json:"received_at"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// OrderQueue is a directory backed FIFO queue. Each job is a single JSON file
+// that moves from pending/ to processing/ while a worker owns it and is
+// removed once handled, so jobs survive process restarts. Jobs of the same
+// Shopify order are handled one at a time in the order they arrived.
+type OrderQueue struct {
+	pendingDir    string
+	processingDir string
+	failedDir     string
+	handler       func(*QueuedOrder) error
+	onFailure     func(*QueuedOrder, error) error
+	notify        chan struct{}
+
+	mu     sync.Mutex
+	active map[string]chan struct{} // orders being handled, closed on release
+}
+
+// dataDir returns the directory used for persistent state
+func dataDir() string {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		dir = DefaultDataDir
+	}
+	return dir
+}
+
+// NewOrderQueue creates the queue directories under DATA_DIR/queue
+func NewOrderQueue(handler func(*QueuedOrder) error) (*OrderQueue, error) {
+	base := filepath.Join(dataDir(), "queue")
+	q := &OrderQueue{
+		pendingDir:    filepath.Join(base, "pending"),
+		processingDir: filepath.Join(base, "processing"),
+		failedDir:     filepath.Join(base, "failed"),
+		handler:       handler,
+		notify:        make(chan struct{}, 1),
+		active:        make(map[string]chan struct{}),
+	}
+
+	for _, dir := range []string{q.pendingDir, q.processingDir, q.failedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create queue directory %s: %w", dir, err)
+		}
+	}
+
+	return q, nil
+}
+
+// OnFailure sets a hook that takes over jobs whose handler failed, e.g. by
+// storing them as dead letters. Jobs the hook cannot take stay in failed/.
+func (q *OrderQueue) OnFailure(hook func(*QueuedOrder, error) error) {
+	q.onFailure = hook
+}
+
+// Enqueue durably stores the order. It only returns once the job file has
+// been synced to disk, so a 200 response to Shopify never loses an order.
+func (q *OrderQueue) Enqueue(job *QueuedOrder) error {
+	// Prefix with the enqueue time so a lexical sort gives FIFO order
+	name := fmt.Sprintf("%020d_%s.json", time.Now().UnixNano(), job.ID)
+	if err := writeJSONFile(filepath.Join(q.pendingDir, name), job); err != nil {
+		return fmt.Errorf("failed to write queue file: %w", err)
+	}
+
+	q.wake()
+	return nil
+}
+
+// wake signals a worker without blocking if one is already signalled
+func (q *OrderQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Depth returns the number of jobs waiting to be processed
+func (q *OrderQueue) Depth() int {
+	return len(q.list(q.pendingDir))
+}
+
+// Failed returns the number of jobs in failed/, which need manual attention
+func (q *OrderQueue) Failed() int {
+	return len(q.list(q.failedDir))
+}
+
+// Start recovers jobs left in processing/ by a previous run and launches the workers
+func (q *OrderQueue) Start(workers int) {
+	if failed := q.Failed(); failed > 0 {
+		log.Printf("Warning: %d failed jobs in %s need manual attention", failed, q.failedDir)
+	}
+	for _, name := range q.list(q.processingDir) {
+		if err := os.Rename(filepath.Join(q.processingDir, name), filepath.Join(q.pendingDir, name)); err != nil {
+			log.Printf("Warning: could not requeue interrupted job %s: %v", name, err)
+			continue
+		}
+		log.Printf("Requeued interrupted job %s", name)
+	}
+
+	for i := 1; i <= workers; i++ {
+		go q.worker(i)
+	}
+}
+
+// worker drains the pending directory, sleeping until notified or the poll interval elapses
+func (q *OrderQueue) worker(id int) {
+	ticker := time.NewTicker(QueuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		for q.processNext(id) {
+		}
+
+		select {
+		case <-q.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNext claims and handles one job, reporting whether a job was found.
+// Jobs of an order another worker is handling are left for later, so a
+// create, update, cancel and refund of one order never run concurrently.
+func (q *OrderQueue) processNext(workerID int) bool {
+	for _, name := range q.list(q.pendingDir) {
+		pendingPath := filepath.Join(q.pendingDir, name)
+		processingPath := filepath.Join(q.processingDir, name)
+
+		job, err := readQueuedOrder(pendingPath)
+		if os.IsNotExist(err) {
+			continue // claimed by another worker
+		}
+		if err != nil {
+			if os.Rename(pendingPath, processingPath) == nil {
+				log.Printf("Worker %d: unreadable job %s moved to failed: %v", workerID, name, err)
+				os.Rename(processingPath, filepath.Join(q.failedDir, name))
+			}
+			return true
+		}
+
+		if !q.acquire(job.OrderID) {
+			continue
+		}
+
+		// Rename is atomic, so only one worker can claim a given job
+		if err := os.Rename(pendingPath, processingPath); err != nil {
+			q.release(job.OrderID)
+			continue
+		}
+
+		q.handle(workerID, job, name, processingPath)
+		q.release(job.OrderID)
+		return true
+	}
+
+	return false
+}
+
+// handle runs the handler for a claimed job and removes or fails its file
+func (q *OrderQueue) handle(workerID int, job *QueuedOrder, name, processingPath string) {
+	log.Printf("[%s] Worker %d processing order %s", job.RequestID, workerID, job.OrderID)
+
+	if err := q.handler(job); err != nil {
+		log.Printf("[%s] Worker %d failed to deliver order %s: %v", job.RequestID, workerID, job.OrderID, err)
+		if q.onFailure != nil {
+			hookErr := q.onFailure(job, err)
+			if hookErr == nil {
+				if err := os.Remove(processingPath); err != nil {
+					log.Printf("[%s] Error removing failed job: %v", job.RequestID, err)
+				}
+				return
+			}
+			log.Printf("[%s] Error handing over failed job: %v", job.RequestID, hookErr)
+		}
+		if err := os.Rename(processingPath, filepath.Join(q.failedDir, name)); err != nil {
+			log.Printf("[%s] Error moving job to failed: %v", job.RequestID, err)
+		}
+		return
+	}
+
+	if err := os.Remove(processingPath); err != nil {
+		log.Printf("[%s] Error removing completed job: %v", job.RequestID, err)
+	}
+}
+
+// acquire marks an order as being handled, failing if a worker already is.
+// Jobs without an order ID are never serialized.
+func (q *OrderQueue) acquire(orderID string) bool {
+	if orderID == "" {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, busy := q.active[orderID]; busy {
+		return false
+	}
+	q.active[orderID] = make(chan struct{})
+	return true
+}
+
+// release frees an order and wakes a worker for jobs that waited on it
+func (q *OrderQueue) release(orderID string) {
+	if orderID == "" {
+		return
+	}
+	q.mu.Lock()
+	if done, ok := q.active[orderID]; ok {
+		close(done)
+		delete(q.active, orderID)
+	}
+	q.mu.Unlock()
+
+	q.wake()
+}
+
+// Lock waits until no worker is handling the order and keeps the workers
+// off it until Unlock. Admin actions that send an order to AX outside the
+// queue take it so they never run alongside a queued job of the same order.
+func (q *OrderQueue) Lock(ctx context.Context, orderID string) error {
+	for {
+		if q.acquire(orderID) {
+			return nil
+		}
+
+		q.mu.Lock()
+		done, busy := q.active[orderID]
+		q.mu.Unlock()
+		if !busy {
+			continue
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Unlock releases an order taken with Lock
+func (q *OrderQueue) Unlock(orderID string) {
+	q.release(orderID)
+}
+
+// list returns the job file names in dir sorted oldest first
+func (q *OrderQueue) list(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Error reading queue directory %s: %v", dir, err)
+		return nil
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// readQueuedOrder loads a job file from disk
+func readQueuedOrder(path string) (*QueuedOrder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var job QueuedOrder
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// queueWorkers returns the configured number of queue workers
+func queueWorkers() int {
+	if value := os.Getenv("QUEUE_WORKERS"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Warning: invalid QUEUE_WORKERS %q, using %d", value, DefaultQueueWorkers)
+	}
+	return DefaultQueueWorkers
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderQueueSerializesJobsPerOrder(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+
+	var (
+		mu      sync.Mutex
+		running = make(map[string]int)
+		seen    = make(map[string][]string)
+		done    sync.WaitGroup
+	)
+
+	queue, err := NewOrderQueue(func(job *QueuedOrder) error {
+		defer done.Done()
+
+		mu.Lock()
+		running[job.OrderID]++
+		concurrent := running[job.OrderID]
+		seen[job.OrderID] = append(seen[job.OrderID], job.ID)
+		mu.Unlock()
+
+		if concurrent > 1 {
+			t.Errorf("order %s handled by %d workers at once", job.OrderID, concurrent)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running[job.OrderID]--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders := []string{"1", "2", "3"}
+	const jobsPerOrder = 5
+	want := make(map[string][]string)
+	for i := 0; i < jobsPerOrder; i++ {
+		for _, order := range orders {
+			id := fmt.Sprintf("job-%s-%d", order, i)
+			want[order] = append(want[order], id)
+			done.Add(1)
+			if err := queue.Enqueue(&QueuedOrder{ID: id, RequestID: id, OrderID: order}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	queue.Start(4)
+
+	finished := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("queue did not drain")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, order := range orders {
+		if fmt.Sprint(seen[order]) != fmt.Sprint(want[order]) {
+			t.Errorf("order %s jobs ran as %v, want %v", order, seen[order], want[order])
+		}
+	}
+}
+
+func TestOrderQueueAcquire(t *testing.T) {
+	q := &OrderQueue{notify: make(chan struct{}, 1), active: make(map[string]chan struct{})}
+
+	if !q.acquire("1") {
+		t.Fatal("first acquire of order 1 failed")
+	}
+	if q.acquire("1") {
+		t.Error("second acquire of order 1 succeeded while held")
+	}
+	if !q.acquire("2") {
+		t.Error("acquire of order 2 blocked by order 1")
+	}
+	if !q.acquire("") || !q.acquire("") {
+		t.Error("jobs without an order ID should never block")
+	}
+
+	q.release("1")
+	if !q.acquire("1") {
+		t.Error("acquire of order 1 failed after release")
+	}
+}
+
+func TestOrderQueueFailedJobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		enqueue func(q *OrderQueue) error
+	}{
+		{
+			name: "handler error",
+			enqueue: func(q *OrderQueue) error {
+				return q.Enqueue(&QueuedOrder{ID: "fail", RequestID: "fail", OrderID: "1"})
+			},
+		},
+		{
+			name: "unreadable job",
+			enqueue: func(q *OrderQueue) error {
+				return os.WriteFile(filepath.Join(q.pendingDir, "00000000000000000001_broken.json"), []byte("{"), 0644)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DATA_DIR", t.TempDir())
+			queue, err := NewOrderQueue(func(job *QueuedOrder) error {
+				return errors.New("boom")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.enqueue(queue); err != nil {
+				t.Fatal(err)
+			}
+
+			if !queue.processNext(1) {
+				t.Fatal("processNext() found no job")
+			}
+			if queue.Depth() != 0 || queue.Failed() != 1 {
+				t.Errorf("depth = %d, failed = %d, want 0 and 1", queue.Depth(), queue.Failed())
+			}
+		})
+	}
+}
+
+func TestOrderQueueOnFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		hookErr    error
+		wantFailed int
+	}{
+		{name: "hook takes the job"},
+		{name: "hook fails", hookErr: errors.New("disk full"), wantFailed: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DATA_DIR", t.TempDir())
+			queue, err := NewOrderQueue(func(job *QueuedOrder) error {
+				return errors.New("boom")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var handedOver []string
+			queue.OnFailure(func(job *QueuedOrder, err error) error {
+				handedOver = append(handedOver, job.ID+": "+err.Error())
+				return tt.hookErr
+			})
+			if err := queue.Enqueue(&QueuedOrder{ID: "fail", RequestID: "fail", OrderID: "1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			queue.processNext(1)
+			if len(handedOver) != 1 || handedOver[0] != "fail: boom" {
+				t.Errorf("hook received %v, want the failed job", handedOver)
+			}
+			if queue.Failed() != tt.wantFailed {
+				t.Errorf("failed jobs = %d, want %d", queue.Failed(), tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestOrderQueueLock(t *testing.T) {
+	q := &OrderQueue{notify: make(chan struct{}, 1), active: make(map[string]chan struct{})}
+	if !q.acquire("1") {
+		t.Fatal("acquire of order 1 failed")
+	}
+
+	tests := []struct {
+		name    string
+		orderID string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{name: "free order", orderID: "2", timeout: time.Second},
+		{name: "order held by a worker", orderID: "1", timeout: 10 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			if err := q.Lock(ctx, tt.orderID); (err != nil) != tt.wantErr {
+				t.Fatalf("Lock() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	if q.acquire("2") {
+		t.Error("worker acquired an order taken with Lock")
+	}
+	q.Unlock("2")
+	if !q.acquire("2") {
+		t.Error("worker could not acquire an unlocked order")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		q.Lock(context.Background(), "1")
+		close(locked)
+	}()
+	q.release("1")
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock() did not return after the worker released the order")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// Reconciliation modes, set with RECONCILE_MODE
+	ReconcileOff   = "off"
+	ReconcileWarn  = "warn"
+	ReconcileBlock = "block"
+
+	DefaultReconcileTolerance = "0.01"
+)
+
+// ErrTotalsMismatch is returned for orders refused by a blocking reconciliation
+var ErrTotalsMismatch = errors.New("order totals do not reconcile")
+
+// ReconcileConfig controls the totals check run by transformOrder
+type ReconcileConfig struct {
+	Mode      string
+	Tolerance Money // largest difference accepted between Shopify's and the computed total
+}
+
+// ReconciliationIssue is a Shopify amount that does not match the amounts it
+// is made of, or that has more decimals than the currency allows
+type ReconciliationIssue struct {
+	Check    string `json:"check"` // "precision", "subtotal", "total" or "tax"
+	Field    string `json:"field"`
+	Expected Money  `json:"expected"` // the amount Shopify sent
+	Computed Money  `json:"computed"`
+}
+
+func (i ReconciliationIssue) String() string {
+	if i.Check == "precision" {
+		return fmt.Sprintf("%s %s has more decimals than the currency allows", i.Field, i.Expected)
+	}
+	return fmt.Sprintf("%s is %s but its parts add up to %s", i.Field, i.Expected, i.Computed)
+}
+
+// NewReconcileConfig reads RECONCILE_MODE (off, warn or block, default warn)
+// and RECONCILE_TOLERANCE (default 0.01)
+func NewReconcileConfig() ReconcileConfig {
+	cfg := ReconcileConfig{
+		Mode:      ReconcileWarn,
+		Tolerance: MustParseMoney(DefaultReconcileTolerance),
+	}
+
+	if value := os.Getenv("RECONCILE_MODE"); value != "" {
+		switch mode := strings.ToLower(value); mode {
+		case ReconcileOff, ReconcileWarn, ReconcileBlock:
+			cfg.Mode = mode
+		default:
+			log.Printf("Warning: invalid RECONCILE_MODE %q, using %s", value, ReconcileWarn)
+		}
+	}
+
+	if value := os.Getenv("RECONCILE_TOLERANCE"); value != "" {
+		tolerance, err := ParseMoney(value)
+		if err != nil || tolerance.Sign() < 0 {
+			log.Printf("Warning: invalid RECONCILE_TOLERANCE %q, using %s", value, DefaultReconcileTolerance)
+		} else {
+			cfg.Tolerance = tolerance
+		}
+	}
+	return cfg
+}
+
+// Describe returns a summary of the configuration for the startup log
+func (c ReconcileConfig) Describe() string {
+	if c.Mode == ReconcileOff {
+		return ReconcileOff
+	}
+	return fmt.Sprintf("%s (tolerance %s)", c.Mode, c.Tolerance)
+}
+
+// Check recomputes an order's subtotal, tax and total from its lines,
+// discounts, shipping and tax lines, using the ordered quantities like
+// total_price does, and returns the amounts that do not match
+func (c ReconcileConfig) Check(order *ShopifyOrder) []ReconciliationIssue {
+	var issues []ReconciliationIssue
+	digits := currencyDigits(order.Currency)
+	precision := func(field string, amount Money) {
+		if rounded := amount.Round(digits); !rounded.Equal(amount) {
+			issues = append(issues, ReconciliationIssue{Check: "precision", Field: field, Expected: amount, Computed: rounded})
+		}
+	}
+	compare := func(check, field string, expected, computed Money) {
+		if expected.Sub(computed).Abs().Cmp(c.Tolerance) > 0 {
+			issues = append(issues, ReconciliationIssue{Check: check, Field: field, Expected: expected, Computed: computed})
+		}
+	}
+
+	precision("total_price", order.TotalPrice)
+	precision("subtotal_price", order.SubtotalPrice)
+	precision("total_tax", order.TotalTax)
+	precision("total_discounts", order.TotalDiscounts)
+
+	// Line discounts include the lines' share of order-level discount codes
+	var subtotal Money
+	for _, item := range order.LineItems {
+		precision(fmt.Sprintf("line %d price", item.ID), item.Price)
+		precision(fmt.Sprintf("line %d total_discount", item.ID), item.TotalDiscount)
+		subtotal = subtotal.Add(item.Price.Mul(item.Quantity)).Sub(item.TotalDiscount)
+	}
+	compare("subtotal", "subtotal_price", order.SubtotalPrice, subtotal)
+
+	var shipping Money
+	for _, line := range order.ShippingLines {
+		precision(fmt.Sprintf("shipping line %d price", line.ID), line.Price)
+		shipping = shipping.Add(line.chargedPrice())
+	}
+
+	if len(order.TaxLines) > 0 {
+		var tax Money
+		for _, line := range order.TaxLines {
+			precision(fmt.Sprintf("tax line %q price", line.Title), line.Price)
+			tax = tax.Add(line.Price)
+		}
+		compare("tax", "total_tax", order.TotalTax, tax)
+	}
+
+	total := subtotal.Add(shipping).Add(order.TotalTipReceived)
+	if !order.TaxesIncluded {
+		total = total.Add(order.TotalTax)
+	}
+	compare("total", "total_price", order.TotalPrice, total)
+
+	return issues
+}
+
+// checkReconciliation logs the reconciliation issues of a transformed order.
+// In block mode an order with issues is refused with ErrTotalsMismatch.
+func (s *Server) checkReconciliation(order *ERPOrder, requestID string) error {
+	if len(order.Reconciliation) == 0 {
+		return nil
+	}
+
+	details := make([]string, len(order.Reconciliation))
+	for i, issue := range order.Reconciliation {
+		details[i] = issue.String()
+		log.Printf("[%s] Warning: order %s does not reconcile: %s", requestID, order.OrderID, issue)
+	}
+	if s.reconcile.Mode == ReconcileBlock {
+		return fmt.Errorf("%w: %s", ErrTotalsMismatch, strings.Join(details, "; "))
+	}
+	return nil
+}
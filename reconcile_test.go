@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func issueFields(issues []ReconciliationIssue) []string {
+	fields := []string{}
+	for _, issue := range issues {
+		fields = append(fields, issue.Field)
+	}
+	return fields
+}
+
+func TestReconcileFixtures(t *testing.T) {
+	data, err := os.ReadFile("test-data/reconciliation.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []struct {
+		Name   string       `json:"name"`
+		Issues []string     `json:"issues"`
+		Order  ShopifyOrder `json:"order"`
+	}
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+
+	config := ReconcileConfig{Mode: ReconcileBlock, Tolerance: MustParseMoney(DefaultReconcileTolerance)}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			got := issueFields(config.Check(&tt.Order))
+			if fmt.Sprint(got) != fmt.Sprint(tt.Issues) {
+				t.Errorf("issues = %v, want %v", got, tt.Issues)
+			}
+		})
+	}
+}
+
+func TestReconcileCheck(t *testing.T) {
+	order := func(edit func(o *ShopifyOrder)) *ShopifyOrder {
+		o := &ShopifyOrder{
+			Currency:      "EUR",
+			SubtotalPrice: MustParseMoney("20.00"),
+			TotalTax:      MustParseMoney("2.00"),
+			TotalPrice:    MustParseMoney("27.00"),
+			LineItems:     []LineItem{{ID: 1, Quantity: 2, Price: MustParseMoney("10.00")}},
+			ShippingLines: []ShippingLine{{ID: 1, Price: MustParseMoney("5.00")}},
+		}
+		if edit != nil {
+			edit(o)
+		}
+		return o
+	}
+	discounted := MustParseMoney("3.00")
+
+	tests := []struct {
+		name      string
+		order     *ShopifyOrder
+		tolerance string
+		want      []string
+	}{
+		{name: "balanced", order: order(nil), want: []string{}},
+		{name: "within tolerance", order: order(func(o *ShopifyOrder) { o.TotalPrice = MustParseMoney("27.01") }), want: []string{}},
+		{name: "outside tolerance", order: order(func(o *ShopifyOrder) { o.TotalPrice = MustParseMoney("27.02") }), want: []string{"total_price"}},
+		{name: "zero tolerance", order: order(func(o *ShopifyOrder) { o.TotalPrice = MustParseMoney("27.01") }), tolerance: "0", want: []string{"total_price"}},
+		{
+			name: "line discount",
+			order: order(func(o *ShopifyOrder) {
+				o.LineItems[0].TotalDiscount = MustParseMoney("4.00")
+				o.SubtotalPrice = MustParseMoney("16.00")
+				o.TotalPrice = MustParseMoney("23.00")
+			}),
+			want: []string{},
+		},
+		{
+			name: "discounted shipping",
+			order: order(func(o *ShopifyOrder) {
+				o.ShippingLines[0].DiscountedPrice = &discounted
+				o.TotalPrice = MustParseMoney("25.00")
+			}),
+			want: []string{},
+		},
+		{
+			name:  "taxes included",
+			order: order(func(o *ShopifyOrder) { o.TaxesIncluded = true; o.TotalPrice = MustParseMoney("25.00") }),
+			want:  []string{},
+		},
+		{
+			name: "tip",
+			order: order(func(o *ShopifyOrder) {
+				o.TotalTipReceived = MustParseMoney("3.00")
+				o.TotalPrice = MustParseMoney("30.00")
+			}),
+			want: []string{},
+		},
+		{
+			name:  "tax lines do not add up",
+			order: order(func(o *ShopifyOrder) { o.TaxLines = []TaxLine{{Title: "VAT", Price: MustParseMoney("1.50")}} }),
+			want:  []string{"total_tax"},
+		},
+		{
+			name:  "too many decimals",
+			order: order(func(o *ShopifyOrder) { o.LineItems[0].Price = MustParseMoney("10.001") }),
+			want:  []string{"line 1 price"},
+		},
+		{
+			name: "currency without decimals",
+			order: order(func(o *ShopifyOrder) {
+				o.Currency = "JPY"
+				o.TotalTax = MustParseMoney("2.50")
+				o.TotalPrice = MustParseMoney("27.50")
+			}),
+			want: []string{"total_price", "total_tax"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tolerance := DefaultReconcileTolerance
+			if tt.tolerance != "" {
+				tolerance = tt.tolerance
+			}
+			config := ReconcileConfig{Mode: ReconcileWarn, Tolerance: MustParseMoney(tolerance)}
+
+			got := issueFields(config.Check(tt.order))
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("issues = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckReconciliation(t *testing.T) {
+	issues := []ReconciliationIssue{{Check: "total", Field: "total_price", Expected: MustParseMoney("10.00"), Computed: MustParseMoney("9.00")}}
+
+	tests := []struct {
+		mode    string
+		issues  []ReconciliationIssue
+		wantErr bool
+	}{
+		{mode: ReconcileBlock, issues: issues, wantErr: true},
+		{mode: ReconcileWarn, issues: issues},
+		{mode: ReconcileBlock},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s with %d issues", tt.mode, len(tt.issues)), func(t *testing.T) {
+			s := &Server{reconcile: ReconcileConfig{Mode: tt.mode}}
+			err := s.checkReconciliation(&ERPOrder{OrderID: "1", Reconciliation: tt.issues}, "r1")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkReconciliation() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
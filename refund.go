@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Documents a Shopify refund can be booked as in AX
+	RefundReturnOrder = DestinationReturnOrder
+	RefundCreditNote  = DestinationCreditNote
+
+	DefaultReturnOperation     = "CreateReturnOrder"
+	DefaultReturnAction        = "http://tempuri.org/CreateReturnOrder"
+	DefaultCreditNoteOperation = "CreateCreditNote"
+	DefaultCreditNoteAction    = "http://tempuri.org/CreateCreditNote"
+)
+
+// ShopifyRefund is the refunds/create webhook payload
+type ShopifyRefund struct {
+	ID               int64                    `json:"id"`
+	OrderID          int64                    `json:"order_id"`
+	CreatedAt        string                   `json:"created_at"`
+	Note             string                   `json:"note"`
+	RefundLineItems  []ShopifyRefundLineItem  `json:"refund_line_items"`
+	Transactions     []ShopifyTransaction     `json:"transactions"`
+	OrderAdjustments []ShopifyOrderAdjustment `json:"order_adjustments"`
+}
+
+type ShopifyRefundLineItem struct {
+	ID          int64    `json:"id"`
+	LineItemID  int64    `json:"line_item_id"`
+	Quantity    int      `json:"quantity"`
+	RestockType string   `json:"restock_type"` // "no_restock", "cancel", "return" or "legacy_restock"
+	Subtotal    Money    `json:"subtotal"`
+	TotalTax    Money    `json:"total_tax"`
+	LineItem    LineItem `json:"line_item"`
+}
+
+type ShopifyTransaction struct {
+	ID       int64  `json:"id"`
+	Kind     string `json:"kind"`
+	Status   string `json:"status"`
+	Amount   Money  `json:"amount"`
+	Currency string `json:"currency"`
+	Gateway  string `json:"gateway"`
+}
+
+type ShopifyOrderAdjustment struct {
+	ID        int64  `json:"id"`
+	Kind      string `json:"kind"` // "shipping_refund" or "refund_discrepancy"
+	Reason    string `json:"reason"`
+	Amount    Money  `json:"amount"`
+	TaxAmount Money  `json:"tax_amount"`
+}
+
+// ERPRefund is a Shopify refund booked against an AX sales order
+type ERPRefund struct {
+	RefundID    string                `json:"refund_id"`
+	Kind        string                `json:"kind"` // "return_order" or "credit_note"
+	OrderID     string                `json:"order_id"`
+	OrderNumber string                `json:"order_number"`
+	SalesID     string                `json:"sales_id"`
+	CustAccount string                `json:"cust_account"` // account the sales order was posted against
+	Note        string                `json:"note"`
+	RefundDate  string                `json:"refund_date"`
+	Currency    string                `json:"currency"`
+	TotalAmount Money                 `json:"total_amount"` // sum of the successful refund transactions
+	Lines       []ERPRefundLine       `json:"lines"`
+	Adjustments []ERPRefundAdjustment `json:"adjustments"`
+	Timestamp   string                `json:"timestamp"`
+}
+
+type ERPRefundLine struct {
+	SKU         string       `json:"sku"`
+	ItemID      string       `json:"item_id"`
+	InventDim   ERPInventDim `json:"invent_dim"`
+	ProductName string       `json:"product_name"`
+	Quantity    int          `json:"quantity"`
+	UnitPrice   Money        `json:"unit_price"`
+	Amount      Money        `json:"amount"`
+	TaxAmount   Money        `json:"tax_amount"`
+	RestockType string       `json:"restock_type"`
+}
+
+// ERPRefundAdjustment is a refunded amount not tied to a line, e.g. shipping
+type ERPRefundAdjustment struct {
+	Kind      string `json:"kind"`
+	Reason    string `json:"reason"`
+	Amount    Money  `json:"amount"`
+	TaxAmount Money  `json:"tax_amount"`
+}
+
+// Returned reports whether the line's goods come back to the warehouse
+func (l ERPRefundLine) Returned() bool {
+	return l.RestockType == "return" || l.RestockType == "legacy_restock"
+}
+
+// transformRefund converts a Shopify refund for a mapped order into the AX
+// documents that book it. In credit_note mode that is a single credit note. In
+// return_order mode, returned lines go on a return order and everything else
+// (lines refunded without a return, shipping and other adjustments) on a
+// credit note, since AX has nothing to receive for those. Lines are resolved
+// to AX items like the order lines; unmapped lines keep the Shopify SKU.
+func transformRefund(refund *ShopifyRefund, mapping *OrderMapping, mode string, items *ItemMap) []*ERPRefund {
+	creditNote := &ERPRefund{
+		RefundID:    strconv.FormatInt(refund.ID, 10),
+		Kind:        RefundCreditNote,
+		OrderID:     mapping.ShopifyOrderID,
+		OrderNumber: mapping.ShopifyOrderNumber,
+		SalesID:     mapping.SalesID,
+		CustAccount: mapping.CustAccount,
+		Note:        refund.Note,
+		RefundDate:  refund.CreatedAt,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	// Only money that actually went back to the customer counts
+	var total Money
+	for _, transaction := range refund.Transactions {
+		if transaction.Kind != "refund" || transaction.Status != "success" {
+			continue
+		}
+		total = total.Add(transaction.Amount)
+		if creditNote.Currency == "" {
+			creditNote.Currency = transaction.Currency
+		}
+	}
+	digits := currencyDigits(creditNote.Currency)
+	creditNote.TotalAmount = total.Round(digits)
+
+	returnOrder := *creditNote
+	returnOrder.Kind = RefundReturnOrder
+	returnOrder.TotalAmount = Money{}
+
+	for _, item := range refund.RefundLineItems {
+		resolved, found := items.Resolve(item.LineItem.SKU, item.LineItem.VariantID)
+		if !found && resolved.ItemID == "" {
+			resolved.ItemID = item.LineItem.SKU
+		}
+		line := ERPRefundLine{
+			SKU:         item.LineItem.SKU,
+			ItemID:      resolved.ItemID,
+			InventDim:   resolved.ERPInventDim,
+			ProductName: item.LineItem.Title,
+			Quantity:    item.Quantity,
+			UnitPrice:   item.LineItem.Price.Round(digits),
+			Amount:      item.Subtotal.Round(digits),
+			TaxAmount:   item.TotalTax.Round(digits),
+			RestockType: item.RestockType,
+		}
+		if mode == RefundReturnOrder && line.Returned() {
+			returnOrder.Lines = append(returnOrder.Lines, line)
+			returnOrder.TotalAmount = returnOrder.TotalAmount.Add(line.Amount).Add(line.TaxAmount)
+			continue
+		}
+		creditNote.Lines = append(creditNote.Lines, line)
+	}
+
+	for _, adjustment := range refund.OrderAdjustments {
+		creditNote.Adjustments = append(creditNote.Adjustments, ERPRefundAdjustment{
+			Kind:      adjustment.Kind,
+			Reason:    adjustment.Reason,
+			Amount:    adjustment.Amount.Round(digits),
+			TaxAmount: adjustment.TaxAmount.Round(digits),
+		})
+	}
+
+	if len(returnOrder.Lines) == 0 {
+		return []*ERPRefund{creditNote}
+	}
+	// The credit note gets whatever the return order does not cover
+	creditNote.TotalAmount = creditNote.TotalAmount.Sub(returnOrder.TotalAmount)
+	if len(creditNote.Lines) == 0 && len(creditNote.Adjustments) == 0 && creditNote.TotalAmount.Sign() <= 0 {
+		return []*ERPRefund{&returnOrder}
+	}
+	return []*ERPRefund{&returnOrder, creditNote}
+}
+
+// RefundAction returns the default SOAPAction of a refund document for the configured format
+func (b *EnvelopeBuilder) RefundAction(kind string) string {
+	if b.config.Format == EnvelopeFormatAIF {
+		if kind == RefundCreditNote {
+			return AIFFreeTextInvoiceCreateAction
+		}
+		return AIFCreateAction
+	}
+	if kind == RefundCreditNote {
+		return DefaultCreditNoteAction
+	}
+	return DefaultReturnAction
+}
+
+// RefundMode returns the configured refund document, "return_order" or "credit_note"
+func (b *EnvelopeBuilder) RefundMode() string {
+	return b.config.RefundMode
+}
+
+// BuildRefund renders the SOAP envelope for a refund
+func (b *EnvelopeBuilder) BuildRefund(r *ERPRefund) (string, error) {
+	operation := b.config.ReturnOperation
+	if r.Kind == RefundCreditNote {
+		operation = b.config.CreditNoteOperation
+	}
+
+	if b.config.Format == EnvelopeFormatAIF {
+		if r.Kind == RefundCreditNote {
+			return b.buildAIFCreditNote(r)
+		}
+		return b.buildAIFReturnOrder(r)
+	}
+	if b.refundTemplate != nil {
+		return b.executeTemplate(b.refundTemplate, envelopeTemplateData{
+			Refund:            r,
+			EnvelopeNamespace: b.envelopeNamespace(r.Kind),
+			Operation:         operation,
+		})
+	}
+
+	el := b.element("refund", "refund")
+	el.add(b.text("RefundID", r.RefundID))
+	el.add(b.text("SalesId", r.SalesID))
+	el.add(b.text("CustAccount", r.CustAccount))
+	el.add(b.text("OrderID", r.OrderID))
+	el.add(b.text("OrderNumber", r.OrderNumber))
+	el.add(b.text("Note", r.Note))
+	el.add(b.text("RefundDate", r.RefundDate))
+	el.add(b.text("Currency", r.Currency))
+	el.add(b.text("TotalAmount", r.TotalAmount.String()))
+
+	lines := b.element("Lines", "Lines")
+	for _, line := range r.Lines {
+		item := b.element("Line", "Line")
+		item.add(b.text("SKU", line.SKU))
+		item.add(b.text("ItemID", line.ItemID))
+		item.add(b.inventDim(line.InventDim))
+		item.add(b.text("ProductName", line.ProductName))
+		item.add(b.text("Quantity", strconv.Itoa(line.Quantity)))
+		item.add(b.text("UnitPrice", line.UnitPrice.String()))
+		item.add(b.text("Amount", line.Amount.String()))
+		item.add(b.text("TaxAmount", line.TaxAmount.String()))
+		item.add(b.text("RestockType", line.RestockType))
+		lines.add(item)
+	}
+	el.add(lines)
+
+	adjustments := b.element("Adjustments", "Adjustments")
+	for _, adjustment := range r.Adjustments {
+		item := b.element("Adjustment", "Adjustment")
+		item.add(b.text("Kind", adjustment.Kind))
+		item.add(b.text("Reason", adjustment.Reason))
+		item.add(b.text("Amount", adjustment.Amount.String()))
+		item.add(b.text("TaxAmount", adjustment.TaxAmount.String()))
+		adjustments.add(item)
+	}
+	el.add(adjustments)
+
+	el.add(b.text("Timestamp", r.Timestamp))
+
+	prefix := b.config.Prefix
+	op := &xmlElement{
+		Name:     qualify(prefix, operation),
+		Attrs:    []xml.Attr{{Name: xml.Name{Local: "xmlns:" + prefix}, Value: b.config.Namespace}},
+		Children: []*xmlElement{el},
+	}
+	return marshalEnvelope(b.envelopeNamespace(r.Kind), nil, op)
+}
+
+// processRefundCreate books a Shopify refund in AX as a return order, a
+// credit note or both, referencing the order's SalesId
+func (s *Server) processRefundCreate(job *QueuedOrder) error {
+	var refund ShopifyRefund
+	if err := json.Unmarshal(job.Body, &refund); err != nil {
+		err = fmt.Errorf("failed to parse refund: %w", err)
+		s.dedupe.MarkFailed(job.WebhookID, "", job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+	refundID := strconv.FormatInt(refund.ID, 10)
+
+	// Either the SalesId is already known, or the pending creation will
+	// queue this refund again once it has one; orderMu makes sure one of
+	// the two happens
+	s.orderMu.Lock()
+	mapping, err := s.orderMap.ByShopifyOrder(job.OrderID)
+	_, delivered := s.dedupe.Delivered(job.OrderID)
+	deferred := errors.Is(err, ErrOrderMappingNotFound) && !delivered
+	if deferred {
+		err = s.refunds.Add(job)
+	}
+	s.orderMu.Unlock()
+
+	if errors.Is(err, ErrOrderMappingNotFound) {
+		// AX accepted the order but did not return a SalesId we could record
+		err = fmt.Errorf("order %s was accepted by AX but its SalesId is unknown, book refund %s in AX manually", job.OrderID, refundID)
+	}
+	if err != nil {
+		log.Printf("[%s] Refund %s: %v", job.RequestID, refundID, err)
+		s.dedupe.MarkFailed(job.WebhookID, "", job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+	if deferred {
+		log.Printf("[%s] Order %s is not in AX yet, refund %s will be booked once it is created", job.RequestID, job.OrderID, refundID)
+		s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, "")
+		return nil
+	}
+
+	if mapping.Status == OrderStatusCancelled {
+		log.Printf("[%s] Refund %s is for cancelled AX sales order %s, nothing to book", job.RequestID, refundID, mapping.SalesID)
+		s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, "")
+		return nil
+	}
+	var documentIDs []string
+	for _, erpRefund := range transformRefund(&refund, mapping, s.envelope.RefundMode(), s.items) {
+		if document := mapping.Refund(refundID, erpRefund.Kind); document != nil {
+			log.Printf("[%s] Refund %s was already booked in AX as %s %s", job.RequestID, refundID, document.Kind, document.DocumentID)
+			documentIDs = append(documentIDs, document.DocumentID)
+			continue
+		}
+
+		soapXML, err := s.envelope.BuildRefund(erpRefund)
+		if err != nil {
+			err = fmt.Errorf("failed to build SOAP envelope: %w", err)
+			s.dedupe.MarkFailed(job.WebhookID, "", job.RequestID, err)
+			return s.deadLetters.Add(job, nil, err)
+		}
+
+		log.Printf("[%s] Booking refund %s of order %s (%s %s) as %s", job.RequestID, refundID, job.OrderID, erpRefund.TotalAmount, erpRefund.Currency, erpRefund.Kind)
+		delivery, err := s.deliverSOAP(s.envelope.Destination(erpRefund.Kind), soapXML, job.OrderID, job.RequestID)
+		if err != nil {
+			// Documents booked so far are recorded, a retry only sends the rest
+			s.dedupe.MarkFailed(job.WebhookID, "", job.RequestID, err)
+			return s.deadLetters.Add(job, delivery, err)
+		}
+
+		document := RefundDocument{
+			RefundID:   refundID,
+			Kind:       erpRefund.Kind,
+			DocumentID: delivery.SalesID,
+			Amount:     erpRefund.TotalAmount,
+			RequestID:  job.RequestID,
+		}
+		if err := s.orderMap.AddRefund(job.OrderID, document); err != nil {
+			log.Printf("[%s] Error saving refund %s of order %s: %v", job.RequestID, refundID, job.OrderID, err)
+		}
+		log.Printf("[%s] Refund %s booked in AX as %s %s", job.RequestID, refundID, erpRefund.Kind, delivery.SalesID)
+		documentIDs = append(documentIDs, delivery.SalesID)
+	}
+	s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, strings.Join(documentIDs, ","))
+
+	// Clear any dead letter left from an earlier failed attempt
+	if err := s.deadLetters.Delete(job.ID); err != nil {
+		log.Printf("[%s] Error removing resolved dead letter: %v", job.RequestID, err)
+	}
+	return nil
+}
+
+// refundsAfterCreate queues the refund webhooks of an order that was
+// refunded before it reached AX
+func (s *Server) refundsAfterCreate(orderID, requestID string) {
+	refunds, err := s.refunds.TakeAll(orderID)
+	if err != nil {
+		log.Printf("[%s] Error reading pending refunds of order %s: %v", requestID, orderID, err)
+		return
+	}
+	for _, refund := range refunds {
+		refund.ID = generateRequestID()
+		refund.WebhookID = ""
+		refund.ReceivedAt = time.Now().UTC().Format(time.RFC3339)
+
+		log.Printf("[%s] Order %s was refunded before it reached AX, queued refund %s", requestID, orderID, refund.ID)
+		if err := s.queue.Enqueue(refund); err != nil {
+			err = fmt.Errorf("failed to queue refund: %w", err)
+			log.Printf("[%s] %v", requestID, err)
+			s.deadLetters.Add(refund, nil, err)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRefund builds a refund with one line per restock type and a
+// successful refund transaction of total
+func testRefund(total string, restockTypes []string, adjustments ...ShopifyOrderAdjustment) *ShopifyRefund {
+	refund := &ShopifyRefund{
+		ID:               7,
+		OrderID:          1001,
+		Transactions:     []ShopifyTransaction{{Kind: "refund", Status: "success", Amount: MustParseMoney(total), Currency: "EUR"}},
+		OrderAdjustments: adjustments,
+	}
+	for i, restockType := range restockTypes {
+		refund.RefundLineItems = append(refund.RefundLineItems, ShopifyRefundLineItem{
+			ID:          int64(i + 1),
+			Quantity:    1,
+			RestockType: restockType,
+			Subtotal:    MustParseMoney("10.00"),
+			TotalTax:    MustParseMoney("2.00"),
+			LineItem:    LineItem{SKU: "SKU-" + restockType, Title: restockType, Price: MustParseMoney("10.00")},
+		})
+	}
+	return refund
+}
+
+func TestTransformRefund(t *testing.T) {
+	shipping := ShopifyOrderAdjustment{Kind: "shipping_refund", Amount: MustParseMoney("-5.00")}
+
+	type document struct {
+		kind  string
+		lines int
+		total string
+	}
+	tests := []struct {
+		name   string
+		mode   string
+		refund *ShopifyRefund
+		want   []document
+	}{
+		{
+			name:   "credit note mode books everything on a credit note",
+			mode:   RefundCreditNote,
+			refund: testRefund("29.00", []string{"return", "no_restock"}, shipping),
+			want:   []document{{RefundCreditNote, 2, "29.00"}},
+		},
+		{
+			name:   "returned lines only",
+			mode:   RefundReturnOrder,
+			refund: testRefund("24.00", []string{"return", "legacy_restock"}),
+			want:   []document{{RefundReturnOrder, 2, "24.00"}},
+		},
+		{
+			name:   "nothing returned",
+			mode:   RefundReturnOrder,
+			refund: testRefund("12.00", []string{"no_restock"}),
+			want:   []document{{RefundCreditNote, 1, "12.00"}},
+		},
+		{
+			name:   "money only",
+			mode:   RefundReturnOrder,
+			refund: testRefund("3.00", nil),
+			want:   []document{{RefundCreditNote, 0, "3.00"}},
+		},
+		{
+			name:   "mixed lines are split",
+			mode:   RefundReturnOrder,
+			refund: testRefund("36.00", []string{"return", "no_restock", "cancel"}),
+			want:   []document{{RefundReturnOrder, 1, "12.00"}, {RefundCreditNote, 2, "24.00"}},
+		},
+		{
+			name:   "adjustments go on the credit note",
+			mode:   RefundReturnOrder,
+			refund: testRefund("17.00", []string{"return"}, shipping),
+			want:   []document{{RefundReturnOrder, 1, "12.00"}, {RefundCreditNote, 0, "5.00"}},
+		},
+	}
+
+	mapping := &OrderMapping{ShopifyOrderID: "1001", SalesID: "SO-1"}
+	items := &ItemMap{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			documents := transformRefund(tt.refund, mapping, tt.mode, items)
+			if len(documents) != len(tt.want) {
+				t.Fatalf("got %d documents, want %d", len(documents), len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := documents[i]
+				if got.Kind != want.kind || len(got.Lines) != want.lines || got.TotalAmount.String() != want.total {
+					t.Errorf("document %d = %s with %d lines for %s, want %s with %d lines for %s",
+						i, got.Kind, len(got.Lines), got.TotalAmount, want.kind, want.lines, want.total)
+				}
+				if got.Kind == RefundReturnOrder {
+					if len(got.Adjustments) > 0 {
+						t.Errorf("return order carries %d adjustments", len(got.Adjustments))
+					}
+					for _, line := range got.Lines {
+						if !line.Returned() {
+							t.Errorf("return order has %s line", line.RestockType)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBuildAIFReturnOrderRejectsAdjustments(t *testing.T) {
+	b := newTestAIFBuilder(t)
+	refund := &ERPRefund{
+		RefundID:    "7",
+		Kind:        RefundReturnOrder,
+		Lines:       []ERPRefundLine{{ItemID: "A", Quantity: 1, UnitPrice: MustParseMoney("10.00"), RestockType: "return"}},
+		Adjustments: []ERPRefundAdjustment{{Kind: "shipping_refund", Amount: MustParseMoney("-5.00")}},
+	}
+	if _, err := b.BuildRefund(refund); err == nil {
+		t.Error("BuildRefund() dropped the adjustments of a return order")
+	}
+}
+
+func TestProcessRefundCreateSplitsMixedRefunds(t *testing.T) {
+	s, erp := newTestServer(t, nil)
+	if err := s.orderMap.Put("1001", "#1001", "SO-1", "WEB", "r0"); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(testRefund("36.00", []string{"return", "no_restock", "cancel"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &QueuedOrder{ID: "r1", RequestID: "r1", Topic: TopicRefundsCreate, OrderID: "1001", Body: body}
+
+	if err := s.processRefundCreate(job); err != nil {
+		t.Fatal(err)
+	}
+	requests := erp.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("sent %d documents, want a return order and a credit note", len(requests))
+	}
+	if !strings.Contains(requests[0], DefaultReturnOperation) || !strings.Contains(requests[1], DefaultCreditNoteOperation) {
+		t.Errorf("documents sent were not a return order and a credit note:\n%s\n%s", requests[0], requests[1])
+	}
+
+	mapping, err := s.orderMap.ByShopifyOrder("1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.Refund("7", RefundReturnOrder) == nil || mapping.Refund("7", RefundCreditNote) == nil {
+		t.Errorf("refund documents = %+v, want both recorded", mapping.Refunds)
+	}
+
+	// A redelivery books nothing again
+	if err := s.processRefundCreate(job); err != nil {
+		t.Fatal(err)
+	}
+	if len(erp.Requests()) != 2 {
+		t.Errorf("redelivered refund was booked again")
+	}
+}
+
+func TestProcessRefundCreateWaitsForCreate(t *testing.T) {
+	refundJob := func(id string, refundID int64) *QueuedOrder {
+		refund := testRefund("12.00", []string{"return"})
+		refund.ID = refundID
+		body, err := json.Marshal(refund)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &QueuedOrder{ID: id, RequestID: id, Topic: TopicRefundsCreate, WebhookID: id, OrderID: "1001", Body: body}
+	}
+
+	tests := []struct {
+		name       string
+		delivered  bool // AX accepted the order without returning a SalesId
+		cancelled  bool
+		wantQueued int
+		wantLetter bool
+	}{
+		{name: "refunds are queued after the create", wantQueued: 2},
+		{name: "cancelled order drops the refunds", cancelled: true, wantQueued: 1},
+		{name: "delivered without SalesId", delivered: true, wantLetter: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, erp := newTestServer(t, nil)
+			if tt.delivered {
+				s.dedupe.Claim("w0", "1001", "create-0")
+				s.dedupe.MarkDelivered("w0", "1001", "create-0", "")
+			}
+
+			for i, job := range []*QueuedOrder{refundJob("r1", 7), refundJob("r2", 8)} {
+				s.dedupe.Claim(job.WebhookID, "", job.RequestID)
+				if err := s.processRefundCreate(job); err != nil {
+					t.Fatalf("refund %d: %v", i, err)
+				}
+			}
+			if len(erp.Requests()) != 0 {
+				t.Fatalf("ERP received %d requests before the order was created", len(erp.Requests()))
+			}
+			letters, _ := s.deadLetters.List("1001")
+			if (len(letters) != 0) != tt.wantLetter {
+				t.Fatalf("dead letters = %d, want dead-lettered %t", len(letters), tt.wantLetter)
+			}
+			if tt.wantLetter {
+				if record, _ := s.dedupe.Claim("r1", "", "again"); record == nil || record.Status != DeliveryFailed {
+					t.Errorf("delivery record = %+v, want failed", record)
+				}
+				return
+			}
+			if record, _ := s.dedupe.Claim("r1", "", "again"); record == nil || record.Status != DeliveryDelivered {
+				t.Errorf("delivery record = %+v, want delivered", record)
+			}
+
+			if tt.cancelled {
+				s.dedupe.RequestCancel("1001", "cancel-1")
+			}
+			s.recordCreatedOrder(&ERPOrder{OrderID: "1001"}, &ERPDelivery{SalesID: "SO-1"}, "create-1")
+
+			pending, _ := filepath.Glob(filepath.Join(os.Getenv("DATA_DIR"), "queue", "pending", "*.json"))
+			if len(pending) != tt.wantQueued {
+				t.Fatalf("queued jobs = %v, want %d", pending, tt.wantQueued)
+			}
+			refunds := map[int64]bool{}
+			for _, path := range pending {
+				job, err := readQueuedOrder(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if job.Topic != TopicRefundsCreate {
+					continue
+				}
+				var refund ShopifyRefund
+				if err := json.Unmarshal(job.Body, &refund); err != nil {
+					t.Fatal(err)
+				}
+				if job.WebhookID != "" || job.ID == "r1" || job.ID == "r2" {
+					t.Errorf("queued refund %s keeps webhook %q, want a new job", job.ID, job.WebhookID)
+				}
+				refunds[refund.ID] = true
+			}
+			if wantRefunds := !tt.cancelled; refunds[7] != wantRefunds || refunds[8] != wantRefunds {
+				t.Errorf("queued refunds = %v, want both queued %t", refunds, wantRefunds)
+			}
+			if jobs, _ := s.refunds.TakeAll("1001"); len(jobs) != 0 {
+				t.Errorf("%d refunds still pending after the create", len(jobs))
+			}
+		})
+	}
+}
+
+func TestBuildAIFCreditNote(t *testing.T) {
+	refund := func(custAccount string, lines []ERPRefundLine, adjustments ...ERPRefundAdjustment) *ERPRefund {
+		return &ERPRefund{
+			RefundID:    "7",
+			Kind:        RefundCreditNote,
+			OrderID:     "1001",
+			OrderNumber: "#1001",
+			SalesID:     "SO-1",
+			CustAccount: custAccount,
+			RefundDate:  "2024-05-02T09:30:00+02:00",
+			Currency:    "EUR",
+			TotalAmount: MustParseMoney("17.00"),
+			Lines:       lines,
+			Adjustments: adjustments,
+		}
+	}
+	line := ERPRefundLine{SKU: "SKU-A", ItemID: "A", ProductName: "Mug", Quantity: 2, Amount: MustParseMoney("12.00")}
+
+	tests := []struct {
+		name            string
+		env             map[string]string
+		refund          *ERPRefund
+		wantAccount     string
+		wantAmounts     []string
+		wantDescription []string
+		wantLedger      []string
+	}{
+		{
+			name: "lines and adjustments",
+			refund: refund("C-42", []ERPRefundLine{line},
+				ERPRefundAdjustment{Kind: "shipping_refund", Reason: "Shipping refund", Amount: MustParseMoney("-5.00")},
+				ERPRefundAdjustment{Kind: "refund_discrepancy", Amount: MustParseMoney("-0.01")}),
+			wantAccount:     "C-42",
+			wantAmounts:     []string{"-12.00", "-5.00", "-0.01"},
+			wantDescription: []string{"2 x Mug (SKU-A)", "Shipping refund", "refund_discrepancy"},
+		},
+		{
+			name:            "money only refund",
+			refund:          refund("", nil),
+			wantAccount:     "WEB",
+			wantAmounts:     []string{"-17.00"},
+			wantDescription: []string{"Refund of order #1001"},
+		},
+		{
+			name:            "ledger account",
+			env:             map[string]string{"AX_CREDIT_NOTE_ACCOUNT": "401100"},
+			refund:          refund("C-42", []ERPRefundLine{line}),
+			wantAccount:     "C-42",
+			wantAmounts:     []string{"-12.00"},
+			wantDescription: []string{"2 x Mug (SKU-A)"},
+			wantLedger:      []string{"401100"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AX_CREDIT_NOTE_ACCOUNT", "")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			b := newTestAIFBuilder(t)
+
+			envelope, err := b.BuildRefund(tt.refund)
+			if err != nil {
+				t.Fatal(err)
+			}
+			root, err := parseSOAPNode([]byte(envelope))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root.find("FreeTextInvoiceServiceCreateRequest") == nil {
+				t.Fatalf("envelope is not a FreeTextInvoiceService create request:\n%s", envelope)
+			}
+
+			texts := elementTexts(t, envelope)
+			want := map[string][]string{
+				"OrderAccount":      {tt.wantAccount},
+				"PurchOrderFormNum": {"SO-1"},
+				"CustomerRef":       {"#1001"},
+				"CurrencyCode":      {"EUR"},
+				"InvoiceDate":       {"2024-05-02"},
+				"AmountCur":         tt.wantAmounts,
+				"Description":       tt.wantDescription,
+				"DisplayValue":      tt.wantLedger,
+			}
+			for name, values := range want {
+				if strings.Join(texts[name], "|") != strings.Join(values, "|") {
+					t.Errorf("%s = %q, want %q", name, texts[name], values)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var ErrWebhookNotFound = errors.New("no stored incoming_webhook payload found")
+
+// StoredWebhook is an incoming_webhook entry read back from the log files
+type StoredWebhook struct {
+	RequestID string          `json:"request_id"`
+	Timestamp string          `json:"timestamp"`
+	Type      string          `json:"type"`
+	Headers   http.Header     `json:"headers"`
+	Body      json.RawMessage `json:"body"`
+	OrderID   string          `json:"order_id"`
+}
+
+// FindIncomingWebhook searches the incoming_webhook logs, newest file first,
+// for a payload by request ID or, failing that, the latest orders/create
+// payload for an order ID
+func (l *Logger) FindIncomingWebhook(requestID, orderID string) (*StoredWebhook, error) {
+	files, err := filepath.Glob(filepath.Join(l.logDir, "*_incoming_webhook.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+
+	for _, path := range files {
+		var match *StoredWebhook
+		err := scanLogFile(path, func(entry *StoredWebhook) {
+			if requestID != "" && entry.RequestID == requestID {
+				match = entry
+			} else if requestID == "" && orderID != "" && entry.OrderID == orderID && entry.Topic() == TopicOrdersCreate {
+				// Keep scanning, later entries in the file are newer
+				match = entry
+			}
+		})
+		if err != nil {
+			log.Printf("Error reading log file %s: %v", path, err)
+		}
+		if match != nil {
+			return match, nil
+		}
+	}
+
+	return nil, ErrWebhookNotFound
+}
+
+// Topic returns the webhook topic, defaulting to orders/create like handleWebhook
+func (w *StoredWebhook) Topic() string {
+	if topic := w.Headers.Get("X-Shopify-Topic"); topic != "" {
+		return topic
+	}
+	return TopicOrdersCreate
+}
+
+// scanLogFile decodes the stream of indented JSON entries written by writeLogEntry
+func scanLogFile(path string, visit func(*StoredWebhook)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var entry StoredWebhook
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		visit(&entry)
+	}
+}
+
+// ErrReplayRefused is returned for orders that must not be sent again
+var ErrReplayRefused = errors.New("replay refused")
+
+// ReplayRequest selects a stored webhook to resend to the ERP
+type ReplayRequest struct {
+	RequestID string `json:"request_id,omitempty"`
+	OrderID   string `json:"order_id,omitempty"`
+	DryRun    bool   `json:"dry_run,omitempty"`
+	Force     bool   `json:"force,omitempty"` // resend an order that was already delivered
+}
+
+// ReplayResult describes the outcome of a replay
+type ReplayResult struct {
+	Status          string       `json:"status"` // "dry_run", "success", "failed"
+	ReplayRequestID string       `json:"replay_request_id"`
+	SourceRequestID string       `json:"source_request_id"`
+	OrderID         string       `json:"order_id"`
+	SalesID         string       `json:"sales_id,omitempty"`
+	Envelope        string       `json:"envelope,omitempty"`
+	Attempts        []ERPAttempt `json:"attempts,omitempty"`
+	Error           string       `json:"error,omitempty"`
+}
+
+// replayOrder runs a stored webhook payload through the same steps as
+// processOrderCreate and sends it to the ERP again. Orders already in AX
+// are only resent with Force, cancelled orders never. The order is locked
+// against the queue workers from the dedupe check until it is recorded.
+func (s *Server) replayOrder(ctx context.Context, req ReplayRequest) (*ReplayResult, error) {
+	if req.RequestID == "" && req.OrderID == "" {
+		return nil, errors.New("request_id or order_id is required")
+	}
+
+	stored, err := s.logger.FindIncomingWebhook(req.RequestID, req.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if topic := stored.Topic(); topic != TopicOrdersCreate {
+		return nil, fmt.Errorf("request %s is a %s webhook, only %s can be replayed", stored.RequestID, topic, TopicOrdersCreate)
+	}
+
+	var shopifyOrder ShopifyOrder
+	if err := json.Unmarshal(stored.Body, &shopifyOrder); err != nil {
+		return nil, fmt.Errorf("stored payload is not a valid order: %w", err)
+	}
+
+	replayID := generateRequestID()
+	result := &ReplayResult{
+		ReplayRequestID: replayID,
+		SourceRequestID: stored.RequestID,
+		OrderID:         stored.OrderID,
+	}
+
+	if !req.DryRun {
+		if err := s.queue.Lock(ctx, stored.OrderID); err != nil {
+			return nil, err
+		}
+		defer s.queue.Unlock(stored.OrderID)
+
+		if previous, delivered := s.dedupe.Delivered(stored.OrderID); delivered && !req.Force {
+			return nil, fmt.Errorf("%w: order %s was already delivered as %s by request %s", ErrReplayRefused, stored.OrderID, previous.SalesID, previous.RequestID)
+		}
+		if s.dedupe.CancelRequested(stored.OrderID) {
+			return nil, fmt.Errorf("%w: order %s was cancelled", ErrReplayRefused, stored.OrderID)
+		}
+	}
+
+	erpOrder := s.transformOrder(&shopifyOrder)
+
+	if req.DryRun {
+		log.Printf("[%s] Dry-run replay of request %s (order %s)", replayID, stored.RequestID, stored.OrderID)
+		if err := s.prepareReplay(&shopifyOrder, erpOrder, replayID, true); err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			return result, nil
+		}
+		envelope, err := s.createSOAPEnvelope(erpOrder)
+		if err != nil {
+			return nil, err
+		}
+		result.Status = "dry_run"
+		result.Envelope = envelope
+		return result, nil
+	}
+
+	log.Printf("[%s] Replaying request %s (order %s) to ERP", replayID, stored.RequestID, stored.OrderID)
+	if err := s.prepareReplay(&shopifyOrder, erpOrder, replayID, false); err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+		return result, nil
+	}
+	delivery, err := s.sendToERP(erpOrder, replayID)
+	if delivery != nil {
+		result.Envelope = delivery.Envelope
+		result.Attempts = delivery.Attempts
+	}
+	if err != nil {
+		s.dedupe.MarkFailed(stored.Headers.Get("X-Shopify-Webhook-Id"), stored.OrderID, replayID, err)
+		result.Status = "failed"
+		result.Error = err.Error()
+		return result, nil
+	}
+
+	s.dedupe.MarkDelivered(stored.Headers.Get("X-Shopify-Webhook-Id"), stored.OrderID, replayID, delivery.SalesID)
+	s.recordCreatedOrder(erpOrder, delivery, replayID)
+	s.discardPendingCreate(stored.OrderID, replayID)
+
+	result.SalesID = delivery.SalesID
+	result.Status = "success"
+	return result, nil
+}
+
+// prepareReplay runs the checks processOrderCreate makes before sending.
+// A replay never holds an order, orders that would be held fail instead.
+func (s *Server) prepareReplay(order *ShopifyOrder, erpOrder *ERPOrder, requestID string, dryRun bool) error {
+	if _, err := s.validateOrder(order, erpOrder, requestID); err != nil {
+		return err
+	}
+	if err := s.checkReconciliation(erpOrder, requestID); err != nil {
+		return err
+	}
+	if err := s.checkItemMapping(erpOrder, requestID); err != nil {
+		return err
+	}
+	if err := s.checkContact(order, erpOrder, requestID); err != nil {
+		return err
+	}
+	return s.lookupCustomer(order, erpOrder, requestID, dryRun)
+}
+
+// handleReplay is the admin endpoint for replaying a stored webhook
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request) {
+	var req ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+
+	started := time.Now()
+	result, err := s.replayOrder(r.Context(), req)
+	if errors.Is(err, ErrWebhookNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, ErrReplayRefused) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("[%s] Replay finished with status %s in %s", result.ReplayRequestID, result.Status, time.Since(started))
+
+	status := http.StatusOK
+	if result.Status == "failed" {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, result)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const replayOrderBody = `{"id": 1001, "email": "jane@example.com", "currency": "EUR", "total_price": "10.00", "subtotal_price": "10.00",
+	"line_items": [{"id": 1, "sku": "A", "title": "A", "quantity": 1, "price": "10.00"}]}`
+
+// logWebhook stores an incoming webhook the way handleWebhook does
+func logWebhook(s *Server, requestID, topic, orderID, body string) {
+	headers := http.Header{}
+	headers.Set("X-Shopify-Topic", topic)
+	headers.Set("X-Shopify-Webhook-Id", "w-"+requestID)
+	s.logger.LogIncomingWebhook(requestID, headers, []byte(body), orderID)
+}
+
+func TestFindIncomingWebhook(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	logWebhook(s, "r1", TopicOrdersCreate, "1001", `{"id": 1001, "note": "first"}`)
+	logWebhook(s, "r2", TopicOrdersCreate, "1001", `{"id": 1001, "note": "second"}`)
+	logWebhook(s, "r3", TopicOrdersUpdated, "1001", `{"id": 1001, "note": "update"}`)
+
+	tests := []struct {
+		name      string
+		requestID string
+		orderID   string
+		want      string
+		wantErr   error
+	}{
+		{name: "by request ID", requestID: "r1", want: "r1"},
+		{name: "by request ID of another topic", requestID: "r3", want: "r3"},
+		{name: "latest create of an order", orderID: "1001", want: "r2"},
+		{name: "unknown request ID", requestID: "r9", wantErr: ErrWebhookNotFound},
+		{name: "unknown order", orderID: "2002", wantErr: ErrWebhookNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, err := s.logger.FindIncomingWebhook(tt.requestID, tt.orderID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FindIncomingWebhook() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && stored.RequestID != tt.want {
+				t.Errorf("found request %s, want %s", stored.RequestID, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleReplay(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		delivered    bool
+		wantStatus   int
+		wantRequests int
+		wantBody     string
+	}{
+		{name: "successful replay", body: `{"order_id": "1001"}`, wantStatus: http.StatusOK, wantRequests: 1, wantBody: `"sales_id":"SO-1"`},
+		{name: "dry run", body: `{"request_id": "r1", "dry_run": true}`, wantStatus: http.StatusOK, wantBody: `"status":"dry_run"`},
+		{name: "already delivered", body: `{"order_id": "1001"}`, delivered: true, wantStatus: http.StatusConflict},
+		{name: "forced replay of a delivered order", body: `{"order_id": "1001", "force": true}`, delivered: true, wantStatus: http.StatusOK, wantRequests: 1},
+		{name: "unknown request", body: `{"request_id": "r9"}`, wantStatus: http.StatusNotFound},
+		{name: "not an orders/create webhook", body: `{"request_id": "r2"}`, wantStatus: http.StatusBadRequest},
+		{name: "nothing selected", body: `{}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, erp := newTestServer(t, map[string]string{"ADMIN_TOKEN": "secret"})
+			logWebhook(s, "r1", TopicOrdersCreate, "1001", replayOrderBody)
+			logWebhook(s, "r2", TopicOrdersUpdated, "1001", replayOrderBody)
+			if tt.delivered {
+				s.dedupe.Claim("w-r1", "1001", "r1")
+				s.dedupe.MarkDelivered("w-r1", "1001", "r1", "SO-0")
+			}
+
+			req := httptest.NewRequest("POST", "/admin/replay", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			s.requireAdmin(s.handleReplay)(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want %s", rec.Body, tt.wantBody)
+			}
+			if len(erp.Requests()) != tt.wantRequests {
+				t.Errorf("ERP received %d requests, want %d", len(erp.Requests()), tt.wantRequests)
+			}
+			if tt.wantRequests > 0 {
+				if previous, ok := s.dedupe.Delivered("1001"); !ok || previous.SalesID != "SO-1" {
+					t.Errorf("delivery record = %+v, want SO-1", previous)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayWaitsForQueuedJob(t *testing.T) {
+	s, erp := newTestServer(t, nil)
+	logWebhook(s, "r1", TopicOrdersCreate, "1001", replayOrderBody)
+
+	// A worker is handling the order and delivers it meanwhile
+	if !s.queue.acquire("1001") {
+		t.Fatal("could not take the order")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.replayOrder(ctx, ReplayRequest{OrderID: "1001"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("replay while the order is locked = %v, want the context error", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.replayOrder(context.Background(), ReplayRequest{OrderID: "1001"})
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.dedupe.Claim("w-r1", "1001", "r1")
+	s.dedupe.MarkDelivered("w-r1", "1001", "r1", "SO-0")
+	s.queue.release("1001")
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrReplayRefused) {
+			t.Errorf("replay after the worker delivered the order = %v, want refused", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay did not resume after the worker released the order")
+	}
+	if len(erp.Requests()) != 0 {
+		t.Errorf("ERP received %d requests, want none", len(erp.Requests()))
+	}
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Review statuses
+const (
+	ReviewHeld      = "held"
+	ReviewApproved  = "approved"  // sent to AX by an admin
+	ReviewRejected  = "rejected"  // never to be sent to AX
+	ReviewCancelled = "cancelled" // closed because the order was cancelled in Shopify
+)
+
+// Audit actions recorded on held orders
+const (
+	AuditHeld          = "held"
+	AuditEdited        = "edited"
+	AuditApproved      = "approved"
+	AuditApproveFailed = "approve_failed"
+	AuditRejected      = "rejected"
+	AuditCancelled     = "cancelled"
+)
+
+// AuditSystem is the user recorded for changes made by the service itself
+const AuditSystem = "system"
+
+var (
+	ErrHeldOrderNotFound = errors.New("held order not found")
+	ErrReviewDecided     = errors.New("held order has already been decided")
+	ErrReviewBusy        = errors.New("held order is being sent to AX")
+
+	errInvalidEdit = errors.New("invalid edit")
+)
+
+// HeldOrder is an order kept back from AX until someone reviews it
+type HeldOrder struct {
+	ID        string          `json:"id"`
+	RequestID string          `json:"request_id"`
+	OrderID   string          `json:"order_id"`
+	Topic     string          `json:"topic,omitempty"`
+	WebhookID string          `json:"webhook_id,omitempty"`
+	Status    string          `json:"status"`
+	Reasons   []string        `json:"reasons"`
+	SalesID   string          `json:"sales_id,omitempty"` // set once approved
+	DecidedBy string          `json:"decided_by,omitempty"`
+	DecidedAt string          `json:"decided_at,omitempty"`
+	CreatedAt string          `json:"created_at"`
+	UpdatedAt string          `json:"updated_at"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Order     *ERPOrder       `json:"order,omitempty"` // the order as it will be sent to AX, including edits
+	Audit     []ReviewAudit   `json:"audit"`
+}
+
+// ReviewAudit records who did what to a held order
+type ReviewAudit struct {
+	At      string        `json:"at"`
+	User    string        `json:"user"`
+	Action  string        `json:"action"`
+	Changes []FieldChange `json:"changes,omitempty"`
+	Note    string        `json:"note,omitempty"`
+}
+
+// FieldChange is an ERP order field changed by an edit
+type FieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old"`
+	New   json.RawMessage `json:"new"`
+}
+
+// ReviewStore keeps one JSON file per held order under DATA_DIR/review.
+// Decided orders stay in the store with their audit trail.
+type ReviewStore struct {
+	mu      sync.Mutex
+	dir     string
+	sending map[string]bool // orders being approved, guarded by mu
+	held    map[string]bool // orders waiting for review, guarded by mu
+}
+
+// NewReviewStore creates the review directory and indexes the orders
+// waiting for review, so Count does not read the directory
+func NewReviewStore() (*ReviewStore, error) {
+	dir := filepath.Join(dataDir(), "review")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create review directory %s: %w", dir, err)
+	}
+
+	r := &ReviewStore{dir: dir, sending: make(map[string]bool), held: make(map[string]bool)}
+	entries, err := r.readAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read review directory %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if entry.Status == ReviewHeld {
+			r.held[entry.ID] = true
+		}
+	}
+	return r, nil
+}
+
+// Hold stores an order for review. Holding a job again, e.g. after a retry
+// from the dead-letter API, replaces the reasons and the ERP order.
+func (r *ReviewStore) Hold(job *QueuedOrder, order *ERPOrder, reasons []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	entry, err := r.read(job.ID)
+	if errors.Is(err, ErrHeldOrderNotFound) {
+		entry = &HeldOrder{
+			ID:        job.ID,
+			RequestID: job.RequestID,
+			OrderID:   job.OrderID,
+			Topic:     job.Topic,
+			WebhookID: job.WebhookID,
+			CreatedAt: now,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	entry.Status = ReviewHeld
+	entry.Reasons = reasons
+	entry.DecidedBy = ""
+	entry.DecidedAt = ""
+	entry.UpdatedAt = now
+	entry.Payload = job.Body
+	entry.Order = order
+	entry.Audit = append(entry.Audit, ReviewAudit{At: now, User: AuditSystem, Action: AuditHeld, Note: strings.Join(reasons, "; ")})
+
+	return r.write(entry)
+}
+
+// Get returns a single held order
+func (r *ReviewStore) Get(id string) (*HeldOrder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.read(id)
+}
+
+// Update applies a change to an order that is still held and saves it. The
+// update is rejected while the order is being sent to AX.
+func (r *ReviewStore) Update(id string, update func(entry *HeldOrder) error) (*HeldOrder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Status != ReviewHeld {
+		return nil, fmt.Errorf("%w: %s", ErrReviewDecided, entry.Status)
+	}
+	if r.sending[id] {
+		return nil, ErrReviewBusy
+	}
+	if err := update(entry); err != nil {
+		return nil, err
+	}
+
+	entry.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := r.write(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// BeginSend claims a held order for approval so it is sent to AX only once
+func (r *ReviewStore) BeginSend(id string) (*HeldOrder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Status != ReviewHeld {
+		return nil, fmt.Errorf("%w: %s", ErrReviewDecided, entry.Status)
+	}
+	if r.sending[id] {
+		return nil, ErrReviewBusy
+	}
+	r.sending[id] = true
+	return entry, nil
+}
+
+// EndSend releases an order claimed by BeginSend
+func (r *ReviewStore) EndSend(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sending, id)
+}
+
+// List returns held orders oldest first, without payloads. An empty status
+// lists the orders waiting for review, "all" lists every order.
+func (r *ReviewStore) List(status string) ([]HeldOrder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if status == "" {
+		status = ReviewHeld
+	}
+
+	entries, err := r.readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	held := []HeldOrder{}
+	for _, entry := range entries {
+		if status != "all" && entry.Status != status {
+			continue
+		}
+		entry.Payload = nil
+		held = append(held, *entry)
+	}
+
+	sort.Slice(held, func(i, j int) bool {
+		return held[i].CreatedAt < held[j].CreatedAt
+	})
+
+	return held, nil
+}
+
+// Cancel closes the held entries of a Shopify order that was cancelled and
+// returns them. Entries being sent to AX are left to the approval, which
+// sees the cancellation request once the order is created.
+func (r *ReviewStore) Cancel(orderID, note string) ([]*HeldOrder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries, err := r.readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var closed []*HeldOrder
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, entry := range entries {
+		if entry.OrderID != orderID || entry.Status != ReviewHeld || r.sending[entry.ID] {
+			continue
+		}
+		entry.Status = ReviewCancelled
+		entry.DecidedBy = AuditSystem
+		entry.DecidedAt = now
+		entry.UpdatedAt = now
+		entry.Audit = append(entry.Audit, ReviewAudit{At: now, User: AuditSystem, Action: AuditCancelled, Note: note})
+		if err := r.write(entry); err != nil {
+			return closed, err
+		}
+		closed = append(closed, entry)
+	}
+	return closed, nil
+}
+
+// Count returns the number of orders waiting for review
+func (r *ReviewStore) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.held)
+}
+
+// readAll loads every held order. Callers must hold r.mu.
+func (r *ReviewStore) readAll() ([]*HeldOrder, error) {
+	files, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*HeldOrder
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		entry, err := r.read(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			log.Printf("Error reading held order %s: %v", name, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// read loads a held order from disk. Callers must hold r.mu.
+func (r *ReviewStore) read(id string) (*HeldOrder, error) {
+	if !validStoreID.MatchString(id) {
+		return nil, ErrHeldOrderNotFound
+	}
+
+	data, err := os.ReadFile(r.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrHeldOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry HeldOrder
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// write saves a held order and keeps the held index in step. Callers must hold r.mu.
+func (r *ReviewStore) write(entry *HeldOrder) error {
+	if err := writeJSONFile(r.path(entry.ID), entry); err != nil {
+		return fmt.Errorf("failed to store held order: %w", err)
+	}
+	if entry.Status == ReviewHeld {
+		r.held[entry.ID] = true
+	} else {
+		delete(r.held, entry.ID)
+	}
+	return nil
+}
+
+func (r *ReviewStore) path(id string) string {
+	return filepath.Join(r.dir, id+".json")
+}
+
+// holdOrder keeps an order back from AX for manual review
+func (s *Server) holdOrder(job *QueuedOrder, order *ERPOrder, reasons ...string) error {
+	if err := s.review.Hold(job, order, reasons); err != nil {
+		s.dedupe.MarkFailed(job.WebhookID, job.OrderID, job.RequestID, err)
+		return s.deadLetters.Add(job, nil, err)
+	}
+	s.dedupe.MarkHeld(job.WebhookID, job.OrderID, job.RequestID)
+
+	// A held order replaces any dead letter left from an earlier attempt
+	if err := s.deadLetters.Delete(job.ID); err != nil {
+		log.Printf("[%s] Error removing resolved dead letter: %v", job.RequestID, err)
+	}
+
+	log.Printf("[%s] Order %s held for review: %s", job.RequestID, job.OrderID, strings.Join(reasons, "; "))
+	return nil
+}
+
+// Fields of a held order that cannot be edited
+var readOnlyOrderFields = map[string]bool{
+	"order_id":       true,
+	"timestamp":      true,
+	"reconciliation": true,
+}
+
+// editOrder applies a partial ERP order in JSON to order and returns the
+// fields that changed. Unknown and read-only fields are refused.
+func editOrder(order *ERPOrder, edit []byte) (*ERPOrder, []FieldChange, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(edit, &fields); err != nil {
+		return nil, nil, err
+	}
+	for field := range fields {
+		if readOnlyOrderFields[field] {
+			return nil, nil, fmt.Errorf("field %s cannot be edited", field)
+		}
+	}
+
+	// Decode onto a deep copy so the held order is untouched on errors
+	original, err := json.Marshal(order)
+	if err != nil {
+		return nil, nil, err
+	}
+	var edited ERPOrder
+	if err := json.Unmarshal(original, &edited); err != nil {
+		return nil, nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(edit))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&edited); err != nil {
+		return nil, nil, err
+	}
+
+	before, err := jsonFields(order)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := jsonFields(&edited)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var changes []FieldChange
+	for field := range fields {
+		oldValue, newValue := nullJSON(before[field]), nullJSON(after[field])
+		if !bytes.Equal(oldValue, newValue) {
+			changes = append(changes, FieldChange{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return &edited, changes, nil
+}
+
+// jsonFields returns the top-level JSON fields of an ERP order
+func jsonFields(order *ERPOrder) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+// nullJSON stands in JSON null for fields left out by omitempty
+func nullJSON(value json.RawMessage) json.RawMessage {
+	if value == nil {
+		return json.RawMessage("null")
+	}
+	return value
+}
+
+// readReviewNote reads the optional {"note": "..."} body of approve and reject requests
+func readReviewNote(r *http.Request) (string, error) {
+	var req struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(req.Note), nil
+}
+
+// writeReviewError writes the response for a failed review store operation
+func writeReviewError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrHeldOrderNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrReviewDecided), errors.Is(err, ErrReviewBusy):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// handleListHeldOrders lists held orders, by default those waiting for
+// review; ?status=approved, rejected or all lists the others
+func (s *Server) handleListHeldOrders(w http.ResponseWriter, r *http.Request) {
+	held, err := s.review.List(r.URL.Query().Get("status"))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":  len(held),
+		"orders": held,
+	})
+}
+
+// handleGetHeldOrder returns a held order including payload, ERP order and audit trail
+func (s *Server) handleGetHeldOrder(w http.ResponseWriter, r *http.Request) {
+	entry, err := s.review.Get(r.PathValue("id"))
+	if err != nil {
+		writeReviewError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// handleEditHeldOrder changes fields of the ERP order of a held order. The
+// body is a partial ERP order, e.g. {"cust_account": "C-1001"}; arrays such
+// as items are replaced as a whole.
+func (s *Server) handleEditHeldOrder(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireAdminUser(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var changes []FieldChange
+	entry, err := s.review.Update(r.PathValue("id"), func(entry *HeldOrder) error {
+		edited, fieldChanges, err := editOrder(entry.Order, body)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidEdit, err)
+		}
+		changes = fieldChanges
+		if len(changes) == 0 {
+			return nil
+		}
+		entry.Order = edited
+		entry.Audit = append(entry.Audit, ReviewAudit{
+			At:      time.Now().UTC().Format(time.RFC3339),
+			User:    user,
+			Action:  AuditEdited,
+			Changes: changes,
+		})
+		return nil
+	})
+	if errors.Is(err, errInvalidEdit) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeReviewError(w, err)
+		return
+	}
+
+	fields := make([]string, len(changes))
+	for i, change := range changes {
+		fields[i] = change.Field
+	}
+	log.Printf("[%s] Held order %s edited by %s: %s", entry.RequestID, entry.OrderID, user, strings.Join(fields, ", "))
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// handleApproveHeldOrder sends a held order to AX as edited. The approval
+// overrides the review rules that held it, not the checks that would have
+// stopped the order, see recheckHeldOrder.
+func (s *Server) handleApproveHeldOrder(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireAdminUser(w, r)
+	if !ok {
+		return
+	}
+	note, err := readReviewNote(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	id := r.PathValue("id")
+	entry, err := s.review.BeginSend(id)
+	if err != nil {
+		writeReviewError(w, err)
+		return
+	}
+	defer s.review.EndSend(id)
+
+	// Wait for a queue worker handling the same order, e.g. a replayed
+	// creation, and keep the workers off it until the approval is sent
+	if err := s.queue.Lock(r.Context(), entry.OrderID); err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, fmt.Sprintf("order %s is being processed, try again: %v", entry.OrderID, err))
+		return
+	}
+	defer s.queue.Unlock(entry.OrderID)
+
+	if previous, delivered := s.dedupe.Delivered(entry.OrderID); delivered {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("order %s was already delivered by request %s", entry.OrderID, previous.RequestID))
+		return
+	}
+	if s.dedupe.CancelRequested(entry.OrderID) {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("order %s was cancelled in Shopify, reject it instead", entry.OrderID))
+		return
+	}
+
+	order := entry.Order
+	var shopifyOrder ShopifyOrder
+	if err := json.Unmarshal(entry.Payload, &shopifyOrder); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to parse held order payload: "+err.Error())
+		return
+	}
+	if err := s.recheckHeldOrder(&shopifyOrder, order, entry.RequestID); err != nil {
+		s.recordApproveFailure(entry, user, err)
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	// Orders are held before their customer is resolved, unless an admin set the account
+	if order.CustAccount == "" {
+		if err := s.resolveCustomer(&shopifyOrder, order, entry.RequestID); err != nil {
+			s.recordApproveFailure(entry, user, err)
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+
+	log.Printf("[%s] Held order %s approved by %s, sending to ERP", entry.RequestID, entry.OrderID, user)
+	delivery, err := s.sendToERP(order, entry.RequestID)
+	if err != nil {
+		s.recordApproveFailure(entry, user, err)
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	s.dedupe.MarkDelivered(entry.WebhookID, entry.OrderID, entry.RequestID, delivery.SalesID)
+
+	s.recordCreatedOrder(order, delivery, entry.RequestID)
+
+	s.review.EndSend(id)
+	_, err = s.review.Update(id, func(entry *HeldOrder) error {
+		now := time.Now().UTC().Format(time.RFC3339)
+		entry.Status = ReviewApproved
+		entry.Order = order
+		entry.SalesID = delivery.SalesID
+		entry.DecidedBy = user
+		entry.DecidedAt = now
+		entry.Audit = append(entry.Audit, ReviewAudit{At: now, User: user, Action: AuditApproved, Note: note})
+		return nil
+	})
+	if err != nil {
+		// The order is in AX; only the review record is out of date
+		log.Printf("[%s] Error recording approval of held order %s: %v", entry.RequestID, id, err)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":     ReviewApproved,
+		"id":         id,
+		"order_id":   order.OrderID,
+		"request_id": entry.RequestID,
+		"sales_id":   delivery.SalesID,
+	})
+}
+
+// recheckHeldOrder prepares an approved order for sending. Its items are
+// resolved through the item map again, so mappings added while it was held
+// apply and edits cannot send items the map does not know. Validation,
+// reconciliation and the item mapping check then run on the order as edited;
+// review rules are what the admin approves, anything blocking is returned.
+func (s *Server) recheckHeldOrder(shopifyOrder *ShopifyOrder, order *ERPOrder, requestID string) error {
+	lines := make(map[string]LineItem, len(shopifyOrder.LineItems))
+	for _, line := range shopifyOrder.LineItems {
+		lines[fmt.Sprintf("%d", line.ID)] = line
+	}
+	for i := range order.Items {
+		item := &order.Items[i]
+
+		// The variant only identifies the line while its SKU is not edited
+		var variantID int64
+		if line, ok := lines[item.LineID]; ok && line.SKU == item.SKU {
+			variantID = line.VariantID
+		}
+		mapping, mapped := s.items.Resolve(item.SKU, variantID)
+		if item.ItemID != "" && item.ItemID != mapping.ItemID {
+			log.Printf("[%s] Line %s of held order %s is sent as AX item %q instead of %q per the item map",
+				requestID, item.LineID, order.OrderID, mapping.ItemID, item.ItemID)
+		}
+		item.ItemID = mapping.ItemID
+		item.InventDim = mapping.ERPInventDim
+		item.Unmapped = !mapped
+	}
+
+	order.Reconciliation = nil
+	if s.reconcile.Mode != ReconcileOff {
+		order.Reconciliation = s.reconcile.Check(shopifyOrder)
+	}
+
+	if review, err := s.validateOrder(shopifyOrder, order, requestID); err != nil && !review {
+		return err
+	}
+	if err := s.checkReconciliation(order, requestID); err != nil {
+		return err
+	}
+	return s.checkItemMapping(order, requestID)
+}
+
+// recordApproveFailure adds a failed approval to the audit trail; the order stays held
+func (s *Server) recordApproveFailure(held *HeldOrder, user string, cause error) {
+	s.review.EndSend(held.ID)
+	_, err := s.review.Update(held.ID, func(entry *HeldOrder) error {
+		entry.Audit = append(entry.Audit, ReviewAudit{
+			At:     time.Now().UTC().Format(time.RFC3339),
+			User:   user,
+			Action: AuditApproveFailed,
+			Note:   cause.Error(),
+		})
+		return nil
+	})
+	if err != nil {
+		log.Printf("[%s] Error recording failed approval of held order %s: %v", held.RequestID, held.ID, err)
+	}
+	log.Printf("[%s] Approval of held order %s by %s failed: %v", held.RequestID, held.OrderID, user, cause)
+}
+
+// handleRejectHeldOrder marks a held order as never to be sent to AX
+func (s *Server) handleRejectHeldOrder(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireAdminUser(w, r)
+	if !ok {
+		return
+	}
+	note, err := readReviewNote(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	entry, err := s.review.Update(r.PathValue("id"), func(entry *HeldOrder) error {
+		now := time.Now().UTC().Format(time.RFC3339)
+		entry.Status = ReviewRejected
+		entry.DecidedBy = user
+		entry.DecidedAt = now
+		entry.Audit = append(entry.Audit, ReviewAudit{At: now, User: user, Action: AuditRejected, Note: note})
+		return nil
+	})
+	if err != nil {
+		writeReviewError(w, err)
+		return
+	}
+	s.dedupe.MarkRejected(entry.WebhookID, entry.OrderID, entry.RequestID)
+
+	log.Printf("[%s] Held order %s rejected by %s", entry.RequestID, entry.OrderID, user)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":   ReviewRejected,
+		"id":       entry.ID,
+		"order_id": entry.OrderID,
+	})
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEditOrder(t *testing.T) {
+	order := &ERPOrder{
+		OrderID:        "1001",
+		CustomerEmail:  "jane@example.com",
+		CustAccount:    "",
+		Currency:       "EUR",
+		Items:          []ERPItem{{LineID: "1", SKU: "A", ItemID: "A", Quantity: 1, UnitPrice: MustParseMoney("10.00")}},
+		BillingAddress: &ERPAddress{Name: "Jane Doe", City: "Berlin"},
+	}
+
+	tests := []struct {
+		name        string
+		edit        string
+		wantChanges []string
+		wantErr     bool
+	}{
+		{name: "set account", edit: `{"cust_account": "C-1001"}`, wantChanges: []string{"cust_account"}},
+		{name: "unchanged value", edit: `{"currency": "EUR"}`},
+		{name: "changes are sorted", edit: `{"customer_email": "j@example.com", "cust_account": "C-1001"}`, wantChanges: []string{"cust_account", "customer_email"}},
+		{name: "items are replaced", edit: `{"items": [{"line_id": "1", "sku": "B", "quantity": 2}]}`, wantChanges: []string{"items"}},
+		{name: "address removed", edit: `{"billing_address": null}`, wantChanges: []string{"billing_address"}},
+		{name: "read-only field", edit: `{"order_id": "1002"}`, wantErr: true},
+		{name: "reconciliation is read-only", edit: `{"reconciliation": []}`, wantErr: true},
+		{name: "unknown field", edit: `{"cust_acount": "C-1001"}`, wantErr: true},
+		{name: "wrong type", edit: `{"items": "A"}`, wantErr: true},
+		{name: "invalid JSON", edit: `{"cust_account":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := json.Marshal(order)
+
+			edited, changes, err := editOrder(order, []byte(tt.edit))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("editOrder() error = %v, want error %t", err, tt.wantErr)
+			}
+			if after, _ := json.Marshal(order); string(after) != string(before) {
+				t.Errorf("editOrder() modified the held order:\n%s", after)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var fields []string
+			for _, change := range changes {
+				fields = append(fields, change.Field)
+				if string(change.Old) == string(change.New) {
+					t.Errorf("change of %s has equal old and new value %s", change.Field, change.Old)
+				}
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.wantChanges, ",") {
+				t.Errorf("changed fields = %v, want %v", fields, tt.wantChanges)
+			}
+			if edited.OrderID != order.OrderID {
+				t.Errorf("edited order ID = %q, want %q", edited.OrderID, order.OrderID)
+			}
+		})
+	}
+}
+
+// reviewRequest calls a review handler through requireAdmin for held order id
+func reviewRequest(s *Server, handler http.HandlerFunc, method, id, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/admin/review/"+id, strings.NewReader(body))
+	req.SetPathValue("id", id)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	s.requireAdmin(handler)(rec, req)
+	return rec
+}
+
+func TestReviewDecisionsNeedAdminUser(t *testing.T) {
+	s, _ := newTestServer(t, map[string]string{"ADMIN_TOKEN": "shared-token", "ADMIN_TOKENS": "alice:a-token"})
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+	}{
+		{name: "edit", handler: s.handleEditHeldOrder, method: "PATCH", body: `{"cust_account": "C-1"}`},
+		{name: "approve", handler: s.handleApproveHeldOrder, method: "POST"},
+		{name: "reject", handler: s.handleRejectHeldOrder, method: "POST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := reviewRequest(s, tt.handler, tt.method, "r1", "shared-token", tt.body)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("status with the shared token = %d, want %d", rec.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestApproveHeldOrderRechecks(t *testing.T) {
+	// Orders over 100 are held for review, orders without an email are blocked
+	const validation = `{"rules": [
+		{"field": "total_amount", "op": "lte", "value": "100", "action": "review"},
+		{"field": "customer_email", "op": "required", "action": "block"}
+	]}`
+	const itemMap = "sku, item_id\nTSHIRT-RED-L, AX-TSHIRT\n"
+	order := func(sku, total, linePrice string) string {
+		return `{"id": 1001, "email": "jane@example.com", "currency": "EUR", "total_price": "` + total +
+			`", "subtotal_price": "` + total + `", "line_items": [{"id": 1, "sku": "` + sku +
+			`", "title": "Shirt", "quantity": 1, "price": "` + linePrice + `"}]}`
+	}
+
+	tests := []struct {
+		name         string
+		env          map[string]string
+		payload      string
+		edit         string
+		mapAfterHold string // item map contents loaded before the approval
+		wantStatus   int
+		wantItem     string // AX item sent to the ERP
+	}{
+		{
+			name:       "review rule is approved",
+			payload:    order("TSHIRT-RED-L", "250.00", "250.00"),
+			wantStatus: http.StatusOK,
+			wantItem:   "AX-TSHIRT",
+		},
+		{
+			name:       "edit cannot set an item the map does not know",
+			payload:    order("TSHIRT-RED-L", "250.00", "250.00"),
+			edit:       `{"items": [{"line_id": "1", "sku": "UNKNOWN", "item_id": "AX-FAKE", "quantity": 1, "unit_price": "250.00"}]}`,
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "edited item ID is replaced by the mapping",
+			payload:    order("TSHIRT-RED-L", "250.00", "250.00"),
+			edit:       `{"items": [{"line_id": "1", "sku": "TSHIRT-RED-L", "item_id": "AX-OTHER", "quantity": 1, "unit_price": "250.00"}]}`,
+			wantStatus: http.StatusOK,
+			wantItem:   "AX-TSHIRT",
+		},
+		{
+			name:         "mapping added while held",
+			payload:      order("NEW-SKU", "50.00", "50.00"),
+			mapAfterHold: itemMap + "NEW-SKU, AX-NEW\n",
+			wantStatus:   http.StatusOK,
+			wantItem:     "AX-NEW",
+		},
+		{
+			name:       "still unmapped",
+			payload:    order("NEW-SKU", "50.00", "50.00"),
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "edit breaks a blocking rule",
+			payload:    order("TSHIRT-RED-L", "250.00", "250.00"),
+			edit:       `{"customer_email": ""}`,
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "totals do not reconcile",
+			env:        map[string]string{"RECONCILE_MODE": ReconcileBlock},
+			payload:    order("TSHIRT-RED-L", "300.00", "250.00"),
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			mapPath := filepath.Join(dir, "items.csv")
+			validationPath := filepath.Join(dir, "validation.json")
+			if err := os.WriteFile(mapPath, []byte(itemMap), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(validationPath, []byte(validation), 0644); err != nil {
+				t.Fatal(err)
+			}
+			env := map[string]string{
+				"ADMIN_TOKENS":      "alice:a-token",
+				"ITEM_MAP_FILE":     mapPath,
+				"ITEM_MAP_UNMAPPED": UnmappedHold,
+				"VALIDATION_CONFIG": validationPath,
+			}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			s, erp := newTestServer(t, env)
+
+			job := &QueuedOrder{ID: "r1", RequestID: "r1", Topic: TopicOrdersCreate, WebhookID: "w1", OrderID: "1001", Body: json.RawMessage(tt.payload)}
+			if err := s.processOrderCreate(job); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.review.Get("r1"); err != nil {
+				t.Fatalf("order was not held: %v", err)
+			}
+
+			if tt.edit != "" {
+				if rec := reviewRequest(s, s.handleEditHeldOrder, "PATCH", "r1", "a-token", tt.edit); rec.Code != http.StatusOK {
+					t.Fatalf("edit status = %d: %s", rec.Code, rec.Body)
+				}
+			}
+			if tt.mapAfterHold != "" {
+				if err := os.WriteFile(mapPath, []byte(tt.mapAfterHold), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.items.Reload(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rec := reviewRequest(s, s.handleApproveHeldOrder, "POST", "r1", "a-token", "")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("approve status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			entry, err := s.review.Get("r1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := entry.Audit[len(entry.Audit)-1]
+			requests := erp.Requests()
+			if tt.wantStatus != http.StatusOK {
+				if len(requests) != 0 {
+					t.Errorf("ERP received %d requests for a refused approval", len(requests))
+				}
+				if entry.Status != ReviewHeld || last.Action != AuditApproveFailed || last.User != "alice" {
+					t.Errorf("held order is %s with last audit %+v, want held with a failed approval by alice", entry.Status, last)
+				}
+				return
+			}
+
+			if len(requests) != 1 || !strings.Contains(requests[0], ">"+tt.wantItem+"<") {
+				t.Fatalf("ERP requests = %v, want one with item %s", requests, tt.wantItem)
+			}
+			if entry.Status != ReviewApproved || entry.DecidedBy != "alice" || last.Action != AuditApproved {
+				t.Errorf("held order is %s decided by %q with last audit %+v, want approved by alice", entry.Status, entry.DecidedBy, last)
+			}
+		})
+	}
+}
+
+func TestApproveHeldOrderWaitsForQueuedJob(t *testing.T) {
+	s, erp := newTestServer(t, map[string]string{"ADMIN_TOKENS": "alice:a-token"})
+
+	payload := `{"id": 1001, "email": "jane@example.com", "currency": "EUR", "total_price": "10.00", "subtotal_price": "10.00",
+		"line_items": [{"id": 1, "sku": "A", "title": "Shirt", "quantity": 1, "price": "10.00"}]}`
+	var shopifyOrder ShopifyOrder
+	if err := json.Unmarshal([]byte(payload), &shopifyOrder); err != nil {
+		t.Fatal(err)
+	}
+	job := &QueuedOrder{ID: "r1", RequestID: "r1", Topic: TopicOrdersCreate, WebhookID: "w1", OrderID: "1001", Body: json.RawMessage(payload)}
+	s.dedupe.Claim(job.WebhookID, job.OrderID, job.RequestID)
+	if err := s.holdOrder(job, s.transformOrder(&shopifyOrder), "needs review"); err != nil {
+		t.Fatal(err)
+	}
+
+	approve := func(ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/review/r1/approve", nil).WithContext(ctx)
+		req.SetPathValue("id", "r1")
+		req.Header.Set("Authorization", "Bearer a-token")
+		rec := httptest.NewRecorder()
+		s.requireAdmin(s.handleApproveHeldOrder)(rec, req)
+		return rec
+	}
+
+	// A worker is handling a replayed creation of the order
+	if !s.queue.acquire("1001") {
+		t.Fatal("could not take the order")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if rec := approve(ctx); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("approve while the order is locked = %d, want %d: %s", rec.Code, http.StatusServiceUnavailable, rec.Body)
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- approve(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	s.dedupe.Claim("w2", "1001", "r2")
+	s.dedupe.MarkDelivered("w2", "1001", "r2", "SO-0")
+	s.queue.release("1001")
+
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusConflict {
+			t.Errorf("approve after the worker delivered the order = %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("approve did not resume after the worker released the order")
+	}
+	if len(erp.Requests()) != 0 {
+		t.Errorf("ERP received %d requests, want none", len(erp.Requests()))
+	}
+	if !s.queue.acquire("1001") {
+		t.Error("approve did not release the order")
+	}
+}
+
+func TestReviewStoreCount(t *testing.T) {
+	t.Setenv("DATA_DIR", t.TempDir())
+	store, err := NewReviewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hold := func(id, orderID string) {
+		t.Helper()
+		if err := store.Hold(&QueuedOrder{ID: id, RequestID: id, OrderID: orderID}, &ERPOrder{OrderID: orderID}, []string{"needs review"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decide := func(status string) func(*HeldOrder) error {
+		return func(entry *HeldOrder) error {
+			entry.Status = status
+			return nil
+		}
+	}
+
+	steps := []struct {
+		name   string
+		action func()
+		want   int
+	}{
+		{name: "empty", action: func() {}, want: 0},
+		{name: "held", action: func() { hold("a", "1"); hold("b", "2"); hold("c", "3") }, want: 3},
+		{name: "held again", action: func() { hold("a", "1") }, want: 3},
+		{name: "approved", action: func() { store.Update("a", decide(ReviewApproved)) }, want: 2},
+		{name: "rejected", action: func() { store.Update("b", decide(ReviewRejected)) }, want: 1},
+		{name: "edited", action: func() { store.Update("c", func(*HeldOrder) error { return nil }) }, want: 1},
+		{name: "cancelled", action: func() { store.Cancel("3", "cancelled") }, want: 0},
+		{name: "rejected order held after a retry", action: func() { hold("b", "2") }, want: 1},
+		{
+			name: "reopened",
+			action: func() {
+				if store, err = NewReviewStore(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: 1,
+		},
+	}
+
+	for _, step := range steps {
+		step.action()
+		if got := store.Count(); got != step.want {
+			t.Errorf("%s: Count() = %d, want %d", step.name, got, step.want)
+		}
+		if held, _ := store.List(ReviewHeld); len(held) != store.Count() {
+			t.Errorf("%s: Count() = %d, but %d orders are listed as held", step.name, store.Count(), len(held))
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SOAPFault holds the interesting parts of a SOAP Fault element
+type SOAPFault struct {
+	Code     string   `json:"code"`
+	Subcode  string   `json:"subcode,omitempty"` // SOAP 1.2 only
+	String   string   `json:"string"`
+	Actor    string   `json:"actor,omitempty"`
+	Detail   []string `json:"detail,omitempty"` // AIF FaultMessage texts or the raw detail text
+	AIFFault bool     `json:"aif_fault,omitempty"`
+}
+
+// InfologMessage is an entry of the AX infolog returned with a response
+type InfologMessage struct {
+	Type    string `json:"type"` // Info, Warning or Error
+	Message string `json:"message"`
+}
+
+// SOAPResult is the interpreted ERP response
+type SOAPResult struct {
+	StatusCode int
+	Fault      *SOAPFault
+	Infolog    []InfologMessage
+	Body       *soapNode // first element inside soap:Body, nil for faults or unparseable responses
+	ParseError error
+}
+
+// SOAPFaultError is returned when the ERP answered with a SOAP Fault or with
+// AX infolog errors embedded in an otherwise successful response
+type SOAPFaultError struct {
+	StatusCode int
+	Fault      *SOAPFault
+	Infolog    []InfologMessage
+}
+
+func (e *SOAPFaultError) Error() string {
+	return fmt.Sprintf("ERP returned status %d: %s", e.StatusCode, e.Reason())
+}
+
+// Reason joins the fault string, fault details and infolog errors
+func (e *SOAPFaultError) Reason() string {
+	var parts []string
+	if e.Fault != nil {
+		code := e.Fault.Code
+		if e.Fault.Subcode != "" {
+			code += "/" + e.Fault.Subcode
+		}
+		parts = append(parts, fmt.Sprintf("SOAP fault %s: %s", code, e.Fault.String))
+		parts = append(parts, e.Fault.Detail...)
+	}
+	for _, entry := range e.Infolog {
+		if strings.EqualFold(entry.Type, "Error") {
+			parts = append(parts, "AX infolog error: "+entry.Message)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Err returns a *SOAPFaultError when the response carries a fault or infolog
+// errors, otherwise nil
+func (r *SOAPResult) Err() error {
+	if r.Fault == nil && !r.HasInfologErrors() {
+		return nil
+	}
+	return &SOAPFaultError{StatusCode: r.StatusCode, Fault: r.Fault, Infolog: r.Infolog}
+}
+
+// HasInfologErrors reports whether any infolog entry is an error
+func (r *SOAPResult) HasInfologErrors() bool {
+	for _, entry := range r.Infolog {
+		if strings.EqualFold(entry.Type, "Error") {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultReason summarises the fault or infolog errors for logging
+func (r *SOAPResult) FaultReason() string {
+	if r.Fault == nil && !r.HasInfologErrors() {
+		return ""
+	}
+	return (&SOAPFaultError{StatusCode: r.StatusCode, Fault: r.Fault, Infolog: r.Infolog}).Reason()
+}
+
+// SalesID extracts the AX sales order number from a successful response. It
+// reads the AIF EntityKey (KeyField with Field=SalesId) and falls back to the
+// first element named element, e.g. SalesId or CreateOrderResult.
+func (r *SOAPResult) SalesID(element string) string {
+	if r.Body == nil {
+		return ""
+	}
+
+	if value := r.keyField("SalesId"); value != "" {
+		return value
+	}
+	if node := r.Body.find(element); node != nil {
+		return strings.TrimSpace(node.allText())
+	}
+	return ""
+}
+
+// AccountNum extracts an AX customer account from a customer find or create
+// response: the AIF EntityKey for AccountNum, or the first AccountNum element
+func (r *SOAPResult) AccountNum() string {
+	if r.Body == nil {
+		return ""
+	}
+	if value := r.keyField("AccountNum"); value != "" {
+		return value
+	}
+	if node := r.Body.find("AccountNum"); node != nil {
+		return strings.TrimSpace(node.allText())
+	}
+	return ""
+}
+
+// keyField returns the value of an AIF EntityKey KeyField, or ""
+func (r *SOAPResult) keyField(field string) string {
+	for _, keyField := range r.Body.findAll("KeyField") {
+		if strings.EqualFold(keyField.childText("Field"), field) {
+			if value := keyField.childText("Value"); value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// SalesStatus returns the AX sales order status reported in a response, e.g.
+// Backorder, Delivered or Invoiced, or "" when the response has none
+func (r *SOAPResult) SalesStatus() string {
+	if r.Body == nil {
+		return ""
+	}
+	if node := r.Body.find("SalesStatus"); node != nil {
+		return strings.TrimSpace(node.allText())
+	}
+	return ""
+}
+
+// parseSOAPResponse interprets an ERP response body. Bodies that are not XML
+// are not an error by themselves; ParseError is set so callers can decide.
+func parseSOAPResponse(statusCode int, body []byte) *SOAPResult {
+	result := &SOAPResult{StatusCode: statusCode}
+
+	root, err := parseSOAPNode(body)
+	if err != nil {
+		result.ParseError = err
+		return result
+	}
+
+	if fault := root.find("Fault"); fault != nil {
+		result.Fault = &SOAPFault{
+			Code:   fault.childText("faultcode"),
+			String: fault.childText("faultstring"),
+			Actor:  fault.childText("faultactor"),
+		}
+		if code := fault.child("Code"); code != nil {
+			// SOAP 1.2: Code/Value with optional Subcode, Reason/Text and Role
+			result.Fault.Code = code.childText("Value")
+			if subcode := code.child("Subcode"); subcode != nil {
+				result.Fault.Subcode = subcode.childText("Value")
+			}
+			if reason := fault.child("Reason"); reason != nil {
+				result.Fault.String = reason.childText("Text")
+			}
+			result.Fault.Actor = fault.childText("Role")
+		}
+		// SOAP 1.1 uses detail, SOAP 1.2 Detail; child matches either
+		if detail := fault.child("detail"); detail != nil {
+			result.Fault.AIFFault = detail.find("AifFault") != nil
+
+			// AIF puts one FaultMessage/Message per validation error
+			for _, message := range detail.findAll("FaultMessage") {
+				if text := message.childText("Message"); text != "" {
+					result.Fault.Detail = append(result.Fault.Detail, text)
+				}
+			}
+			if len(result.Fault.Detail) == 0 {
+				if text := strings.TrimSpace(detail.allText()); text != "" {
+					result.Fault.Detail = []string{text}
+				}
+			}
+		}
+	} else if bodyNode := root.find("Body"); bodyNode != nil && len(bodyNode.Children) > 0 {
+		result.Body = bodyNode.Children[0]
+	}
+
+	// AX 2012 returns the infolog as InfologMessage entries in the header or body
+	for _, entry := range root.findAll("InfologMessage") {
+		result.Infolog = append(result.Infolog, InfologMessage{
+			Type:    entry.childText("InfologMessageType"),
+			Message: entry.childText("Message"),
+		})
+	}
+
+	return result
+}
+
+// soapNode is a minimal namespace-agnostic XML tree used to read responses
+type soapNode struct {
+	Name     xml.Name
+	Attr     []xml.Attr
+	Text     string
+	Children []*soapNode
+}
+
+// parseSOAPNode decodes an XML document into a soapNode tree
+func parseSOAPNode(data []byte) (*soapNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	var stack []*soapNode
+	var root *soapNode
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid XML response: %w", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &soapNode{Name: t.Name, Attr: t.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].Text += string(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("invalid XML response: no root element")
+	}
+	return root, nil
+}
+
+// child returns the first direct child with the given local name
+func (n *soapNode) child(local string) *soapNode {
+	for _, c := range n.Children {
+		if strings.EqualFold(c.Name.Local, local) {
+			return c
+		}
+	}
+	return nil
+}
+
+// childText returns the trimmed text of a direct child, or ""
+func (n *soapNode) childText(local string) string {
+	if c := n.child(local); c != nil {
+		return strings.TrimSpace(c.allText())
+	}
+	return ""
+}
+
+// find returns the first descendant (or n itself) with the given local name
+func (n *soapNode) find(local string) *soapNode {
+	if strings.EqualFold(n.Name.Local, local) {
+		return n
+	}
+	for _, c := range n.Children {
+		if found := c.find(local); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// findAll returns every descendant with the given local name in document order
+func (n *soapNode) findAll(local string) []*soapNode {
+	var matches []*soapNode
+	for _, c := range n.Children {
+		if strings.EqualFold(c.Name.Local, local) {
+			matches = append(matches, c)
+		}
+		matches = append(matches, c.findAll(local)...)
+	}
+	return matches
+}
+
+// allText concatenates the text of n and all descendants
+func (n *soapNode) allText() string {
+	var b strings.Builder
+	b.WriteString(strings.TrimSpace(n.Text))
+	for _, c := range n.Children {
+		text := strings.TrimSpace(c.allText())
+		if text == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(text)
+	}
+	return b.String()
+}
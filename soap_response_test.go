@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseSOAPResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantFault   *SOAPFault
+		wantInfolog []InfologMessage
+		wantBody    string
+		wantParse   bool
+	}{
+		{
+			name:     "success",
+			body:     `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><CreateOrderResponse><CreateOrderResult>SO-1</CreateOrderResult></CreateOrderResponse></s:Body></s:Envelope>`,
+			wantBody: "CreateOrderResponse",
+		},
+		{
+			name: "SOAP 1.1 fault",
+			body: `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+				<faultcode>s:Client</faultcode><faultstring>Bad request</faultstring><faultactor>AOS</faultactor>
+				<detail><Info>Missing field</Info></detail></s:Fault></s:Body></s:Envelope>`,
+			wantFault: &SOAPFault{Code: "s:Client", String: "Bad request", Actor: "AOS", Detail: []string{"Missing field"}},
+		},
+		{
+			name: "SOAP 1.2 fault",
+			body: `<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body><env:Fault>
+				<env:Code><env:Value>env:Sender</env:Value><env:Subcode><env:Value>a:InvalidOrder</env:Value></env:Subcode></env:Code>
+				<env:Reason><env:Text xml:lang="en">Order rejected</env:Text></env:Reason><env:Role>AOS</env:Role>
+				</env:Fault></env:Body></env:Envelope>`,
+			wantFault: &SOAPFault{Code: "env:Sender", Subcode: "a:InvalidOrder", String: "Order rejected", Actor: "AOS"},
+		},
+		{
+			name: "AIF fault",
+			body: `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+				<faultcode>s:Client</faultcode><faultstring>Request Failed. See the Exception Log for details.</faultstring>
+				<detail><AifFault xmlns="http://schemas.microsoft.com/dynamics/2008/01/documents/Fault"><FaultMessageListArray><ArrayOfFaultMessageList><FaultMessageList><FaultMessageArray>
+				<FaultMessage><Code>E1</Code><Message>Item 1000 does not exist.</Message></FaultMessage>
+				<FaultMessage><Code>E2</Code><Message>Customer C-1 is on hold.</Message></FaultMessage>
+				</FaultMessageArray></FaultMessageList></ArrayOfFaultMessageList></FaultMessageListArray></AifFault></detail>
+				</s:Fault></s:Body></s:Envelope>`,
+			wantFault: &SOAPFault{
+				Code:     "s:Client",
+				String:   "Request Failed. See the Exception Log for details.",
+				Detail:   []string{"Item 1000 does not exist.", "Customer C-1 is on hold."},
+				AIFFault: true,
+			},
+		},
+		{
+			name: "infolog in a successful response",
+			body: `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Header><Infolog>
+				<InfologMessage><InfologMessageType>Warning</InfologMessageType><Message>Price changed</Message></InfologMessage>
+				<InfologMessage><InfologMessageType>Error</InfologMessageType><Message>Site is blocked</Message></InfologMessage>
+				</Infolog></s:Header><s:Body><CreateOrderResponse/></s:Body></s:Envelope>`,
+			wantInfolog: []InfologMessage{{Type: "Warning", Message: "Price changed"}, {Type: "Error", Message: "Site is blocked"}},
+			wantBody:    "CreateOrderResponse",
+		},
+		{name: "not XML", body: `Service Unavailable`, wantParse: true},
+		{name: "empty", body: ``, wantParse: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := parseSOAPResponse(200, []byte(tt.body))
+
+			if (result.ParseError != nil) != tt.wantParse {
+				t.Fatalf("ParseError = %v, want error %t", result.ParseError, tt.wantParse)
+			}
+			if !reflect.DeepEqual(result.Fault, tt.wantFault) {
+				t.Errorf("Fault = %+v, want %+v", result.Fault, tt.wantFault)
+			}
+			if !reflect.DeepEqual(result.Infolog, tt.wantInfolog) {
+				t.Errorf("Infolog = %+v, want %+v", result.Infolog, tt.wantInfolog)
+			}
+			body := ""
+			if result.Body != nil {
+				body = result.Body.Name.Local
+			}
+			if body != tt.wantBody {
+				t.Errorf("Body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSOAPResultErr(t *testing.T) {
+	tests := []struct {
+		name       string
+		result     *SOAPResult
+		wantErr    bool
+		wantReason string
+	}{
+		{name: "clean", result: &SOAPResult{StatusCode: 200}},
+		{
+			name:   "infolog warnings only",
+			result: &SOAPResult{StatusCode: 200, Infolog: []InfologMessage{{Type: "Warning", Message: "w"}}},
+		},
+		{
+			name:       "fault with detail",
+			result:     &SOAPResult{StatusCode: 500, Fault: &SOAPFault{Code: "s:Server", String: "rejected", Detail: []string{"d1", "d2"}}},
+			wantErr:    true,
+			wantReason: "SOAP fault s:Server: rejected; d1; d2",
+		},
+		{
+			name:       "SOAP 1.2 fault with subcode",
+			result:     &SOAPResult{StatusCode: 500, Fault: &SOAPFault{Code: "env:Sender", Subcode: "a:Bad", String: "rejected"}},
+			wantErr:    true,
+			wantReason: "SOAP fault env:Sender/a:Bad: rejected",
+		},
+		{
+			name:       "infolog errors",
+			result:     &SOAPResult{StatusCode: 200, Infolog: []InfologMessage{{Type: "Info", Message: "i"}, {Type: "error", Message: "Site is blocked"}}},
+			wantErr:    true,
+			wantReason: "AX infolog error: Site is blocked",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.result.Err()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Err() = %v, want error %t", err, tt.wantErr)
+			}
+			if got := tt.result.FaultReason(); got != tt.wantReason {
+				t.Errorf("FaultReason() = %q, want %q", got, tt.wantReason)
+			}
+			var faultErr *SOAPFaultError
+			if err != nil && (!errors.As(err, &faultErr) || faultErr.StatusCode != tt.result.StatusCode) {
+				t.Errorf("Err() = %#v, want *SOAPFaultError with status %d", err, tt.result.StatusCode)
+			}
+		})
+	}
+}
+
+func TestSOAPResultSalesID(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		element string
+		want    string
+	}{
+		{
+			name:    "AIF entity key",
+			body:    `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><SalesOrderServiceCreateResponse><EntityKeyList><EntityKey><KeyData><KeyField><Field>SalesId</Field><Value>SO-000123</Value></KeyField></KeyData></EntityKey></EntityKeyList></SalesOrderServiceCreateResponse></s:Body></s:Envelope>`,
+			element: "CreateOrderResult",
+			want:    "SO-000123",
+		},
+		{
+			name:    "result element",
+			body:    `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><CreateOrderResponse><CreateOrderResult> SO-42 </CreateOrderResult></CreateOrderResponse></s:Body></s:Envelope>`,
+			element: "CreateOrderResult",
+			want:    "SO-42",
+		},
+		{
+			name:    "configured element",
+			body:    `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><Response><Order><SalesNumber>SO-7</SalesNumber></Order></Response></s:Body></s:Envelope>`,
+			element: "SalesNumber",
+			want:    "SO-7",
+		},
+		{
+			name:    "other key field",
+			body:    `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><Response><KeyField><Field>RecId</Field><Value>5637</Value></KeyField></Response></s:Body></s:Envelope>`,
+			element: "CreateOrderResult",
+		},
+		{
+			name:    "fault",
+			body:    `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Server</faultcode><CreateOrderResult>SO-1</CreateOrderResult></s:Fault></s:Body></s:Envelope>`,
+			element: "CreateOrderResult",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSOAPResponse(200, []byte(tt.body)).SalesID(tt.element); got != tt.want {
+				t.Errorf("SalesID(%q) = %q, want %q", tt.element, got, tt.want)
+			}
+		})
+	}
+}
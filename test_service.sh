@@ -23,6 +23,13 @@ YELLOW='\033[1;33m'
 BLUE='\033[0;34m'
 NC='\033[0m' # No Color
 
+# Signs a payload the same way Shopify does when SHOPIFY_WEBHOOK_SECRET is set
+sign_payload() {
+    if [ -n "$SHOPIFY_WEBHOOK_SECRET" ]; then
+        printf '%s' "$1" | openssl dgst -sha256 -hmac "$SHOPIFY_WEBHOOK_SECRET" -binary | base64
+    fi
+}
+
 # Test functions
 test_health_check() {
     echo -e "${BLUE}1. Testing Health Check Endpoint${NC}"
@@ -79,6 +86,7 @@ test_webhook_invalid_json() {
         -X POST \
         -H "Content-Type: application/json" \
         -H "X-Shopify-Topic: orders/create" \
+        -H "X-Shopify-Hmac-Sha256: $(sign_payload '{"invalid": json}')" \
         -d '{"invalid": json}' \
         "$WEBHOOK_URL")
     
@@ -92,8 +100,35 @@ test_webhook_invalid_json() {
     echo ""
 }
 
+test_webhook_invalid_signature() {
+    echo -e "${BLUE}5. Testing Webhook with Invalid Signature${NC}"
+    
+    if [ -z "$SHOPIFY_WEBHOOK_SECRET" ]; then
+        echo -e "${YELLOW}⚠️  Skipping (SHOPIFY_WEBHOOK_SECRET not set)${NC}"
+        echo ""
+        return
+    fi
+    
+    response=$(curl -s -w "HTTPSTATUS:%{http_code}" \
+        -X POST \
+        -H "Content-Type: application/json" \
+        -H "X-Shopify-Topic: orders/create" \
+        -H "X-Shopify-Hmac-Sha256: aW52YWxpZA==" \
+        -d '{"id": 1}' \
+        "$WEBHOOK_URL")
+    
+    status=$(echo "$response" | tr -d '\n' | sed -E 's/.*HTTPSTATUS:([0-9]{3})$/\1/')
+    
+    if [ "$status" -eq 401 ]; then
+        echo -e "${GREEN}✅ Webhook correctly rejects invalid signatures${NC}"
+    else
+        echo -e "${YELLOW}⚠️  Expected 401, got $status${NC}"
+    fi
+    echo ""
+}
+
 test_webhook_valid_order() {
-    echo -e "${BLUE}5. Testing Webhook with Valid Shopify Order (SOAP)${NC}"
+    echo -e "${BLUE}6. Testing Webhook with Valid Shopify Order (SOAP)${NC}"
     
     # Sample Shopify order payload
     payload='{
@@ -163,6 +198,7 @@ test_webhook_valid_order() {
         -X POST \
         -H "Content-Type: application/json" \
         -H "X-Shopify-Topic: orders/create" \
+        -H "X-Shopify-Hmac-Sha256: $(sign_payload "$payload")" \
         -d "$payload" \
         "$WEBHOOK_URL")
     
@@ -172,7 +208,7 @@ test_webhook_valid_order() {
     if [ "$status" -eq 200 ]; then
         echo -e "${GREEN}✅ Webhook successfully processed valid order${NC}"
         echo "Response: $body"
-        echo -e "${GREEN}✅ Order converted to SOAP format and sent to ERP${NC}"
+        echo -e "${GREEN}✅ Order queued for conversion to SOAP and delivery to ERP${NC}"
     else
         echo -e "${YELLOW}⚠️  Webhook returned status $status${NC}"
         echo "This is expected if the ERP SOAP endpoint is not configured"
@@ -193,11 +229,12 @@ test_webhook_valid_order() {
 }
 
 test_performance() {
-    echo -e "${BLUE}6. Testing Performance (10 concurrent requests)${NC}"
+    echo -e "${BLUE}7. Testing Performance (10 concurrent requests)${NC}"
     
     # Create a simple payload for performance testing
     simple_payload='{"id": 99999, "order_number": 9999, "email": "test@example.com", "created_at": "2024-01-15T10:30:00Z", "updated_at": "2024-01-15T10:30:00Z", "total_price": "100.00", "subtotal_price": "90.00", "total_tax": "10.00", "currency": "USD", "financial_status": "paid", "fulfillment_status": "unfulfilled", "customer": {"id": 1, "email": "test@example.com", "first_name": "Test", "last_name": "User", "phone": "+1234567890"}, "line_items": [{"id": 1, "product_id": 1, "variant_id": 1, "title": "Test", "name": "Test", "quantity": 1, "price": "90.00", "sku": "TEST", "variant_title": "", "fulfillment_service": "manual"}], "shipping_address": {"first_name": "Test", "last_name": "User", "company": "", "address1": "123 Test St", "address2": "", "city": "Test City", "province": "Test State", "country": "United States", "zip": "12345", "phone": "+1234567890", "province_code": "TS", "country_code": "US"}, "billing_address": {"first_name": "Test", "last_name": "User", "company": "", "address1": "123 Test St", "address2": "", "city": "Test City", "province": "Test State", "country": "United States", "zip": "12345", "phone": "+1234567890", "province_code": "TS", "country_code": "US"}}'
     
+    signature=$(sign_payload "$simple_payload")
     start_time=$(date +%s.%N)
     
     # Run 10 concurrent requests
@@ -205,6 +242,7 @@ test_performance() {
         curl -s -X POST \
             -H "Content-Type: application/json" \
             -H "X-Shopify-Topic: orders/create" \
+            -H "X-Shopify-Hmac-Sha256: $signature" \
             -d "$simple_payload" \
             "$WEBHOOK_URL" > /dev/null &
     done
@@ -228,7 +266,7 @@ main() {
     # Check if service is running
     if ! curl -s "$HEALTH_URL" > /dev/null; then
         echo -e "${RED}❌ Service is not running at $BASE_URL${NC}"
-        echo "Please start the service first with: go run main.go"
+        echo "Please start the service first with: go run ."
         exit 1
     fi
     
@@ -236,6 +274,7 @@ main() {
     test_root_endpoint
     test_webhook_invalid_method
     test_webhook_invalid_json
+    test_webhook_invalid_signature
     test_webhook_valid_order
     
     # Only run performance test if 'bc' is available
@@ -250,6 +289,7 @@ main() {
     echo ""
     echo "📁 Check log files in ./logs/ directory:"
     echo "- $(date +%Y-%m-%d)_incoming_webhook.log - Shopify webhook requests"
+    echo "- $(date +%Y-%m-%d)_rejected_webhook.log - Webhooks with invalid signatures"
     echo "- $(date +%Y-%m-%d)_outgoing_soap.log - SOAP requests to ERP"  
     echo "- $(date +%Y-%m-%d)_soap_response.log - ERP responses"
     echo ""
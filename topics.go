@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// Shopify webhook topics handled by the middleware
+const (
+	TopicOrdersCreate       = "orders/create"
+	TopicOrdersUpdated      = "orders/updated"
+	TopicOrdersCancelled    = "orders/cancelled"
+	TopicOrdersPaid         = "orders/paid"
+	TopicRefundsCreate      = "refunds/create"
+	TopicFulfillmentsCreate = "fulfillments/create"
+)
+
+// TopicHandler processes a queued webhook of one topic. Handlers record ERP
+// failures in the dead-letter store themselves; a returned error moves the
+// job to the queue's failed directory.
+type TopicHandler func(job *QueuedOrder) error
+
+// registerTopics builds the routing table used by handleWebhook and the queue workers
+func (s *Server) registerTopics() {
+	s.topics = map[string]TopicHandler{
+		TopicOrdersCreate:       s.processOrderCreate,
+		TopicOrdersUpdated:      s.processOrderUpdated,
+		TopicOrdersCancelled:    s.processOrderCancelled,
+		TopicOrdersPaid:         s.processOrderPaid,
+		TopicRefundsCreate:      s.processRefundCreate,
+		TopicFulfillmentsCreate: s.processFulfillmentCreate,
+	}
+}
+
+// webhookPayload holds the identifiers shared by the supported topics. Order
+// topics carry the order itself, refunds and fulfillments reference it by order_id.
+type webhookPayload struct {
+	ID          int64 `json:"id"`
+	OrderID     int64 `json:"order_id"`
+	OrderNumber int   `json:"order_number"`
+}
+
+// parseWebhookPayload reads the Shopify order ID a webhook refers to
+func parseWebhookPayload(topic string, body []byte) (*webhookPayload, string, error) {
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, "", err
+	}
+
+	orderID := payload.ID
+	if topic == TopicRefundsCreate || topic == TopicFulfillmentsCreate {
+		orderID = payload.OrderID
+	}
+	if orderID == 0 {
+		return nil, "", fmt.Errorf("%s payload has no order ID", topic)
+	}
+	return &payload, strconv.FormatInt(orderID, 10), nil
+}
+
+// dedupeOrderID returns the order ID used for deduplication. Only creation is
+// idempotent per order; every other topic may legitimately arrive many times
+// for the same order and is deduplicated on the webhook ID alone.
+func dedupeOrderID(topic, orderID string) string {
+	if topic == TopicOrdersCreate {
+		return orderID
+	}
+	return ""
+}
+
+// processQueuedOrder dispatches a queued webhook to the handler for its topic.
+// Jobs queued before topics were recorded are order creations.
+func (s *Server) processQueuedOrder(job *QueuedOrder) error {
+	topic := job.Topic
+	if topic == "" {
+		topic = TopicOrdersCreate
+	}
+
+	handler, ok := s.topics[topic]
+	if !ok {
+		err := fmt.Errorf("no handler for webhook topic %q", topic)
+		return s.deadLetters.Add(job, nil, err)
+	}
+	return handler(job)
+}
+
+// processOrderPaid records payment notifications. Payments are captured by
+// Shopify, AX only needs the order, so nothing is sent to the ERP.
+func (s *Server) processOrderPaid(job *QueuedOrder) error {
+	log.Printf("[%s] Order %s marked as paid in Shopify, no ERP update required", job.RequestID, job.OrderID)
+	s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, "")
+	return nil
+}
+
+// processFulfillmentCreate records fulfillment notifications. Orders are
+// shipped from AX, so Shopify fulfillments are not sent back to the ERP.
+func (s *Server) processFulfillmentCreate(job *QueuedOrder) error {
+	log.Printf("[%s] Fulfillment created for order %s, no ERP update required", job.RequestID, job.OrderID)
+	s.dedupe.MarkDelivered(job.WebhookID, "", job.RequestID, "")
+	return nil
+}
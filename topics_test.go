@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseWebhookPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "order", topic: TopicOrdersCreate, body: `{"id":1001,"order_number":7}`, want: "1001"},
+		{name: "refund references the order", topic: TopicRefundsCreate, body: `{"id":5,"order_id":1001}`, want: "1001"},
+		{name: "fulfillment references the order", topic: TopicFulfillmentsCreate, body: `{"id":6,"order_id":1001}`, want: "1001"},
+		{name: "refund without order", topic: TopicRefundsCreate, body: `{"id":5}`, wantErr: true},
+		{name: "order without ID", topic: TopicOrdersUpdated, body: `{}`, wantErr: true},
+		{name: "invalid JSON", topic: TopicOrdersCreate, body: `{`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, orderID, err := parseWebhookPayload(tt.topic, []byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWebhookPayload() error = %v, want error %t", err, tt.wantErr)
+			}
+			if orderID != tt.want {
+				t.Errorf("order ID = %q, want %q", orderID, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleWebhookTopics(t *testing.T) {
+	tests := []struct {
+		name       string
+		topic      string
+		wantCode   int
+		wantStatus string
+		wantLog    string // log file type the request is recorded in
+		wantQueued int
+	}{
+		{name: "handled topic", topic: TopicOrdersCreate, wantCode: http.StatusOK, wantStatus: "queued", wantLog: "incoming_webhook", wantQueued: 1},
+		{name: "unhandled topic", topic: "products/update", wantCode: http.StatusOK, wantStatus: "ignored", wantLog: "ignored_webhook"},
+		{name: "missing topic", wantCode: http.StatusBadRequest, wantLog: "rejected_webhook"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(`{"id":1001,"order_number":7}`))
+			req.Header.Set("X-Shopify-Webhook-Id", "w1")
+			if tt.topic != "" {
+				req.Header.Set("X-Shopify-Topic", tt.topic)
+			}
+			rec := httptest.NewRecorder()
+			s.handleWebhook(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status code = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantStatus != "" {
+				var response map[string]string
+				json.Unmarshal(rec.Body.Bytes(), &response)
+				if response["status"] != tt.wantStatus {
+					t.Errorf("status = %q, want %q", response["status"], tt.wantStatus)
+				}
+			}
+
+			logs, _ := filepath.Glob(filepath.Join(os.Getenv("LOG_DIR"), "*_webhook.log"))
+			if len(logs) != 1 || !strings.HasSuffix(logs[0], "_"+tt.wantLog+".log") {
+				t.Errorf("webhook logs = %v, want only %s", logs, tt.wantLog)
+			}
+			if depth := s.queue.Depth(); depth != tt.wantQueued {
+				t.Errorf("queue depth = %d, want %d", depth, tt.wantQueued)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Actions taken for a rule violation
+const (
+	ValidationOff    = "off"    // the rule is not evaluated
+	ValidationWarn   = "warn"   // log the violation and send the order
+	ValidationReview = "review" // hold the order for manual review
+	ValidationBlock  = "block"  // dead-letter the order
+)
+
+// Built-in rules; their actions can be changed in VALIDATION_CONFIG
+const (
+	RuleLineItems = "line_items" // the order has lines to send
+	RuleQuantity  = "quantity"   // every line has a positive quantity
+	RuleSKU       = "sku"        // every line has a SKU or a mapped AX item
+	RulePrice     = "price"      // no line has a negative price
+	RuleCurrency  = "currency"   // the currency is supported
+)
+
+// ErrValidationFailed is returned for orders that break a blocking or review rule
+var ErrValidationFailed = errors.New("order failed validation")
+
+// ValidationRule is a rule declared in VALIDATION_CONFIG. It checks a field
+// of the ERP order by its JSON name; a path into the lines such as
+// "items.quantity" checks every line. The order violates the rule when the
+// condition does not hold.
+type ValidationRule struct {
+	Name    string   `json:"name"`
+	Field   string   `json:"field"`
+	Op      string   `json:"op"` // required, eq, ne, gt, gte, lt, lte, in, not_in or matches
+	Value   string   `json:"value,omitempty"`
+	Values  []string `json:"values,omitempty"` // for in and not_in
+	Action  string   `json:"action"`
+	Message string   `json:"message,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// ValidationConfig is the file named by VALIDATION_CONFIG
+type ValidationConfig struct {
+	Currencies []string          `json:"currencies"` // supported currencies, any ISO code when empty
+	Actions    map[string]string `json:"actions"`    // built-in rule name to action
+	Rules      []ValidationRule  `json:"rules"`
+}
+
+// RuleViolation is a rule an order does not satisfy
+type RuleViolation struct {
+	Rule    string `json:"rule"`
+	Action  string `json:"action"`
+	Message string `json:"message"`
+}
+
+func (v RuleViolation) String() string {
+	return fmt.Sprintf("%s: %s", v.Rule, v.Message)
+}
+
+// Validator checks orders between parsing and sending them to AX
+type Validator struct {
+	actions    map[string]string
+	currencies map[string]bool
+	rules      []ValidationRule
+}
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// NewValidator loads VALIDATION_CONFIG. VALIDATION_CURRENCIES, a comma
+// separated list, replaces the currencies of the file.
+func NewValidator() (*Validator, error) {
+	var config ValidationConfig
+	if path := os.Getenv("VALIDATION_CONFIG"); path != "" {
+		if err := readJSONFile(path, &config); err != nil {
+			return nil, fmt.Errorf("failed to load VALIDATION_CONFIG %s: %w", path, err)
+		}
+	}
+	if value := os.Getenv("VALIDATION_CURRENCIES"); value != "" {
+		config.Currencies = splitList(value)
+	}
+
+	v := &Validator{
+		actions: map[string]string{
+			RuleLineItems: ValidationBlock,
+			RuleQuantity:  ValidationBlock,
+			RuleSKU:       ValidationBlock,
+			RulePrice:     ValidationBlock,
+			RuleCurrency:  ValidationBlock,
+		},
+		currencies: make(map[string]bool),
+	}
+
+	for rule, action := range config.Actions {
+		if _, ok := v.actions[rule]; !ok {
+			return nil, fmt.Errorf("unknown validation rule %q", rule)
+		}
+		if !validAction(action) {
+			return nil, fmt.Errorf("invalid action %q for validation rule %s", action, rule)
+		}
+		v.actions[rule] = action
+	}
+
+	for _, currency := range config.Currencies {
+		v.currencies[strings.ToUpper(currency)] = true
+	}
+
+	for i, rule := range config.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule_%d", i+1)
+		}
+		if rule.Field == "" {
+			return nil, fmt.Errorf("validation rule %s needs a field", rule.Name)
+		}
+		if rule.Action == "" {
+			rule.Action = ValidationBlock
+		}
+		if !validAction(rule.Action) {
+			return nil, fmt.Errorf("invalid action %q for validation rule %s", rule.Action, rule.Name)
+		}
+		switch rule.Op {
+		case "required", "eq", "ne", "gt", "gte", "lt", "lte", "in", "not_in":
+		case "matches":
+			pattern, err := regexp.Compile(rule.Value)
+			if err != nil {
+				return nil, fmt.Errorf("validation rule %s: %w", rule.Name, err)
+			}
+			rule.pattern = pattern
+		default:
+			return nil, fmt.Errorf("validation rule %s has unknown op %q", rule.Name, rule.Op)
+		}
+		v.rules = append(v.rules, rule)
+	}
+
+	return v, nil
+}
+
+func validAction(action string) bool {
+	switch action {
+	case ValidationOff, ValidationWarn, ValidationReview, ValidationBlock:
+		return true
+	}
+	return false
+}
+
+// Describe summarises the rule set for the startup log
+func (v *Validator) Describe() string {
+	currencies := "any"
+	if len(v.currencies) > 0 {
+		currencies = fmt.Sprintf("%d", len(v.currencies))
+	}
+	return fmt.Sprintf("%d built-in and %d configured rules, %s currencies", len(v.actions), len(v.rules), currencies)
+}
+
+// Validate runs all rules against an order and its transformed version
+func (v *Validator) Validate(order *ShopifyOrder, erpOrder *ERPOrder) []RuleViolation {
+	var violations []RuleViolation
+	add := func(rule, message string) {
+		if action := v.actions[rule]; action != ValidationOff {
+			violations = append(violations, RuleViolation{Rule: rule, Action: action, Message: message})
+		}
+	}
+
+	if len(erpOrder.Items) == 0 {
+		add(RuleLineItems, "order has no line items")
+	}
+	for _, item := range order.LineItems {
+		if item.Quantity <= 0 {
+			add(RuleQuantity, fmt.Sprintf("line %d has quantity %d", item.ID, item.Quantity))
+		}
+		if item.Price.Sign() < 0 {
+			add(RulePrice, fmt.Sprintf("line %d has negative price %s", item.ID, item.Price))
+		}
+	}
+
+	// Lines without a SKU are fine when the item map resolved their variant
+	for _, item := range erpOrder.Items {
+		if strings.TrimSpace(item.SKU) == "" && item.ItemID == "" {
+			add(RuleSKU, fmt.Sprintf("line %s (%s) has no SKU", item.LineID, item.ProductName))
+		}
+	}
+
+	currency := order.Currency
+	switch {
+	case !currencyCode.MatchString(currency):
+		add(RuleCurrency, fmt.Sprintf("currency %q is not an ISO 4217 code", currency))
+	case len(v.currencies) > 0 && !v.currencies[currency]:
+		add(RuleCurrency, fmt.Sprintf("currency %s is not supported", currency))
+	}
+
+	if len(v.rules) > 0 {
+		fields, err := orderFields(erpOrder)
+		if err != nil {
+			log.Printf("Error evaluating validation rules for order %s: %v", erpOrder.OrderID, err)
+			return violations
+		}
+		for _, rule := range v.rules {
+			if rule.Action == ValidationOff {
+				continue
+			}
+			if message, ok := rule.check(fields); !ok {
+				violations = append(violations, RuleViolation{Rule: rule.Name, Action: rule.Action, Message: message})
+			}
+		}
+	}
+
+	return violations
+}
+
+// orderFields decodes the ERP order into its JSON form for configured rules
+func orderFields(order *ERPOrder) (map[string]interface{}, error) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// fieldValues returns the values at a dotted path, one per line for paths
+// into arrays. Missing fields are returned as empty strings; a path into an
+// empty array returns no values.
+func fieldValues(value interface{}, path []string) []string {
+	if list, ok := value.([]interface{}); ok {
+		var values []string
+		for _, element := range list {
+			values = append(values, fieldValues(element, path)...)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		if value == nil {
+			return []string{""}
+		}
+		return []string{fmt.Sprint(value)}
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return []string{""}
+	}
+	return fieldValues(object[path[0]], path[1:])
+}
+
+// check evaluates the rule, returning a message when it is violated
+func (r ValidationRule) check(fields map[string]interface{}) (string, bool) {
+	values := fieldValues(fields, strings.Split(r.Field, "."))
+	if len(values) == 0 && r.Op == "required" {
+		// A path into an empty array has no values, which is not a value set
+		values = []string{""}
+	}
+	for _, value := range values {
+		if r.holds(value) {
+			continue
+		}
+		if r.Message != "" {
+			return r.Message, false
+		}
+		if r.Op == "required" {
+			return fmt.Sprintf("%s is required", r.Field), false
+		}
+		expected := r.Value
+		if r.Op == "in" || r.Op == "not_in" {
+			expected = strings.Join(r.Values, ", ")
+		}
+		return fmt.Sprintf("%s is %q, expected %s %s", r.Field, value, r.Op, expected), false
+	}
+	return "", true
+}
+
+// holds reports whether a single value satisfies the rule. Values that
+// parse as amounts are compared as amounts, others as strings.
+func (r ValidationRule) holds(value string) bool {
+	switch r.Op {
+	case "required":
+		return strings.TrimSpace(value) != ""
+	case "in", "not_in":
+		found := false
+		for _, candidate := range r.Values {
+			if strings.EqualFold(candidate, value) {
+				found = true
+			}
+		}
+		return found == (r.Op == "in")
+	case "matches":
+		return r.pattern.MatchString(value)
+	}
+
+	cmp := strings.Compare(value, r.Value)
+	if amount, err := ParseMoney(value); err == nil && value != "" {
+		if limit, err := ParseMoney(r.Value); err == nil {
+			cmp = amount.Cmp(limit)
+		}
+	}
+	switch r.Op {
+	case "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+// validateOrder runs the validation rules, logs the violations and records
+// them in the log. Blocking violations and violations that need review
+// return ErrValidationFailed; review reports whether the order should be
+// held instead of dead-lettered.
+func (s *Server) validateOrder(order *ShopifyOrder, erpOrder *ERPOrder, requestID string) (review bool, err error) {
+	violations := s.validator.Validate(order, erpOrder)
+	if len(violations) == 0 {
+		return false, nil
+	}
+	s.logger.LogValidation(requestID, erpOrder.OrderID, violations)
+
+	var blocking, held []string
+	for _, violation := range violations {
+		switch violation.Action {
+		case ValidationBlock:
+			blocking = append(blocking, violation.String())
+		case ValidationReview:
+			held = append(held, violation.String())
+		default:
+			log.Printf("[%s] Warning: order %s breaks validation rule %s", requestID, erpOrder.OrderID, violation)
+		}
+	}
+
+	if len(blocking) > 0 {
+		return false, fmt.Errorf("%w: %s", ErrValidationFailed, strings.Join(append(blocking, held...), "; "))
+	}
+	if len(held) > 0 {
+		return true, fmt.Errorf("%w: %s", ErrValidationFailed, strings.Join(held, "; "))
+	}
+	return false, nil
+}
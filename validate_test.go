@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestValidator loads a VALIDATION_CONFIG with the given content
+func newTestValidator(t *testing.T, config string) (*Validator, error) {
+	t.Helper()
+	t.Setenv("VALIDATION_CONFIG", "")
+	t.Setenv("VALIDATION_CURRENCIES", "")
+	if config != "" {
+		path := filepath.Join(t.TempDir(), "validation.json")
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("VALIDATION_CONFIG", path)
+	}
+	return NewValidator()
+}
+
+func TestNewValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{name: "no config"},
+		{name: "actions and rules", config: `{"actions": {"sku": "warn"}, "rules": [{"field": "total_amount", "op": "lte", "value": "1000", "action": "review"}]}`},
+		{name: "unknown built-in rule", config: `{"actions": {"weight": "warn"}}`, wantErr: true},
+		{name: "invalid action", config: `{"actions": {"sku": "ignore"}}`, wantErr: true},
+		{name: "rule without field", config: `{"rules": [{"op": "required"}]}`, wantErr: true},
+		{name: "unknown op", config: `{"rules": [{"field": "currency", "op": "like"}]}`, wantErr: true},
+		{name: "invalid pattern", config: `{"rules": [{"field": "currency", "op": "matches", "value": "("}]}`, wantErr: true},
+		{name: "invalid rule action", config: `{"rules": [{"field": "currency", "op": "required", "action": "drop"}]}`, wantErr: true},
+		{name: "not json", config: `rules:`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTestValidator(t, tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("NewValidator() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidationRuleHolds(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  ValidationRule
+		value string
+		want  bool
+	}{
+		{name: "required set", rule: ValidationRule{Op: "required"}, value: "x", want: true},
+		{name: "required blank", rule: ValidationRule{Op: "required"}, value: "  "},
+		{name: "eq string", rule: ValidationRule{Op: "eq", Value: "paid"}, value: "paid", want: true},
+		{name: "ne string", rule: ValidationRule{Op: "ne", Value: "paid"}, value: "pending", want: true},
+		{name: "eq amounts with other decimals", rule: ValidationRule{Op: "eq", Value: "10"}, value: "10.00", want: true},
+		{name: "gt compares amounts, not strings", rule: ValidationRule{Op: "gt", Value: "9.00"}, value: "10.00", want: true},
+		{name: "gte", rule: ValidationRule{Op: "gte", Value: "10"}, value: "10.00", want: true},
+		{name: "lt", rule: ValidationRule{Op: "lt", Value: "1000"}, value: "999.99", want: true},
+		{name: "lte exceeded", rule: ValidationRule{Op: "lte", Value: "1000"}, value: "1000.01"},
+		{name: "empty value is not an amount", rule: ValidationRule{Op: "gte", Value: "0"}, value: ""},
+		{name: "in ignores case", rule: ValidationRule{Op: "in", Values: []string{"EUR", "USD"}}, value: "eur", want: true},
+		{name: "in missing", rule: ValidationRule{Op: "in", Values: []string{"EUR", "USD"}}, value: "GBP"},
+		{name: "not_in", rule: ValidationRule{Op: "not_in", Values: []string{"test"}}, value: "live", want: true},
+		{name: "not_in listed", rule: ValidationRule{Op: "not_in", Values: []string{"test"}}, value: "TEST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.holds(tt.value); got != tt.want {
+				t.Errorf("holds(%q) = %t, want %t", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatorValidate(t *testing.T) {
+	order := func() (*ShopifyOrder, *ERPOrder) {
+		return &ShopifyOrder{
+			Currency:  "EUR",
+			LineItems: []LineItem{{ID: 1, Quantity: 2, Price: MustParseMoney("10.00")}},
+		}, &ERPOrder{
+			OrderID:     "1001",
+			Currency:    "EUR",
+			TotalAmount: MustParseMoney("20.00"),
+			Items:       []ERPItem{{LineID: "1", SKU: "A", ItemID: "A", Quantity: 2}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		edit   func(*ShopifyOrder, *ERPOrder)
+		want   []string // rule:action
+	}{
+		{name: "valid order"},
+		{
+			name: "no lines",
+			edit: func(_ *ShopifyOrder, e *ERPOrder) { e.Items = nil },
+			want: []string{"line_items:block"},
+		},
+		{
+			name: "zero quantity and negative price",
+			edit: func(o *ShopifyOrder, _ *ERPOrder) {
+				o.LineItems[0].Quantity = 0
+				o.LineItems[0].Price = MustParseMoney("-1.00")
+			},
+			want: []string{"quantity:block", "price:block"},
+		},
+		{
+			name: "missing sku",
+			edit: func(_ *ShopifyOrder, e *ERPOrder) { e.Items[0].SKU, e.Items[0].ItemID = " ", "" },
+			want: []string{"sku:block"},
+		},
+		{
+			name: "mapped item without sku",
+			edit: func(_ *ShopifyOrder, e *ERPOrder) { e.Items[0].SKU = "" },
+		},
+		{
+			name: "invalid currency",
+			edit: func(o *ShopifyOrder, _ *ERPOrder) { o.Currency = "euro" },
+			want: []string{"currency:block"},
+		},
+		{
+			name:   "unsupported currency",
+			config: `{"currencies": ["usd"]}`,
+			want:   []string{"currency:block"},
+		},
+		{
+			name:   "built-in rule downgraded",
+			config: `{"actions": {"sku": "warn", "line_items": "off"}}`,
+			edit:   func(_ *ShopifyOrder, e *ERPOrder) { e.Items[0].SKU, e.Items[0].ItemID = "", "" },
+			want:   []string{"sku:warn"},
+		},
+		{
+			name:   "configured rule on the order",
+			config: `{"rules": [{"name": "max_total", "field": "total_amount", "op": "lte", "value": "10", "action": "review"}]}`,
+			want:   []string{"max_total:review"},
+		},
+		{
+			name:   "configured rule on every line",
+			config: `{"rules": [{"field": "items.quantity", "op": "lte", "value": "1"}]}`,
+			want:   []string{"rule_1:block"},
+		},
+		{
+			name:   "required line field on an order without lines",
+			config: `{"actions": {"line_items": "off"}, "rules": [{"field": "items.sku", "op": "required"}]}`,
+			edit:   func(_ *ShopifyOrder, e *ERPOrder) { e.Items = []ERPItem{} },
+			want:   []string{"rule_1:block"},
+		},
+		{
+			name:   "configured rule that holds",
+			config: `{"rules": [{"field": "currency", "op": "matches", "value": "^EUR$"}]}`,
+		},
+		{
+			name:   "configured rule switched off",
+			config: `{"rules": [{"field": "customer_email", "op": "required", "action": "off"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newTestValidator(t, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			shopifyOrder, erpOrder := order()
+			if tt.edit != nil {
+				tt.edit(shopifyOrder, erpOrder)
+			}
+
+			var got []string
+			for _, violation := range v.Validate(shopifyOrder, erpOrder) {
+				got = append(got, violation.Rule+":"+violation.Action)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("violations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidationRuleMessage(t *testing.T) {
+	fields := map[string]interface{}{"currency": "GBP"}
+
+	tests := []struct {
+		name string
+		rule ValidationRule
+		want string
+	}{
+		{name: "required", rule: ValidationRule{Field: "customer_email", Op: "required"}, want: "customer_email is required"},
+		{name: "comparison", rule: ValidationRule{Field: "currency", Op: "eq", Value: "EUR"}, want: `currency is "GBP", expected eq EUR`},
+		{name: "list", rule: ValidationRule{Field: "currency", Op: "in", Values: []string{"EUR", "USD"}}, want: `currency is "GBP", expected in EUR, USD`},
+		{name: "custom message", rule: ValidationRule{Field: "currency", Op: "eq", Value: "EUR", Message: "EUR only"}, want: "EUR only"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, ok := tt.rule.check(fields)
+			if ok || message != tt.want {
+				t.Errorf("check() = %q, %t, want %q", message, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		wantReview bool
+		wantErr    bool
+	}{
+		{name: "warning only", config: `{"rules": [{"field": "customer_email", "op": "required", "action": "warn"}]}`},
+		{name: "review", config: `{"rules": [{"field": "customer_email", "op": "required", "action": "review"}]}`, wantReview: true, wantErr: true},
+		{
+			name:    "block wins over review",
+			config:  `{"rules": [{"field": "customer_email", "op": "required", "action": "review"}, {"field": "customer_name", "op": "required"}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, nil)
+			v, err := newTestValidator(t, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.validator = v
+
+			order := &ShopifyOrder{Currency: "EUR", LineItems: []LineItem{{ID: 1, Quantity: 1}}}
+			erpOrder := &ERPOrder{OrderID: "1001", Items: []ERPItem{{LineID: "1", SKU: "A"}}}
+			review, err := s.validateOrder(order, erpOrder, "r1")
+			if review != tt.wantReview || (err != nil) != tt.wantErr {
+				t.Errorf("validateOrder() = %t, %v, want review %t, error %t", review, err, tt.wantReview, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrValidationFailed) {
+				t.Errorf("error %v is not ErrValidationFailed", err)
+			}
+		})
+	}
+}
+
+func TestValidationRuleCheckArrays(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   ValidationRule
+		fields string
+		want   bool
+	}{
+		{name: "required on every line", rule: ValidationRule{Field: "items.sku", Op: "required"}, fields: `{"items": [{"sku": "A"}, {"sku": "B"}]}`, want: true},
+		{name: "required with a blank line", rule: ValidationRule{Field: "items.sku", Op: "required"}, fields: `{"items": [{"sku": "A"}, {"sku": ""}]}`},
+		{name: "required on an empty array", rule: ValidationRule{Field: "items.sku", Op: "required"}, fields: `{"items": []}`},
+		{name: "required on a missing array", rule: ValidationRule{Field: "items.sku", Op: "required"}, fields: `{}`},
+		{name: "required on a nested empty array", rule: ValidationRule{Field: "items.tax_lines.rate", Op: "required"}, fields: `{"items": [{"tax_lines": []}]}`},
+		{name: "comparison on an empty array", rule: ValidationRule{Field: "items.quantity", Op: "lte", Value: "1"}, fields: `{"items": []}`, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.fields), &fields); err != nil {
+				t.Fatal(err)
+			}
+			if message, ok := tt.rule.check(fields); ok != tt.want {
+				t.Errorf("check() = %q, %t, want %t", message, ok, tt.want)
+			}
+		})
+	}
+}
@@ -73,6 +73,8 @@ filter_by_request_id() {
     
     local files=(
         "$LOG_DIR/${date}_incoming_webhook.log"
+        "$LOG_DIR/${date}_rejected_webhook.log"
+        "$LOG_DIR/${date}_ignored_webhook.log"
         "$LOG_DIR/${date}_outgoing_soap.log"
         "$LOG_DIR/${date}_soap_response.log"
     )
@@ -113,9 +115,9 @@ show_errors() {
     
     if [[ -f "$response_file" ]]; then
         if command -v jq &> /dev/null; then
-            jq -r 'select(.status_code >= 400 or .error != null)' "$response_file" 2>/dev/null | jq .
+            jq -r 'select(.status_code >= 400 or .error != null or .fault_reason != null)' "$response_file" 2>/dev/null | jq .
         else
-            grep -E '"status_code": [4-5][0-9][0-9]|"error":' "$response_file" || echo "No errors found"
+            grep -E '"status_code": [4-5][0-9][0-9]|"error":|"fault_reason":' "$response_file" || echo "No errors found"
         fi
     else
         echo -e "${YELLOW}⚠️  No response log file found for $date${NC}"
@@ -128,6 +130,8 @@ show_count() {
     
     local files=(
         "$LOG_DIR/${date}_incoming_webhook.log"
+        "$LOG_DIR/${date}_rejected_webhook.log"
+        "$LOG_DIR/${date}_ignored_webhook.log"
         "$LOG_DIR/${date}_outgoing_soap.log"
         "$LOG_DIR/${date}_soap_response.log"
     )
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestNewWebhookVerifier(t *testing.T) {
+	tests := []struct {
+		name        string
+		secret      string
+		verify      string
+		wantErr     bool
+		wantEnabled bool
+	}{
+		{name: "secret", secret: "s3cret", wantEnabled: true},
+		{name: "no secret", wantErr: true},
+		{name: "explicit opt-out", verify: "off"},
+		{name: "opt-out ignores secret", secret: "s3cret", verify: "OFF"},
+		{name: "other value does not opt out", verify: "no", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SHOPIFY_WEBHOOK_SECRET", tt.secret)
+			t.Setenv("SHOPIFY_WEBHOOK_SECRET_PREVIOUS", "")
+			t.Setenv("WEBHOOK_VERIFY", tt.verify)
+
+			v, err := NewWebhookVerifier()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewWebhookVerifier() error = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && v.Enabled() != tt.wantEnabled {
+				t.Errorf("Enabled() = %t, want %t", v.Enabled(), tt.wantEnabled)
+			}
+		})
+	}
+}
+
+func TestWebhookVerifierVerify(t *testing.T) {
+	t.Setenv("SHOPIFY_WEBHOOK_SECRET", "current")
+	t.Setenv("SHOPIFY_WEBHOOK_SECRET_PREVIOUS", "previous")
+	t.Setenv("WEBHOOK_VERIFY", "")
+
+	v, err := NewWebhookVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"id":1}`)
+
+	tests := []struct {
+		name      string
+		signature string
+		want      error
+	}{
+		{name: "current secret", signature: sign("current", body)},
+		{name: "previous secret", signature: sign("previous", body)},
+		{name: "surrounding whitespace", signature: " " + sign("current", body) + "\n"},
+		{name: "missing", signature: "", want: ErrMissingSignature},
+		{name: "wrong secret", signature: sign("other", body), want: ErrInvalidSignature},
+		{name: "not base64", signature: "%%%", want: ErrInvalidSignature},
+		{name: "other body", signature: sign("current", []byte(`{"id":2}`)), want: ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := v.Verify(body, tt.signature); !errors.Is(err, tt.want) {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withFixedNonce makes headerXML use nonce for the rest of the test
+func withFixedNonce(t *testing.T, nonce []byte) {
+	t.Helper()
+	previous := wssNonce
+	wssNonce = func() []byte { return append([]byte(nil), nonce...) }
+	t.Cleanup(func() { wssNonce = previous })
+}
+
+func TestWSSecurityHeaderXML(t *testing.T) {
+	nonce := []byte("0123456789abcdef")
+	withFixedNonce(t, nonce)
+	now := time.Date(2024, 3, 1, 12, 30, 45, 123000000, time.FixedZone("EET", 2*60*60))
+	created := "2024-03-01T10:30:45.123Z"
+
+	digest := sha1.Sum([]byte(string(nonce) + created + "s3cret"))
+	wantDigest := base64.StdEncoding.EncodeToString(digest[:])
+
+	tests := []struct {
+		name   string
+		config WSSecurityConfig
+		want   map[string]string
+		absent []string
+	}{
+		{
+			name:   "password text",
+			config: WSSecurityConfig{Username: "ax-user", Password: "s3cret"},
+			want: map[string]string{
+				"Username": "ax-user",
+				"Password": "s3cret",
+			},
+			absent: []string{"Nonce", "Created", "Timestamp"},
+		},
+		{
+			name:   "password digest",
+			config: WSSecurityConfig{Username: "ax-user", Password: "s3cret", PasswordType: "DIGEST"},
+			want: map[string]string{
+				"Username": "ax-user",
+				"Password": wantDigest,
+				"Nonce":    base64.StdEncoding.EncodeToString(nonce),
+				"Created":  created,
+			},
+			absent: []string{"Timestamp"},
+		},
+		{
+			name:   "timestamp",
+			config: WSSecurityConfig{TimestampTTL: "5m"},
+			want: map[string]string{
+				"Created": created,
+				"Expires": "2024-03-01T10:35:45.123Z",
+			},
+			absent: []string{"UsernameToken"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.prepare(); err != nil {
+				t.Fatalf("prepare: %v", err)
+			}
+			header, err := tt.config.headerXML("soap", SOAP11Namespace, now)
+			if err != nil {
+				t.Fatalf("headerXML: %v", err)
+			}
+			root, err := parseSOAPNode([]byte(header))
+			if err != nil {
+				t.Fatalf("header is not well-formed XML: %v\n%s", err, header)
+			}
+			if root.Name.Space != WSSENamespace || root.Name.Local != "Security" {
+				t.Fatalf("root = %v, want wsse:Security", root.Name)
+			}
+
+			for local, want := range tt.want {
+				node := root.find(local)
+				if node == nil {
+					t.Errorf("%s missing\n%s", local, header)
+					continue
+				}
+				if node.Text != want {
+					t.Errorf("%s = %q, want %q", local, node.Text, want)
+				}
+			}
+			for _, local := range tt.absent {
+				if root.find(local) != nil {
+					t.Errorf("unexpected %s\n%s", local, header)
+				}
+			}
+
+			if password := root.find("Password"); password != nil {
+				wantType := wssTokenProfile + "#PasswordText"
+				if tt.config.PasswordType == PasswordTypeDigest {
+					wantType = wssTokenProfile + "#PasswordDigest"
+				}
+				if got := attrValue(password, "", "Type"); got != wantType {
+					t.Errorf("Password Type = %q, want %q", got, wantType)
+				}
+			}
+		})
+	}
+}
+
+func TestWSSecurityMustUnderstand(t *testing.T) {
+	config := WSSecurityConfig{Username: "ax-user", Password: "s3cret", MustUnderstand: true}
+	if err := config.prepare(); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		envelope  string
+		namespace string
+	}{
+		{"SOAP 1.1", `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"><soap:Body/></soap:Envelope>`, SOAP11Namespace},
+		{"SOAP 1.2", `<env:Envelope xmlns:env="` + SOAP12Namespace + `"><env:Body/></env:Envelope>`, SOAP12Namespace},
+		{"SOAP 1.2 default namespace", `<Envelope xmlns="` + SOAP12Namespace + `"><Body/></Envelope>`, SOAP12Namespace},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, namespace := envelopeName(tt.envelope)
+			if namespace != tt.namespace {
+				t.Fatalf("envelopeName namespace = %q, want %q", namespace, tt.namespace)
+			}
+			header, err := config.headerXML(prefix, namespace, time.Now())
+			if err != nil {
+				t.Fatalf("headerXML: %v", err)
+			}
+			envelope, err := insertSOAPHeader(tt.envelope, header)
+			if err != nil {
+				t.Fatalf("insertSOAPHeader: %v", err)
+			}
+			root, err := parseSOAPNode([]byte(envelope))
+			if err != nil {
+				t.Fatalf("envelope is not well-formed XML: %v\n%s", err, envelope)
+			}
+			security := root.find("Security")
+			if security == nil {
+				t.Fatalf("Security missing\n%s", envelope)
+			}
+			if got := attrValue(security, tt.namespace, "mustUnderstand"); got != "1" {
+				t.Errorf("mustUnderstand in %s = %q, want 1\n%s", tt.namespace, got, envelope)
+			}
+		})
+	}
+}
+
+func TestWSSecurityDescribe(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *WSSecurityConfig
+		want   string
+	}{
+		{"nil", nil, "none"},
+		{"empty", &WSSecurityConfig{}, "none"},
+		{"username", &WSSecurityConfig{Username: "ax-user", Password: "s3cret"}, "UsernameToken ax-user (text)"},
+		{"digest", &WSSecurityConfig{Username: "ax-user", PasswordType: "digest"}, "UsernameToken ax-user (digest)"},
+		{"timestamp", &WSSecurityConfig{TimestampTTL: "90s"}, "Timestamp 1m30s"},
+		{
+			name: "everything",
+			config: &WSSecurityConfig{
+				Username:     "ax-user",
+				TimestampTTL: "5m",
+				Headers:      []string{`<a:One xmlns:a="urn:a"/>`, `<a:Two xmlns:a="urn:a"/>`},
+			},
+			want: "UsernameToken ax-user (text), Timestamp 5m0s, 2 custom headers",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config != nil {
+				if err := tt.config.prepare(); err != nil {
+					t.Fatalf("prepare: %v", err)
+				}
+			}
+			if got := tt.config.Describe(); got != tt.want {
+				t.Errorf("Describe() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInsertSOAPHeader(t *testing.T) {
+	const entries = `<x:Token xmlns:x="urn:x">t</x:Token>`
+
+	tests := []struct {
+		name     string
+		envelope string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "no header",
+			envelope: `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"><soap:Body><Op/></soap:Body></soap:Envelope>`,
+			want:     `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"><soap:Header>` + entries + `</soap:Header><soap:Body><Op/></soap:Body></soap:Envelope>`,
+		},
+		{
+			name:     "existing header",
+			envelope: `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"><soap:Header><Ctx/></soap:Header><soap:Body/></soap:Envelope>`,
+			want:     `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"><soap:Header>` + entries + `<Ctx/></soap:Header><soap:Body/></soap:Envelope>`,
+		},
+		{
+			name:     "empty header element",
+			envelope: `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"><soap:Header /><soap:Body/></soap:Envelope>`,
+			want:     `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"><soap:Header >` + entries + `</soap:Header><soap:Body/></soap:Envelope>`,
+		},
+		{
+			name:     "other prefix",
+			envelope: "<?xml version=\"1.0\"?>\n<s:Envelope xmlns:s=\"" + SOAP12Namespace + "\">\n  <s:Body/>\n</s:Envelope>",
+			want:     "<?xml version=\"1.0\"?>\n<s:Envelope xmlns:s=\"" + SOAP12Namespace + "\">\n  <s:Header>" + entries + "</s:Header><s:Body/>\n</s:Envelope>",
+		},
+		{
+			name:     "default namespace",
+			envelope: `<Envelope xmlns="` + SOAP11Namespace + `"><Body/></Envelope>`,
+			want:     `<Envelope xmlns="` + SOAP11Namespace + `"><Header>` + entries + `</Header><Body/></Envelope>`,
+		},
+		{
+			name:     "nested Body is not the envelope body",
+			envelope: `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"><soap:Body><Body/></soap:Body></soap:Envelope>`,
+			want:     `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"><soap:Header>` + entries + `</soap:Header><soap:Body><Body/></soap:Body></soap:Envelope>`,
+		},
+		{
+			name:     "no body",
+			envelope: `<soap:Envelope xmlns:soap="` + SOAP11Namespace + `"/>`,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := insertSOAPHeader(tt.envelope, entries)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("insertSOAPHeader() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("insertSOAPHeader: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("insertSOAPHeader()\n got %s\nwant %s", got, tt.want)
+			}
+			if !strings.Contains(got, entries) {
+				t.Errorf("entries missing from %s", got)
+			}
+			if _, err := parseSOAPNode([]byte(got)); err != nil {
+				t.Errorf("result is not well-formed XML: %v", err)
+			}
+		})
+	}
+}
+
+// attrValue returns the value of the attribute with the given namespace and name
+func attrValue(node *soapNode, space, local string) string {
+	for _, attr := range node.Attr {
+		if attr.Name.Space == space && attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}